@@ -0,0 +1,280 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cluster.go contains code related to Redis Cluster, including computing
+// hash slots for keys, discovering which node serves each hash slot, and
+// following MOVED and ASK redirects.
+
+package zoom
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// numSlots is the number of hash slots in a Redis Cluster.
+const numSlots = 16384
+
+// maxRedirects is the maximum number of MOVED or ASK redirects that will be
+// followed when executing a transaction in cluster mode.
+const maxRedirects = 16
+
+// cluster keeps track of the nodes in a Redis Cluster and which hash slots
+// they serve, and maintains a separate pool of connections for each node.
+type cluster struct {
+	options PoolOptions
+	mutex   sync.RWMutex
+	// slots maps each hash slot to the address of the node which serves it. It
+	// is nil until the slots have been loaded from the cluster.
+	slots []string
+	// pools maps the address of each node to a pool of connections to it.
+	pools map[string]*redis.Pool
+}
+
+// newCluster returns a cluster which uses seedPool to connect to the node at
+// options.Address. The hash slots are loaded from the cluster the first time
+// they are needed.
+func newCluster(options PoolOptions, seedPool *redis.Pool) *cluster {
+	return &cluster{
+		options: options,
+		pools: map[string]*redis.Pool{
+			options.Address: seedPool,
+		},
+	}
+}
+
+// connForSlot returns a connection to the node which serves the given hash
+// slot. If there was a problem discovering which node serves the slot, the
+// returned connection will return an error for every method call.
+func (c *cluster) connForSlot(slot int) redis.Conn {
+	address, err := c.addressForSlot(slot)
+	if err != nil {
+		return errorConn{err: err}
+	}
+	return c.connForAddress(address)
+}
+
+// connForAddress returns a connection to the node with the given address,
+// creating a new pool of connections for the node if needed.
+func (c *cluster) connForAddress(address string) redis.Conn {
+	c.mutex.RLock()
+	pool, found := c.pools[address]
+	c.mutex.RUnlock()
+	if !found {
+		c.mutex.Lock()
+		if pool, found = c.pools[address]; !found {
+			pool = newRedisPool(c.options.WithAddress(address))
+			c.pools[address] = pool
+		}
+		c.mutex.Unlock()
+	}
+	return pool.Get()
+}
+
+// addressForSlot returns the address of the node which serves the given hash
+// slot, loading the slots from the cluster if they have not been loaded yet.
+func (c *cluster) addressForSlot(slot int) (string, error) {
+	c.mutex.RLock()
+	var address string
+	if c.slots != nil {
+		address = c.slots[slot]
+	}
+	c.mutex.RUnlock()
+	if address != "" {
+		return address, nil
+	}
+	if err := c.loadSlots(); err != nil {
+		return "", err
+	}
+	c.mutex.RLock()
+	address = c.slots[slot]
+	c.mutex.RUnlock()
+	if address == "" {
+		return "", fmt.Errorf("zoom: No node in the cluster serves hash slot %d", slot)
+	}
+	return address, nil
+}
+
+// setSlotAddress records that the given hash slot is served by the node with
+// the given address. It is used to handle MOVED redirects.
+func (c *cluster) setSlotAddress(slot int, address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.slots == nil {
+		c.slots = make([]string, numSlots)
+	}
+	c.slots[slot] = address
+}
+
+// loadSlots uses the CLUSTER SLOTS command to discover which node serves each
+// hash slot. It tries each known node in turn until one of them replies.
+func (c *cluster) loadSlots() error {
+	c.mutex.RLock()
+	addresses := []string{c.options.Address}
+	for address := range c.pools {
+		if address != c.options.Address {
+			addresses = append(addresses, address)
+		}
+	}
+	c.mutex.RUnlock()
+	var lastErr error
+	for _, address := range addresses {
+		slots, err := c.loadSlotsFromNode(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mutex.Lock()
+		c.slots = slots
+		c.mutex.Unlock()
+		return nil
+	}
+	return fmt.Errorf("zoom: Could not load hash slots from the cluster: %s", lastErr.Error())
+}
+
+// loadSlotsFromNode runs the CLUSTER SLOTS command on the node with the given
+// address and returns the address of the master node for each hash slot.
+func (c *cluster) loadSlotsFromNode(address string) ([]string, error) {
+	conn := c.connForAddress(address)
+	defer func() {
+		_ = conn.Close()
+	}()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]string, numSlots)
+	for _, r := range ranges {
+		var start, end int
+		var master []interface{}
+		values, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := redis.Scan(values, &start, &end, &master); err != nil {
+			return nil, err
+		}
+		var host string
+		var port int
+		if _, err := redis.Scan(master, &host, &port); err != nil {
+			return nil, err
+		}
+		if host == "" {
+			// An empty host means the node is the same one we asked
+			host, _, _ = net.SplitHostPort(address)
+		}
+		nodeAddress := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < numSlots; slot++ {
+			slots[slot] = nodeAddress
+		}
+	}
+	return slots, nil
+}
+
+// close closes the pools for every known node in the cluster.
+func (c *cluster) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var firstErr error
+	for _, pool := range c.pools {
+		if err := pool.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// redirect is a MOVED or ASK redirect returned by a node in the cluster.
+type redirect struct {
+	ask     bool
+	slot    int
+	address string
+}
+
+// parseRedirect returns the redirect represented by err and true if err is a
+// MOVED or ASK error. Otherwise it returns nil and false.
+func parseRedirect(err error) (*redirect, bool) {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return nil, false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return nil, false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, false
+	}
+	return &redirect{
+		ask:     fields[0] == "ASK",
+		slot:    slot,
+		address: fields[2],
+	}, true
+}
+
+// keySlot returns the hash slot for the given key. If the key contains a hash
+// tag, i.e. a non-empty substring between the first "{" and the next "}",
+// only the hash tag is hashed.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % numSlots)
+}
+
+// crc16 returns the CRC16 (XMODEM) checksum for s, which is used by Redis
+// Cluster to compute hash slots.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// actionKey returns the key which the action operates on, which is used to
+// route the action to the right node in cluster mode. By convention, the key is
+// the first argument for both commands and scripts. It returns an empty string
+// if the action has no arguments.
+func actionKey(a *Action) string {
+	if len(a.args) == 0 {
+		return ""
+	}
+	switch arg := a.args[0].(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// errorConn is a redis.Conn which returns err for every method call. It is
+// returned by cluster.connForSlot if the node for the slot could not be found.
+type errorConn struct {
+	err error
+}
+
+func (ec errorConn) Close() error                                   { return nil }
+func (ec errorConn) Err() error                                     { return ec.err }
+func (ec errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, ec.err }
+func (ec errorConn) Send(string, ...interface{}) error              { return ec.err }
+func (ec errorConn) Flush() error                                   { return ec.err }
+func (ec errorConn) Receive() (interface{}, error)                  { return nil, ec.err }
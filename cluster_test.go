@@ -0,0 +1,423 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cluster_test.go tests the code in cluster.go and the behavior of a
+// pool in cluster mode.
+
+package zoom
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestKeySlot(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected int
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"{foo}:bar", 12182},
+		{"baz:{foo}:{bar}", 12182},
+		{"{}foo", 9500},
+	}
+	for _, tc := range testCases {
+		if got := keySlot(tc.key); got != tc.expected {
+			t.Errorf("Expected keySlot(%q) to be %d but got %d", tc.key, tc.expected, got)
+		}
+	}
+	// Keys with an empty hash tag should be hashed in their entirety
+	if keySlot("{}foo") == keySlot("foo") {
+		t.Errorf("Expected an empty hash tag to be ignored")
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Errorf("Expected keys with the same hash tag to have the same slot")
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected *redirect
+	}{
+		{redis.Error("MOVED 3999 127.0.0.1:6381"), &redirect{slot: 3999, address: "127.0.0.1:6381"}},
+		{redis.Error("ASK 3999 127.0.0.1:6381"), &redirect{ask: true, slot: 3999, address: "127.0.0.1:6381"}},
+		{redis.Error("ERR unknown command"), nil},
+		{redis.Error("MOVED foo 127.0.0.1:6381"), nil},
+		{nil, nil},
+	}
+	for _, tc := range testCases {
+		got, ok := parseRedirect(tc.err)
+		if ok != (tc.expected != nil) || !reflect.DeepEqual(tc.expected, got) {
+			t.Errorf("Expected parseRedirect(%v) to return %+v but got %+v", tc.err, tc.expected, got)
+		}
+	}
+}
+
+// clusterTestModel is a model type used for testing pools in cluster mode.
+type clusterTestModel struct {
+	Int    int    `zoom:"index"`
+	String string `zoom:"index"`
+	Email  string `zoom:"unique"`
+	RandomID
+}
+
+// clusterOtherTestModel is a second model type used for testing transactions
+// which involve more than one collection in cluster mode.
+type clusterOtherTestModel struct {
+	Int int
+	RandomID
+}
+
+func TestClusterMode(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Connect to the testing database in cluster mode. This requires the server
+	// to support the CLUSTER SLOTS command.
+	options := testPool.options.WithCluster(true)
+	pool := NewPoolWithOptions(options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	conn := pool.NewConn()
+	_, err := conn.Do("CLUSTER", "SLOTS")
+	_ = conn.Close()
+	if err != nil {
+		t.Skipf("Skipping cluster mode test because CLUSTER SLOTS failed: %s", err.Error())
+	}
+	models, err := pool.NewCollectionWithOptions(&clusterTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	others, err := pool.NewCollectionWithOptions(&clusterOtherTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	if _, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithName("{invalid}")); err == nil {
+		t.Errorf("Expected error when registering a collection with curly braces in its name but got none")
+	}
+
+	// Every key for a collection should have the same hash tag
+	model := &clusterTestModel{Int: 1, String: "a", Email: "a@example.com"}
+	if err := models.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectedKeys := []string{
+		"{clusterTestModel}:" + model.ModelID(),
+		"{clusterTestModel}:all",
+		"{clusterTestModel}:Int",
+		"{clusterTestModel}:String",
+		"{clusterTestModel}:Email:unique",
+	}
+	for _, key := range expectedKeys {
+		expectKeyExists(t, key)
+	}
+	if models.ModelKey(model.ModelID()) != expectedKeys[0] {
+		t.Errorf("Expected ModelKey to be %s but got %s", expectedKeys[0], models.ModelKey(model.ModelID()))
+	}
+
+	// A transaction which involves more than one collection should work
+	other := &clusterOtherTestModel{Int: 2}
+	model2 := &clusterTestModel{Int: 2, String: "b", Email: "b@example.com"}
+	tx := pool.NewTransaction()
+	tx.Save(others, other)
+	tx.Save(models, model2)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	expectModelsExist(t, others, []Model{other})
+
+	// Unique constraints should still be enforced
+	duplicate := &clusterTestModel{Email: model.Email}
+	if err := models.Save(duplicate); err == nil {
+		t.Errorf("Expected UniqueConstraintError but got none")
+	} else if _, ok := err.(UniqueConstraintError); !ok {
+		t.Errorf("Expected UniqueConstraintError but got %T: %s", err, err.Error())
+	}
+
+	// Queries and finders should work
+	got := []*clusterTestModel{}
+	if err := models.NewQuery().Filter("Int >", 0).Order("-String").Run(&got); err != nil {
+		t.Fatalf("Unexpected error in Run: %s", err.Error())
+	}
+	expected := []*clusterTestModel{model2, model}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Query returned wrong models.\nExpected: %+v\nGot:      %+v", expected, got)
+	}
+	count, err := models.NewQuery().Filter("String =", "a").Count()
+	if err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("Expected Count to return 1 but got %d", count)
+	}
+	iter := models.NewQuery().Order("Int").Iter()
+	gotModel := &clusterTestModel{}
+	for iter.Next(gotModel) {
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Unexpected error in iterator: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model2, gotModel) {
+		t.Errorf("Iterator returned wrong last model.\nExpected: %+v\nGot:      %+v", model2, gotModel)
+	}
+
+	// Watching keys in more than one hash slot should fail
+	tx = pool.NewTransaction()
+	if err := tx.Watch(model); err != nil {
+		t.Fatalf("Unexpected error in Watch: %s", err.Error())
+	}
+	if err := tx.Watch(other); err == nil {
+		t.Errorf("Expected error when watching keys in different hash slots but got none")
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+
+	// Delete and DeleteAll should work
+	if _, err := models.Delete(model.ModelID()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, expectedKeys[0])
+	if _, err := models.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	if _, err := others.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, "{clusterTestModel}:all")
+	expectKeyDoesNotExist(t, "{clusterTestModel}:Email:unique")
+	expectModelsDoNotExist(t, others, []Model{other})
+}
+
+func TestClusterRedirects(t *testing.T) {
+	target, err := newFakeClusterNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.close()
+	seed, err := newFakeClusterNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.close()
+
+	// The seed node claims to serve every slot but sends MOVED redirects to the
+	// target node for every key.
+	seed.setRedirect("MOVED", target.address())
+	pool := NewPoolWithOptions(DefaultPoolOptions.WithAddress(seed.address()).WithCluster(true))
+	defer func() {
+		_ = pool.Close()
+	}()
+	slot := keySlot("foo")
+	var got string
+	tx := pool.NewTransaction()
+	tx.Command("SET", redis.Args{"foo", "moved"}, nil)
+	tx.Command("GET", redis.Args{"foo"}, NewScanStringHandler(&got))
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if got != "moved" {
+		t.Errorf("Expected GET to return moved but got %s", got)
+	}
+	if seed.numRedirects() != 1 {
+		t.Errorf("Expected 1 redirect from the seed node but got %d", seed.numRedirects())
+	}
+	// The new address of the slot should be remembered
+	if address, _ := pool.cluster.addressForSlot(slot); address != target.address() {
+		t.Errorf("Expected slot %d to be served by %s but got %s", slot, target.address(), address)
+	}
+	tx = pool.NewTransaction()
+	tx.Command("GET", redis.Args{"foo"}, NewScanStringHandler(&got))
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if seed.numRedirects() != 1 {
+		t.Errorf("Expected the second transaction to go to the target node directly but got %d redirects", seed.numRedirects())
+	}
+
+	// ASK redirects should be followed with the ASKING command, without
+	// changing the address of the slot.
+	seed.setRedirect("ASK", target.address())
+	pool.cluster.setSlotAddress(slot, seed.address())
+	tx = pool.NewTransaction()
+	tx.Command("SET", redis.Args{"foo", "asked"}, nil)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if value := target.value("foo"); value != "asked" {
+		t.Errorf("Expected foo to be asked on the target node but got %s", value)
+	}
+	if target.numAskings() != 1 {
+		t.Errorf("Expected the target node to receive ASKING once but got %d", target.numAskings())
+	}
+	if address, _ := pool.cluster.addressForSlot(slot); address != seed.address() {
+		t.Errorf("Expected slot %d to still be served by %s but got %s", slot, seed.address(), address)
+	}
+}
+
+// fakeClusterNode is a minimal in-memory Redis Cluster node which understands
+// just enough commands to test MOVED and ASK redirects: CLUSTER SLOTS (which
+// reports that the node serves every slot), MULTI, EXEC, ASKING, GET, SET, and
+// the commands used to initialize a connection.
+type fakeClusterNode struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string]string
+	// redirect is "MOVED" or "ASK" if every command with a key should be
+	// redirected to redirectAddress, or empty otherwise.
+	redirect        string
+	redirectAddress string
+	redirects       int
+	askings         int
+}
+
+// newFakeClusterNode starts a fakeClusterNode which does not redirect any
+// commands.
+func newFakeClusterNode() (*fakeClusterNode, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	node := &fakeClusterNode{
+		listener: listener,
+		values:   map[string]string{},
+	}
+	go node.serve()
+	return node, nil
+}
+
+func (node *fakeClusterNode) address() string {
+	return node.listener.Addr().String()
+}
+
+func (node *fakeClusterNode) close() {
+	_ = node.listener.Close()
+}
+
+func (node *fakeClusterNode) setRedirect(redirect string, address string) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.redirect = redirect
+	node.redirectAddress = address
+}
+
+func (node *fakeClusterNode) numRedirects() int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.redirects
+}
+
+func (node *fakeClusterNode) numAskings() int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.askings
+}
+
+func (node *fakeClusterNode) value(key string) string {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.values[key]
+}
+
+func (node *fakeClusterNode) serve() {
+	for {
+		conn, err := node.listener.Accept()
+		if err != nil {
+			return
+		}
+		go node.handle(conn)
+	}
+}
+
+func (node *fakeClusterNode) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	asking := false
+	inMulti := false
+	aborted := false
+	queued := [][]string{}
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		switch name := strings.ToUpper(args[0]); name {
+		case "CLUSTER":
+			host, port, _ := net.SplitHostPort(node.address())
+			fmt.Fprintf(conn, "*1\r\n*3\r\n:0\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", numSlots-1, len(host), host, port)
+		case "SELECT", "AUTH", "CLIENT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "ASKING":
+			node.mutex.Lock()
+			node.askings++
+			node.mutex.Unlock()
+			asking = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case "MULTI":
+			inMulti = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case "EXEC":
+			if aborted {
+				fmt.Fprint(conn, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+			} else {
+				fmt.Fprintf(conn, "*%d\r\n", len(queued))
+				for _, command := range queued {
+					fmt.Fprint(conn, node.do(command))
+				}
+			}
+			asking, inMulti, aborted, queued = false, false, false, [][]string{}
+		default:
+			node.mutex.Lock()
+			redirect, redirectAddress := node.redirect, node.redirectAddress
+			if redirect != "" && !asking && !aborted {
+				// Count each redirected transaction once
+				node.redirects++
+			}
+			node.mutex.Unlock()
+			switch {
+			case len(args) < 2:
+				fmt.Fprintf(conn, "-ERR unknown command %s\r\n", name)
+			case redirect != "" && !asking:
+				fmt.Fprintf(conn, "-%s %d %s\r\n", redirect, keySlot(args[1]), redirectAddress)
+				aborted = aborted || inMulti
+			case inMulti:
+				queued = append(queued, args)
+				fmt.Fprint(conn, "+QUEUED\r\n")
+			default:
+				fmt.Fprint(conn, node.do(args))
+				asking = false
+			}
+		}
+	}
+}
+
+// do executes a GET or SET command and returns the reply in the Redis
+// protocol.
+func (node *fakeClusterNode) do(args []string) string {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, found := node.values[args[1]]
+		if !found {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case "SET":
+		node.values[args[1]] = args[2]
+		return "+OK\r\n"
+	}
+	return "-ERR unknown command " + args[0] + "\r\n"
+}
@@ -10,9 +10,11 @@ package zoom
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -23,9 +25,22 @@ var collections = list.New()
 // for saving, finding, and deleting models of a specific type. Use the
 // NewCollection method to create a new collection.
 type Collection struct {
-	spec  *modelSpec
-	pool  *Pool
-	index bool
+	spec   *modelSpec
+	pool   *Pool
+	index  bool
+	ttl    time.Duration
+	notify bool
+	// softDelete is true if Delete, DeleteAll, and Query.Delete only mark models
+	// as deleted instead of removing them from the database.
+	softDelete bool
+	// migrations are the migrations added with AddMigration, in order of
+	// increasing version.
+	migrations []Migration
+	// nextExpiration is the earliest time that a model in the collection might
+	// expire, as a unix timestamp in milliseconds, or 0 if it is not known. It
+	// is only used for collections with a TTL and must be accessed atomically.
+	// See Transaction.sweepCollections.
+	nextExpiration int64
 }
 
 // CollectionOptions contains various options for a pool.
@@ -51,13 +66,34 @@ type CollectionOptions struct {
 	// name corresponding to *models.User would be "User". If a custom name is
 	// provided, it cannot contain a colon.
 	Name string
+	// TTL is how long models in the collection will exist after they were last
+	// saved. If TTL is 0, models never expire. Expired models are removed from
+	// the database by Redis, and their ids are removed from the index on all
+	// models and from any field indexes the next time the collection is queried
+	// or DeleteExpired is called. TTL requires Index to be true.
+	TTL time.Duration
+	// If Notify is true, Save, SaveFields, Delete, and DeleteAll will publish a
+	// ChangeEvent to the channel returned by ChangesChannel in the same
+	// transaction. You can receive the events with the Subscribe method.
+	Notify bool
+	// If SoftDelete is true, Delete, DeleteAll, and Query.Delete do not remove
+	// models from the database. Instead, each model is removed from the index on
+	// all models and from any field indexes, and its id is added to a separate
+	// index of deleted models along with the time it was deleted. Soft deleted
+	// models are excluded from Find, FindAll, Count, Exists, and queries, but can
+	// be found with FindDeleted and FindAllDeleted, restored with Restore, and
+	// permanently removed with Purge. Saving a soft deleted model also restores
+	// it, but only the saved fields are indexed, so Restore is usually a better
+	// choice. References to soft deleted models are still loaded. SoftDelete
+	// requires Index to be true.
+	SoftDelete bool
 }
 
 // DefaultCollectionOptions is the default set of options for a collection.
 var DefaultCollectionOptions = CollectionOptions{
 	FallbackMarshalerUnmarshaler: GobMarshalerUnmarshaler,
-	Index: false,
-	Name:  "",
+	Index:                        false,
+	Name:                         "",
 }
 
 // WithFallbackMarshalerUnmarshaler returns a new copy of the options with the
@@ -82,6 +118,27 @@ func (options CollectionOptions) WithName(name string) CollectionOptions {
 	return options
 }
 
+// WithTTL returns a new copy of the options with the TTL property set to the
+// given value. It does not mutate the original options.
+func (options CollectionOptions) WithTTL(ttl time.Duration) CollectionOptions {
+	options.TTL = ttl
+	return options
+}
+
+// WithNotify returns a new copy of the options with the Notify property set to
+// the given value. It does not mutate the original options.
+func (options CollectionOptions) WithNotify(notify bool) CollectionOptions {
+	options.Notify = notify
+	return options
+}
+
+// WithSoftDelete returns a new copy of the options with the SoftDelete property
+// set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithSoftDelete(softDelete bool) CollectionOptions {
+	options.SoftDelete = softDelete
+	return options
+}
+
 // NewCollection registers and returns a new collection of the given model type.
 // You must create a collection for each model type you want to save. The type
 // of model must be unique, i.e., not already registered, and must be a pointer
@@ -102,6 +159,16 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 		options.Name = getDefaultModelSpecName(typ)
 	} else if strings.Contains(options.Name, ":") {
 		return nil, fmt.Errorf("zoom: CollectionOptions.Name cannot contain a colon. Got: %s", options.Name)
+	} else if p.options.Cluster && strings.ContainsAny(options.Name, "{}") {
+		return nil, fmt.Errorf("zoom: CollectionOptions.Name cannot contain curly braces in cluster mode. Got: %s", options.Name)
+	}
+	if options.TTL < 0 {
+		return nil, fmt.Errorf("zoom: CollectionOptions.TTL cannot be negative. Got: %s", options.TTL)
+	} else if options.TTL > 0 && !options.Index {
+		return nil, fmt.Errorf("zoom: CollectionOptions.TTL requires Index to be true")
+	}
+	if options.SoftDelete && !options.Index {
+		return nil, fmt.Errorf("zoom: CollectionOptions.SoftDelete requires Index to be true")
 	}
 
 	// Make sure the name and type have not been previously registered
@@ -121,13 +188,17 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 	}
 	spec.name = options.Name
 	spec.fallback = options.FallbackMarshalerUnmarshaler
+	spec.cluster = p.options.Cluster
 	p.modelTypeToSpec[typ] = spec
 	p.modelNameToSpec[options.Name] = spec
 
 	collection := &Collection{
-		spec:  spec,
-		pool:  p,
-		index: options.Index,
+		spec:       spec,
+		pool:       p,
+		index:      options.Index,
+		ttl:        options.TTL,
+		notify:     options.Notify,
+		softDelete: options.SoftDelete,
 	}
 	addCollection(collection)
 	return collection, nil
@@ -135,7 +206,9 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 
 // Name returns the name for the given collection. The name is a unique string
 // identifier to use for the collection in redis. All models in this collection
-// that are saved in the database will use the collection name as a prefix.
+// that are saved in the database will use the collection name as a prefix. In
+// cluster mode, the name is wrapped in a hash tag (e.g. "{Person}") in the
+// prefix.
 func (c *Collection) Name() string {
 	return c.spec.name
 }
@@ -235,12 +308,22 @@ func newUnindexedCollectionError(methodName string) error {
 
 // Save writes a model (a struct which satisfies the Model interface) to the
 // redis database. Save returns an error if the type of model does not match the
-// registered Collection. To make a struct satisfy the Model interface, you can
-// embed zoom.RandomID, which will generate pseudo-random ids for each model.
+// registered Collection. If saving the model would violate a unique constraint,
+// Save returns a UniqueConstraintError and nothing is saved. If the model has a
+// version field and the version does not match the version in the database,
+// Save returns a VersionConflictError and nothing is saved. To make a struct
+// satisfy the Model interface, you can embed zoom.RandomID, which will generate
+// pseudo-random ids for each model.
 func (c *Collection) Save(model Model) error {
+	return c.SaveContext(context.Background(), model)
+}
+
+// SaveContext is like Save but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) SaveContext(ctx context.Context, model Model) error {
 	t := c.pool.NewTransaction()
 	t.Save(c, model)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return err
 	}
 	return nil
@@ -263,16 +346,27 @@ func (t *Transaction) Save(c *Collection, model Model) {
 		t.setError(fmt.Errorf("zoom: Error in Save or Transaction.Save: %s", err.Error()))
 		return
 	}
+	if err := c.spec.checkModelID(model.ModelID()); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in Save or Transaction.Save: %s", err.Error()))
+		return
+	}
 	// Create a modelRef and start a transaction
 	mr := &modelRef{
 		collection: c,
 		model:      model,
 		spec:       c.spec,
 	}
+	// Increment the version (if any). This must happen before any of the field
+	// values are used, so that the new version is saved.
+	t.saveVersion(mr)
 	// Save indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
 	t.saveFieldIndexes(mr)
+	// Save unique indexes. This also relies on reading the old field values.
+	t.saveUniqueIndexesForFields(mr.spec.fieldNames(), mr)
+	// Save the ids for any references to many other models
+	t.saveReferences(mr)
 	// Save the model fields in a hash in the database
 	hashArgs, err := mr.mainHashArgs()
 	if err != nil {
@@ -289,6 +383,14 @@ func (t *Transaction) Save(c *Collection, model Model) {
 	if c.index {
 		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelID()}, nil)
 	}
+	// Saving a soft deleted model restores it
+	if c.softDelete {
+		t.Command("ZREM", redis.Args{c.spec.deletedKey(), model.ModelID()}, nil)
+	}
+	// Set the expiration (if any)
+	t.saveExpiration(mr)
+	// Publish a change event (if enabled)
+	t.publishChange(c, SaveOperation, model.ModelID(), c.spec.fieldNames())
 }
 
 // saveFieldIndexes adds commands to the transaction for saving the indexes
@@ -352,7 +454,7 @@ func (t *Transaction) saveBooleanIndex(mr *modelRef, fs *fieldSpec) {
 // index on the given field. This includes removing the old index (if any).
 func (t *Transaction) saveStringIndex(mr *modelRef, fs *fieldSpec) {
 	// Remove the old index (if any)
-	t.deleteStringIndex(mr.spec.name, mr.model.ModelID(), fs.redisName)
+	t.deleteStringIndex(mr.spec.keyPrefix(), mr.model.ModelID(), fs.redisName)
 	fieldValue := mr.fieldValue(fs.name)
 	for fieldValue.Kind() == reflect.Ptr {
 		if fieldValue.IsNil() {
@@ -368,18 +470,58 @@ func (t *Transaction) saveStringIndex(mr *modelRef, fs *fieldSpec) {
 	t.Command("ZADD", redis.Args{indexKey, 0, member}, nil)
 }
 
-// SaveFields saves only the given fields of the model. SaveFields uses
-// "last write wins" semantics. If another caller updates the the same fields
-// concurrently, your updates may be overwritten. It will return an error if
+// saveReferences adds commands to the transaction for saving the ids of the
+// models referenced by each field which is a reference to many other models.
+func (t *Transaction) saveReferences(mr *modelRef) {
+	t.saveReferencesForFields(mr.spec.fieldNames(), mr)
+}
+
+// saveReferencesForFields works like saveReferences, but only saves the
+// references for the given fieldNames. The ids are stored in a separate set
+// which replaces any set that was previously saved. Only the ids are saved, not
+// the referenced models themselves.
+func (t *Transaction) saveReferencesForFields(fieldNames []string, mr *modelRef) {
+	for _, fs := range mr.spec.fields {
+		if fs.kind != referencesField || !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		key := mr.spec.referencesKey(mr.model.ModelID(), fs)
+		t.Command("DEL", redis.Args{key}, nil)
+		args := redis.Args{key}
+		fieldVal := mr.fieldValue(fs.name)
+		for i := 0; i < fieldVal.Len(); i++ {
+			related := fieldVal.Index(i)
+			if related.IsNil() {
+				continue
+			}
+			args = append(args, related.Interface().(Model).ModelID())
+		}
+		if len(args) > 1 {
+			t.Command("SADD", args, nil)
+		}
+	}
+}
+
+// SaveFields saves only the given fields of the model. Unless the model has a
+// version field, SaveFields uses "last write wins" semantics. If another caller
+// updates the the same fields concurrently, your updates may be overwritten. If
+// the model has a version field, it is always checked and saved, even if it is
+// not one of the given fieldNames. It will return an error if
 // the type of model does not match the registered Collection, or if any of
 // the given fieldNames are not found in the registered Collection. If
 // SaveFields is called on a model that has not yet been saved, it will not
 // return an error. Instead, only the given fields will be saved in the
 // database.
 func (c *Collection) SaveFields(fieldNames []string, model Model) error {
+	return c.SaveFieldsContext(context.Background(), fieldNames, model)
+}
+
+// SaveFieldsContext is like SaveFields but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) SaveFieldsContext(ctx context.Context, fieldNames []string, model Model) error {
 	t := c.pool.NewTransaction()
 	t.SaveFields(c, fieldNames, model)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return err
 	}
 	return nil
@@ -389,17 +531,23 @@ func (c *Collection) SaveFields(fieldNames []string, model Model) error {
 // transaction. SaveFields will set the err property of the transaction if the
 // type of model does not match the registered Collection, or if any of the
 // given fieldNames are not found in the model type. In either case, the
-// transaction will return the error when you call Exec. SaveFields uses "last
-// write wins" semantics. If another caller updates the the same fields
-// concurrently, your updates may be overwritten. If SaveFields is called on a
-// model that has not yet been saved, it will not return an error. Instead, only
-// the given fields will be saved in the database.
+// transaction will return the error when you call Exec. Unless the model has a
+// version field, SaveFields uses "last write wins" semantics. If another caller
+// updates the the same fields concurrently, your updates may be overwritten. If
+// the model has a version field, it is always checked and saved, even if it is
+// not one of the given fieldNames. If SaveFields is called on a model that has
+// not yet been saved, it will not return an error. Instead, only the given
+// fields will be saved in the database.
 func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model) {
 	// Check the model type
 	if err := c.checkModelType(model); err != nil {
 		t.setError(fmt.Errorf("zoom: Error in SaveFields or Transaction.SaveFields: %s", err.Error()))
 		return
 	}
+	if err := c.spec.checkModelID(model.ModelID()); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in SaveFields or Transaction.SaveFields: %s", err.Error()))
+		return
+	}
 	// Check the given field names
 	for _, fieldName := range fieldNames {
 		if !stringSliceContains(c.spec.fieldNames(), fieldName) {
@@ -413,10 +561,18 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 		model:      model,
 		spec:       c.spec,
 	}
+	// Increment the version (if any) and make sure it is saved along with the
+	// given fields. This must happen before any of the field values are used.
+	fieldNames = c.spec.withVersionField(fieldNames)
+	t.saveVersion(mr)
 	// Update indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
 	t.saveFieldIndexesForFields(fieldNames, mr)
+	// Save unique indexes. This also relies on reading the old field values.
+	t.saveUniqueIndexesForFields(fieldNames, mr)
+	// Save the ids for any references to many other models
+	t.saveReferencesForFields(fieldNames, mr)
 	// Get the main hash args.
 	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
 	if err != nil {
@@ -434,6 +590,14 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 	if c.index {
 		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelID()}, nil)
 	}
+	// Saving a soft deleted model restores it
+	if c.softDelete {
+		t.Command("ZREM", redis.Args{c.spec.deletedKey(), model.ModelID()}, nil)
+	}
+	// Set the expiration (if any)
+	t.saveExpiration(mr)
+	// Publish a change event (if enabled)
+	t.publishChange(c, SaveOperation, model.ModelID(), fieldNames)
 }
 
 // Find retrieves a model with the given id from redis and scans its values
@@ -443,9 +607,15 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 // with the given id does not exist, if the given model was the wrong type, or
 // if there was a problem connecting to the database.
 func (c *Collection) Find(id string, model Model) error {
+	return c.FindContext(context.Background(), id, model)
+}
+
+// FindContext is like Find but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) FindContext(ctx context.Context, id string, model Model) error {
 	t := c.pool.NewTransaction()
 	t.Find(c, id, model)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return err
 	}
 	return nil
@@ -456,7 +626,8 @@ func (c *Collection) Find(id string, model Model) error {
 // of a registered type corresponding to the Collection. find will mutate the struct,
 // filling in its fields and overwriting any previous values. Any errors encountered
 // will be added to the transaction and returned as an error when the transaction is
-// executed.
+// executed. The model is not watched and is only read when the transaction is
+// executed, so inside Pool.Update use WatchAndFind instead.
 func (t *Transaction) Find(c *Collection, id string, model Model) {
 	if c == nil {
 		t.setError(newNilCollectionError("Find"))
@@ -466,6 +637,16 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 		t.setError(fmt.Errorf("zoom: Error in Find or Transaction.Find: %s", err.Error()))
 		return
 	}
+	// Soft deleted models can only be found with FindDeleted
+	if c.softDelete {
+		t.checkDeleted(c, id, false)
+	}
+	t.findModel(c, id, model)
+}
+
+// findModel adds commands to the transaction for checking that the model with
+// the given id exists and scanning its values into model.
+func (t *Transaction) findModel(c *Collection, id string, model Model) {
 	model.SetModelID(id)
 	mr := &modelRef{
 		collection: c,
@@ -479,7 +660,10 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 	for _, fieldName := range mr.spec.fieldRedisNames() {
 		args = append(args, fieldName)
 	}
-	t.Command("HMGET", args, newScanModelRefHandler(mr.spec.fieldNames(), mr))
+	handler := newScanModelRefHandler(mr.spec.fieldNames(), mr)
+	t.Command("HMGET", args, newLoadReferencesHandler(handler, t, c.spec, mr.spec.fieldNames(), func() []Model {
+		return []Model{model}
+	}))
 }
 
 // FindFields is like Find but finds and sets only the specified fields. Any
@@ -487,9 +671,15 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 // FindFields will return an error if any of the given fieldNames are not found
 // in the model type.
 func (c *Collection) FindFields(id string, fieldNames []string, model Model) error {
+	return c.FindFieldsContext(context.Background(), id, fieldNames, model)
+}
+
+// FindFieldsContext is like FindFields but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) FindFieldsContext(ctx context.Context, id string, fieldNames []string, model Model) error {
 	t := c.pool.NewTransaction()
 	t.FindFields(c, id, fieldNames, model)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return err
 	}
 	return nil
@@ -498,7 +688,7 @@ func (c *Collection) FindFields(id string, fieldNames []string, model Model) err
 // FindFields is like Find but finds and sets only the specified fields. Any
 // fields of the model which are not in the given fieldNames are not mutated.
 // FindFields will return an error if any of the given fieldNames are not found
-// in the model type.
+// in the model type. Inside Pool.Update, use WatchAndFindFields instead.
 func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string, model Model) {
 	if err := c.checkModelType(model); err != nil {
 		t.setError(fmt.Errorf("zoom: Error in FindFields or Transaction.FindFields: %s", err.Error()))
@@ -526,8 +716,14 @@ func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string,
 	}
 	// Check if the model actually exists.
 	t.Command("EXISTS", redis.Args{mr.key()}, newModelExistsHandler(c, id))
+	if c.softDelete {
+		t.checkDeleted(c, id, false)
+	}
 	// Get the fields from the main hash for this model
-	t.Command("HMGET", args, newScanModelRefHandler(fieldNames, mr))
+	handler := newScanModelRefHandler(fieldNames, mr)
+	t.Command("HMGET", args, newLoadReferencesHandler(handler, t, c.spec, fieldNames, func() []Model {
+		return []Model{model}
+	}))
 }
 
 // FindAll finds all the models of the given type. It executes the commands needed
@@ -538,11 +734,17 @@ func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string,
 // FindAll returns an error if models is the wrong type or if there was a problem connecting
 // to the database.
 func (c *Collection) FindAll(models interface{}) error {
+	return c.FindAllContext(context.Background(), models)
+}
+
+// FindAllContext is like FindAll but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) FindAllContext(ctx context.Context, models interface{}) error {
 	// Since this is somewhat type-unsafe, we need to verify that
 	// models is the correct type
 	t := c.pool.NewTransaction()
 	t.FindAll(c, models)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return err
 	}
 	return nil
@@ -570,18 +772,26 @@ func (t *Transaction) FindAll(c *Collection, models interface{}) {
 		t.setError(fmt.Errorf("zoom: Error in FindAll or Transaction.FindAll: %s", err.Error()))
 		return
 	}
+	t.sweepExpired(c)
 	sortArgs := c.spec.sortArgs(c.spec.indexKey(), c.spec.fieldRedisNames(), 0, 0, false)
 	fieldNames := append(c.spec.fieldNames(), "-")
-	t.Command("SORT", sortArgs, newScanModelsHandler(c.spec, fieldNames, models))
+	handler := newScanModelsHandler(c.spec, fieldNames, models)
+	t.Command("SORT", sortArgs, newLoadReferencesHandler(handler, t, c.spec, fieldNames, modelsGetter(models)))
 }
 
 // Exists returns true if the collection has a model with the given id. It
 // returns an error if there was a problem connecting to the database.
 func (c *Collection) Exists(id string) (bool, error) {
+	return c.ExistsContext(context.Background(), id)
+}
+
+// ExistsContext is like Exists but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) ExistsContext(ctx context.Context, id string) (bool, error) {
 	t := c.pool.NewTransaction()
 	exists := false
 	t.Exists(c, id, &exists)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return false, err
 	}
 	return exists, nil
@@ -597,15 +807,30 @@ func (t *Transaction) Exists(c *Collection, id string, exists *bool) {
 		return
 	}
 	t.Command("EXISTS", redis.Args{c.ModelKey(id)}, NewScanBoolHandler(exists))
+	if c.softDelete {
+		// Soft deleted models do not count as existing
+		t.Command("ZSCORE", redis.Args{c.spec.deletedKey(), id}, func(reply interface{}) error {
+			if reply != nil {
+				*exists = false
+			}
+			return nil
+		})
+	}
 }
 
 // Count returns the number of models of the given type that exist in the database.
 // It returns an error if there was a problem connecting to the database.
 func (c *Collection) Count() (int, error) {
+	return c.CountContext(context.Background())
+}
+
+// CountContext is like Count but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) CountContext(ctx context.Context) (int, error) {
 	t := c.pool.NewTransaction()
 	count := 0
 	t.Count(c, &count)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return 0, err
 	}
 	return count, nil
@@ -624,6 +849,7 @@ func (t *Transaction) Count(c *Collection, count *int) {
 		t.setError(newUnindexedCollectionError("Count"))
 		return
 	}
+	t.sweepExpired(c)
 	t.Command("SCARD", redis.Args{c.IndexKey()}, NewScanIntHandler(count))
 }
 
@@ -631,12 +857,22 @@ func (t *Transaction) Count(c *Collection, count *int) {
 // not return an error if the model corresponding to the given id was not
 // found in the database. Instead, it will return a boolean representing whether
 // or not the model was found and deleted, and will only return an error
-// if there was a problem connecting to the database.
+// if there was a problem connecting to the database. If the collection uses soft
+// deletes, the model is marked as deleted instead of being removed. See
+// CollectionOptions.SoftDelete. The ids of the model in any reference fields of
+// other models are not removed, but they are skipped when references are
+// loaded.
 func (c *Collection) Delete(id string) (bool, error) {
+	return c.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext is like Delete but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) DeleteContext(ctx context.Context, id string) (bool, error) {
 	t := c.pool.NewTransaction()
 	deleted := false
 	t.Delete(c, id, &deleted)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return deleted, err
 	}
 	return deleted, nil
@@ -654,20 +890,39 @@ func (t *Transaction) Delete(c *Collection, id string, deleted *bool) {
 		t.setError(newNilCollectionError("Delete"))
 		return
 	}
-	// Delete any field indexes
-	// This must happen first, because it relies on reading the old field values
-	// from the hash for string indexes (if any)
-	t.deleteFieldIndexes(c, id)
 	var handler ReplyHandler
 	if deleted == nil {
 		handler = nil
 	} else {
 		handler = NewScanBoolHandler(deleted)
 	}
+	if c.softDelete {
+		t.softDelete(c, "id", id, "", handler)
+		t.publishChange(c, DeleteOperation, id, nil)
+		return
+	}
+	// Delete any field indexes
+	// This must happen first, because it relies on reading the old field values
+	// from the hash for string indexes (if any)
+	t.deleteFieldIndexes(c, id)
+	t.deleteUniqueIndexes(c, id)
+	// Delete the sets of ids for any references to many other models
+	for _, fs := range c.spec.fields {
+		if fs.kind == referencesField {
+			t.Command("DEL", redis.Args{c.spec.referencesKey(id, fs)}, nil)
+		}
+	}
 	// Delete the main hash
-	t.Command("DEL", redis.Args{c.Name() + ":" + id}, handler)
+	t.Command("DEL", redis.Args{c.spec.keyPrefix() + ":" + id}, handler)
 	// Remvoe the id from the index of all models for the given type
 	t.Command("SREM", redis.Args{c.IndexKey(), id}, nil)
+	// Remove the id from the expiration times (if any)
+	if c.ttl > 0 {
+		t.Command("ZREM", redis.Args{c.spec.expireKey(), id}, nil)
+		t.Command("HDEL", redis.Args{c.spec.expireValuesKey(), id}, nil)
+	}
+	// Publish a change event (if enabled)
+	t.publishChange(c, DeleteOperation, id, nil)
 }
 
 // deleteFieldIndexes adds commands to the transaction for deleting the field
@@ -681,7 +936,7 @@ func (t *Transaction) deleteFieldIndexes(c *Collection, id string) {
 			t.deleteNumericOrBooleanIndex(fs, c.spec, id)
 		case stringIndex:
 			// NOTE: this invokes a lua script which is defined in scripts/delete_string_index.lua
-			t.deleteStringIndex(c.Name(), id, fs.redisName)
+			t.deleteStringIndex(c.spec.keyPrefix(), id, fs.redisName)
 		}
 	}
 }
@@ -698,12 +953,20 @@ func (t *Transaction) deleteNumericOrBooleanIndex(fs *fieldSpec, ms *modelSpec,
 
 // DeleteAll deletes all the models of the given type in a single transaction. See
 // http://redis.io/topics/transactions. It returns the number of models deleted
-// and an error if there was a problem connecting to the database.
+// and an error if there was a problem connecting to the database. If the
+// collection uses soft deletes, the models are marked as deleted instead of
+// being removed.
 func (c *Collection) DeleteAll() (int, error) {
+	return c.DeleteAllContext(context.Background())
+}
+
+// DeleteAllContext is like DeleteAll but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) DeleteAllContext(ctx context.Context) (int, error) {
 	t := c.pool.NewTransaction()
 	count := 0
 	t.DeleteAll(c, &count)
-	if err := t.Exec(); err != nil {
+	if err := t.ExecContext(ctx); err != nil {
 		return count, err
 	}
 	return count, nil
@@ -729,7 +992,31 @@ func (t *Transaction) DeleteAll(c *Collection, count *int) {
 	} else {
 		handler = NewScanIntHandler(count)
 	}
-	t.DeleteModelsBySetIDs(c.IndexKey(), c.Name(), handler)
+	if c.softDelete {
+		t.softDelete(c, "set", c.IndexKey(), "", handler)
+		t.publishChange(c, DeleteAllOperation, "", nil)
+		return
+	}
+	t.deleteModelsBySetIDs(c.IndexKey(), c.spec.keyPrefix(), c.spec.referencesFieldRedisNames(), handler)
+	// Every model was deleted, so the field indexes and unique indexes can be
+	// deleted entirely
+	indexKeys := redis.Args{}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind != noIndex {
+			indexKeys = append(indexKeys, c.spec.keyPrefix()+":"+fs.redisName)
+		}
+		if fs.unique {
+			indexKeys = append(indexKeys, c.spec.uniqueIndexKey(fs))
+		}
+	}
+	if len(indexKeys) > 0 {
+		t.Command("DEL", indexKeys, nil)
+	}
+	if c.ttl > 0 {
+		t.Command("DEL", redis.Args{c.spec.expireKey(), c.spec.expireValuesKey()}, nil)
+	}
+	// Publish a change event (if enabled)
+	t.publishChange(c, DeleteAllOperation, "", nil)
 }
 
 // checkModelType returns an error iff model is not of the registered type that
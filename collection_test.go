@@ -134,6 +134,27 @@ func TestSave(t *testing.T) {
 	expectFieldEquals(t, key, "Bool", mu, model.Bool)
 }
 
+func TestSaveReservedID(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	for _, id := range []string{"all", "expire", "expire:values", "deleted", "migrations", "migrations:lock"} {
+		model := &testModel{RandomID: RandomID{ID: id}}
+		if err := testModels.Save(model); err == nil {
+			t.Errorf("Expected an error in Save for the reserved id %s but got none", id)
+		}
+		if err := testModels.SaveFields([]string{"Int"}, model); err == nil {
+			t.Errorf("Expected an error in SaveFields for the reserved id %s but got none", id)
+		}
+	}
+	// Ids which only look similar should be allowed
+	for _, id := range []string{"allowed", "expired", "deleted-user"} {
+		if err := testModels.Save(&testModel{RandomID: RandomID{ID: id}}); err != nil {
+			t.Errorf("Unexpected error in Save for the id %s: %s", id, err.Error())
+		}
+	}
+}
+
 func TestSaveFields(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -442,4 +463,19 @@ func TestDeleteAll(t *testing.T) {
 
 	// Make sure the models were deleted
 	expectModelsDoNotExist(t, testModels, Models(models))
+
+	// DeleteAll should also remove every entry in the field indexes
+	indexedModels, err := createAndSaveIndexedTestModels(3)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	if count, err := indexedTestModels.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	} else if count != len(indexedModels) {
+		t.Errorf("Expected count to be %d but got %d", len(indexedModels), count)
+	}
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectKeyDoesNotExist(t, indexedTestModels.spec.keyPrefix()+":"+fieldName)
+	}
+	expectNoIndexProblems(t, indexedTestModels)
 }
@@ -0,0 +1,180 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File context.go contains code related to executing transactions with a
+// context.Context, including cancelling connection acquisition and applying
+// deadlines to the underlying network connections.
+
+package zoom
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// watchContextCommand and unwatchContextCommand are pseudo-commands which are
+// understood by dialedConn. They are never sent to Redis. Since redis.Pool
+// forwards any command it does not recognize to the underlying connection,
+// they are the only way to reach the network connection behind a pooled
+// connection.
+const (
+	watchContextCommand   = "ZOOM.WATCHCONTEXT"
+	unwatchContextCommand = "ZOOM.UNWATCHCONTEXT"
+)
+
+// aLongTimeAgo is a deadline in the past, which causes any pending reads or
+// writes on a network connection to fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// dialedConn is a redis.Conn created by dial. It keeps a reference to the
+// underlying network connection so that the deadline and cancellation of a
+// context can be applied to it.
+type dialedConn struct {
+	redis.Conn
+	netConn net.Conn
+	// stop and done are used to stop the goroutine started by watchContext
+	// and wait for it to exit. They are nil if no context is being watched.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newDialedConn returns a dialedConn which uses the given network connection.
+func newDialedConn(netConn net.Conn) *dialedConn {
+	return &dialedConn{
+		Conn:    redis.NewConn(netConn, 0, 0),
+		netConn: netConn,
+	}
+}
+
+// Do handles watchContextCommand and unwatchContextCommand and sends every
+// other command to Redis.
+func (c *dialedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	switch commandName {
+	case watchContextCommand:
+		c.watchContext(args[0].(context.Context))
+		return nil, nil
+	case unwatchContextCommand:
+		c.unwatchContext()
+		return nil, nil
+	}
+	return c.Conn.Do(commandName, args...)
+}
+
+// watchContext applies the deadline of ctx (if any) to the network connection
+// and starts a goroutine which interrupts any pending reads or writes when ctx
+// is done. Interrupted connections have a permanent error, so redis.Pool will
+// not reuse them.
+func (c *dialedConn) watchContext(ctx context.Context) {
+	c.unwatchContext()
+	deadline, _ := ctx.Deadline()
+	_ = c.netConn.SetDeadline(deadline)
+	if ctx.Done() == nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.stop, c.done = stop, done
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			_ = c.netConn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+}
+
+// unwatchContext stops the goroutine started by watchContext (if any) and
+// clears the deadline on the network connection.
+func (c *dialedConn) unwatchContext() {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop, c.done = nil, nil
+	}
+	_ = c.netConn.SetDeadline(time.Time{})
+}
+
+// contextConn is a redis.Conn which is watching a context (see
+// dialedConn.watchContext). It stops watching the context when it is closed,
+// before the connection is returned to the pool.
+type contextConn struct {
+	redis.Conn
+}
+
+func (cc contextConn) Close() error {
+	_, _ = cc.Conn.Do(unwatchContextCommand)
+	return cc.Conn.Close()
+}
+
+// connWithContext calls get to get a connection and returns a connection which
+// respects the deadline and cancellation of ctx. If ctx is done before get
+// returns, it gives up and returns a connection which always returns
+// ctx.Err(). get is called in a separate goroutine because redis.Pool may block
+// while waiting for a connection to become available.
+func connWithContext(ctx context.Context, get func() redis.Conn) redis.Conn {
+	if err := ctx.Err(); err != nil {
+		return errorConn{err: err}
+	}
+	if ctx.Done() == nil {
+		return watchContext(ctx, get())
+	}
+	result := make(chan redis.Conn, 1)
+	go func() {
+		result <- get()
+	}()
+	select {
+	case conn := <-result:
+		return watchContext(ctx, conn)
+	case <-ctx.Done():
+		// Return the connection to the pool whenever it becomes available
+		go func() {
+			_ = (<-result).Close()
+		}()
+		return errorConn{err: ctx.Err()}
+	}
+}
+
+// watchContext causes conn to respect the deadline and cancellation of ctx
+// until it is closed. It returns conn as is if ctx can never be done or conn
+// already has an error.
+func watchContext(ctx context.Context, conn redis.Conn) redis.Conn {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && ctx.Done() == nil {
+		return conn
+	}
+	if conn.Err() != nil {
+		return conn
+	}
+	if _, err := conn.Do(watchContextCommand, ctx); err != nil {
+		_ = conn.Close()
+		return errorConn{err: err}
+	}
+	return contextConn{Conn: conn}
+}
+
+// getConn calls get to get a connection for the transaction. If the
+// transaction is being executed with a context (see ExecContext), the
+// connection respects the deadline and cancellation of the context.
+func (t *Transaction) getConn(get func() redis.Conn) redis.Conn {
+	if t.ctx == nil {
+		return get()
+	}
+	return connWithContext(t.ctx, get)
+}
+
+// contextErr returns ctx.Err(), or context.DeadlineExceeded if the deadline of
+// ctx has passed. The deadline on a network connection can pass slightly
+// before ctx itself is marked as done.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File context_test.go tests the code in context.go, i.e. executing
+// transactions, finders, and queries with a context.Context.
+
+package zoom
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestContextCancelled(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(3)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := indexedTestModels.FindContext(ctx, models[0].ModelID(), &indexedTestModel{}); err != context.Canceled {
+		t.Errorf("Expected FindContext to return %v but got %v", context.Canceled, err)
+	}
+	if _, err := indexedTestModels.NewQuery().Order("Int").CountContext(ctx); err != context.Canceled {
+		t.Errorf("Expected CountContext to return %v but got %v", context.Canceled, err)
+	}
+	tx := testPool.NewTransaction()
+	if err := tx.WatchKey(indexedTestModels.ModelKey(models[0].ModelID())); err != nil {
+		t.Fatalf("Unexpected error in WatchKey: %s", err.Error())
+	}
+	tx.Delete(indexedTestModels, models[0].ModelID(), nil)
+	if err := tx.ExecContext(ctx); err != context.Canceled {
+		t.Errorf("Expected ExecContext to return %v but got %v", context.Canceled, err)
+	}
+	expectModelExists(t, indexedTestModels, models[0])
+}
+
+func TestContextSuccess(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	model := createIndexedTestModels(1)[0]
+	if err := indexedTestModels.SaveContext(ctx, model); err != nil {
+		t.Fatalf("Unexpected error in SaveContext: %s", err.Error())
+	}
+	got := &indexedTestModel{}
+	if err := indexedTestModels.FindContext(ctx, model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in FindContext: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, got) {
+		t.Errorf("Expected %+v but got %+v", model, got)
+	}
+	gotModels := []*indexedTestModel{}
+	if err := indexedTestModels.NewQuery().Order("Int").RunContext(ctx, &gotModels); err != nil {
+		t.Fatalf("Unexpected error in RunContext: %s", err.Error())
+	}
+	if len(gotModels) != 1 || !reflect.DeepEqual(model, gotModels[0]) {
+		t.Errorf("Expected [%+v] but got %+v", model, gotModels)
+	}
+
+	// After the context is done, the connections should still be usable without
+	// a context.
+	cancel()
+	if err := indexedTestModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find after the context was cancelled: %s", err.Error())
+	}
+}
+
+func TestContextWaitForConn(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options.WithMaxActive(1).WithWait(true))
+	defer func() {
+		_ = pool.Close()
+	}()
+	models, err := pool.NewCollectionWithOptions(&contextTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+
+	// Hold the only connection, so CountContext has to wait for it
+	conn := pool.NewConn()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := models.CountContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected CountContext to return %v but got %v", context.DeadlineExceeded, err)
+	}
+	_ = conn.Close()
+
+	// Once the connection is released, the pool should work as usual
+	if _, err := models.CountContext(context.Background()); err != nil {
+		t.Errorf("Unexpected error in CountContext: %s", err.Error())
+	}
+}
+
+func TestContextInterruptsReads(t *testing.T) {
+	server, err := newUnresponsiveServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+	pool := NewPoolWithOptions(DefaultPoolOptions.WithAddress(server.address()))
+	defer func() {
+		_ = pool.Close()
+	}()
+
+	// The deadline of the context should apply to reads
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tx := pool.NewTransaction()
+	tx.Command("GET", redis.Args{"key"}, nil)
+	if err := tx.ExecContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected ExecContext to return %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	// Cancelling the context should interrupt pending reads
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	tx = pool.NewTransaction()
+	tx.Command("GET", redis.Args{"key"}, nil)
+	if err := tx.ExecContext(ctx); err != context.Canceled {
+		t.Errorf("Expected ExecContext to return %v but got %v", context.Canceled, err)
+	}
+
+	// The interrupted connections should not be returned to the pool
+	if count := pool.redisPool.ActiveCount(); count != 0 {
+		t.Errorf("Expected the interrupted connections to be closed but there were %d active connections", count)
+	}
+}
+
+// contextTestModel is a model type used for testing collections which belong
+// to a pool other than testPool.
+type contextTestModel struct {
+	Int int
+	RandomID
+}
+
+// unresponsiveServer is a server which replies to the SELECT command sent when
+// a connection is created, and never replies to anything else.
+type unresponsiveServer struct {
+	listener net.Listener
+}
+
+func newUnresponsiveServer() (*unresponsiveServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &unresponsiveServer{listener: listener}
+	go server.serve()
+	return server, nil
+}
+
+func (server *unresponsiveServer) address() string {
+	return server.listener.Addr().String()
+}
+
+func (server *unresponsiveServer) close() {
+	_ = server.listener.Close()
+}
+
+func (server *unresponsiveServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *unresponsiveServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		if args[0] == "Select" {
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+	}
+}
@@ -56,6 +56,12 @@ func scanModel(fieldNames []string, fieldValues []interface{}, mr *modelRef) err
 			if err := scanPointerVal(replyBytes, fieldVal); err != nil {
 				return err
 			}
+		case referenceField:
+			scanReferenceVal(replyBytes, fieldVal)
+		case referencesField:
+			// The ids for these fields are stored in a separate set and are
+			// scanned by loadReferences.
+			continue
 		default:
 			if err := scanInconvertibleVal(mr.spec.fallback, replyBytes, fieldVal); err != nil {
 				return err
@@ -119,6 +125,19 @@ func scanPointerVal(src []byte, dest reflect.Value) error {
 	return scanPrimitiveVal(src, dest.Elem())
 }
 
+// scanReferenceVal sets dest, which should be a pointer to a model, to a new
+// model with only the id set. The other fields of the related model are
+// filled in by loadReferences.
+func scanReferenceVal(src []byte, dest reflect.Value) {
+	if len(src) == 0 || string(src) == "NULL" {
+		dest.Set(reflect.Zero(dest.Type()))
+		return
+	}
+	related := reflect.New(dest.Type().Elem())
+	related.Interface().(Model).SetModelID(string(src))
+	dest.Set(related)
+}
+
 // scanIncovertibleVal unmarshals src into dest using the given
 // MarshalerUnmarshaler
 func scanInconvertibleVal(marshalerUnmarshaler MarshalerUnmarshaler, src []byte, dest reflect.Value) error {
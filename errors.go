@@ -43,3 +43,52 @@ type WatchError struct {
 func (e WatchError) Error() string {
 	return fmt.Sprintf("zoom: watch error: at least one of the following keys has changed: %v", e.keys)
 }
+
+// UniqueConstraintError is returned when saving a model would violate a unique
+// constraint, i.e. when a different model in the same collection already has
+// the same value for a field with the `zoom:"unique"` struct tag. When it is
+// returned, none of the commands in the transaction are executed.
+type UniqueConstraintError struct {
+	Collection *Collection
+	// FieldName is the name of the field whose unique constraint would be
+	// violated.
+	FieldName string
+	// Value is the value of the field that is already taken.
+	Value interface{}
+	// ExistingID is the id of the model which already has the value.
+	ExistingID string
+}
+
+func (e UniqueConstraintError) Error() string {
+	return fmt.Sprintf("zoom: UniqueConstraintError: %s with id = %s already has %s = %v", e.Collection.Name(), e.ExistingID, e.FieldName, e.Value)
+}
+
+// VersionConflictError is returned when saving a model with a version field
+// (i.e. a field with the `zoom:"version"` struct tag) whose version does not
+// match the version in the database, which means that the model was changed by
+// another caller after it was retrieved. When it is returned, none of the
+// commands in the transaction are executed.
+type VersionConflictError struct {
+	Collection *Collection
+	// ID is the id of the model.
+	ID string
+	// Version is the version of the model that was being saved.
+	Version int64
+	// CurrentVersion is the version of the model in the database. It is 0 if
+	// the model does not exist.
+	CurrentVersion int64
+}
+
+func (e VersionConflictError) Error() string {
+	return fmt.Sprintf("zoom: VersionConflictError: %s with id = %s has version %d but the model being saved has version %d", e.Collection.Name(), e.ID, e.CurrentVersion, e.Version)
+}
+
+// MigrationInProgressError is returned by Migrate if the migrations for the
+// collection are already being run by another caller.
+type MigrationInProgressError struct {
+	Collection *Collection
+}
+
+func (e MigrationInProgressError) Error() string {
+	return fmt.Sprintf("zoom: MigrationInProgressError: the migrations for %s are already being run by another caller", e.Collection.Name())
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File expire.go contains code related to expiring models, i.e. models in a
+// collection with a TTL.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// saveExpiration adds commands to the transaction for setting the expiration
+// of the model if its collection has a TTL. The expiration is set on the main
+// hash and any separate keys for the model, and the expiration time is added to
+// a sorted set so that the model can be removed from any indexes after it
+// expires.
+func (t *Transaction) saveExpiration(mr *modelRef) {
+	c := mr.collection
+	if c.ttl <= 0 {
+		return
+	}
+	ttl := int64(c.ttl / time.Millisecond)
+	id := mr.model.ModelID()
+	t.Command("PEXPIRE", redis.Args{mr.key(), ttl}, nil)
+	for _, fs := range mr.spec.fields {
+		if fs.kind == referencesField {
+			t.Command("PEXPIRE", redis.Args{mr.spec.referencesKey(id, fs), ttl}, nil)
+		}
+	}
+	expireAt := unixMilliseconds(time.Now()) + ttl
+	t.Command("ZADD", redis.Args{mr.spec.expireKey(), expireAt, id}, nil)
+	t.saveExpireValues(c, id)
+}
+
+// saveExpireValues adds a script to the transaction which copies the values of
+// any fields with a string index or a unique constraint from the main hash of
+// the model with the given id into a hash which does not expire, so that the
+// model can be removed from those indexes after Redis removes the main hash.
+// It does nothing if c does not have a TTL or does not have any such fields.
+// It must be called after the main hash is saved.
+func (t *Transaction) saveExpireValues(c *Collection, id string) {
+	if c.ttl <= 0 {
+		return
+	}
+	args := redis.Args{c.spec.keyPrefix(), id}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind == stringIndex || fs.unique {
+			args = append(args, fs.redisName)
+		}
+	}
+	if len(args) > 2 {
+		t.Script(saveExpireValuesScript, args, nil)
+	}
+}
+
+// DeleteExpired removes every model in the collection which has expired from
+// the index on all models and from any field indexes, and returns the number of
+// models that were removed. A model is only removed once Redis has removed its
+// main hash, so the clock of the client which saved the model does not need to
+// be accurate. You do not need to call DeleteExpired before running a query,
+// since queries do so automatically. However, you may wish to call it
+// periodically to free up the memory used by the indexes for collections which
+// are rarely queried. It returns an error if the collection does not have a
+// TTL.
+func (c *Collection) DeleteExpired() (int, error) {
+	return c.DeleteExpiredContext(context.Background())
+}
+
+// DeleteExpiredContext is like DeleteExpired but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) DeleteExpiredContext(ctx context.Context) (int, error) {
+	t := c.pool.NewTransaction()
+	count := 0
+	t.DeleteExpired(c, &count)
+	if err := t.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// DeleteExpired removes every model in the collection which has expired from
+// the index on all models and from any field indexes in an existing
+// transaction. count will be set to the number of models that were removed.
+// You may pass in nil for count if you do not care about the number of models
+// that were removed. Any errors encountered will be added to the transaction
+// and returned as an error when the transaction is executed.
+func (t *Transaction) DeleteExpired(c *Collection, count *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("DeleteExpired"))
+		return
+	}
+	if c.ttl <= 0 {
+		t.setError(fmt.Errorf("zoom: Error in DeleteExpired or Transaction.DeleteExpired: Collection %s does not have a TTL", c.Name()))
+		return
+	}
+	args := redis.Args{c.spec.keyPrefix(), unixMilliseconds(time.Now()), 0}
+	args = append(args, c.fieldCleanupArgs()...)
+	t.Script(deleteExpiredModelsScript, args, func(reply interface{}) error {
+		counts, err := redis.Ints(reply, nil)
+		if err != nil {
+			return err
+		}
+		if count != nil {
+			*count = counts[0]
+		}
+		return nil
+	})
+}
+
+// fieldCleanupArgs returns the arguments for the delete_expired_models,
+// delete_models_by_list_ids, and soft_delete_models scripts which describe the fields of c that need to
+// be cleaned up when a model is deleted. There is a pair of arguments for each
+// field index, unique index, and reference to many other models.
+func (c *Collection) fieldCleanupArgs() redis.Args {
+	args := redis.Args{}
+	for _, fs := range c.spec.fields {
+		switch {
+		case fs.indexKind == numericIndex || fs.indexKind == booleanIndex:
+			args = append(args, "numeric", fs.redisName)
+		case fs.indexKind == stringIndex:
+			args = append(args, "string", fs.redisName)
+		}
+		if fs.unique {
+			args = append(args, "unique", fs.redisName)
+		}
+		if fs.kind == referencesField {
+			args = append(args, "references", fs.redisName)
+		}
+	}
+	return args
+}
+
+// sweepExpired causes any expired models to be removed from the indexes for c
+// before the transaction is executed iff c has a TTL. It is used before reading
+// from the indexes so that expired models are never included. See
+// sweepCollections.
+func (t *Transaction) sweepExpired(c *Collection) {
+	if c.ttl <= 0 {
+		return
+	}
+	for _, other := range t.sweeps {
+		if other == c {
+			return
+		}
+	}
+	t.sweeps = append(t.sweeps, c)
+}
+
+// sweepCollections removes any expired models from the indexes for each
+// collection passed to sweepExpired. It is called by Exec before the
+// transaction is executed, and uses a separate connection to the primary so
+// that a transaction which only reads can still be sent to a replica. Since
+// every model in a collection has the same TTL, a model which is saved later
+// never expires earlier, so a collection is only swept once the earliest
+// expiration time found by the previous sweep has passed. If any models were
+// removed, the transaction is sent to the primary, since the changes might not
+// have been replicated yet.
+func (t *Transaction) sweepCollections() error {
+	for _, c := range t.sweeps {
+		now := unixMilliseconds(time.Now())
+		if now < atomic.LoadInt64(&c.nextExpiration) {
+			continue
+		}
+		count, nextExpiration, err := t.sweepCollection(c, now)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&c.nextExpiration, nextExpiration)
+		if count > 0 {
+			t.usePrimary = true
+		}
+	}
+	return nil
+}
+
+// sweepBatchSize is the maximum number of expired ids which are checked by
+// each run of the delete_expired_models script during a sweep, so that a large
+// number of expired models does not block the server for a long time.
+var sweepBatchSize = 1000
+
+// sweepCollection removes the models in c which expired at or before now from
+// the indexes, in batches of sweepBatchSize. It returns the number of models removed and the earliest
+// expiration time of the remaining models, or the expiration time of a model
+// saved now if there are none.
+func (t *Transaction) sweepCollection(c *Collection, now int64) (int, int64, error) {
+	conn := t.getConn(func() redis.Conn {
+		return t.pool.NewConnForKey(c.spec.expireKey())
+	})
+	defer func() {
+		_ = conn.Close()
+	}()
+	args := redis.Args{c.spec.keyPrefix(), now, sweepBatchSize}
+	args = append(args, c.fieldCleanupArgs()...)
+	count := 0
+	for {
+		counts, err := redis.Ints(deleteExpiredModelsScript.Do(conn, args...))
+		if err != nil {
+			return 0, 0, err
+		}
+		count += counts[0]
+		if counts[1] < sweepBatchSize {
+			break
+		}
+	}
+	reply, err := redis.Values(conn.Do("ZRANGE", c.spec.expireKey(), 0, 0, "WITHSCORES"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(reply) < 2 {
+		return count, now + int64(c.ttl/time.Millisecond), nil
+	}
+	nextExpiration, err := redis.Float64(reply[1], nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, int64(nextExpiration), nil
+}
+
+// unixMilliseconds returns the given time as the number of milliseconds since
+// the unix epoch.
+func unixMilliseconds(tm time.Time) int64 {
+	return tm.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,283 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File expire_test.go tests the code in expire.go and the handling of
+// collections with a TTL.
+
+package zoom
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestInvalidTTLThrowsError(t *testing.T) {
+	testingSetUp()
+	testingTearDown()
+
+	type unindexed struct {
+		Int int
+		RandomID
+	}
+	options := DefaultCollectionOptions.WithTTL(time.Minute)
+	if _, err := testPool.NewCollectionWithOptions(&unindexed{}, options); err == nil {
+		t.Error("Expected error when registering unindexed collection with a TTL but got none")
+	}
+	if _, err := testModels.DeleteExpired(); err == nil {
+		t.Error("Expected error when calling DeleteExpired on a collection without a TTL but got none")
+	}
+}
+
+func TestExpiringModels(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	related, err := createAndSaveTestModels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := []*expiringTestModel{}
+	for i := 0; i < 3; i++ {
+		model := &expiringTestModel{
+			Int:    i,
+			String: randomString(),
+			Many:   related,
+		}
+		if err := expiringTestModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		models = append(models, model)
+	}
+
+	// The main hash and the set of references should expire, and the
+	// expiration time should be stored.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	for _, model := range models {
+		modelKey := expiringTestModels.ModelKey(model.ModelID())
+		for _, key := range []string{modelKey, modelKey + ":Many"} {
+			ttl, err := redis.Int64(conn.Do("PTTL", key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl <= 0 || ttl > int64(time.Hour/time.Millisecond) {
+				t.Errorf("Expected key %s to expire within an hour but got PTTL %d", key, ttl)
+			}
+		}
+		score, err := redis.Int64(conn.Do("ZSCORE", "expiringTestModel:expire", model.ModelID()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := unixMilliseconds(time.Now().Add(time.Hour))
+		if score <= unixMilliseconds(time.Now()) || score > expected {
+			t.Errorf("Expected expiration time to be about %d but got %d", expected, score)
+		}
+	}
+
+	// Simulate the expiration of the first model by removing its main hash and
+	// its references the way Redis would. The second model has an expiration
+	// time in the past, e.g. because the clock of the client which saved it is
+	// ahead, but its main hash has not actually expired.
+	for _, model := range models[:2] {
+		if _, err := conn.Do("ZADD", "expiringTestModel:expire", 0, model.ModelID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modelKey := expiringTestModels.ModelKey(models[0].ModelID())
+	if _, err := conn.Do("DEL", modelKey, modelKey+":Many"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries should not include the expired model and should remove it from
+	// all the indexes.
+	got := []*expiringTestModel{}
+	if err := expiringTestModels.NewQuery().Order("Int").Run(&got); err != nil {
+		t.Fatalf("Unexpected error in Run: %s", err.Error())
+	}
+	if len(got) != 2 || got[0].ModelID() != models[1].ModelID() || got[1].ModelID() != models[2].ModelID() {
+		t.Errorf("Expected only the unexpired models but got %v", got)
+	}
+	expectSetDoesNotContain(t, expiringTestModels.IndexKey(), models[0].ModelID())
+	expectNoExpiration(t, models[0])
+	expectIndexDoesNotExist(t, expiringTestModels, models[0], "Int")
+	expectIndexDoesNotExist(t, expiringTestModels, models[0], "String")
+	exists, err := redis.Bool(conn.Do("HEXISTS", "expiringTestModel:String:unique", models[0].String))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("Expected unique index to not contain %s", models[0].String)
+	}
+	exists, err = redis.Bool(conn.Do("HEXISTS", "expiringTestModel:expire:values", models[0].ModelID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("Expected the values for model %s to be removed", models[0].ModelID())
+	}
+
+	// The model which has not actually expired should be kept, and its
+	// expiration time should be corrected.
+	for _, model := range models[1:] {
+		expectIndexExists(t, expiringTestModels, model, "String")
+	}
+	score, err := redis.Int64(conn.Do("ZSCORE", "expiringTestModel:expire", models[1].ModelID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score <= unixMilliseconds(time.Now()) {
+		t.Errorf("Expected expiration time to be in the future but got %d", score)
+	}
+	if count, err := expiringTestModels.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 2 {
+		t.Errorf("Expected Count to be 2 but got %d", count)
+	}
+
+	// DeleteExpired should return the number of models deleted
+	for _, model := range models[1:] {
+		modelKey := expiringTestModels.ModelKey(model.ModelID())
+		if _, err := conn.Do("ZADD", "expiringTestModel:expire", 0, model.ModelID()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("DEL", modelKey, modelKey+":Many"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := expiringTestModels.DeleteExpired(); err != nil {
+		t.Fatalf("Unexpected error in DeleteExpired: %s", err.Error())
+	} else if count != 2 {
+		t.Errorf("Expected DeleteExpired to delete 2 models but got %d", count)
+	}
+	for _, model := range models[1:] {
+		expectModelDoesNotExist(t, expiringTestModels, model)
+		expectSetDoesNotContain(t, expiringTestModels.IndexKey(), model.ModelID())
+		expectNoExpiration(t, model)
+	}
+
+	// Delete and DeleteAll should remove the expiration times
+	if err := expiringTestModels.Save(models[0]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if _, err := expiringTestModels.Delete(models[0].ModelID()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	expectNoExpiration(t, models[0])
+	if err := expiringTestModels.Save(models[1]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if _, err := expiringTestModels.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, "expiringTestModel:expire")
+	expectKeyDoesNotExist(t, "expiringTestModel:expire:values")
+}
+
+func TestSweepExpiredModels(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &expiringTestModel{
+		Int:    1,
+		String: randomString(),
+	}
+	if err := expiringTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Reading from the indexes should not add any writes to the transaction,
+	// so that it can still be sent to a replica.
+	tx := testPool.NewTransaction()
+	got := []*expiringTestModel{}
+	count := 0
+	tx.FindAll(expiringTestModels, &got)
+	tx.Query(expiringTestModels).Order("Int").Count(&count)
+	if !actionsAreReadOnly(tx.actions) {
+		t.Error("Expected reading a collection with a TTL to only use read-only commands")
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if len(got) != 1 || count != 1 {
+		t.Errorf("Expected to find 1 model but got %d and count %d", len(got), count)
+	}
+
+	// The sweep should remember when the next model expires, so that it does
+	// not need to run again until then.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	score, err := redis.Int64(conn.Do("ZSCORE", "expiringTestModel:expire", model.ModelID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := atomic.LoadInt64(&expiringTestModels.nextExpiration); next != score {
+		t.Errorf("Expected the next expiration time to be %d but got %d", score, next)
+	}
+
+	// The values needed to remove the model from the string and unique indexes
+	// should be kept after the main hash expires.
+	values, err := redis.String(conn.Do("HGET", "expiringTestModel:expire:values", model.ModelID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`{"String":%q}`, model.String)
+	if values != expected {
+		t.Errorf("Expected values to be %s but got %s", expected, values)
+	}
+}
+
+func TestSweepExpiredModelsInBatches(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	originalBatchSize := sweepBatchSize
+	sweepBatchSize = 2
+	defer func() {
+		sweepBatchSize = originalBatchSize
+	}()
+
+	// Make 5 models expire, so that the sweep needs 3 batches.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		model := &expiringTestModel{
+			Int:    i,
+			String: randomString(),
+		}
+		if err := expiringTestModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		if _, err := conn.Do("ZADD", "expiringTestModel:expire", 0, model.ModelID()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("DEL", expiringTestModels.ModelKey(model.ModelID())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	atomic.StoreInt64(&expiringTestModels.nextExpiration, 0)
+	if count, err := expiringTestModels.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 0 {
+		t.Errorf("Expected the sweep to remove all 5 models but Count returned %d", count)
+	}
+	expectNoIndexProblems(t, expiringTestModels)
+}
+
+// expectNoExpiration calls t.Errorf if there is an expiration time for the
+// given model.
+func expectNoExpiration(t *testing.T, model Model) {
+	conn := testPool.NewConn()
+	defer conn.Close()
+	reply, err := conn.Do("ZSCORE", "expiringTestModel:expire", model.ModelID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil {
+		t.Errorf("Expected model %s to not have an expiration time but it did", model.ModelID())
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File increment.go contains code related to atomically incrementing numeric
+// fields.
+
+package zoom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Increment atomically adds delta to the numeric field identified by fieldName
+// for the model with the given id and returns the new value of the field. Unlike
+// SaveFields, Increment does not overwrite changes made by other callers, so it
+// is safe to use for counters which are updated concurrently. delta may be
+// negative. For integer fields, delta must be a whole number. If the field has a
+// numeric index, the index is updated in the same script, and if the model has
+// a version field, it is incremented. Increment returns a ModelNotFoundError if
+// the model does not exist or was soft deleted. It returns an error if the field
+// is not a numeric field (pointers to numeric types are not supported), if it
+// is unique, if it is the version field, or if the new value would not fit in
+// the type of the field (e.g. a negative value for an unsigned field or 128 for
+// an int8), in which case the field is not changed. Since delta is a float64,
+// it cannot exactly represent every integer, so Increment returns an error for
+// integer fields if delta is larger than 2^53 in absolute value.
+func (c *Collection) Increment(id string, fieldName string, delta float64) (float64, error) {
+	return c.IncrementContext(context.Background(), id, fieldName, delta)
+}
+
+// IncrementContext is like Increment but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) IncrementContext(ctx context.Context, id string, fieldName string, delta float64) (float64, error) {
+	t := c.pool.NewTransaction()
+	var newValue float64
+	t.Increment(c, id, fieldName, delta, NewScanFloat64Handler(&newValue))
+	if err := t.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return newValue, nil
+}
+
+// Increment atomically adds delta to the numeric field identified by fieldName
+// for the model with the given id in an existing transaction. handler will be
+// called with the new value of the field when the transaction is executed. The
+// reply is a string which can be scanned with NewScanIntHandler for integer
+// fields or NewScanFloat64Handler for float fields. You may pass in nil for
+// handler if you do not care about the new value. See Collection.Increment for
+// more information. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) Increment(c *Collection, id string, fieldName string, delta float64, handler ReplyHandler) {
+	if c == nil {
+		t.setError(newNilCollectionError("Increment"))
+		return
+	}
+	fs, found := c.spec.fieldsByName[fieldName]
+	var err error
+	switch {
+	case !found:
+		err = fmt.Errorf("Collection %s does not have field named %s", c.Name(), fieldName)
+	case fs.kind != primativeField || !typeIsNumeric(fs.typ):
+		err = fmt.Errorf("Field %s is not a numeric field", fieldName)
+	case fs.unique:
+		err = fmt.Errorf("Cannot increment field %s because it is unique", fieldName)
+	case fs == c.spec.versionField:
+		err = fmt.Errorf("Cannot increment field %s because it is the version field", fieldName)
+	}
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in Increment or Transaction.Increment: %s", err.Error()))
+		return
+	}
+	args := redis.Args{c.spec.keyPrefix(), id, fs.redisName}
+	switch fs.typ.Kind() {
+	case reflect.Float32, reflect.Float64:
+		args = append(args, delta, "HINCRBYFLOAT")
+	default:
+		if delta != math.Trunc(delta) {
+			t.setError(fmt.Errorf("zoom: Error in Increment or Transaction.Increment: Field %s is an integer but delta is %v", fieldName, delta))
+			return
+		}
+		if math.Abs(delta) > maxExactFloat64Int {
+			t.setError(fmt.Errorf("zoom: Error in Increment or Transaction.Increment: delta %v is too large to be represented exactly", delta))
+			return
+		}
+		args = append(args, int64(delta), "HINCRBY")
+	}
+	args = append(args, convertBoolToInt(fs.indexKind == numericIndex))
+	eventFieldNames := []string{fieldName}
+	if vf := c.spec.versionField; vf != nil {
+		args = append(args, vf.redisName, convertBoolToInt(vf.indexKind != noIndex))
+		eventFieldNames = append(eventFieldNames, vf.name)
+	} else {
+		args = append(args, "", 0)
+	}
+	channel := ""
+	var event []byte
+	if c.notify {
+		channel = c.ChangesChannel()
+		event, err = json.Marshal(ChangeEvent{
+			Collection: c.Name(),
+			ModelID:    id,
+			FieldNames: eventFieldNames,
+			Operation:  SaveOperation,
+		})
+		if err != nil {
+			t.setError(err)
+			return
+		}
+	}
+	min, max := numericRange(fs.typ)
+	args = append(args, channel, event, min, max)
+	t.Script(incrementFieldScript, args, func(reply interface{}) error {
+		if reply == nil {
+			return ModelNotFoundError{
+				Collection: c,
+				Msg:        fmt.Sprintf("Could not find %s with id = %s", c.spec.name, id),
+			}
+		}
+		if _, ok := reply.(int64); ok {
+			// The script returns -1 instead of the new value if the new value
+			// would not fit in the field.
+			return fmt.Errorf("zoom: Error in Increment or Transaction.Increment: Field %s cannot be incremented by %v because the new value would not fit in a %s", fieldName, delta, fs.typ.String())
+		}
+		if handler != nil {
+			return handler(reply)
+		}
+		return nil
+	})
+}
+
+// maxExactFloat64Int is the largest integer such that it and every smaller
+// integer can be represented exactly by a float64.
+const maxExactFloat64Int = 1 << 53
+
+// numericRange returns the smallest and largest values that a numeric field of
+// the given type can hold, formatted as strings for the increment_field script.
+// Either may be empty if the limit is the same as (or beyond) the limit Redis
+// enforces for HINCRBY or HINCRBYFLOAT.
+func numericRange(typ reflect.Type) (min string, max string) {
+	bits := uint(typ.Bits())
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if bits == 64 {
+			return "", ""
+		}
+		return strconv.FormatInt(-1<<(bits-1), 10), strconv.FormatInt(1<<(bits-1)-1, 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if bits == 64 {
+			return "0", ""
+		}
+		return "0", strconv.FormatUint(1<<bits-1, 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(-math.MaxFloat32, 'g', -1, 64), strconv.FormatFloat(math.MaxFloat32, 'g', -1, 64)
+	default:
+		return "", ""
+	}
+}
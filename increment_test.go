@@ -0,0 +1,183 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File increment_test.go tests the code in increment.go, i.e. atomically
+// incrementing numeric fields.
+
+package zoom
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIncrement(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedPrimativesModel()
+	model.Int = 10
+	model.Float64 = 1.5
+	if err := indexedPrimativesModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	newValue, err := indexedPrimativesModels.Increment(model.ModelID(), "Int", -3)
+	if err != nil {
+		t.Fatalf("Unexpected error in Increment: %s", err.Error())
+	}
+	if newValue != 7 {
+		t.Errorf("Expected new value to be 7 but got %v", newValue)
+	}
+	newValue, err = indexedPrimativesModels.Increment(model.ModelID(), "Float64", 0.25)
+	if err != nil {
+		t.Fatalf("Unexpected error in Increment: %s", err.Error())
+	}
+	if newValue != 1.75 {
+		t.Errorf("Expected new value to be 1.75 but got %v", newValue)
+	}
+	got := &indexedPrimativesModel{}
+	if err := indexedPrimativesModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int != 7 || got.Float64 != 1.75 {
+		t.Errorf("Expected Int to be 7 and Float64 to be 1.75 but got %d and %v", got.Int, got.Float64)
+	}
+	// The numeric indexes should be updated
+	expectIndexExists(t, indexedPrimativesModels, got, "Int")
+	expectIndexExists(t, indexedPrimativesModels, got, "Float64")
+	expectNoIndexProblems(t, indexedPrimativesModels)
+
+	// Test inside of a transaction
+	var intValue int
+	tx := testPool.NewTransaction()
+	tx.Increment(indexedPrimativesModels, model.ModelID(), "Int", 5, NewScanIntHandler(&intValue))
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in tx.Exec: %s", err.Error())
+	}
+	if intValue != 12 {
+		t.Errorf("Expected new value to be 12 but got %d", intValue)
+	}
+
+	// The version field should be incremented
+	versioned := &versionedTestModel{}
+	if err := versionedTestModels.Save(versioned); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if _, err := versionedTestModels.Increment(versioned.ModelID(), "Int", 1); err != nil {
+		t.Fatalf("Unexpected error in Increment: %s", err.Error())
+	}
+	expectFieldEquals(t, versionedTestModels.ModelKey(versioned.ModelID()), "Version", versionedTestModels.spec.fallback, 2)
+	expectNoIndexProblems(t, versionedTestModels)
+
+	// Unsigned fields should not be allowed to become negative, and the field
+	// and its index should be unchanged
+	model.Uint = 2
+	if err := indexedPrimativesModels.SaveFields([]string{"Uint"}, model); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	if _, err := indexedPrimativesModels.Increment(model.ModelID(), "Uint", -3); err == nil {
+		t.Errorf("Expected an error when an unsigned field would become negative but got none")
+	}
+	newValue, err = indexedPrimativesModels.Increment(model.ModelID(), "Uint", -2)
+	if err != nil {
+		t.Fatalf("Unexpected error in Increment: %s", err.Error())
+	}
+	if newValue != 0 {
+		t.Errorf("Expected new value to be 0 but got %v", newValue)
+	}
+	got = &indexedPrimativesModel{}
+	if err := indexedPrimativesModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Uint != 0 {
+		t.Errorf("Expected Uint to be 0 but got %d", got.Uint)
+	}
+	expectIndexExists(t, indexedPrimativesModels, got, "Uint")
+	expectNoIndexProblems(t, indexedPrimativesModels)
+
+	// Narrower integer fields should not overflow
+	model.Int8 = 127
+	model.Uint8 = 255
+	if err := indexedPrimativesModels.SaveFields([]string{"Int8", "Uint8"}, model); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	if _, err := indexedPrimativesModels.Increment(model.ModelID(), "Int8", 1); err == nil {
+		t.Errorf("Expected an error when an int8 field would overflow but got none")
+	}
+	if _, err := indexedPrimativesModels.Increment(model.ModelID(), "Uint8", 1); err == nil {
+		t.Errorf("Expected an error when a uint8 field would overflow but got none")
+	}
+	got = &indexedPrimativesModel{}
+	if err := indexedPrimativesModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int8 != 127 || got.Uint8 != 255 {
+		t.Errorf("Expected Int8 to be 127 and Uint8 to be 255 but got %d and %d", got.Int8, got.Uint8)
+	}
+	expectIndexExists(t, indexedPrimativesModels, got, "Int8")
+	expectIndexExists(t, indexedPrimativesModels, got, "Uint8")
+	expectNoIndexProblems(t, indexedPrimativesModels)
+
+	// Incrementing a model which does not exist should not create it
+	if _, err := indexedPrimativesModels.Increment("fakeID", "Int", 1); err == nil {
+		t.Errorf("Expected a ModelNotFoundError but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got %T: %s", err, err.Error())
+	}
+	expectKeyDoesNotExist(t, indexedPrimativesModels.ModelKey("fakeID"))
+
+	// Test invalid increments
+	invalidIncrements := []struct {
+		collection *Collection
+		fieldName  string
+		delta      float64
+	}{
+		{indexedPrimativesModels, "Foo", 1},
+		{indexedPrimativesModels, "String", 1},
+		{indexedPrimativesModels, "Int", 1.5},
+		{indexedPrimativesModels, "Int64", 1 << 60},
+		{indexedPointersModels, "Int", 1},
+		{versionedTestModels, "Version", 1},
+	}
+	for i, increment := range invalidIncrements {
+		if _, err := increment.collection.Increment(model.ModelID(), increment.fieldName, increment.delta); err == nil {
+			t.Errorf("Expected an error for invalid increment %d but got none", i)
+		}
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &testModel{}
+	if err := testModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	// No increments should be lost
+	numIncrements := 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, numIncrements)
+	for i := 0; i < numIncrements; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := testModels.Increment(model.ModelID(), "Int", 1); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unexpected error in Increment: %s", err.Error())
+	}
+	got := &testModel{}
+	if err := testModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int != numIncrements {
+		t.Errorf("Expected Int to be %d but got %d", numIncrements, got.Int)
+	}
+}
@@ -0,0 +1,525 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File indexes.go contains code for verifying and repairing the field indexes
+// and unique indexes of a collection.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// indexCheckBatchSize is the COUNT hint passed to SSCAN, ZSCAN, and HSCAN by
+// VerifyIndexes and RepairIndexes. Each batch is checked in its own
+// transaction.
+const indexCheckBatchSize = 100
+
+// IndexProblemKind is the kind of an IndexProblem, and is either
+// MissingIndexEntry, StaleIndexEntry, or MismatchedIndexEntry.
+type IndexProblemKind int
+
+const (
+	// MissingIndexEntry means that a model has a value for an indexed or unique
+	// field but the field index or unique index does not contain a
+	// corresponding entry.
+	MissingIndexEntry IndexProblemKind = iota
+	// StaleIndexEntry means that the field index or unique index contains an
+	// entry for a model which does not exist.
+	StaleIndexEntry
+	// MismatchedIndexEntry means that the field index or unique index contains
+	// an entry for a model which exists, but the entry does not match the value
+	// of the field.
+	MismatchedIndexEntry
+)
+
+// String returns a human-readable name for the kind of problem.
+func (kind IndexProblemKind) String() string {
+	switch kind {
+	case MissingIndexEntry:
+		return "missing"
+	case StaleIndexEntry:
+		return "stale"
+	case MismatchedIndexEntry:
+		return "mismatched"
+	}
+	return "unknown"
+}
+
+// IndexProblem is an inconsistency between the field index for an indexed
+// field (or the unique index for a unique field) and the models in a
+// collection. It is returned by VerifyIndexes and RepairIndexes.
+type IndexProblem struct {
+	Kind      IndexProblemKind
+	FieldName string
+	ModelID   string
+	// Unique is true if the problem is in the unique index for the field, which
+	// maps each value to the id of the model which has it, rather than in the
+	// field index.
+	Unique bool
+	// indexKey, member, and score describe the entry which needs to be added to
+	// the field index to fix the problem, or the entry which needs to be removed
+	// if remove is true. For unique indexes, member is the value and ModelID is
+	// the id it maps to.
+	indexKey string
+	member   string
+	score    float64
+	remove   bool
+}
+
+// String returns a human-readable description of the problem.
+func (p IndexProblem) String() string {
+	index := "index"
+	if p.Unique {
+		index = "unique index"
+	}
+	return fmt.Sprintf("%s %s entry for field %s of model with id = %s", p.Kind, index, p.FieldName, p.ModelID)
+}
+
+// VerifyIndexes checks the field indexes for every indexed field and the unique
+// indexes for every unique field in the collection and returns any problems it
+// finds. It reports missing entries, i.e. models whose field values are not
+// indexed, stale entries, i.e. entries for models which no longer exist, and
+// mismatched entries, i.e. entries which do not match the current field value
+// of the model. A value in a unique index which maps to a different model than
+// the one which has the value is only reported if that other model does not
+// have the value. The indexes are scanned in batches with SSCAN, ZSCAN, and
+// HSCAN, so VerifyIndexes does not block the database
+// for long and can be used while other callers are saving and deleting models.
+// Each batch is read atomically, but models which are changed during the scan
+// might not be checked. VerifyIndexes only works for indexed collections.
+func (c *Collection) VerifyIndexes() ([]IndexProblem, error) {
+	return c.checkIndexes("VerifyIndexes", false)
+}
+
+// RepairIndexes is like VerifyIndexes but also fixes each problem it finds by
+// adding or removing entries in the field indexes and unique indexes. The fixes for each batch are
+// executed in a transaction which watches the models in the batch, so it is
+// safe to use RepairIndexes while other callers are saving and deleting
+// models. It returns the problems that were fixed.
+func (c *Collection) RepairIndexes() ([]IndexProblem, error) {
+	return c.checkIndexes("RepairIndexes", true)
+}
+
+// indexChecker holds the state for VerifyIndexes and RepairIndexes.
+type indexChecker struct {
+	collection *Collection
+	repair     bool
+	fields     []*fieldSpec
+	// uniqueFields are the fields with a unique constraint, which may or may not
+	// be in fields as well.
+	uniqueFields []*fieldSpec
+	problems     []IndexProblem
+	// seen is used to avoid reporting the same problem twice, since SSCAN, ZSCAN,
+	// and HSCAN may return the same member more than once.
+	seen map[IndexProblem]struct{}
+}
+
+// checkIndexes checks (and optionally repairs) the field indexes for every
+// indexed field and the unique indexes for every unique field in the
+// collection.
+func (c *Collection) checkIndexes(methodName string, repair bool) ([]IndexProblem, error) {
+	if c == nil {
+		return nil, newNilCollectionError(methodName)
+	}
+	if !c.index {
+		return nil, newUnindexedCollectionError(methodName)
+	}
+	checker := &indexChecker{
+		collection: c,
+		repair:     repair,
+		seen:       map[IndexProblem]struct{}{},
+	}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind != noIndex {
+			checker.fields = append(checker.fields, fs)
+		}
+		if fs.unique {
+			checker.uniqueFields = append(checker.uniqueFields, fs)
+		}
+	}
+	if len(checker.fields) == 0 && len(checker.uniqueFields) == 0 {
+		return nil, nil
+	}
+	// First check that every model has the expected entries
+	if err := c.scanKey("SSCAN", c.IndexKey(), checker.checkModels); err != nil {
+		return nil, err
+	}
+	// Then check that every entry belongs to a model and matches its value
+	for _, fs := range checker.fields {
+		fs := fs
+		indexKey, err := c.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.scanKey("ZSCAN", indexKey, func(members []string) error {
+			return checker.checkEntries(fs, indexKey, members)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, fs := range checker.uniqueFields {
+		fs := fs
+		uniqueKey := c.spec.uniqueIndexKey(fs)
+		if err := c.scanKey("HSCAN", uniqueKey, func(fieldsAndValues []string) error {
+			return checker.checkUniqueEntries(fs, uniqueKey, fieldsAndValues)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return checker.problems, nil
+}
+
+// scanKey iterates over the members of the set, sorted set, or hash at key using
+// the given command (SSCAN, ZSCAN, or HSCAN) and calls handle with each batch of
+// members. For HSCAN, the members are the fields and values of the hash. A
+// new connection is used for each batch, so that the connection is not held
+// while handle is running.
+func (c *Collection) scanKey(command string, key string, handle func(members []string) error) error {
+	cursor := "0"
+	for {
+		var members []string
+		var err error
+		cursor, members, err = c.scanBatch(command, key, cursor)
+		if err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			if err := handle(members); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// scanBatch sends a single SSCAN, ZSCAN, or HSCAN command and returns the next
+// cursor and the members in the reply. For ZSCAN, the scores are discarded.
+func (c *Collection) scanBatch(command string, key string, cursor string) (string, []string, error) {
+	conn := c.pool.NewConnForKey(key)
+	defer func() {
+		_ = conn.Close()
+	}()
+	reply, err := redis.Values(conn.Do(command, key, cursor, "COUNT", indexCheckBatchSize))
+	if err != nil {
+		return "", nil, err
+	}
+	var values []string
+	if _, err := redis.Scan(reply, &cursor, &values); err != nil {
+		return "", nil, err
+	}
+	if command != "ZSCAN" {
+		return cursor, values, nil
+	}
+	members := make([]string, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		members = append(members, values[i])
+	}
+	return cursor, members, nil
+}
+
+// checkModels checks that each model in ids which exists has the expected
+// entry in each field index and unique index. For numeric and boolean indexes,
+// it also checks that the entry has the expected score.
+func (checker *indexChecker) checkModels(ids []string) error {
+	c := checker.collection
+	return checker.checkBatch(ids, func(tx *Transaction, models map[string]*modelRef) ([]IndexProblem, error) {
+		problems := []IndexProblem{}
+		actions := []*Action{}
+		for _, id := range ids {
+			mr, found := models[id]
+			if !found {
+				// The model was deleted after it was scanned
+				continue
+			}
+			for _, fs := range checker.fields {
+				indexKey, err := c.spec.fieldIndexKey(fs.name)
+				if err != nil {
+					return nil, err
+				}
+				member, score, hasValue := expectedIndexEntry(mr, fs)
+				if !hasValue && fs.indexKind == stringIndex {
+					// Any entries for the model are reported by checkEntries
+					continue
+				}
+				if !hasValue {
+					member = id
+				}
+				problem := IndexProblem{
+					FieldName: fs.name,
+					ModelID:   id,
+					indexKey:  indexKey,
+					member:    member,
+					score:     score,
+				}
+				actions = append(actions, &Action{
+					kind: commandAction,
+					name: "ZSCORE",
+					args: redis.Args{indexKey, member},
+					handler: func(reply interface{}) error {
+						switch {
+						case reply == nil && hasValue:
+							problem.Kind = MissingIndexEntry
+						case reply != nil && !hasValue:
+							problem.Kind = MismatchedIndexEntry
+							problem.remove = true
+						case reply != nil:
+							gotScore, err := redis.Float64(reply, nil)
+							if err != nil {
+								return err
+							}
+							if gotScore == score {
+								return nil
+							}
+							problem.Kind = MismatchedIndexEntry
+						default:
+							return nil
+						}
+						problems = append(problems, problem)
+						return nil
+					},
+				})
+			}
+			for _, fs := range checker.uniqueFields {
+				value, hasValue := uniqueValue(mr, fs)
+				if !hasValue {
+					// Any entries for the model are reported by checkUniqueEntries
+					continue
+				}
+				problem := IndexProblem{
+					Kind:      MissingIndexEntry,
+					FieldName: fs.name,
+					ModelID:   id,
+					Unique:    true,
+					indexKey:  c.spec.uniqueIndexKey(fs),
+					member:    formatUniqueValue(value),
+				}
+				actions = append(actions, &Action{
+					kind: commandAction,
+					name: "HGET",
+					args: redis.Args{problem.indexKey, value},
+					handler: func(reply interface{}) error {
+						// If the value maps to a different model, the entry is checked by
+						// checkUniqueEntries.
+						if reply == nil {
+							problems = append(problems, problem)
+						}
+						return nil
+					},
+				})
+			}
+		}
+		if err := doActionsWithoutMulti(tx.conn, actions); err != nil {
+			return nil, err
+		}
+		return problems, nil
+	})
+}
+
+// checkEntries checks that each of the given members of the field index for fs
+// belongs to a model which exists and, for string indexes, that it matches the
+// current value of the field.
+func (checker *indexChecker) checkEntries(fs *fieldSpec, indexKey string, members []string) error {
+	ids := []string{}
+	memberIDs := make([]string, len(members))
+	for i, member := range members {
+		id := member
+		if fs.indexKind == stringIndex {
+			id = member[strings.LastIndex(member, nullString)+1:]
+		}
+		memberIDs[i] = id
+		if !stringSliceContains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return checker.checkBatch(ids, func(tx *Transaction, models map[string]*modelRef) ([]IndexProblem, error) {
+		problems := []IndexProblem{}
+		for i, member := range members {
+			problem := IndexProblem{
+				FieldName: fs.name,
+				ModelID:   memberIDs[i],
+				indexKey:  indexKey,
+				member:    member,
+				remove:    true,
+			}
+			mr, found := models[memberIDs[i]]
+			if !found {
+				problem.Kind = StaleIndexEntry
+				problems = append(problems, problem)
+				continue
+			}
+			if fs.indexKind != stringIndex {
+				// The score was already checked by checkModels
+				continue
+			}
+			if expected, _, hasValue := expectedIndexEntry(mr, fs); !hasValue || expected != member {
+				problem.Kind = MismatchedIndexEntry
+				problems = append(problems, problem)
+			}
+		}
+		return problems, nil
+	})
+}
+
+// checkUniqueEntries checks that each entry of the unique index for fs, given
+// as a list of alternating values and ids, belongs to a model which exists and
+// matches the current value of the field.
+func (checker *indexChecker) checkUniqueEntries(fs *fieldSpec, uniqueKey string, valuesAndIDs []string) error {
+	ids := []string{}
+	for i := 1; i < len(valuesAndIDs); i += 2 {
+		if !stringSliceContains(ids, valuesAndIDs[i]) {
+			ids = append(ids, valuesAndIDs[i])
+		}
+	}
+	return checker.checkBatch(ids, func(tx *Transaction, models map[string]*modelRef) ([]IndexProblem, error) {
+		problems := []IndexProblem{}
+		for i := 0; i+1 < len(valuesAndIDs); i += 2 {
+			value, id := valuesAndIDs[i], valuesAndIDs[i+1]
+			problem := IndexProblem{
+				FieldName: fs.name,
+				ModelID:   id,
+				Unique:    true,
+				indexKey:  uniqueKey,
+				member:    value,
+				remove:    true,
+			}
+			mr, found := models[id]
+			if !found {
+				problem.Kind = StaleIndexEntry
+				problems = append(problems, problem)
+				continue
+			}
+			if expected, hasValue := uniqueValue(mr, fs); !hasValue || formatUniqueValue(expected) != value {
+				problem.Kind = MismatchedIndexEntry
+				problems = append(problems, problem)
+			}
+		}
+		return problems, nil
+	})
+}
+
+// checkBatch watches and finds the models with the given ids and then calls
+// check, which returns any problems it finds for the batch. If the checker is
+// repairing the indexes, the fixes are executed in the same transaction, so
+// they are only applied if none of the models changed. Otherwise the batch is
+// checked again.
+func (checker *indexChecker) checkBatch(ids []string, check func(tx *Transaction, models map[string]*modelRef) ([]IndexProblem, error)) error {
+	c := checker.collection
+	fieldNames := []string{}
+	for _, fs := range append(checker.fields, checker.uniqueFields...) {
+		if !stringSliceContains(fieldNames, fs.name) {
+			fieldNames = append(fieldNames, fs.name)
+		}
+	}
+	modelKeys := make([]string, len(ids))
+	for i, id := range ids {
+		modelKeys[i] = c.ModelKey(id)
+	}
+	if c.softDelete {
+		modelKeys = append(modelKeys, c.spec.deletedKey())
+	}
+	// Entries in the unique indexes are removed and added by value rather than
+	// by id, so the unique indexes need to be watched as well.
+	for _, fs := range checker.uniqueFields {
+		modelKeys = append(modelKeys, c.spec.uniqueIndexKey(fs))
+	}
+	var problems []IndexProblem
+	if _, err := c.pool.Update(func(tx *Transaction) error {
+		if err := tx.watchKeys(modelKeys); err != nil {
+			return err
+		}
+		mrs, err := findExistingModels(c, tx, ids, fieldNames)
+		if err != nil {
+			return err
+		}
+		models := make(map[string]*modelRef, len(mrs))
+		for _, mr := range mrs {
+			models[mr.model.ModelID()] = mr
+		}
+		problems, err = check(tx, models)
+		if err != nil {
+			return err
+		}
+		if checker.repair {
+			for _, problem := range problems {
+				switch {
+				case problem.Unique && problem.remove:
+					tx.Command("HDEL", redis.Args{problem.indexKey, problem.member}, nil)
+				case problem.Unique:
+					tx.Command("HSET", redis.Args{problem.indexKey, problem.member, problem.ModelID}, nil)
+				case problem.remove:
+					tx.Command("ZREM", redis.Args{problem.indexKey, problem.member}, nil)
+				default:
+					tx.Command("ZADD", redis.Args{problem.indexKey, problem.score, problem.member}, nil)
+				}
+			}
+		}
+		return nil
+	}, DefaultUpdateOptions); err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		if _, found := checker.seen[problem]; found {
+			continue
+		}
+		checker.seen[problem] = struct{}{}
+		checker.problems = append(checker.problems, problem)
+	}
+	return nil
+}
+
+// expectedIndexEntry returns the member and score of the entry that the field
+// index for fs should contain for the given model. hasValue is false if the
+// field is a nil pointer, in which case the index should not contain an entry
+// for the model.
+func expectedIndexEntry(mr *modelRef, fs *fieldSpec) (member string, score float64, hasValue bool) {
+	fieldValue := mr.fieldValue(fs.name)
+	for fieldValue.Kind() == reflect.Ptr {
+		if fieldValue.IsNil() {
+			return "", 0, false
+		}
+		fieldValue = fieldValue.Elem()
+	}
+	switch fs.indexKind {
+	case numericIndex:
+		return mr.model.ModelID(), numericScore(fieldValue), true
+	case booleanIndex:
+		return mr.model.ModelID(), float64(boolScore(fieldValue)), true
+	case stringIndex:
+		return fieldValue.String() + nullString + mr.model.ModelID(), 0, true
+	}
+	return "", 0, false
+}
+
+// formatUniqueValue returns value as it is stored in a unique index, i.e. in the
+// same way that redigo formats it as an argument to a command.
+func formatUniqueValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case bool:
+		if value {
+			return "1"
+		}
+		return "0"
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File indexes_test.go tests the code in indexes.go, i.e. verifying and
+// repairing field indexes.
+
+package zoom
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestVerifyIndexesConsistent(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if _, err := createAndSaveIndexedTestModels(5); err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	problems, err := indexedTestModels.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems but got %v", problems)
+	}
+
+	// Unindexed collections should return an error
+	unindexedModels, err := NewPoolWithOptions(testPool.options).NewCollection(&indexedTestModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	if _, err := unindexedModels.VerifyIndexes(); err == nil {
+		t.Errorf("Expected error for an unindexed collection but got none")
+	}
+}
+
+func TestRepairIndexesStaleEntries(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(3)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	// Deleting the models directly does not remove the entries in the field
+	// indexes
+	conn := testPool.NewConn()
+	defer conn.Close()
+	for _, model := range models {
+		if _, err := conn.Do("DEL", indexedTestModels.ModelKey(model.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("SREM", indexedTestModels.IndexKey(), model.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems, err := indexedTestModels.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	// There should be one stale entry for each model and indexed field
+	expectIndexProblemCounts(t, problems, map[IndexProblemKind]int{StaleIndexEntry: 9})
+
+	repaired, err := indexedTestModels.RepairIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in RepairIndexes: %s", err.Error())
+	}
+	expectIndexProblemCounts(t, repaired, map[IndexProblemKind]int{StaleIndexEntry: 9})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectKeyDoesNotExist(t, indexedTestModels.spec.keyPrefix()+":"+fieldName)
+	}
+	expectNoIndexProblems(t, indexedTestModels)
+}
+
+func TestRepairIndexesMissingAndMismatchedEntries(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(2)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	first, second := models[0], models[1]
+	prefix := indexedTestModels.spec.keyPrefix()
+	conn := testPool.NewConn()
+	defer conn.Close()
+	commands := []redis.Args{
+		// Remove the entries for the first model
+		{prefix + ":Int", first.ID},
+		{prefix + ":String", first.String + nullString + first.ID},
+		// Change the entries for the second model
+		{prefix + ":Bool", second.ID},
+		{prefix + ":String", second.String + nullString + second.ID},
+	}
+	for _, args := range commands {
+		if _, err := conn.Do("ZREM", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conn.Do("ZADD", prefix+":Int", -1, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", prefix+":Bool", 7, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", prefix+":String", 0, "wrong"+nullString+second.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := indexedTestModels.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	expected := map[IndexProblemKind]int{
+		// Int and String for the first model and String for the second model
+		MissingIndexEntry: 3,
+		// Int, Bool, and String for the second model
+		MismatchedIndexEntry: 3,
+	}
+	expectIndexProblemCounts(t, problems, expected)
+	repaired, err := indexedTestModels.RepairIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in RepairIndexes: %s", err.Error())
+	}
+	expectIndexProblemCounts(t, repaired, expected)
+	expectNoIndexProblems(t, indexedTestModels)
+	for _, model := range models {
+		expectIndexExists(t, indexedTestModels, model, "Int")
+		expectIndexExists(t, indexedTestModels, model, "String")
+		expectIndexExists(t, indexedTestModels, model, "Bool")
+	}
+	if score, err := conn.Do("ZSCORE", prefix+":String", "wrong"+nullString+second.ID); err != nil {
+		t.Fatal(err)
+	} else if score != nil {
+		t.Errorf("Expected the mismatched string index entry to be removed but it was not")
+	}
+}
+
+// expectIndexProblemCounts reports an error if the number of problems of each
+// kind is not expected.
+func TestRepairUniqueIndexes(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*uniqueTestModel{}
+	for i := 0; i < 3; i++ {
+		model := &uniqueTestModel{Email: randomString()}
+		if err := uniqueTestModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		models = append(models, model)
+	}
+	uniqueKey := uniqueTestModels.spec.keyPrefix() + ":Email:unique"
+	conn := testPool.NewConn()
+	defer conn.Close()
+	// Remove the entry for the first model, add an entry for a model which does
+	// not exist, and add an entry with the wrong value for the second model.
+	for _, args := range []redis.Args{
+		{"HDEL", uniqueKey, models[0].Email},
+		{"HSET", uniqueKey, "stale@example.com", "fakeID"},
+		{"HSET", uniqueKey, "wrong@example.com", models[1].ID},
+	} {
+		if _, err := conn.Do(args[0].(string), args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems, err := uniqueTestModels.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	expectIndexProblemCounts(t, problems, map[IndexProblemKind]int{
+		MissingIndexEntry:    1,
+		StaleIndexEntry:      1,
+		MismatchedIndexEntry: 1,
+	})
+	for _, problem := range problems {
+		if !problem.Unique || problem.FieldName != "Email" {
+			t.Errorf("Expected a problem with the unique index for Email but got %s", problem)
+		}
+	}
+
+	repaired, err := uniqueTestModels.RepairIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in RepairIndexes: %s", err.Error())
+	}
+	if len(repaired) != 3 {
+		t.Errorf("Expected RepairIndexes to fix 3 problems but got %v", repaired)
+	}
+	expectNoIndexProblems(t, uniqueTestModels)
+	if id, err := redis.String(conn.Do("HGET", uniqueKey, models[0].Email)); err != nil {
+		t.Fatal(err)
+	} else if id != models[0].ID {
+		t.Errorf("Expected the unique index to map %s to %s but got %s", models[0].Email, models[0].ID, id)
+	}
+	for _, value := range []string{"stale@example.com", "wrong@example.com"} {
+		if exists, err := redis.Bool(conn.Do("HEXISTS", uniqueKey, value)); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected the unique index to not contain %s", value)
+		}
+	}
+}
+
+func expectIndexProblemCounts(t *testing.T, problems []IndexProblem, expected map[IndexProblemKind]int) {
+	got := map[IndexProblemKind]int{}
+	for _, problem := range problems {
+		got[problem.Kind]++
+	}
+	for _, kind := range []IndexProblemKind{MissingIndexEntry, StaleIndexEntry, MismatchedIndexEntry} {
+		if got[kind] != expected[kind] {
+			t.Errorf("Expected %d %s entries but got %d: %v", expected[kind], kind, got[kind], problems)
+		}
+	}
+}
+
+// expectNoIndexProblems reports an error if VerifyIndexes finds any problems
+// for the given collection.
+func expectNoIndexProblems(t *testing.T, collection *Collection) {
+	problems, err := collection.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems but got %v", problems)
+	}
+}
@@ -7,9 +7,12 @@
 package zoom
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/garyburd/redigo/redis"
@@ -24,10 +27,13 @@ type query struct {
 	pool       *Pool
 	includes   []string
 	excludes   []string
-	order      order
+	orders     []order
 	limit      uint
 	offset     uint
 	filters    []filter
+	groups     []*filterGroup
+	cursor     *queryCursor
+	usePrimary bool
 	err        error
 }
 
@@ -54,8 +60,14 @@ func (q *query) String() string {
 	for _, filter := range q.filters {
 		result += fmt.Sprintf(".%s", filter)
 	}
-	if q.hasOrder() {
-		result += fmt.Sprintf(".%s", q.order)
+	for _, group := range q.groups {
+		result += fmt.Sprintf(".Where(%s)", group)
+	}
+	for _, order := range q.orders {
+		result += fmt.Sprintf(".%s", order)
+	}
+	if q.hasCursor() {
+		result += fmt.Sprintf(`.After("%s")`, q.cursor)
 	}
 	if q.hasOffset() {
 		result += fmt.Sprintf(".Offset(%d)", q.offset)
@@ -68,9 +80,20 @@ func (q *query) String() string {
 	} else if q.hasExcludes() {
 		result += fmt.Sprintf(`.Exclude("%s")`, strings.Join(q.excludes, `", "`))
 	}
+	if q.usePrimary {
+		result += ".UsePrimary()"
+	}
 	return result
 }
 
+// newTransaction returns a new transaction for executing the query. The
+// transaction uses the primary if the query has the UsePrimary modifier.
+func (q *query) newTransaction() *Transaction {
+	tx := q.pool.NewTransaction()
+	tx.usePrimary = q.usePrimary
+	return tx
+}
+
 type order struct {
 	fieldName string
 	redisName string
@@ -84,6 +107,15 @@ func (o order) String() string {
 	return fmt.Sprintf(`Order("-%s")`, o.fieldName)
 }
 
+// orderString returns the string that was passed to Order to create o, i.e.
+// the field name with a "-" prefix for descending orders.
+func (o order) orderString() string {
+	if o.kind == descendingOrder {
+		return "-" + o.fieldName
+	}
+	return o.fieldName
+}
+
 type orderKind int
 
 const (
@@ -101,6 +133,70 @@ func (ok orderKind) String() string {
 	return ""
 }
 
+// queryCursor identifies a position in the results of a query with a single
+// order. It consists of the order itself and the (value, id) pair of the last
+// model that was seen. For numeric and boolean fields, Value holds the score of
+// the model in the field index.
+type queryCursor struct {
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    string `json:"i"`
+}
+
+// newQueryCursor returns a cursor which points to the position of model in
+// the results of a query ordered by the given order.
+func newQueryCursor(spec *modelSpec, order order, model Model) (*queryCursor, error) {
+	fieldSpec, found := spec.fieldsByName[order.fieldName]
+	if !found {
+		return nil, fmt.Errorf("zoom: could not find field %s in type %s", order.fieldName, spec.typ.String())
+	}
+	fieldVal := reflect.ValueOf(model).Elem().FieldByName(order.fieldName)
+	for fieldVal.Kind() == reflect.Ptr {
+		if fieldVal.IsNil() {
+			return nil, fmt.Errorf("zoom: cannot create a cursor for model with id %s because %s is nil", model.ModelID(), order.fieldName)
+		}
+		fieldVal = fieldVal.Elem()
+	}
+	cursor := &queryCursor{
+		Order: order.orderString(),
+		ID:    model.ModelID(),
+	}
+	switch fieldSpec.indexKind {
+	case numericIndex:
+		cursor.Value = strconv.FormatFloat(numericScore(fieldVal), 'g', -1, 64)
+	case booleanIndex:
+		cursor.Value = strconv.Itoa(boolScore(fieldVal))
+	case stringIndex:
+		cursor.Value = fieldVal.String()
+	}
+	return cursor, nil
+}
+
+// decodeQueryCursor converts a string returned by queryCursor.String back into
+// a queryCursor. It returns an error if s is not a valid cursor.
+func decodeQueryCursor(s string) (*queryCursor, error) {
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("zoom: invalid cursor %q: %s", s, err.Error())
+	}
+	cursor := &queryCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("zoom: invalid cursor %q: %s", s, err.Error())
+	}
+	if cursor.Order == "" || cursor.ID == "" {
+		return nil, fmt.Errorf("zoom: invalid cursor %q: missing order or id", s)
+	}
+	return cursor, nil
+}
+
+// String returns the opaque string representation of the cursor, which is safe
+// to use in urls.
+func (c *queryCursor) String() string {
+	// Marshaling a struct with only string fields cannot fail.
+	data, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(data)
+}
+
 type filter struct {
 	fieldSpec *fieldSpec
 	op        filterOp
@@ -108,6 +204,9 @@ type filter struct {
 }
 
 func (f filter) String() string {
+	if f.op.isSetOp() || f.op == betweenOp {
+		return fmt.Sprintf(`Filter("%s %s", %#v)`, f.fieldSpec.name, f.op, f.value.Interface())
+	}
 	if f.value.Kind() == reflect.String {
 		return fmt.Sprintf(`Filter("%s %s", "%s")`, f.fieldSpec.name, f.op, f.value.String())
 	}
@@ -123,6 +222,10 @@ const (
 	lessOp
 	greaterOrEqualOp
 	lessOrEqualOp
+	inOp
+	notInOp
+	prefixOp
+	betweenOp
 )
 
 func (fk filterOp) String() string {
@@ -139,17 +242,78 @@ func (fk filterOp) String() string {
 		return ">="
 	case lessOrEqualOp:
 		return "<="
+	case inOp:
+		return "IN"
+	case notInOp:
+		return "NOT IN"
+	case prefixOp:
+		return "PREFIX"
+	case betweenOp:
+		return "BETWEEN"
 	}
 	return ""
 }
 
+// isSetOp returns true iff fk is an operator which expects a slice of values,
+// i.e. either IN or NOT IN.
+func (fk filterOp) isSetOp() bool {
+	return fk == inOp || fk == notInOp
+}
+
+// isComparisonOp returns true iff fk is one of the basic comparison operators
+// (=, !=, >, <, >=, or <=), which expect a single value with the same type as
+// the field and work on all kinds of indexes.
+func (fk filterOp) isComparisonOp() bool {
+	return fk <= lessOrEqualOp
+}
+
 var filterOps = map[string]filterOp{
-	"=":  equalOp,
-	"!=": notEqualOp,
-	">":  greaterOp,
-	"<":  lessOp,
-	">=": greaterOrEqualOp,
-	"<=": lessOrEqualOp,
+	"=":       equalOp,
+	"!=":      notEqualOp,
+	">":       greaterOp,
+	"<":       lessOp,
+	">=":      greaterOrEqualOp,
+	"<=":      lessOrEqualOp,
+	"IN":      inOp,
+	"NOT IN":  notInOp,
+	"PREFIX":  prefixOp,
+	"BETWEEN": betweenOp,
+}
+
+// filterGroup is a group of filters and nested groups which are combined
+// with either a logical AND or a logical OR.
+type filterGroup struct {
+	op      groupOp
+	filters []filter
+	groups  []*filterGroup
+}
+
+func (g *filterGroup) String() string {
+	exprs := []string{}
+	for _, filter := range g.filters {
+		exprs = append(exprs, strings.Replace(filter.String(), "Filter(", "NewFilter(", 1))
+	}
+	for _, group := range g.groups {
+		exprs = append(exprs, group.String())
+	}
+	return fmt.Sprintf("%s(%s)", g.op, strings.Join(exprs, ", "))
+}
+
+type groupOp int
+
+const (
+	andGroup groupOp = iota
+	orGroup
+)
+
+func (op groupOp) String() string {
+	switch op {
+	case andGroup:
+		return "And"
+	case orGroup:
+		return "Or"
+	}
+	return ""
 }
 
 // setError sets the err property of q only if it has not already been set
@@ -164,21 +328,16 @@ func (q *query) setError(e error) {
 // constructor. By default, the records are sorted by ascending order by the given
 // field. To sort by descending order, put a negative sign before the field name.
 // Zoom can only sort by fields which have been indexed, i.e. those which have the
-// `zoom:"index"` struct tag. However, in the future this may change. Only one
-// order may be specified per query. However in the future, secondary orders may be
-// allowed, and will take effect when two or more models have the same value for the
-// primary order field. Order will set an error on the query if the fieldName is invalid,
-// if another order has already been applied to the query, or if the fieldName specified
-// does not correspond to an indexed field. The error, same as any other error
-// that occurs during the lifetime of the query, is not returned until the query
-// is executed. When the query is executed the first error that occurred during
-// the lifetime of the query object (if any) will be returned.
+// `zoom:"index"` struct tag. Order may be called more than once on the same query.
+// Each subsequent order is a secondary order, and only takes effect when two or more
+// models have the same value for all of the previous order fields. Order will set an
+// error on the query if the fieldName is invalid, if the same field has already been
+// used to order the query, or if the fieldName specified does not correspond to an
+// indexed field. The error, same as any other error that occurs during the lifetime
+// of the query, is not returned until the query is executed. When the query is
+// executed the first error that occurred during the lifetime of the query object
+// (if any) will be returned.
 func (q *query) Order(fieldName string) {
-	if q.hasOrder() {
-		// TODO: allow secondary sort orders?
-		q.setError(errors.New("zoom: error in Query.Order: previous order already specified (only one order per query is allowed)"))
-		return
-	}
 	// Check for the presence of the "-" prefix
 	var ok orderKind
 	if strings.HasPrefix(fieldName, "-") {
@@ -195,11 +354,23 @@ func (q *query) Order(fieldName string) {
 		q.setError(err)
 		return
 	}
-	q.order = order{
+	if fs.indexKind == noIndex {
+		err := fmt.Errorf("zoom: error in Query.Order: orders are only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", q.collection.spec.typ.String(), fieldName)
+		q.setError(err)
+		return
+	}
+	for _, order := range q.orders {
+		if order.fieldName == fs.name {
+			err := fmt.Errorf("zoom: error in Query.Order: previous order already specified for field %s", fieldName)
+			q.setError(err)
+			return
+		}
+	}
+	q.orders = append(q.orders, order{
 		fieldName: fs.name,
 		redisName: fs.redisName,
 		kind:      ok,
-	}
+	})
 }
 
 // Limit specifies an upper limit on the number of records to return. If amount
@@ -250,42 +421,109 @@ func (q *query) Exclude(fields ...string) {
 // Filter applies a filter to the query, which will cause the query to only
 // return models with attributes matching the expression. filterString should be
 // an expression which includes a fieldName, a space, and an operator in that
-// order. Operators must be one of "=", "!=", ">", "<", ">=", or "<=". You can
-// only use Filter on fields which are indexed, i.e. those which have the
-// `zoom:"index"` struct tag. If multiple filters are applied to the same query,
-// the query will only return models which have matches for ALL of the filters.
-// I.e. applying multiple filters is logically equivalent to combining them with
-// a AND or INTERSECT operator. Filter will set an error on the query if the
-// arguments are improperly formated, if the field you are attempting to filter
-// is not indexed, or if the type of value does not match the type of the field.
-// The error, same as any other error that occurs during the lifetime of the
-// query, is not returned until the query is executed. When the query is
-// executed the first error that occurred during the lifetime of the query
-// object (if any) will be returned.
+// order. Operators must be one of "=", "!=", ">", "<", ">=", "<=", "IN",
+// "NOT IN", "PREFIX", or "BETWEEN". For the IN and NOT IN operators, value must
+// be a slice or array of values, each of which has the same type as the field.
+// The PREFIX operator is only allowed on string fields. For the BETWEEN
+// operator, value must be a Range. You can only use Filter on fields which are
+// indexed, i.e. those which have the `zoom:"index"` struct tag. If multiple
+// filters are applied to the same query, the query will only return models
+// which have matches for ALL of the filters. I.e. applying multiple filters is
+// logically equivalent to combining them with a AND or INTERSECT operator.
+// Filter will set an error on the query if the arguments are improperly
+// formated, if the field you are attempting to filter is not indexed, or if the
+// type of value does not match the type of the field. The error, same as any
+// other error that occurs during the lifetime of the query, is not returned
+// until the query is executed. When the query is executed the first error that
+// occurred during the lifetime of the query object (if any) will be returned.
 func (q *query) Filter(filterString string, value interface{}) {
-	fieldName, operator, err := splitFilterString(filterString)
+	fltr, err := q.parseFilter(filterString, value)
+	if err != nil {
+		q.setError(err)
+		return
+	}
+	q.filters = append(q.filters, fltr)
+}
+
+// Between applies an inclusive BETWEEN filter to the query. It is equivalent to
+// Filter(fieldName+" BETWEEN", Range{Min: min, Max: max}).
+func (q *query) Between(fieldName string, min, max interface{}) {
+	q.Filter(fieldName+" BETWEEN", Range{Min: min, Max: max})
+}
+
+// After causes the query to only return models which come after the position
+// identified by cursor, which should be a cursor returned by RunPage. If cursor
+// is an empty string, After has no effect, which makes it easy to request the
+// first page. After will set an error on the query if cursor is invalid. The
+// query must have exactly one order, which must be the same order that was used
+// by the query which created the cursor. The error, same as any other error that
+// occurs during the lifetime of the query, is not returned until the query is
+// executed. When the query is executed the first error that occurred during the
+// lifetime of the query object (if any) will be returned.
+func (q *query) After(cursor string) {
+	if cursor == "" {
+		return
+	}
+	c, err := decodeQueryCursor(cursor)
 	if err != nil {
 		q.setError(err)
 		return
 	}
+	q.cursor = c
+}
+
+// Where applies a filter expression to the query, which will cause the query to
+// only return models which match the expression. Filter expressions are created
+// with the NewFilter, Or, and And functions and may be nested to any depth. If
+// Where is called more than once, or is used together with Filter, the query will
+// only return models which match ALL of the filters and expressions. Where will
+// set an error on the query if any of the filters in expr are invalid. The error,
+// same as any other error that occurs during the lifetime of the query, is not
+// returned until the query is executed. When the query is executed the first
+// error that occurred during the lifetime of the query object (if any) will be
+// returned.
+func (q *query) Where(expr FilterExpr) {
+	if !expr.isGroup() {
+		q.Filter(expr.filterString, expr.value)
+		return
+	}
+	group, err := q.parseFilterGroup(expr)
+	if err != nil {
+		q.setError(err)
+		return
+	}
+	q.groups = append(q.groups, group)
+}
+
+// parseFilter parses filterString and value and returns a filter for the field
+// that filterString refers to. It returns an error if the arguments are
+// improperly formatted, if the field is not indexed, or if the type of value does
+// not match the type of the field.
+func (q *query) parseFilter(filterString string, value interface{}) (filter, error) {
+	fieldName, operator, err := splitFilterString(filterString)
+	if err != nil {
+		return filter{}, err
+	}
 	// Parse the filter operator
-	fOp, found := filterOps[operator]
+	fOp, found := filterOps[strings.ToUpper(operator)]
 	if !found {
-		q.setError(errors.New("zoom: invalid Filter operator in fieldStr (should be one of =, !=, >, <, >=, or <=)"))
-		return
+		return filter{}, errors.New("zoom: invalid Filter operator in fieldStr (should be one of =, !=, >, <, >=, <=, IN, NOT IN, PREFIX, or BETWEEN)")
 	}
 	// Get the fieldSpec for the given fieldName
 	fieldSpec, found := q.collection.spec.fieldsByName[fieldName]
 	if !found {
-		err := fmt.Errorf("zoom: error in Query.Order: could not find field %s in type %s", fieldName, q.collection.spec.typ.String())
-		q.setError(err)
-		return
+		return filter{}, fmt.Errorf("zoom: error in Query.Filter: could not find field %s in type %s", fieldName, q.collection.spec.typ.String())
 	}
 	// Make sure the field is an indexed field
 	if fieldSpec.indexKind == noIndex {
-		err := fmt.Errorf("zoom: filters are only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", q.collection.spec.typ.String(), fieldName)
-		q.setError(err)
-		return
+		return filter{}, fmt.Errorf("zoom: filters are only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", q.collection.spec.typ.String(), fieldName)
+	}
+	// Make sure the operator is supported for the kind of index
+	switch {
+	case fOp == prefixOp && fieldSpec.indexKind != stringIndex:
+		return filter{}, fmt.Errorf("zoom: the %s operator is only allowed on string fields and %s.%s is not a string", fOp, q.collection.spec.typ.String(), fieldName)
+	case fOp == betweenOp && fieldSpec.indexKind == booleanIndex:
+		return filter{}, fmt.Errorf("zoom: the %s operator is only allowed on numeric and string fields and %s.%s is a bool", fOp, q.collection.spec.typ.String(), fieldName)
 	}
 	fltr := filter{
 		fieldSpec: fieldSpec,
@@ -293,30 +531,96 @@ func (q *query) Filter(filterString string, value interface{}) {
 	}
 	// Make sure the given value is the correct type
 	if err := fltr.checkValType(value); err != nil {
-		q.setError(err)
-		return
+		return filter{}, err
 	}
 	fltr.value = reflect.ValueOf(value)
-	q.filters = append(q.filters, fltr)
-	return
+	return fltr, nil
+}
+
+// parseFilterGroup converts expr, which must be a group created with Or or And,
+// into a filterGroup. It returns an error if the group is empty or if any of the
+// filters inside of it are invalid.
+func (q *query) parseFilterGroup(expr FilterExpr) (*filterGroup, error) {
+	if len(expr.exprs) == 0 {
+		return nil, fmt.Errorf("zoom: error in Query.Where: %s requires at least one filter expression", expr.groupOp)
+	}
+	group := &filterGroup{
+		op: expr.groupOp,
+	}
+	for _, child := range expr.exprs {
+		if child.isGroup() {
+			childGroup, err := q.parseFilterGroup(child)
+			if err != nil {
+				return nil, err
+			}
+			group.groups = append(group.groups, childGroup)
+		} else {
+			fltr, err := q.parseFilter(child.filterString, child.value)
+			if err != nil {
+				return nil, err
+			}
+			group.filters = append(group.filters, fltr)
+		}
+	}
+	return group, nil
 }
 
 func splitFilterString(filterString string) (fieldName string, operator string, err error) {
-	tokens := strings.Split(filterString, " ")
+	// The field name cannot contain a space, but the operator can (e.g. NOT IN),
+	// so we only split on the first space.
+	tokens := strings.SplitN(filterString, " ", 2)
 	if len(tokens) != 2 {
+		return "", "", errors.New("zoom: missing space in fieldStr argument (should be a field name, a space, and an operator)")
+	}
+	if _, found := filterOps[strings.ToUpper(tokens[1])]; !found && strings.Contains(tokens[1], " ") {
 		return "", "", errors.New("zoom: too many spaces in fieldStr argument (should be a field name, a space, and an operator)")
 	}
 	return tokens[0], tokens[1], nil
 }
 
 // checkValType returns an error if the type of value does not correspond to
-// filter.fieldSpec.
+// filter.fieldSpec. For the IN and NOT IN operators, value must be a slice or
+// array and the type of each element must correspond to filter.fieldSpec. For
+// the BETWEEN operator, value must be a Range and the type of both Min and Max
+// must correspond to filter.fieldSpec.
 func (f filter) checkValType(value interface{}) error {
+	if f.op == betweenOp {
+		rng, ok := value.(Range)
+		if !ok {
+			return fmt.Errorf("zoom: invalid value for Filter on %s: the %s operator requires a Range but got %T", f.fieldSpec.name, f.op, value)
+		}
+		if err := f.checkElemValType(rng.Min); err != nil {
+			return err
+		}
+		return f.checkElemValType(rng.Max)
+	}
+	if f.op.isSetOp() {
+		valueType := reflect.TypeOf(value)
+		if valueType == nil || (valueType.Kind() != reflect.Slice && valueType.Kind() != reflect.Array) {
+			return fmt.Errorf("zoom: invalid value for Filter on %s: the %s operator requires a slice or array of values but got %T", f.fieldSpec.name, f.op, value)
+		}
+		valueVal := reflect.ValueOf(value)
+		for i := 0; i < valueVal.Len(); i++ {
+			if err := f.checkElemValType(valueVal.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return f.checkElemValType(value)
+}
+
+// checkElemValType returns an error if the type of value does not correspond
+// to filter.fieldSpec.
+func (f filter) checkElemValType(value interface{}) error {
 	// Here we iterate through pointer indirections. This is so you can
 	// just pass in a primitive instead of a pointer to a primitive for
 	// filtering on fields which have pointer values.
 	valueType := reflect.TypeOf(value)
 	valueVal := reflect.ValueOf(value)
+	if valueType == nil {
+		return errors.New("zoom: invalid value for Filter. Is it nil?")
+	}
 	for valueType.Kind() == reflect.Ptr {
 		valueType = valueType.Elem()
 		valueVal = valueVal.Elem()
@@ -340,18 +644,35 @@ func (f filter) checkValType(value interface{}) error {
 // during the process of creating the set of ids. Note that tmpKeys may contain idsKey itself,
 // so the temporary keys should not be deleted until after the ids have been read from idsKey.
 func generateIDsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interface{}, err error) {
+	tx.sweepExpired(q.collection)
 	idsKey = q.collection.spec.indexKey()
 	tmpKeys = []interface{}{}
-	if q.hasOrder() {
-		fieldIndexKey, err := q.collection.spec.fieldIndexKey(q.order.fieldName)
+	if q.hasCursor() && q.hasLimit() && !q.hasFilters() {
+		// As an optimization, if there are no filters, the ids after the cursor
+		// can be read from the field index in order, and only as many as are
+		// needed. One more is included so that RunPage can tell whether there is
+		// another page.
+		cursorKey := generateRandomKey("tmp:cursor:" + q.collection.spec.keyPrefix())
+		tmpKeys = append(tmpKeys, cursorKey)
+		if err := extractIDsAfterCursor(q, tx, cursorKey, int(q.offset)+int(q.limit)+1); err != nil {
+			return "", tmpKeys, err
+		}
+		return cursorKey, tmpKeys, nil
+	}
+	// If there is more than one order, the ids are sorted by a script after
+	// they have been filtered (see below), so that only the ids which match the
+	// filters need to be sorted.
+	if q.hasOrder() && !q.hasSecondaryOrders() {
+		order := q.orders[0]
+		fieldIndexKey, err := q.collection.spec.fieldIndexKey(order.fieldName)
 		if err != nil {
 			return "", nil, err
 		}
-		fieldSpec := q.collection.spec.fieldsByName[q.order.fieldName]
+		fieldSpec := q.collection.spec.fieldsByName[order.fieldName]
 		if fieldSpec.indexKind == stringIndex {
 			// If the order is a string field, we need to extract the ids before
 			// we use ZRANGE. Create a temporary set to store the ordered ids
-			orderedIDsKey := generateRandomKey("tmp:order:" + q.order.fieldName)
+			orderedIDsKey := generateRandomKey("tmp:order:" + q.collection.spec.keyPrefix() + ":" + order.fieldName)
 			tmpKeys = append(tmpKeys, orderedIDsKey)
 			idsKey = orderedIDsKey
 			// TODO: as an optimization, if there is a filter on the same field,
@@ -361,49 +682,334 @@ func generateIDsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interfa
 			idsKey = fieldIndexKey
 		}
 	}
-	if q.hasFilters() {
-		filteredIDsKey := generateRandomKey("tmp:filter:all")
+	if q.hasFilters() || q.hasCursor() {
+		filteredIDsKey := generateRandomKey("tmp:filter:" + q.collection.spec.indexKey())
 		tmpKeys = append(tmpKeys, filteredIDsKey)
-		for i, filter := range q.filters {
-			if i == 0 {
-				// The first time, we should intersect with the ids key from above
-				if err := intersectFilter(q, tx, filter, idsKey, filteredIDsKey); err != nil {
-					return "", tmpKeys, err
-				}
-			} else {
-				// All other times, we should intersect with the filteredIDsKey itself
-				if err := intersectFilter(q, tx, filter, filteredIDsKey, filteredIDsKey); err != nil {
-					return "", tmpKeys, err
-				}
+		// The first time, we should intersect with the ids key from above. All
+		// other times, we should intersect with the filteredIDsKey itself.
+		origKey := idsKey
+		for _, filter := range q.filters {
+			if err := intersectFilter(q, tx, filter, origKey, filteredIDsKey); err != nil {
+				return "", tmpKeys, err
+			}
+			origKey = filteredIDsKey
+		}
+		for _, group := range q.groups {
+			if err := intersectFilterGroup(q, tx, group, origKey, filteredIDsKey); err != nil {
+				return "", tmpKeys, err
+			}
+			origKey = filteredIDsKey
+		}
+		if q.hasCursor() {
+			if err := intersectCursor(q, tx, origKey, filteredIDsKey); err != nil {
+				return "", tmpKeys, err
 			}
 		}
 		idsKey = filteredIDsKey
 	}
+	if q.hasSecondaryOrders() {
+		// Use a script to sort the ids by each field in turn. Create a temporary
+		// set to store the ordered ids.
+		orderedIDsKey := generateRandomKey("tmp:order:" + q.collection.spec.keyPrefix() + ":" + q.orders[0].fieldName)
+		tmpKeys = append(tmpKeys, orderedIDsKey)
+		if err := orderIDsByFields(q, tx, idsKey, orderedIDsKey); err != nil {
+			return "", tmpKeys, err
+		}
+		idsKey = orderedIDsKey
+	}
 	return idsKey, tmpKeys, nil
 }
 
+// orderIDsByFields adds a script to the query transaction which, when run, will
+// create a sorted set identified by destKey which contains the ids in sourceKey
+// of all models that have a value for every order field, sorted by each of the
+// query's orders in turn.
+func orderIDsByFields(q *query, tx *Transaction, sourceKey string, destKey string) error {
+	args := redis.Args{destKey, sourceKey, q.collection.spec.keyPrefix(), len(q.orders)}
+	for _, order := range q.orders {
+		fieldIndexKey, err := q.collection.spec.fieldIndexKey(order.fieldName)
+		if err != nil {
+			return err
+		}
+		kind := "numeric"
+		if q.collection.spec.fieldsByName[order.fieldName].indexKind == stringIndex {
+			kind = "string"
+		}
+		direction := "asc"
+		if order.kind == descendingOrder {
+			direction = "desc"
+		}
+		args = append(args, fieldIndexKey, kind, direction, q.collection.spec.fieldsByName[order.fieldName].redisName)
+	}
+	tx.Script(orderIdsByFieldsScript, args, nil)
+	return nil
+}
+
+// intersectCursor adds commands to the query transaction which, when run, will
+// intersect the set identified by origKey with the ids of all models that come
+// after the position identified by the query's cursor and store the results in
+// destKey. The scores from origKey are preserved, so the ids will still be in
+// the correct order.
+func intersectCursor(q *query, tx *Transaction, origKey string, destKey string) error {
+	cursorKey := generateRandomKey("tmp:cursor:" + q.collection.spec.keyPrefix())
+	if err := extractIDsAfterCursor(q, tx, cursorKey, 0); err != nil {
+		return err
+	}
+	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, cursorKey, "WEIGHTS", 1, 0}, nil)
+	tx.Command("DEL", redis.Args{cursorKey}, nil)
+	return nil
+}
+
+// extractIDsAfterCursor adds a script to the query transaction which, when run,
+// will store the ids of the models that come after the position identified by
+// the query's cursor in the sorted set identified by destKey, in order. If
+// limit is positive, only the first limit ids are stored. It returns an error
+// if the query does not have exactly one order, or if the cursor was created
+// for a different order.
+func extractIDsAfterCursor(q *query, tx *Transaction, destKey string, limit int) error {
+	if len(q.orders) != 1 {
+		return errors.New("zoom: queries which use a cursor must have exactly one order")
+	}
+	order := q.orders[0]
+	if q.cursor.Order != order.orderString() {
+		return fmt.Errorf("zoom: cursor was created by a query with a different order (%s)", q.cursor.Order)
+	}
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(order.fieldName)
+	if err != nil {
+		return err
+	}
+	kind := "numeric"
+	if q.collection.spec.fieldsByName[order.fieldName].indexKind == stringIndex {
+		kind = "string"
+	}
+	direction := "asc"
+	if order.kind == descendingOrder {
+		direction = "desc"
+	}
+	tx.Script(extractIdsAfterCursorScript, redis.Args{fieldIndexKey, destKey, kind, direction, q.cursor.Value, q.cursor.ID, limit}, nil)
+	return nil
+}
+
 // intersectFilter adds commands to the query transaction which, when run, will create a
 // temporary set which contains all the ids that fit the given filter criteria. Then it will
 // intersect them with origKey and stores the result in destKey. The function will automatically
 // delete any temporary sets created since, in this case, they are guaranteed to not be needed
 // by any other transaction commands.
 func intersectFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+	if err != nil {
+		return err
+	}
+	// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
+	filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+	if err := extractFilter(q, tx, filter, filterKey); err != nil {
+		return err
+	}
+	// Intersect filterKey with origKey and store result in destKey
+	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+	// Delete the temporary key
+	tx.Command("DEL", redis.Args{filterKey}, nil)
+	return nil
+}
+
+// intersectFilterGroup works like intersectFilter, but creates a temporary set
+// which contains all the ids that match the given filter group.
+func intersectFilterGroup(q *query, tx *Transaction, group *filterGroup, origKey string, destKey string) error {
+	groupKey := generateRandomKey("tmp:filter:" + q.collection.spec.keyPrefix() + ":group")
+	if err := extractFilterGroup(q, tx, group, groupKey); err != nil {
+		return err
+	}
+	// Intersect groupKey with origKey and store result in destKey
+	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, groupKey, "WEIGHTS", 1, 0}, nil)
+	// Delete the temporary key
+	tx.Command("DEL", redis.Args{groupKey}, nil)
+	return nil
+}
+
+// extractFilterGroup adds commands to the query transaction which, when run,
+// will store the ids of all models which match the given filter group in a
+// sorted set identified by destKey. The scores in destKey are not meaningful.
+// Each filter and nested group is first extracted into its own temporary set.
+// Then the temporary sets are combined with ZUNIONSTORE (for Or groups) or
+// ZINTERSTORE (for And groups), and finally deleted.
+func extractFilterGroup(q *query, tx *Transaction, group *filterGroup, destKey string) error {
+	childKeys := []interface{}{}
+	for _, filter := range group.filters {
+		fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+		if err != nil {
+			return err
+		}
+		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+		childKeys = append(childKeys, filterKey)
+		if err := extractFilter(q, tx, filter, filterKey); err != nil {
+			return err
+		}
+	}
+	for _, childGroup := range group.groups {
+		childGroupKey := generateRandomKey("tmp:filter:" + q.collection.spec.keyPrefix() + ":group")
+		childKeys = append(childKeys, childGroupKey)
+		if err := extractFilterGroup(q, tx, childGroup, childGroupKey); err != nil {
+			return err
+		}
+	}
+	command := "ZINTERSTORE"
+	if group.op == orGroup {
+		command = "ZUNIONSTORE"
+	}
+	args := redis.Args{destKey, len(childKeys)}.Add(childKeys...).Add("WEIGHTS")
+	for range childKeys {
+		args = args.Add(0)
+	}
+	tx.Command(command, args, nil)
+	// Delete the temporary keys
+	tx.Command("DEL", (redis.Args{}).Add(childKeys...), nil)
+	return nil
+}
+
+// extractFilter adds commands to the query transaction which, when run, will
+// store the ids of all models which match the given filter criteria in a sorted
+// set identified by destKey.
+func extractFilter(q *query, tx *Transaction, filter filter, destKey string) error {
+	switch filter.op {
+	case inOp:
+		return extractInFilter(q, tx, filter, destKey)
+	case notInOp:
+		return extractNotInFilter(q, tx, filter, destKey)
+	case prefixOp:
+		return extractPrefixFilter(q, tx, filter, destKey)
+	case betweenOp:
+		return extractBetweenFilter(q, tx, filter, destKey)
+	}
 	switch filter.fieldSpec.indexKind {
 	case numericIndex:
-		return intersectNumericFilter(q, tx, filter, origKey, destKey)
+		return extractNumericFilter(q, tx, filter, destKey)
 	case booleanIndex:
-		return intersectBoolFilter(q, tx, filter, origKey, destKey)
+		return extractBoolFilter(q, tx, filter, destKey)
+	case stringIndex:
+		return extractStringFilter(q, tx, filter, destKey)
+	}
+	return nil
+}
+
+// extractInFilter adds commands to the query transaction which, when run, will
+// store the ids of all models which have a value equal to any of the values in
+// the given IN filter in a sorted set identified by destKey. Since the scripts
+// used to extract ids add to destKey without removing existing members, this
+// is done by extracting the ids for each value in turn.
+func extractInFilter(q *query, tx *Transaction, filter filter, destKey string) error {
+	for i := 0; i < filter.value.Len(); i++ {
+		elemFilter := filter
+		elemFilter.op = equalOp
+		elemFilter.value = indirectFilterValue(filter.value.Index(i))
+		if err := extractFilter(q, tx, elemFilter, destKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractNotInFilter adds commands to the query transaction which, when run,
+// will store the ids of all models which have a value that is not equal to any
+// of the values in the given NOT IN filter in a sorted set identified by
+// destKey. Like the != operator, models which do not have a value for the field
+// in the index are not included. It works by extracting all the ids in the field
+// index and all the ids that match the corresponding IN filter into temporary
+// sets, then using ZUNIONSTORE to give every id that matched the IN filter a
+// positive score and removing those ids with ZREMRANGEBYSCORE.
+func extractNotInFilter(q *query, tx *Transaction, filter filter, destKey string) error {
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+	if err != nil {
+		return err
+	}
+	allKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+	switch filter.fieldSpec.indexKind {
+	case numericIndex, booleanIndex:
+		tx.ExtractIDsFromFieldIndex(fieldIndexKey, allKey, "-inf", "+inf")
 	case stringIndex:
-		return intersectStringFilter(q, tx, filter, origKey, destKey)
+		tx.ExtractIDsFromStringIndex(fieldIndexKey, allKey, "-", "+")
+	}
+	inFilter := filter
+	inFilter.op = inOp
+	inKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
+	if err := extractInFilter(q, tx, inFilter, inKey); err != nil {
+		return err
+	}
+	tx.Command("ZUNIONSTORE", redis.Args{destKey, 2, allKey, inKey, "WEIGHTS", 0, 1, "AGGREGATE", "MAX"}, nil)
+	tx.Command("ZREMRANGEBYSCORE", redis.Args{destKey, "(0", "+inf"}, nil)
+	tx.Command("DEL", redis.Args{allKey, inKey}, nil)
+	return nil
+}
+
+// indirectFilterValue follows any pointers or interfaces in value and returns
+// the underlying value. checkValType has already made sure that none of them
+// are nil.
+func indirectFilterValue(value reflect.Value) reflect.Value {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	return value
+}
+
+// extractPrefixFilter adds commands to the query transaction which, when run,
+// will store the ids of all models which have a value that starts with the
+// value of the given PREFIX filter in a sorted set identified by destKey. It
+// only works for string indexes.
+func extractPrefixFilter(q *query, tx *Transaction, filter filter, destKey string) error {
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+	if err != nil {
+		return err
 	}
+	// Any member which starts with the prefix is greater than or equal to the
+	// prefix itself and less than the prefix followed by the highest possible
+	// byte. We can't use delString here because the values may contain non-ASCII
+	// characters.
+	prefix := indirectFilterValue(filter.value).String()
+	tx.ExtractIDsFromStringIndex(fieldIndexKey, destKey, "["+prefix, "("+prefix+maxByteString)
 	return nil
 }
 
-// intersectNumericFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// numeric filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectNumericFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+// extractBetweenFilter adds commands to the query transaction which, when run,
+// will store the ids of all models which have a value inside of the Range for
+// the given BETWEEN filter in a sorted set identified by destKey. It works for
+// both numeric and string indexes and only requires a single temporary set.
+func extractBetweenFilter(q *query, tx *Transaction, filter filter, destKey string) error {
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+	if err != nil {
+		return err
+	}
+	rng := filter.value.Interface().(Range)
+	minVal := indirectFilterValue(reflect.ValueOf(rng.Min))
+	maxVal := indirectFilterValue(reflect.ValueOf(rng.Max))
+	switch filter.fieldSpec.indexKind {
+	case numericIndex:
+		var min, max interface{} = minVal.Interface(), maxVal.Interface()
+		if rng.ExcludeMin {
+			min = fmt.Sprintf("(%v", min)
+		}
+		if rng.ExcludeMax {
+			max = fmt.Sprintf("(%v", max)
+		}
+		tx.ExtractIDsFromFieldIndex(fieldIndexKey, destKey, min, max)
+	case stringIndex:
+		// These are the same as the bounds used for the >, >=, <, and <=
+		// operators respectively.
+		min := "[" + minVal.String()
+		if rng.ExcludeMin {
+			min = "(" + minVal.String() + nullString + delString
+		}
+		max := "(" + maxVal.String() + nullString + delString
+		if rng.ExcludeMax {
+			max = "(" + maxVal.String()
+		}
+		tx.ExtractIDsFromStringIndex(fieldIndexKey, destKey, min, max)
+	}
+	return nil
+}
+
+// extractNumericFilter adds commands to the query transaction which, when run, will
+// store the ids of all models which match the given numeric filter criteria in a
+// sorted set identified by destKey.
+func extractNumericFilter(q *query, tx *Transaction, filter filter, destKey string) error {
 	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
 	if err != nil {
 		return err
@@ -411,50 +1017,38 @@ func intersectNumericFilter(q *query, tx *Transaction, filter filter, origKey st
 	if filter.op == notEqualOp {
 		// Special case for not equal. We need to use two separate commands
 		valueExclusive := fmt.Sprintf("(%v", filter.value.Interface())
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
 		// ZADD all ids greater than filter.value
-		tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, valueExclusive, "+inf")
+		tx.ExtractIDsFromFieldIndex(fieldIndexKey, destKey, valueExclusive, "+inf")
 		// ZADD all ids less than filter.value
-		tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, "-inf", valueExclusive)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
-	} else {
-		var min, max interface{}
-		switch filter.op {
-		case equalOp:
-			min, max = filter.value.Interface(), filter.value.Interface()
-		case lessOp:
-			min = "-inf"
-			// use "(" for exclusive
-			max = fmt.Sprintf("(%v", filter.value.Interface())
-		case greaterOp:
-			min = fmt.Sprintf("(%v", filter.value.Interface())
-			max = "+inf"
-		case lessOrEqualOp:
-			min = "-inf"
-			max = filter.value.Interface()
-		case greaterOrEqualOp:
-			min = filter.value.Interface()
-			max = "+inf"
-		}
-		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, min, max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		tx.ExtractIDsFromFieldIndex(fieldIndexKey, destKey, "-inf", valueExclusive)
+		return nil
+	}
+	var min, max interface{}
+	switch filter.op {
+	case equalOp:
+		min, max = filter.value.Interface(), filter.value.Interface()
+	case lessOp:
+		min = "-inf"
+		// use "(" for exclusive
+		max = fmt.Sprintf("(%v", filter.value.Interface())
+	case greaterOp:
+		min = fmt.Sprintf("(%v", filter.value.Interface())
+		max = "+inf"
+	case lessOrEqualOp:
+		min = "-inf"
+		max = filter.value.Interface()
+	case greaterOrEqualOp:
+		min = filter.value.Interface()
+		max = "+inf"
 	}
+	tx.ExtractIDsFromFieldIndex(fieldIndexKey, destKey, min, max)
 	return nil
 }
 
-// intersectBoolFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// bool filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+// extractBoolFilter adds commands to the query transaction which, when run, will
+// store the ids of all models which match the given bool filter criteria in a
+// sorted set identified by destKey.
+func extractBoolFilter(q *query, tx *Transaction, filter filter, destKey string) error {
 	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
 	if err != nil {
 		return err
@@ -508,21 +1102,14 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 			min, max = 1, 1
 		}
 	}
-	// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-	filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-	tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, min, max)
-	// Intersect filterKey with origKey and store result in destKey
-	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-	// Delete the temporary key
-	tx.Command("DEL", redis.Args{filterKey}, nil)
+	tx.ExtractIDsFromFieldIndex(fieldIndexKey, destKey, min, max)
 	return nil
 }
 
-// intersectStringFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// string filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+// extractStringFilter adds commands to the query transaction which, when run, will
+// store the ids of all models which match the given string filter criteria in a
+// sorted set identified by destKey.
+func extractStringFilter(q *query, tx *Transaction, filter filter, destKey string) error {
 	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
 	if err != nil {
 		return err
@@ -530,44 +1117,33 @@ func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey str
 	valString := filter.value.String()
 	if filter.op == notEqualOp {
 		// Special case for not equal. We need to use two separate commands
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
 		// ZADD all ids greater than filter.value
 		min := "(" + valString + nullString + delString
-		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, min, "+")
+		tx.ExtractIDsFromStringIndex(fieldIndexKey, destKey, min, "+")
 		// ZADD all ids less than filter.value
 		max := "(" + valString
-		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, "-", max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
-	} else {
-		var min, max string
-		switch filter.op {
-		case equalOp:
-			min = "[" + valString
-			max = "(" + valString + nullString + delString
-		case lessOp:
-			min = "-"
-			max = "(" + valString
-		case greaterOp:
-			min = "(" + valString + nullString + delString
-			max = "+"
-		case lessOrEqualOp:
-			min = "-"
-			max = "(" + valString + nullString + delString
-		case greaterOrEqualOp:
-			min = "[" + valString
-			max = "+"
-		}
-		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, min, max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		tx.ExtractIDsFromStringIndex(fieldIndexKey, destKey, "-", max)
+		return nil
+	}
+	var min, max string
+	switch filter.op {
+	case equalOp:
+		min = "[" + valString
+		max = "(" + valString + nullString + delString
+	case lessOp:
+		min = "-"
+		max = "(" + valString
+	case greaterOp:
+		min = "(" + valString + nullString + delString
+		max = "+"
+	case lessOrEqualOp:
+		min = "-"
+		max = "(" + valString + nullString + delString
+	case greaterOrEqualOp:
+		min = "[" + valString
+		max = "+"
 	}
+	tx.ExtractIDsFromStringIndex(fieldIndexKey, destKey, min, max)
 	return nil
 }
 
@@ -613,11 +1189,26 @@ func (q *query) getStartStop() (start int, stop int) {
 }
 
 func (q *query) hasFilters() bool {
-	return len(q.filters) > 0
+	return len(q.filters) > 0 || len(q.groups) > 0
 }
 
 func (q *query) hasOrder() bool {
-	return q.order.fieldName != ""
+	return len(q.orders) > 0
+}
+
+func (q *query) hasSecondaryOrders() bool {
+	return len(q.orders) > 1
+}
+
+// reverse returns true iff the ids returned by generateIDsSet should be
+// read in reverse order. When there are secondary orders, the direction of
+// each order is already taken into account by generateIDsSet.
+func (q *query) reverse() bool {
+	return len(q.orders) == 1 && q.orders[0].kind == descendingOrder
+}
+
+func (q *query) hasCursor() bool {
+	return q.cursor != nil
 }
 
 func (q *query) hasLimit() bool {
@@ -642,7 +1233,9 @@ func (q *query) hasError() bool {
 
 // generateRandomKey generates a random string that is more or less
 // guaranteed to be unique and then prepends the given prefix. It is
-// used to generate keys for temporary sorted sets in queries.
+// used to generate keys for temporary sorted sets in queries. In cluster mode,
+// the prefix must contain the hash tag of the collection being queried, so that
+// the temporary keys are stored in the same hash slot as the collection.
 func generateRandomKey(prefix string) string {
 	return prefix + ":" + generateRandomID()
 }
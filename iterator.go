@@ -0,0 +1,272 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File iterator.go contains code related to iterating over the results of a
+// query in batches.
+
+package zoom
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultIteratorBatchSize is the number of models an Iterator will fetch from
+// the database at once if no batch size is specified.
+const DefaultIteratorBatchSize = 100
+
+// iteratorExpiration is how long the ids for an Iterator will be kept in the
+// database after the last batch was fetched. It exists so that the ids are
+// eventually deleted even if the Iterator is never closed.
+const iteratorExpiration = 10 * time.Minute
+
+// Iterator iterates over the models which match a query, fetching them from the
+// database in batches. Unlike Run, an Iterator only holds one batch of models in
+// memory at a time, which makes it suitable for exporting or processing a large
+// number of models. An Iterator should always be closed when you are done with
+// it. A typical use looks like this:
+//
+//	iter := People.NewQuery().Filter("Age >=", 25).Order("Name").Iter()
+//	defer iter.Close()
+//	person := &Person{}
+//	for iter.Next(person) {
+//		// do something with person
+//	}
+//	if err := iter.Err(); err != nil {
+//		// handle error
+//	}
+//
+// The ids of the models which match the query are stored in a temporary list in
+// the database when Next is first called, so filters, order, limit, and offset
+// are all honored, and models which are saved after that point will not be
+// included. Models which are deleted after that point will be skipped.
+type Iterator struct {
+	query      *query
+	batchSize  uint
+	fieldNames []string
+	idsKey     string
+	total      int
+	offset     int
+	batch      []Model
+	started    bool
+	closed     bool
+	err        error
+}
+
+// Iter returns an Iterator which can be used to iterate over the models that
+// match the query without loading all of them into memory. See the
+// documentation for Iterator for more information. Nothing touches the database
+// until Next is called. Any errors that occurred during the lifetime of the
+// query will be returned by Iterator.Err.
+func (q *Query) Iter() *Iterator {
+	return &Iterator{
+		query:     q.query,
+		batchSize: DefaultIteratorBatchSize,
+	}
+}
+
+// Iter returns an Iterator which can be used to iterate over all the models in
+// the collection without loading all of them into memory. It is equivalent to
+// c.NewQuery().Iter(). See the documentation for Iterator for more information.
+func (c *Collection) Iter() *Iterator {
+	return c.NewQuery().Iter()
+}
+
+// BatchSize sets the number of models that will be fetched from the database at
+// once. If size is 0, DefaultIteratorBatchSize will be used. BatchSize returns
+// the Iterator itself so it can be chained. It has no effect after Next has been
+// called.
+func (it *Iterator) BatchSize(size uint) *Iterator {
+	if size == 0 {
+		size = DefaultIteratorBatchSize
+	}
+	it.batchSize = size
+	return it
+}
+
+// Next scans the next model into model and returns true, or returns false if
+// there are no more models or if an error occurred. model must be the type
+// corresponding to the Collection of the query. The same model may be passed
+// to Next each time, in which case all the fields which were read from the
+// database will be overwritten. When Next returns false, you should check Err
+// to find out if an error occurred.
+func (it *Iterator) Next(model Model) bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	if err := it.query.collection.spec.checkModelType(model); err != nil {
+		it.setError(err)
+		return false
+	}
+	if !it.started {
+		if err := it.start(); err != nil {
+			it.setError(err)
+			return false
+		}
+	}
+	for {
+		if len(it.batch) == 0 {
+			if it.offset >= it.total {
+				// There are no more models. Close the iterator to delete the
+				// temporary list of ids.
+				it.setError(it.Close())
+				return false
+			}
+			if err := it.fetchBatch(); err != nil {
+				it.setError(err)
+				return false
+			}
+			// Every model in the batch might have been deleted
+			continue
+		}
+		next := it.batch[0]
+		it.batch = it.batch[1:]
+		// Copy the fields which were read from the database. Other fields of
+		// model are left unchanged.
+		mr := &modelRef{
+			collection: it.query.collection,
+			model:      model,
+			spec:       it.query.collection.spec,
+		}
+		nextRef := &modelRef{
+			collection: it.query.collection,
+			model:      next,
+			spec:       it.query.collection.spec,
+		}
+		for _, fieldName := range it.fieldNames {
+			if fieldName != "-" {
+				mr.fieldValue(fieldName).Set(nextRef.fieldValue(fieldName))
+			}
+		}
+		model.SetModelID(next.ModelID())
+		return true
+	}
+}
+
+// Err returns the first error that occurred during the lifetime of the Iterator
+// (if any), including any errors that occurred during the lifetime of the query.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close deletes the temporary list of ids from the database and causes all
+// future calls to Next to return false. It is safe to call Close more than once.
+// Close is called automatically when Next reaches the last model.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.batch = nil
+	if !it.started {
+		return nil
+	}
+	conn := it.query.pool.NewConnForKey(it.idsKey)
+	defer conn.Close()
+	_, err := conn.Do("DEL", it.idsKey)
+	return err
+}
+
+// setError sets the err property of the Iterator iff it was not already set.
+func (it *Iterator) setError(err error) {
+	if it.err == nil {
+		it.err = err
+	}
+}
+
+// start runs the query and stores the ids of all the models that match it in
+// a temporary list. It also sets the fields which will be scanned into each
+// model.
+func (it *Iterator) start() error {
+	if it.query.hasError() {
+		return it.query.err
+	}
+	it.started = true
+	it.fieldNames = append(it.query.fieldNames(), "-")
+	it.idsKey = generateRandomKey("tmp:iter:" + it.query.collection.spec.indexKey())
+	q := it.query
+	tx := q.newTransaction()
+	idsKey, tmpKeys, err := generateIDsSet(q, tx)
+	if err != nil {
+		return err
+	}
+	limit := int(q.limit)
+	if limit == 0 {
+		// In our query syntax, a limit of 0 means unlimited
+		// But in Redis, -1 means unlimited
+		limit = -1
+	}
+	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.reverse())
+	tx.Command("SORT", append(sortArgs, "STORE", it.idsKey), NewScanIntHandler(&it.total))
+	tx.Command("EXPIRE", redis.Args{it.idsKey, int(iteratorExpiration.Seconds())}, nil)
+	if len(tmpKeys) > 0 {
+		tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+	return tx.Exec()
+}
+
+// fetchBatch fetches the next batch of models, skipping any models which were
+// deleted, and resets the expiration of the temporary list of ids. The
+// references of all the models in the batch are loaded at once.
+func (it *Iterator) fetchBatch() error {
+	var values []interface{}
+	tx := it.query.newTransaction()
+	spec := it.query.collection.spec
+	sortArgs := spec.sortArgs(it.idsKey, it.query.redisFieldNames(), int(it.batchSize), uint(it.offset), false)
+	tx.Command("SORT", sortArgs, func(reply interface{}) error {
+		var err error
+		values, err = redis.Values(reply, nil)
+		return err
+	})
+	tx.Command("EXPIRE", redis.Args{it.idsKey, int(iteratorExpiration.Seconds())}, nil)
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errors.New("zoom: the ids for the Iterator expired before all of the models were read")
+	}
+	numFields := len(it.fieldNames)
+	it.offset += len(values) / numFields
+	models := []Model{}
+	for len(values) > 0 {
+		fieldValues := values[:numFields]
+		values = values[numFields:]
+		if modelWasDeleted(fieldValues) {
+			continue
+		}
+		model := reflect.New(spec.typ.Elem()).Interface().(Model)
+		mr := &modelRef{
+			collection: it.query.collection,
+			model:      model,
+			spec:       spec,
+		}
+		if err := scanModel(it.fieldNames, fieldValues, mr); err != nil {
+			return err
+		}
+		models = append(models, model)
+	}
+	if err := loadReferences(it.query.pool, (*Transaction).Exec, spec, it.fieldNames, models); err != nil {
+		return err
+	}
+	it.batch = models
+	return nil
+}
+
+// modelWasDeleted returns true iff fieldValues, which should have the id as
+// the last element, has no values for any of the other fields. This happens
+// when a model was deleted after its id was stored.
+func modelWasDeleted(fieldValues []interface{}) bool {
+	if len(fieldValues) <= 1 {
+		return false
+	}
+	for _, value := range fieldValues[:len(fieldValues)-1] {
+		if value != nil {
+			return false
+		}
+	}
+	return true
+}
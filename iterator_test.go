@@ -0,0 +1,221 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File iterator_test.go tests the code in iterator.go
+
+package zoom
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(23)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newQueries := []func() *Query{
+		func() *Query { return indexedTestModels.NewQuery() },
+		func() *Query { return indexedTestModels.NewQuery().Order("-Int") },
+		func() *Query { return indexedTestModels.NewQuery().Filter("Bool =", true).Order("String") },
+		func() *Query { return indexedTestModels.NewQuery().Order("Int").Offset(3).Limit(12) },
+		func() *Query { return indexedTestModels.NewQuery().Order("String").Include("Int") },
+		func() *Query {
+			return indexedTestModels.NewQuery().Filter("Int >", models[0].Int).Order("Bool").Order("-Int")
+		},
+	}
+	for i, newQuery := range newQueries {
+		expected := []*indexedTestModel{}
+		if err := newQuery().Run(&expected); err != nil {
+			t.Fatalf("Unexpected error in Run: %s", err.Error())
+		}
+		for _, batchSize := range []uint{0, 1, 5, 100} {
+			iter := newQuery().Iter().BatchSize(batchSize)
+			got := []*indexedTestModel{}
+			// Reuse the same model each time to make sure that values from
+			// previous models are not left over.
+			model := &indexedTestModel{}
+			for iter.Next(model) {
+				modelCopy := *model
+				got = append(got, &modelCopy)
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatalf("Unexpected error in iterator for query %d: %s", i, err.Error())
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatalf("Unexpected error in Close: %s", err.Error())
+			}
+			// If the query has no order, the models may be returned in any order.
+			orderMatters := newQuery().hasOrder()
+			if err := expectModelsToBeEqual(expected, got, orderMatters); err != nil {
+				t.Errorf("Iterator for query %d with batch size %d failed: %s", i, batchSize, err.Error())
+			}
+			checkForLeakedTmpKeys(t, newQuery().query)
+		}
+	}
+
+	// Test Collection.Iter
+	iter := indexedTestModels.Iter().BatchSize(4)
+	count := 0
+	for iter.Next(&indexedTestModel{}) {
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Unexpected error in iterator: %s", err.Error())
+	}
+	if count != len(models) {
+		t.Errorf("Expected %d models from Collection.Iter but got %d", len(models), count)
+	}
+}
+
+func TestIteratorLoadsReferences(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	related, err := createAndSaveTestModels(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only some of the models have references, so that left over references
+	// from the previous model would be noticed.
+	expected := []*referenceTestModel{
+		{Name: "a", One: related[0], Many: []*testModel{related[1], related[2]}},
+		{Name: "b", Many: []*testModel{}},
+		{Name: "c", One: related[2], Many: []*testModel{related[0]}},
+	}
+	for _, model := range expected {
+		if err := referenceTestModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	for _, batchSize := range []uint{1, 2, 100} {
+		iter := referenceTestModels.Iter().BatchSize(batchSize)
+		got := []*referenceTestModel{}
+		model := &referenceTestModel{}
+		for iter.Next(model) {
+			modelCopy := *model
+			got = append(got, &modelCopy)
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatalf("Unexpected error in iterator: %s", err.Error())
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %d models but got %d", len(expected), len(got))
+		}
+		sort.Slice(got, func(i, j int) bool {
+			return got[i].Name < got[j].Name
+		})
+		for i, model := range got {
+			for _, many := range [][]*testModel{expected[i].Many, model.Many} {
+				sort.Slice(many, func(i, j int) bool {
+					return many[i].ID < many[j].ID
+				})
+			}
+			if !reflect.DeepEqual(expected[i], model) {
+				t.Errorf("Iterator with batch size %d did not load references.\nExpected: %+v\nGot:      %+v", batchSize, expected[i], model)
+			}
+		}
+	}
+}
+
+func TestIteratorDeletedAndClosed(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedIDs, err := indexedTestModels.NewQuery().Order("Int").IDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Models which are deleted after iteration starts should be skipped and
+	// models which are saved after iteration starts should not be included.
+	iter := indexedTestModels.NewQuery().Order("Int").Iter().BatchSize(3)
+	model := &indexedTestModel{}
+	if !iter.Next(model) {
+		t.Fatalf("Expected Next to return true. Error was: %v", iter.Err())
+	}
+	gotIDs := []string{model.ModelID()}
+	if _, err := indexedTestModels.Delete(expectedIDs[5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexedTestModels.Save(&indexedTestModel{Int: models[0].Int}); err != nil {
+		t.Fatal(err)
+	}
+	for iter.Next(model) {
+		gotIDs = append(gotIDs, model.ModelID())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Unexpected error in iterator: %s", err.Error())
+	}
+	expectedIDs = append(expectedIDs[:5], expectedIDs[6:]...)
+	if len(gotIDs) != len(expectedIDs) {
+		t.Fatalf("Expected ids %v but got %v", expectedIDs, gotIDs)
+	}
+	for i := range expectedIDs {
+		if expectedIDs[i] != gotIDs[i] {
+			t.Fatalf("Expected ids %v but got %v", expectedIDs, gotIDs)
+		}
+	}
+	checkForLeakedTmpKeys(t, iter.query)
+
+	// Closing the iterator early should delete the temporary keys and cause Next
+	// to return false.
+	iter = indexedTestModels.Iter().BatchSize(2)
+	if !iter.Next(model) {
+		t.Fatalf("Expected Next to return true. Error was: %v", iter.Err())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if iter.Next(model) {
+		t.Error("Expected Next to return false after Close")
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Expected second call to Close to succeed but got error: %s", err.Error())
+	}
+	checkForLeakedTmpKeys(t, iter.query)
+}
+
+func TestIteratorErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if _, err := createAndSaveIndexedTestModels(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Query errors should be returned by Err
+	iter := indexedTestModels.NewQuery().Order("Foo").Iter()
+	if iter.Next(&indexedTestModel{}) {
+		t.Error("Expected Next to return false for invalid query")
+	}
+	if iter.Err() == nil {
+		t.Error("Expected an error for invalid query but got none")
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Unexpected error in Close: %s", err.Error())
+	}
+
+	// Passing in the wrong model type should result in an error
+	iter = indexedTestModels.Iter()
+	if iter.Next(&testModel{}) {
+		t.Error("Expected Next to return false for wrong model type")
+	}
+	if iter.Err() == nil {
+		t.Error("Expected an error for wrong model type but got none")
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Unexpected error in Close: %s", err.Error())
+	}
+}
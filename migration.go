@@ -0,0 +1,577 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File migration.go contains code related to schema migrations, i.e. updating
+// the existing models and indexes for a collection after the model type has
+// changed.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultMigrationBatchSize is the number of models migrated in each
+// transaction if Migration.BatchSize is 0.
+const DefaultMigrationBatchSize = 100
+
+// migrationLockTimeout is how long the lock acquired by Migrate lasts. It is
+// extended after each transaction, so it only expires if the caller crashed
+// or lost its connection to the database.
+const migrationLockTimeout = 30 * time.Second
+
+// Migration is a versioned change to the data for a collection, e.g. renaming a
+// field or adding an index to an existing field. It consists of one or more
+// steps, which are created with RenameField, BackfillIndex, DropIndex, or
+// TransformField.
+type Migration struct {
+	// Version identifies the migration. It must be positive and unique within
+	// the collection. Migrations are run in order of increasing version, and
+	// each migration only runs once.
+	Version int
+	// Description is a short description of the migration which is included in
+	// error messages.
+	Description string
+	// Steps are run in order.
+	Steps []MigrationStep
+	// BatchSize is the number of models migrated in each transaction. A value
+	// of 0 means DefaultMigrationBatchSize.
+	BatchSize int
+}
+
+// MigrationStep is a single step in a Migration.
+type MigrationStep struct {
+	// migrateBatch adds commands to tx for migrating the models with the given
+	// ids. It may read from the database using tx.conn, which is watching the
+	// keys for the models. Some of the models might have been deleted. It is nil
+	// for steps which do not need to migrate each model.
+	migrateBatch func(c *Collection, tx *Transaction, ids []string) error
+	// finish adds commands to tx which are executed once after all the models
+	// have been migrated. It may be nil.
+	finish func(c *Collection, tx *Transaction) error
+}
+
+// migrationState is the progress of the migrations for a collection, which is
+// stored in a hash in the database. version is the version of the last
+// migration which was completed. step is the index of the next step of the
+// following migration, and offset is the number of models that have already
+// been migrated by that step.
+type migrationState struct {
+	version int
+	step    int
+	offset  int
+}
+
+// AddMigration adds a migration to the collection, which will be run the next
+// time Migrate is called unless it has already been run. AddMigration returns
+// an error if the version of the migration is not positive or if the
+// collection already has a migration with the same version. It is not safe to
+// call AddMigration concurrently with Migrate.
+func (c *Collection) AddMigration(migration Migration) error {
+	if migration.Version <= 0 {
+		return fmt.Errorf("zoom: Error in AddMigration: Version must be positive but got %d", migration.Version)
+	}
+	for _, other := range c.migrations {
+		if other.Version == migration.Version {
+			return fmt.Errorf("zoom: Error in AddMigration: Collection %s already has a migration with version %d", c.Name(), migration.Version)
+		}
+	}
+	c.migrations = append(c.migrations, migration)
+	sort.Slice(c.migrations, func(i, j int) bool {
+		return c.migrations[i].Version < c.migrations[j].Version
+	})
+	return nil
+}
+
+// Migrate runs all the migrations that have been added to the collection but
+// have not been run yet, in order of increasing version. Migrations are
+// resumable. The progress of each migration is stored in the database and
+// updated atomically with each batch of models, so if Migrate is interrupted
+// (e.g. by a crash), calling it again resumes from the last batch that was
+// migrated. Only one caller can run the migrations for a collection at a time.
+// If another caller is already running them, Migrate returns a
+// MigrationInProgressError. Migrate only works for indexed collections.
+func (c *Collection) Migrate() error {
+	if len(c.migrations) == 0 {
+		return nil
+	}
+	if !c.index {
+		return newUnindexedCollectionError("Migrate")
+	}
+	token := generateRandomID()
+	if err := c.lockMigrations(token); err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.unlockMigrations(token)
+	}()
+	state, err := c.migrationState()
+	if err != nil {
+		return err
+	}
+	for _, migration := range c.migrations {
+		if migration.Version <= state.version {
+			continue
+		}
+		if err := c.runMigration(token, migration, state); err != nil {
+			return fmt.Errorf("zoom: Error in migration %d (%s) for %s: %s", migration.Version, migration.Description, c.Name(), err.Error())
+		}
+		state = migrationState{version: migration.Version}
+	}
+	return nil
+}
+
+// MigrationVersion returns the version of the last migration that was
+// completed for the collection, or 0 if no migrations have been completed.
+func (c *Collection) MigrationVersion() (int, error) {
+	state, err := c.migrationState()
+	if err != nil {
+		return 0, err
+	}
+	return state.version, nil
+}
+
+// runMigration runs the given migration, starting from the step and offset in
+// state.
+func (c *Collection) runMigration(token string, migration Migration, state migrationState) error {
+	batchSize := migration.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+	stateKey := c.spec.migrationStateKey()
+	idsKey := c.spec.migrationIDsKey()
+	if len(migration.Steps) == 0 {
+		return c.migrationTransaction(token, nil, func(tx *Transaction) error {
+			tx.Command("HMSET", redis.Args{stateKey, "version", migration.Version, "step", 0, "offset", 0}, nil)
+			return nil
+		})
+	}
+	for i := state.step; i < len(migration.Steps); i++ {
+		step := migration.Steps[i]
+		offset := 0
+		if i == state.step {
+			offset = state.offset
+		}
+		if step.migrateBatch != nil {
+			if offset == 0 {
+				// Take a snapshot of the ids of all the models. Models which are saved
+				// after this point are assumed to be saved with the new schema.
+				if err := c.migrationTransaction(token, nil, func(tx *Transaction) error {
+					if !c.softDelete {
+						tx.Command("SORT", redis.Args{c.IndexKey(), "ALPHA", "STORE", idsKey}, nil)
+						return nil
+					}
+					// Soft deleted models also need to be migrated, since they can be
+					// restored later.
+					unionKey := generateRandomKey("tmp:migrationIDs:" + c.spec.keyPrefix())
+					tx.Command("ZUNIONSTORE", redis.Args{unionKey, 2, c.IndexKey(), c.spec.deletedKey()}, nil)
+					tx.Command("SORT", redis.Args{unionKey, "ALPHA", "STORE", idsKey}, nil)
+					tx.Command("DEL", redis.Args{unionKey}, nil)
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			for {
+				ids, err := c.migrationIDs(offset, batchSize)
+				if err != nil {
+					return err
+				}
+				if len(ids) == 0 {
+					break
+				}
+				modelKeys := make([]string, len(ids))
+				for j, id := range ids {
+					modelKeys[j] = c.ModelKey(id)
+				}
+				if c.softDelete {
+					modelKeys = append(modelKeys, c.spec.deletedKey())
+				}
+				newOffset := offset + len(ids)
+				if err := c.migrationTransaction(token, modelKeys, func(tx *Transaction) error {
+					if err := step.migrateBatch(c, tx, ids); err != nil {
+						return err
+					}
+					tx.Command("HSET", redis.Args{stateKey, "offset", newOffset}, nil)
+					return nil
+				}); err != nil {
+					return err
+				}
+				offset = newOffset
+			}
+		}
+		// Finish the step and move on to the next one
+		if err := c.migrationTransaction(token, nil, func(tx *Transaction) error {
+			if step.finish != nil {
+				if err := step.finish(c, tx); err != nil {
+					return err
+				}
+			}
+			if i == len(migration.Steps)-1 {
+				tx.Command("HMSET", redis.Args{stateKey, "version", migration.Version, "step", 0, "offset", 0}, nil)
+			} else {
+				tx.Command("HMSET", redis.Args{stateKey, "step", i + 1, "offset", 0}, nil)
+			}
+			tx.Command("DEL", redis.Args{idsKey}, nil)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationTransaction uses Pool.Update to execute a transaction which watches
+// the lock for the migrations and the given keys. If the lock no longer belongs
+// to the caller with the given token, it returns a MigrationInProgressError.
+// Otherwise it calls migrate to add commands to the transaction and extends the
+// lock. Since migrations are resumable and each transaction only changes a
+// batch of models, it retries until there are no more conflicts instead of
+// giving up after a fixed number of attempts.
+func (c *Collection) migrationTransaction(token string, keys []string, migrate func(tx *Transaction) error) error {
+	lockKey := c.spec.migrationLockKey()
+	_, err := c.pool.Update(func(tx *Transaction) error {
+		if err := tx.watchKeys(append([]string{lockKey}, keys...)); err != nil {
+			return err
+		}
+		owner, err := redis.String(tx.conn.Do("GET", lockKey))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		if owner != token {
+			return MigrationInProgressError{Collection: c}
+		}
+		if err := migrate(tx); err != nil {
+			return err
+		}
+		tx.Command("PEXPIRE", redis.Args{lockKey, int64(migrationLockTimeout / time.Millisecond)}, nil)
+		return nil
+	}, DefaultUpdateOptions.WithMaxAttempts(0))
+	return err
+}
+
+// lockMigrations acquires the lock for running the migrations for the
+// collection, or returns a MigrationInProgressError if another caller already
+// has it.
+func (c *Collection) lockMigrations(token string) error {
+	conn := c.pool.NewConnForKey(c.spec.migrationLockKey())
+	defer func() {
+		_ = conn.Close()
+	}()
+	reply, err := conn.Do("SET", c.spec.migrationLockKey(), token, "NX", "PX", int64(migrationLockTimeout/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return MigrationInProgressError{Collection: c}
+	}
+	return nil
+}
+
+// unlockMigrations releases the lock for running the migrations for the
+// collection if it still belongs to the caller with the given token.
+func (c *Collection) unlockMigrations(token string) error {
+	return c.migrationTransaction(token, nil, func(tx *Transaction) error {
+		tx.Command("DEL", redis.Args{c.spec.migrationLockKey()}, nil)
+		return nil
+	})
+}
+
+// migrationState returns the progress of the migrations for the collection.
+func (c *Collection) migrationState() (migrationState, error) {
+	state := migrationState{}
+	conn := c.pool.NewConnForKey(c.spec.migrationStateKey())
+	defer func() {
+		_ = conn.Close()
+	}()
+	reply, err := redis.Values(conn.Do("HMGET", c.spec.migrationStateKey(), "version", "step", "offset"))
+	if err != nil {
+		return state, err
+	}
+	if _, err := redis.Scan(reply, &state.version, &state.step, &state.offset); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+// migrationIDs returns up to count model ids from the snapshot taken by the
+// current migration step, starting at offset.
+func (c *Collection) migrationIDs(offset int, count int) ([]string, error) {
+	conn := c.pool.NewConnForKey(c.spec.migrationIDsKey())
+	defer func() {
+		_ = conn.Close()
+	}()
+	return redis.Strings(conn.Do("LRANGE", c.spec.migrationIDsKey(), offset, offset+count-1))
+}
+
+// migrationStateKey returns the key for the hash which stores the progress of
+// the migrations for the collection.
+func (ms *modelSpec) migrationStateKey() string {
+	return ms.keyPrefix() + ":migrations"
+}
+
+// migrationIDsKey returns the key for the list of model ids which is used by
+// the current migration step.
+func (ms *modelSpec) migrationIDsKey() string {
+	return ms.keyPrefix() + ":migrations:ids"
+}
+
+// migrationLockKey returns the key for the lock which is held while running
+// the migrations for the collection.
+func (ms *modelSpec) migrationLockKey() string {
+	return ms.keyPrefix() + ":migrations:lock"
+}
+
+// RenameField returns a MigrationStep which renames a field in the hash for
+// every model from oldName to newName. Both names are the names of the field as
+// it is stored in Redis (e.g. as set by the `redis` struct tag). If the field
+// was indexed or unique, the index entries are moved as well. Models which were
+// saved with the new schema while the migration was running keep their new
+// values, both in the hash and in the indexes. If a unique value which is moved
+// to the new unique index already belongs to another model, Migrate returns a
+// UniqueConstraintError and the current batch of models is not changed.
+func RenameField(oldName, newName string) MigrationStep {
+	return MigrationStep{
+		migrateBatch: func(c *Collection, tx *Transaction, ids []string) error {
+			prefix := c.spec.keyPrefix()
+			oldIndexKey, newIndexKey := prefix+":"+oldName, prefix+":"+newName
+			if err := addRenameUniqueChecks(c, tx, ids, oldName, newName); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				args := redis.Args{c.ModelKey(id), oldName, newName, id, oldIndexKey, newIndexKey, oldIndexKey + ":unique", newIndexKey + ":unique"}
+				tx.Script(renameHashFieldScript, args, nil)
+				tx.saveExpireValues(c, id)
+			}
+			return nil
+		},
+		finish: func(c *Collection, tx *Transaction) error {
+			// The entries for every model in the snapshot were already moved, so any
+			// remaining entries in the old indexes are stale.
+			prefix := c.spec.keyPrefix()
+			tx.Command("DEL", redis.Args{prefix + ":" + oldName, prefix + ":" + oldName + ":unique"}, nil)
+			return nil
+		},
+	}
+}
+
+// addRenameUniqueChecks adds a uniqueCheck to tx for every model in ids whose
+// value for oldName will be moved to the unique index for newName by the
+// rename_hash_field script, i.e. every model which has a value for oldName but
+// not for newName, and which owns that value in the unique index for oldName.
+// This way a conflict is reported before the transaction is executed, in the
+// same way as for Save.
+func addRenameUniqueChecks(c *Collection, tx *Transaction, ids []string, oldName, newName string) error {
+	oldUniqueKey := c.spec.keyPrefix() + ":" + oldName + ":unique"
+	values := make([]interface{}, len(ids))
+	hasNewField := make([]bool, len(ids))
+	actions := []*Action{}
+	for i, id := range ids {
+		i := i
+		actions = append(actions, &Action{
+			kind: commandAction,
+			name: "HGET",
+			args: redis.Args{c.ModelKey(id), oldName},
+			handler: func(reply interface{}) error {
+				values[i] = reply
+				return nil
+			},
+		}, &Action{
+			kind: commandAction,
+			name: "HEXISTS",
+			args: redis.Args{c.ModelKey(id), newName},
+			handler: func(reply interface{}) error {
+				var err error
+				hasNewField[i], err = redis.Bool(reply, nil)
+				return err
+			},
+		})
+	}
+	if err := doActionsWithoutMulti(tx.conn, actions); err != nil {
+		return err
+	}
+	owners := make([]string, len(ids))
+	actions = []*Action{}
+	for i := range ids {
+		if values[i] == nil || hasNewField[i] {
+			continue
+		}
+		i := i
+		actions = append(actions, &Action{
+			kind: commandAction,
+			name: "HGET",
+			args: redis.Args{oldUniqueKey, values[i]},
+			handler: func(reply interface{}) error {
+				if reply != nil {
+					owners[i], _ = redis.String(reply, nil)
+				}
+				return nil
+			},
+		})
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	if err := doActionsWithoutMulti(tx.conn, actions); err != nil {
+		return err
+	}
+	// The new field might not be part of the current schema (e.g. when the
+	// migration is run with the old model type), in which case the error refers
+	// to the field by its name in Redis.
+	fs := &fieldSpec{name: newName, redisName: newName}
+	for _, field := range c.spec.fields {
+		if field.redisName == newName {
+			fs = field
+		}
+	}
+	for i, id := range ids {
+		if owners[i] != id {
+			continue
+		}
+		value, err := redis.String(values[i], nil)
+		if err != nil {
+			return err
+		}
+		tx.uniqueChecks = append(tx.uniqueChecks, &uniqueCheck{
+			collection: c,
+			fs:         fs,
+			value:      value,
+			id:         id,
+		})
+	}
+	return nil
+}
+
+// BackfillIndex returns a MigrationStep which adds every model to the index
+// for the field with the given name. It is needed after adding the
+// `zoom:"index"` struct tag to an existing field, since the index only includes
+// models that were saved after the tag was added. fieldName is the name of the
+// field in the struct, and the field must be indexed.
+func BackfillIndex(fieldName string) MigrationStep {
+	return MigrationStep{
+		migrateBatch: func(c *Collection, tx *Transaction, ids []string) error {
+			fs, found := c.spec.fieldsByName[fieldName]
+			if !found {
+				return fmt.Errorf("Collection %s does not have field named %s", c.Name(), fieldName)
+			}
+			if fs.indexKind == noIndex {
+				return fmt.Errorf("Field %s of collection %s is not indexed", fieldName, c.Name())
+			}
+			mrs, err := findExistingModels(c, tx, ids, []string{fieldName})
+			if err != nil {
+				return err
+			}
+			for _, mr := range mrs {
+				tx.saveFieldIndexesForFields([]string{fieldName}, mr)
+				tx.saveExpireValues(c, mr.model.ModelID())
+			}
+			return nil
+		},
+	}
+}
+
+// DropIndex returns a MigrationStep which deletes the index for the field with
+// the given name, including the index for a unique constraint. It is typically
+// used after removing the `zoom:"index"` or `zoom:"unique"` struct tag from a
+// field, or removing the field altogether. name is the name of the field as it
+// is stored in Redis.
+func DropIndex(name string) MigrationStep {
+	return MigrationStep{
+		finish: func(c *Collection, tx *Transaction) error {
+			prefix := c.spec.keyPrefix()
+			tx.Command("DEL", redis.Args{prefix + ":" + name, prefix + ":" + name + ":unique"}, nil)
+			return nil
+		},
+	}
+}
+
+// TransformField returns a MigrationStep which calls transform with the value
+// of the field with the given name for every model, and replaces the value with
+// the result. It is typically used after changing the type of a field. name is
+// the name of the field as it is stored in Redis, and the values are passed to
+// transform exactly as they are stored. Models which do not have a value for
+// the field are skipped. If the field is indexed or unique, the index entries
+// are replaced in the same transaction, and if a new value conflicts with the
+// value of another model, Migrate returns a UniqueConstraintError. If transform
+// returns an error, Migrate stops and returns the error, and the current batch
+// of models is not changed.
+func TransformField(name string, transform func(value string) (string, error)) MigrationStep {
+	return MigrationStep{
+		migrateBatch: func(c *Collection, tx *Transaction, ids []string) error {
+			var fs *fieldSpec
+			for _, field := range c.spec.fields {
+				if field.redisName == name && (field.indexKind != noIndex || field.unique) {
+					fs = field
+				}
+			}
+			values := make([]interface{}, len(ids))
+			deleted := make([]bool, len(ids))
+			actions := []*Action{}
+			for i, id := range ids {
+				i := i
+				actions = append(actions, &Action{
+					kind: commandAction,
+					name: "HGET",
+					args: redis.Args{c.ModelKey(id), name},
+					handler: func(reply interface{}) error {
+						values[i] = reply
+						return nil
+					},
+				})
+				if c.softDelete {
+					actions = append(actions, &Action{
+						kind: commandAction,
+						name: "ZSCORE",
+						args: redis.Args{c.spec.deletedKey(), id},
+						handler: func(reply interface{}) error {
+							deleted[i] = reply != nil
+							return nil
+						},
+					})
+				}
+			}
+			if err := doActionsWithoutMulti(tx.conn, actions); err != nil {
+				return err
+			}
+			for i, id := range ids {
+				if values[i] == nil {
+					continue
+				}
+				value, err := redis.String(values[i], nil)
+				if err != nil {
+					return err
+				}
+				newValue, err := transform(value)
+				if err != nil {
+					return err
+				}
+				// Soft deleted models are not in the indexes, so only their hash is
+				// changed.
+				if fs != nil && !deleted[i] {
+					model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+					mr := &modelRef{
+						collection: c,
+						model:      model,
+						spec:       c.spec,
+					}
+					if err := scanModel([]string{"-", fs.name}, []interface{}{[]byte(id), []byte(newValue)}, mr); err != nil {
+						return err
+					}
+					// This must happen before the hash is changed, because it relies on
+					// reading the old value from the hash.
+					tx.saveFieldIndexesForFields([]string{fs.name}, mr)
+					tx.saveUniqueIndexesForFields([]string{fs.name}, mr)
+				}
+				tx.Command("HSET", redis.Args{c.ModelKey(id), name, newValue}, nil)
+				tx.saveExpireValues(c, id)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File migration_test.go tests the code in migration.go, i.e. schema
+// migrations.
+
+package zoom
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestAddMigration(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	_, newModels := createMigrationTestCollections(t)
+	if err := newModels.AddMigration(Migration{Version: 0}); err == nil {
+		t.Errorf("Expected error for a migration with version 0 but got none")
+	}
+	if err := newModels.AddMigration(Migration{Version: 1}); err != nil {
+		t.Errorf("Unexpected error in AddMigration: %s", err.Error())
+	}
+	if err := newModels.AddMigration(Migration{Version: 1}); err == nil {
+		t.Errorf("Expected error for a duplicate version but got none")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	oldModels, newModels := createMigrationTestCollections(t)
+	old := []*migrationOldModel{}
+	for i := 0; i < 5; i++ {
+		model := &migrationOldModel{Name: "name" + strconv.Itoa(i), Age: i, Nickname: "nick" + strconv.Itoa(i)}
+		if err := oldModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		old = append(old, model)
+	}
+
+	// Migrations can be added in any order
+	migrations := []Migration{
+		{
+			Version:     2,
+			Description: "double the ages and index them",
+			Steps: []MigrationStep{
+				TransformField("Age", func(value string) (string, error) {
+					age, err := strconv.Atoi(value)
+					return strconv.Itoa(age * 2), err
+				}),
+				BackfillIndex("Age"),
+			},
+			BatchSize: 2,
+		},
+		{
+			Version:     1,
+			Description: "rename name to full_name",
+			Steps:       []MigrationStep{RenameField("name", "full_name")},
+			BatchSize:   2,
+		},
+		{
+			Version:     3,
+			Description: "drop the nickname index",
+			Steps:       []MigrationStep{DropIndex("Nickname")},
+		},
+	}
+	for _, migration := range migrations {
+		if err := newModels.AddMigration(migration); err != nil {
+			t.Fatalf("Unexpected error in AddMigration: %s", err.Error())
+		}
+	}
+	expectKeyExists(t, newModels.spec.keyPrefix()+":Nickname")
+	if err := newModels.Migrate(); err != nil {
+		t.Fatalf("Unexpected error in Migrate: %s", err.Error())
+	}
+	expectMigrationVersion(t, newModels, 3)
+	for _, oldModel := range old {
+		got := &migrationNewModel{}
+		if err := newModels.Find(oldModel.ModelID(), got); err != nil {
+			t.Fatalf("Unexpected error in Find: %s", err.Error())
+		}
+		if got.FullName != oldModel.Name {
+			t.Errorf("Expected FullName to be %s but got %s", oldModel.Name, got.FullName)
+		}
+		if got.Age != oldModel.Age*2 {
+			t.Errorf("Expected Age to be %d but got %d", oldModel.Age*2, got.Age)
+		}
+	}
+	ids, err := newModels.NewQuery().Filter("Age >=", 4).Order("Age").IDs()
+	if err != nil {
+		t.Fatalf("Unexpected error in query: %s", err.Error())
+	}
+	expectedIDs := []string{old[2].ModelID(), old[3].ModelID(), old[4].ModelID()}
+	if len(ids) != len(expectedIDs) {
+		t.Fatalf("Expected query to return %v but got %v", expectedIDs, ids)
+	}
+	for i := range ids {
+		if ids[i] != expectedIDs[i] {
+			t.Errorf("Expected query to return %v but got %v", expectedIDs, ids)
+			break
+		}
+	}
+	expectKeyDoesNotExist(t, newModels.spec.keyPrefix()+":Nickname")
+	expectKeyDoesNotExist(t, newModels.spec.migrationIDsKey())
+	expectKeyDoesNotExist(t, newModels.spec.migrationLockKey())
+
+	// Running the migrations again should do nothing
+	if err := newModels.Migrate(); err != nil {
+		t.Fatalf("Unexpected error in Migrate: %s", err.Error())
+	}
+	got := &migrationNewModel{}
+	if err := newModels.Find(old[1].ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Age != 2 {
+		t.Errorf("Expected Age to still be 2 but got %d", got.Age)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	oldModels, newModels := createMigrationTestCollections(t)
+	old := []*migrationOldModel{}
+	for i := 0; i < 5; i++ {
+		model := &migrationOldModel{Name: "name" + strconv.Itoa(i)}
+		if err := oldModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		old = append(old, model)
+	}
+	// Simulate a crash by failing while transforming the third model
+	calls := 0
+	crashErr := errors.New("crash")
+	migration := Migration{
+		Version: 1,
+		Steps: []MigrationStep{
+			TransformField("name", func(value string) (string, error) {
+				calls++
+				if calls == 3 {
+					return "", crashErr
+				}
+				return value + "!", nil
+			}),
+		},
+		BatchSize: 2,
+	}
+	if err := newModels.AddMigration(migration); err != nil {
+		t.Fatalf("Unexpected error in AddMigration: %s", err.Error())
+	}
+	if err := newModels.Migrate(); err == nil {
+		t.Fatalf("Expected error in Migrate but got none")
+	}
+	expectMigrationVersion(t, newModels, 0)
+	expectKeyDoesNotExist(t, newModels.spec.migrationLockKey())
+
+	// Resuming should transform each value exactly once
+	if err := newModels.Migrate(); err != nil {
+		t.Fatalf("Unexpected error in Migrate: %s", err.Error())
+	}
+	expectMigrationVersion(t, newModels, 1)
+	for _, oldModel := range old {
+		expectFieldEquals(t, oldModels.ModelKey(oldModel.ModelID()), "name", oldModels.spec.fallback, oldModel.Name+"!")
+	}
+}
+
+func TestRenameFieldKeepsNewValues(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	oldModels, _ := createMigrationTestCollections(t)
+	models := []*migrationOldModel{}
+	for i := 0; i < 3; i++ {
+		model := &migrationOldModel{Nickname: "nick" + strconv.Itoa(i)}
+		if err := oldModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		models = append(models, model)
+	}
+	// Simulate saving the first model with the new schema before the migration
+	// reaches it. Save does not remove the old field from the hash.
+	prefix := oldModels.spec.keyPrefix()
+	resaved := models[0]
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", oldModels.ModelKey(resaved.ID), "nick", "fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", prefix+":nick", 0, "fresh"+nullString+resaved.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldModels.AddMigration(Migration{
+		Version:   1,
+		Steps:     []MigrationStep{RenameField("Nickname", "nick")},
+		BatchSize: 2,
+	}); err != nil {
+		t.Fatalf("Unexpected error in AddMigration: %s", err.Error())
+	}
+	if err := oldModels.Migrate(); err != nil {
+		t.Fatalf("Unexpected error in Migrate: %s", err.Error())
+	}
+	expectFieldEquals(t, oldModels.ModelKey(resaved.ID), "nick", oldModels.spec.fallback, "fresh")
+	expectIndexMember := func(member string, expected bool) {
+		score, err := conn.Do("ZSCORE", prefix+":nick", member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (score != nil) != expected {
+			t.Errorf("Expected index membership of %q to be %v but it was not", member, expected)
+		}
+	}
+	expectIndexMember("fresh"+nullString+resaved.ID, true)
+	expectIndexMember("nick0"+nullString+resaved.ID, false)
+	for _, model := range models {
+		if exists, err := redis.Bool(conn.Do("HEXISTS", oldModels.ModelKey(model.ID), "Nickname")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected the old field to be removed from model %s", model.ID)
+		}
+	}
+	for _, model := range models[1:] {
+		expectFieldEquals(t, oldModels.ModelKey(model.ID), "nick", oldModels.spec.fallback, model.Nickname)
+		expectIndexMember(model.Nickname+nullString+model.ID, true)
+	}
+	expectKeyDoesNotExist(t, prefix+":Nickname")
+}
+
+func TestRenameFieldUniqueConflict(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	options := DefaultCollectionOptions.WithIndex(true).WithName("renameTestModel")
+	models, err := NewPoolWithOptions(testPool.options).NewCollectionWithOptions(&uniqueTestModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	model := &uniqueTestModel{Email: "taken@example.com"}
+	if err := models.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	// Simulate another model which was saved with the new schema and already
+	// has the same value for the renamed field.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	newUniqueKey := models.spec.keyPrefix() + ":mail:unique"
+	if _, err := conn.Do("HSET", newUniqueKey, model.Email, "otherID"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.AddMigration(Migration{
+		Version: 1,
+		Steps:   []MigrationStep{RenameField("Email", "mail")},
+	}); err != nil {
+		t.Fatalf("Unexpected error in AddMigration: %s", err.Error())
+	}
+	err = models.Migrate()
+	if err == nil || !strings.Contains(err.Error(), "UniqueConstraintError") {
+		t.Fatalf("Expected a UniqueConstraintError from Migrate but got %v", err)
+	}
+	expectMigrationVersion(t, models, 0)
+	// The batch should not have been changed
+	expectFieldEquals(t, models.ModelKey(model.ID), "Email", models.spec.fallback, model.Email)
+	if id, err := redis.String(conn.Do("HGET", newUniqueKey, model.Email)); err != nil {
+		t.Fatal(err)
+	} else if id != "otherID" {
+		t.Errorf("Expected the new unique index to still map %s to otherID but got %s", model.Email, id)
+	}
+}
+
+func TestTransformFieldUpdatesIndexes(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	options := DefaultCollectionOptions.WithIndex(true).WithName("transformTestModel")
+	models, err := NewPoolWithOptions(testPool.options).NewCollectionWithOptions(&uniqueTestModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	saved := []*uniqueTestModel{}
+	for i := 0; i < 3; i++ {
+		nickname := "nick" + strconv.Itoa(i)
+		model := &uniqueTestModel{Email: randomString(), Nickname: &nickname}
+		if err := models.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		saved = append(saved, model)
+	}
+	migration := Migration{
+		Version: 1,
+		Steps: []MigrationStep{
+			TransformField("Nickname", func(value string) (string, error) {
+				return strings.ToUpper(value), nil
+			}),
+		},
+		BatchSize: 2,
+	}
+	if err := models.AddMigration(migration); err != nil {
+		t.Fatalf("Unexpected error in AddMigration: %s", err.Error())
+	}
+	if err := models.Migrate(); err != nil {
+		t.Fatalf("Unexpected error in Migrate: %s", err.Error())
+	}
+
+	// The string index and the unique index should only contain the new values
+	conn := testPool.NewConn()
+	defer conn.Close()
+	uniqueKey := models.spec.keyPrefix() + ":Nickname:unique"
+	for _, model := range saved {
+		newValue := strings.ToUpper(*model.Nickname)
+		ids, err := models.NewQuery().Filter("Nickname =", newValue).IDs()
+		if err != nil {
+			t.Fatalf("Unexpected error in query: %s", err.Error())
+		}
+		if len(ids) != 1 || ids[0] != model.ModelID() {
+			t.Errorf("Expected query for %s to return [%s] but got %v", newValue, model.ModelID(), ids)
+		}
+		id, err := redis.String(conn.Do("HGET", uniqueKey, newValue))
+		if err != nil {
+			t.Fatalf("Unexpected error in HGET: %s", err.Error())
+		}
+		if id != model.ModelID() {
+			t.Errorf("Expected unique index to map %s to %s but got %s", newValue, model.ModelID(), id)
+		}
+		exists, err := redis.Bool(conn.Do("HEXISTS", uniqueKey, *model.Nickname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("Expected unique index to not contain the old value %s", *model.Nickname)
+		}
+	}
+	expectNoIndexProblems(t, models)
+}
+
+func TestMigrationInProgress(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	_, newModels := createMigrationTestCollections(t)
+	if err := newModels.AddMigration(Migration{Version: 1}); err != nil {
+		t.Fatalf("Unexpected error in AddMigration: %s", err.Error())
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("SET", newModels.spec.migrationLockKey(), "someoneElse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newModels.Migrate(); err == nil {
+		t.Errorf("Expected a MigrationInProgressError but got none")
+	} else if _, ok := err.(MigrationInProgressError); !ok {
+		t.Errorf("Expected a MigrationInProgressError but got %T: %s", err, err.Error())
+	}
+	owner, err := redis.String(conn.Do("GET", newModels.spec.migrationLockKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "someoneElse" {
+		t.Errorf("Expected the lock to be unchanged but got %s", owner)
+	}
+	expectMigrationVersion(t, newModels, 0)
+}
+
+// migrationOldModel and migrationNewModel are two versions of the same model
+// type, used for testing migrations.
+type migrationOldModel struct {
+	Name     string `redis:"name"`
+	Age      int
+	Nickname string `zoom:"index"`
+	RandomID
+}
+
+type migrationNewModel struct {
+	FullName string `redis:"full_name"`
+	Age      int    `zoom:"index"`
+	Nickname string
+	RandomID
+}
+
+// createMigrationTestCollections returns two collections with the same name
+// which use migrationOldModel and migrationNewModel respectively. Each
+// collection belongs to its own pool, since a pool can only have one
+// collection with a given name.
+func createMigrationTestCollections(t *testing.T) (*Collection, *Collection) {
+	options := DefaultCollectionOptions.WithIndex(true).WithName("migrationTestModel")
+	oldModels, err := NewPoolWithOptions(testPool.options).NewCollectionWithOptions(&migrationOldModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	newModels, err := NewPoolWithOptions(testPool.options).NewCollectionWithOptions(&migrationNewModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	return oldModels, newModels
+}
+
+// expectMigrationVersion reports an error if the version of the last migration
+// that was completed for the collection is not expected.
+func expectMigrationVersion(t *testing.T, collection *Collection, expected int) {
+	version, err := collection.MigrationVersion()
+	if err != nil {
+		t.Fatalf("Unexpected error in MigrationVersion: %s", err.Error())
+	}
+	if version != expected {
+		t.Errorf("Expected migration version to be %d but got %d", expected, version)
+	}
+}
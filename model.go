@@ -54,6 +54,12 @@ type modelSpec struct {
 	fieldsByName map[string]*fieldSpec
 	fields       []*fieldSpec
 	fallback     MarshalerUnmarshaler
+	// cluster is true if the spec belongs to a pool in cluster mode, in which
+	// case the name is wrapped in a hash tag in every key.
+	cluster bool
+	// versionField is the field with the `zoom:"version"` struct tag, or nil if
+	// there is no such field.
+	versionField *fieldSpec
 }
 
 // fieldSpec contains parsed information about a particular field.
@@ -63,18 +69,31 @@ type fieldSpec struct {
 	redisName string
 	typ       reflect.Type
 	indexKind indexKind
+	// unique is true iff the field has the `zoom:"unique"` struct tag, in which
+	// case no two models in the collection may have the same value for it.
+	unique bool
+	// refType is the type of the related model for reference fields, i.e.
+	// fields with the `zoom:"ref"` struct tag. It is nil for all other fields.
+	refType reflect.Type
 }
 
 // fieldKind is the kind of a particular field, and is either a primitive,
-// a pointer, or an inconvertible.
+// a pointer, an inconvertible, or a reference to one or more other models.
 type fieldKind int
 
 const (
 	primativeField     fieldKind = iota // any primitive type
 	pointerField                        // pointer to any primitive type
 	inconvertibleField                  // all other types
+	referenceField                      // pointer to another model, stored as its id
+	referencesField                     // slice of pointers to other models, stored as a set of ids
 )
 
+// isReference returns true iff fs is a reference to one or more other models.
+func (fs *fieldSpec) isReference() bool {
+	return fs.kind == referenceField || fs.kind == referencesField
+}
+
 // indexKind is the kind of an index, and is either noIndex, numericIndex,
 // stringIndex, or booleanIndex.
 type indexKind int
@@ -129,23 +148,46 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 			fs.redisName = fs.name
 		}
 
-		// Parse the "zoom" tag (currently only "index" is supported)
+		// Parse the "zoom" tag (currently "index", "unique", "ref", and "version"
+		// are supported)
 		zoomTag := tag.Get("zoom")
 		shouldIndex := false
+		isRef := false
+		isVersion := false
 		if zoomTag != "" {
 			options := strings.Split(zoomTag, ",")
 			for _, op := range options {
 				switch op {
 				case "index":
 					shouldIndex = true
+				case "unique":
+					fs.unique = true
+				case "ref":
+					isRef = true
+				case "version":
+					isVersion = true
 				default:
 					return nil, fmt.Errorf("zoom: unrecognized option specified in struct tag: %s", op)
 				}
 			}
 		}
 
+		if isVersion {
+			if err := setVersionField(ms, fs, field.Type, isRef); err != nil {
+				return nil, err
+			}
+		}
+
 		// Detect the kind of the field and (if applicable) the kind of the index
-		if typeIsPrimative(field.Type) {
+		if isRef {
+			// Reference to one or more other models
+			if shouldIndex || fs.unique {
+				return nil, fmt.Errorf("zoom: the index and unique options cannot be used together with the ref option (%s.%s)", typ.String(), field.Name)
+			}
+			if err := setReferenceKind(fs, field.Type); err != nil {
+				return nil, err
+			}
+		} else if typeIsPrimative(field.Type) {
 			// Primitive
 			fs.kind = primativeField
 			if shouldIndex {
@@ -166,6 +208,9 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 			if shouldIndex {
 				return nil, fmt.Errorf("zoom: Requested index on unsupported type %s", field.Type)
 			}
+			if fs.unique {
+				return nil, fmt.Errorf("zoom: Requested unique constraint on unsupported type %s", field.Type)
+			}
 			fs.kind = inconvertibleField
 		}
 	}
@@ -185,6 +230,44 @@ func getDefaultModelSpecName(typ reflect.Type) string {
 	return strings.Join(strings.Split(nameWithPackage, ".")[1:], "")
 }
 
+// setReferenceKind sets the kind and refType fields of fs based on fieldType,
+// which must be either a pointer to a struct that implements Model or a slice of
+// pointers to structs that implement Model.
+func setReferenceKind(fs *fieldSpec, fieldType reflect.Type) error {
+	modelType := reflect.TypeOf((*Model)(nil)).Elem()
+	switch {
+	case typeIsPointerToStruct(fieldType) && fieldType.Implements(modelType):
+		fs.kind = referenceField
+		fs.refType = fieldType
+	case fieldType.Kind() == reflect.Slice && typeIsPointerToStruct(fieldType.Elem()) && fieldType.Elem().Implements(modelType):
+		fs.kind = referencesField
+		fs.refType = fieldType.Elem()
+	default:
+		return fmt.Errorf("zoom: the ref option is only allowed on fields which are pointers to models or slices of pointers to models. Got type %s", fieldType.String())
+	}
+	return nil
+}
+
+// setVersionField sets the versionField of ms to fs, after making sure fs can
+// be used as a version field. Version fields must be integers, and a model can
+// have at most one of them.
+func setVersionField(ms *modelSpec, fs *fieldSpec, fieldType reflect.Type, isRef bool) error {
+	if ms.versionField != nil {
+		return fmt.Errorf("zoom: the version option can only be used on one field (%s.%s and %s.%s)", ms.typ.String(), ms.versionField.name, ms.typ.String(), fs.name)
+	}
+	if isRef || fs.unique {
+		return fmt.Errorf("zoom: the unique and ref options cannot be used together with the version option (%s.%s)", ms.typ.String(), fs.name)
+	}
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("zoom: the version option is only allowed on integer fields. Got type %s", fieldType.String())
+	}
+	ms.versionField = fs
+	return nil
+}
+
 // setIndexKind sets the indexKind field of fs based on fieldType.
 func setIndexKind(fs *fieldSpec, fieldType reflect.Type) error {
 	switch {
@@ -200,10 +283,43 @@ func setIndexKind(fs *fieldSpec, fieldType reflect.Type) error {
 	return nil
 }
 
+// keyPrefix returns the prefix for every key used to store models of the given
+// type. It is the name of the spec, or if the spec belongs to a pool in cluster
+// mode, the name wrapped in a hash tag (e.g. "{Person}"). The hash tag causes
+// all the keys for a collection to be stored in the same hash slot.
+func (ms *modelSpec) keyPrefix() string {
+	if ms.cluster {
+		return "{" + ms.name + "}"
+	}
+	return ms.name
+}
+
 // allIndexKey returns a key which is used in redis to store all the ids of every model of a
 // given type
 func (ms *modelSpec) indexKey() string {
-	return ms.name + ":all"
+	return ms.keyPrefix() + ":all"
+}
+
+// expireKey returns the key for the sorted set which contains the ids of every
+// model of the given type which will expire, scored by their expiration time as
+// a unix timestamp in milliseconds.
+func (ms *modelSpec) expireKey() string {
+	return ms.keyPrefix() + ":expire"
+}
+
+// expireValuesKey returns the key for the hash which contains the values of
+// any fields with a string index or a unique constraint for every model of the
+// given type which will expire. The values are needed to remove a model from
+// those indexes after Redis has removed its main hash.
+func (ms *modelSpec) expireValuesKey() string {
+	return ms.keyPrefix() + ":expire:values"
+}
+
+// deletedKey returns the key for the sorted set which contains the ids of every
+// soft deleted model of the given type, scored by the time they were deleted as
+// a unix timestamp in milliseconds.
+func (ms *modelSpec) deletedKey() string {
+	return ms.keyPrefix() + ":deleted"
 }
 
 // modelKey returns the key that identifies a hash in the database
@@ -213,7 +329,24 @@ func (ms *modelSpec) modelKey(id string) (string, error) {
 	if id == "" {
 		return "", fmt.Errorf("zoom: Error in modelKey: id was empty")
 	}
-	return ms.name + ":" + id, nil
+	return ms.keyPrefix() + ":" + id, nil
+}
+
+// reservedIDs are the ids which cannot be used for models, because the key for
+// the main hash would be the same as one of the other keys for the collection,
+// e.g. the set of all ids or the sorted set of expiration times. Ids which
+// start with one of them followed by a colon are reserved as well.
+var reservedIDs = []string{"all", "expire", "deleted", "migrations"}
+
+// checkModelID returns an error if id is one of the reservedIDs, or starts with
+// one of them followed by a colon.
+func (ms *modelSpec) checkModelID(id string) error {
+	for _, reserved := range reservedIDs {
+		if id == reserved || strings.HasPrefix(id, reserved+":") {
+			return fmt.Errorf("id %q is reserved because the key for the model would collide with the key %s used by the collection", id, ms.keyPrefix()+":"+reserved)
+		}
+	}
+	return nil
 }
 
 // fieldNames returns all the field names for the given modelSpec
@@ -251,6 +384,31 @@ func (ms modelSpec) redisNamesForFieldNames(fieldNames []string) ([]string, erro
 	return redisNames, nil
 }
 
+// uniqueIndexKey returns the key for the hash which maps each value of the
+// given unique field to the id of the model which has that value.
+func (ms *modelSpec) uniqueIndexKey(fs *fieldSpec) string {
+	return ms.keyPrefix() + ":" + fs.redisName + ":unique"
+}
+
+// referencesKey returns the key for the set which contains the ids of the
+// models referenced by the given field of the model with the given id. fs must
+// be a referencesField.
+func (ms *modelSpec) referencesKey(id string, fs *fieldSpec) string {
+	return ms.keyPrefix() + ":" + id + ":" + fs.redisName
+}
+
+// referencesFieldRedisNames returns the redis names for each field in ms which
+// is a reference to many other models.
+func (ms *modelSpec) referencesFieldRedisNames() []string {
+	names := []string{}
+	for _, fs := range ms.fields {
+		if fs.kind == referencesField {
+			names = append(names, fs.redisName)
+		}
+	}
+	return names
+}
+
 // fieldIndexKey returns the key for the sorted set used to index the field identified
 // by fieldName. It returns an error if fieldName does not identify a field in the spec
 // or if the field it identifies is not an indexed field.
@@ -261,7 +419,7 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 	} else if fs.indexKind == noIndex {
 		return "", fmt.Errorf("%s.%s is not an indexed field", ms.typ.Name(), fieldName)
 	}
-	return ms.name + ":" + fs.redisName, nil
+	return ms.keyPrefix() + ":" + fs.redisName, nil
 }
 
 // sortArgs returns arguments that can be used to get all the fields in includeFields
@@ -275,7 +433,7 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 func (ms *modelSpec) sortArgs(idsKey string, redisFieldNames []string, limit int, offset uint, reverse bool) redis.Args {
 	args := redis.Args{idsKey, "BY", "nosort"}
 	for _, fieldName := range redisFieldNames {
-		args = append(args, "GET", ms.name+":*->"+fieldName)
+		args = append(args, "GET", ms.keyPrefix()+":*->"+fieldName)
 	}
 	// We always want to get the id
 	args = append(args, "GET", "#")
@@ -352,7 +510,7 @@ func (mr *modelRef) fieldValue(name string) reflect.Value {
 
 // key returns a key which is used in redis to store the model
 func (mr *modelRef) key() string {
-	return mr.spec.name + ":" + mr.model.ModelID()
+	return mr.spec.keyPrefix() + ":" + mr.model.ModelID()
 }
 
 // mainHashArgs returns the args for the main hash for this model. Typically
@@ -388,6 +546,17 @@ func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (redis.Args, erro
 			} else {
 				args = args.Add(fs.redisName, "NULL")
 			}
+		case referenceField:
+			// Only the id of the related model is stored
+			if !fieldVal.IsNil() {
+				args = args.Add(fs.redisName, fieldVal.Interface().(Model).ModelID())
+			} else {
+				args = args.Add(fs.redisName, "NULL")
+			}
+		case referencesField:
+			// The ids of the related models are stored in a separate set. See
+			// Transaction.saveReferences.
+			continue
 		case inconvertibleField:
 			switch fieldVal.Type().Kind() {
 			// For nilable types that are nil store NULL
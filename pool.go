@@ -9,6 +9,11 @@
 package zoom
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"time"
 
@@ -27,29 +32,70 @@ type Pool struct {
 	modelTypeToSpec map[reflect.Type]*modelSpec
 	// modelNameToSpec maps a registered model name to a modelSpec
 	modelNameToSpec map[string]*modelSpec
+	// cluster routes connections to the nodes of a Redis Cluster. It is nil
+	// unless options.Cluster is true.
+	cluster *cluster
+	// replicaPools are the pools of connections to each of the replicas in
+	// options.ReplicaAddresses.
+	replicaPools []*redis.Pool
+	// nextReplica is used to choose replicas in round-robin order. It must be
+	// accessed atomically.
+	nextReplica uint32
 }
 
 // DefaultPoolOptions is the default set of options for a Pool.
 var DefaultPoolOptions = PoolOptions{
-	Address:     "localhost:6379",
-	Database:    0,
-	IdleTimeout: 240 * time.Second,
-	MaxActive:   1000,
-	MaxIdle:     1000,
-	Network:     "tcp",
-	Password:    "",
-	Wait:        true,
+	Address:           "localhost:6379",
+	ClientName:        "",
+	Cluster:           false,
+	Database:          0,
+	IdleTimeout:       240 * time.Second,
+	MasterName:        "",
+	MaxActive:         1000,
+	MaxIdle:           1000,
+	Network:           "tcp",
+	Password:          "",
+	ReadYourWrites:    0,
+	ReplicaAddresses:  nil,
+	SentinelAddresses: nil,
+	SentinelPassword:  "",
+	TLSConfig:         nil,
+	Username:          "",
+	Wait:              true,
 }
 
 // PoolOptions contains various options for a pool.
 type PoolOptions struct {
-	// Address to use when connecting to Redis.
+	// Address to use when connecting to Redis. In cluster mode, it is the
+	// address of any node in the cluster, which is used to discover the rest of
+	// the nodes. It is ignored if MasterName is set.
 	Address string
+	// ClientName is the name of every connection, as shown by CLIENT LIST. If
+	// not empty, every connection will use the CLIENT SETNAME command during
+	// initialization.
+	ClientName string
+	// Cluster indicates whether or not to connect to a Redis Cluster. In cluster
+	// mode, the keys for each collection share a hash tag (e.g. "{Person}"), so
+	// that they are all stored in the same hash slot. Connections are routed to
+	// the node which serves the hash slot for the keys involved, and MOVED and
+	// ASK redirects are followed automatically. A transaction which involves
+	// keys in more than one hash slot (e.g. keys for more than one collection)
+	// is split into one MULTI/EXEC per slot, so it is only atomic within each
+	// slot: if a later part fails, the earlier parts stay committed. See
+	// Transaction.Exec. Database must be 0 in cluster mode.
+	Cluster bool
 	// Database id to use (using SELECT).
 	Database int
 	// IdleTimeout is the amount of time to wait before timing out (closing) idle
 	// connections.
 	IdleTimeout time.Duration
+	// MasterName is the name of the master to connect to using Redis Sentinel.
+	// If not empty, the address of the current master is discovered by asking
+	// the sentinels at SentinelAddresses, and every connection is checked with
+	// the ROLE command when it is taken from the pool. If the master fails over,
+	// connections to the old master are discarded and new connections are made
+	// to the new master. MasterName cannot be used in cluster mode.
+	MasterName string
 	// MaxActive is the maximum number of active connections the pool will keep.
 	// A value of 0 means unlimited.
 	MaxActive int
@@ -62,6 +108,38 @@ type PoolOptions struct {
 	// every connection will use the AUTH command during initialization
 	// to authenticate with the database.
 	Password string
+	// ReadYourWrites is how long read-only transactions are sent to the primary
+	// instead of a replica after a write in the same session (see WithSession).
+	// It should be longer than the typical replication lag, so that reads always
+	// see the effects of the session's recent writes. Transactions which are
+	// not executed in a session are always sent to a replica. A value of 0 means
+	// reads are always sent to a replica.
+	ReadYourWrites time.Duration
+	// ReplicaAddresses are the addresses of replicas of the primary at Address.
+	// If not empty, transactions which only consist of read-only commands (e.g.
+	// Find, FindAll, Count, and queries without filters) are load-balanced
+	// across the replicas. All other transactions, including those that watch
+	// keys or include scripts, are sent to the primary. ReplicaAddresses are
+	// ignored in cluster mode.
+	ReplicaAddresses []string
+	// Username is the name of the ACL user to authenticate as (Redis 6 and
+	// above). If not empty, every connection will use the AUTH command with
+	// both Username and Password during initialization.
+	Username string
+	// SentinelAddresses are the addresses of the sentinels which monitor the
+	// master identified by MasterName. They are asked for the address of the
+	// master in order until one of them replies.
+	SentinelAddresses []string
+	// SentinelPassword is the password for the sentinels at SentinelAddresses,
+	// which might differ from Password. If not empty, every connection to a
+	// sentinel will use the AUTH command to authenticate with the sentinel.
+	SentinelPassword string
+	// TLSConfig is the configuration for connecting to Redis over TLS. If nil,
+	// TLS is not used. If TLSConfig.ServerName is empty, the host from the
+	// address is used to verify the certificate of the server. NewTLSConfig can
+	// be used to create a TLSConfig from certificate files. TLSConfig also
+	// applies to the connections to sentinels.
+	TLSConfig *tls.Config
 	// Wait indicates whether or not the pool should wait for a free connection
 	// if the MaxActive limit has been reached. If Wait is false and the
 	// MaxActive limit is reached, Zoom will return an error indicating that the
@@ -76,6 +154,20 @@ func (options PoolOptions) WithAddress(address string) PoolOptions {
 	return options
 }
 
+// WithCluster returns a new copy of the options with the Cluster property set
+// to the given value. It does not mutate the original options.
+func (options PoolOptions) WithCluster(cluster bool) PoolOptions {
+	options.Cluster = cluster
+	return options
+}
+
+// WithClientName returns a new copy of the options with the ClientName property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithClientName(name string) PoolOptions {
+	options.ClientName = name
+	return options
+}
+
 // WithDatabase returns a new copy of the options with the Database property set
 // to the given value. It does not mutate the original options.
 func (options PoolOptions) WithDatabase(database int) PoolOptions {
@@ -90,6 +182,13 @@ func (options PoolOptions) WithIdleTimeout(timeout time.Duration) PoolOptions {
 	return options
 }
 
+// WithMasterName returns a new copy of the options with the MasterName
+// property set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithMasterName(masterName string) PoolOptions {
+	options.MasterName = masterName
+	return options
+}
+
 // WithMaxActive returns a new copy of the options with the MaxActive property
 // set to the given value. It does not mutate the original options.
 func (options PoolOptions) WithMaxActive(maxActive int) PoolOptions {
@@ -118,6 +217,51 @@ func (options PoolOptions) WithPassword(password string) PoolOptions {
 	return options
 }
 
+// WithReadYourWrites returns a new copy of the options with the ReadYourWrites
+// property set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithReadYourWrites(window time.Duration) PoolOptions {
+	options.ReadYourWrites = window
+	return options
+}
+
+// WithReplicaAddresses returns a new copy of the options with the
+// ReplicaAddresses property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithReplicaAddresses(addresses ...string) PoolOptions {
+	options.ReplicaAddresses = addresses
+	return options
+}
+
+// WithSentinelAddresses returns a new copy of the options with the
+// SentinelAddresses property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithSentinelAddresses(addresses ...string) PoolOptions {
+	options.SentinelAddresses = addresses
+	return options
+}
+
+// WithSentinelPassword returns a new copy of the options with the
+// SentinelPassword property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithSentinelPassword(password string) PoolOptions {
+	options.SentinelPassword = password
+	return options
+}
+
+// WithTLSConfig returns a new copy of the options with the TLSConfig property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithTLSConfig(config *tls.Config) PoolOptions {
+	options.TLSConfig = config
+	return options
+}
+
+// WithUsername returns a new copy of the options with the Username property set
+// to the given value. It does not mutate the original options.
+func (options PoolOptions) WithUsername(username string) PoolOptions {
+	options.Username = username
+	return options
+}
+
 // WithWait returns a new copy of the options with the Wait property set to the
 // given value. It does not mutate the original options.
 func (options PoolOptions) WithWait(wait bool) PoolOptions {
@@ -141,19 +285,62 @@ func NewPoolWithOptions(options PoolOptions) *Pool {
 		modelTypeToSpec: map[reflect.Type]*modelSpec{},
 		modelNameToSpec: map[string]*modelSpec{},
 	}
-	pool.redisPool = &redis.Pool{
+	pool.redisPool = newRedisPool(options)
+	if options.Cluster {
+		pool.cluster = newCluster(options, pool.redisPool)
+	} else {
+		for _, address := range options.ReplicaAddresses {
+			replicaOptions := options.WithAddress(address).WithMasterName("")
+			pool.replicaPools = append(pool.replicaPools, newRedisPool(replicaOptions))
+		}
+	}
+	return pool
+}
+
+// newRedisPool returns a redis.Pool which connects to options.Address using
+// the given options, or to the current master if options.MasterName is set.
+func newRedisPool(options PoolOptions) *redis.Pool {
+	var sentinel *sentinel
+	if options.MasterName != "" && !options.Cluster {
+		sentinel = newSentinel(options)
+	}
+	redisPool := &redis.Pool{
 		MaxIdle:     options.MaxIdle,
 		MaxActive:   options.MaxActive,
 		IdleTimeout: options.IdleTimeout,
 		Wait:        options.Wait,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial(options.Network, options.Address)
+			address := options.Address
+			if sentinel != nil {
+				// Ask the sentinels for the address of the current master
+				var err error
+				if address, err = sentinel.masterAddress(); err != nil {
+					return nil, err
+				}
+			}
+			c, err := dial(options, address)
 			if err != nil {
 				return nil, err
 			}
-			// If a options.Password was provided, use the AUTH command to authenticate
-			if options.Password != "" {
+			// If options.Username was provided, use the AUTH command to authenticate
+			// as an ACL user. Otherwise, if options.Password was provided, use the
+			// AUTH command to authenticate with the password alone.
+			if options.Username != "" {
+				if _, err := c.Do("AUTH", options.Username, options.Password); err != nil {
+					_ = c.Close()
+					return nil, err
+				}
+			} else if options.Password != "" {
 				if _, err := c.Do("AUTH", options.Password); err != nil {
+					_ = c.Close()
+					return nil, err
+				}
+			}
+			// If options.ClientName was provided, use the CLIENT SETNAME command to
+			// set the name of the connection
+			if options.ClientName != "" {
+				if _, err := c.Do("CLIENT", "SETNAME", options.ClientName); err != nil {
+					_ = c.Close()
 					return nil, err
 				}
 			}
@@ -162,23 +349,129 @@ func NewPoolWithOptions(options PoolOptions) *Pool {
 				_ = c.Close()
 				return nil, err
 			}
+			// The sentinels might not have noticed a failover yet, so make sure we
+			// actually connected to the master
+			if sentinel != nil {
+				if err := checkMasterRole(c); err != nil {
+					_ = c.Close()
+					return nil, err
+				}
+			}
 			return c, err
 		},
 	}
-	return pool
+	if sentinel != nil {
+		// Discard any connections to a master which has since been demoted
+		redisPool.TestOnBorrow = func(c redis.Conn, _ time.Time) error {
+			return checkMasterRole(c)
+		}
+	}
+	return redisPool
+}
+
+// dial connects to Redis at the given address, using TLS if options.TLSConfig
+// is not nil.
+func dial(options PoolOptions, address string) (redis.Conn, error) {
+	return dialTimeout(options, address, 0)
+}
+
+// dialTimeout is like dial, but if timeout is not 0, connecting (including the
+// TLS handshake) and every read and write on the connection must be finished
+// within timeout. It is used for short-lived connections, e.g. to sentinels.
+func dialTimeout(options PoolOptions, address string, timeout time.Duration) (redis.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	netConn, err := dialer.Dial(options.Network, address)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := netConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			_ = netConn.Close()
+			return nil, err
+		}
+	}
+	if options.TLSConfig == nil {
+		return newDialedConn(netConn), nil
+	}
+	config := options.TLSConfig
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		// Verify the certificate using the host from the address
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(netConn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	return newDialedConn(tlsConn), nil
+}
+
+// NewTLSConfig returns a TLS configuration which can be used for the TLSConfig
+// option. caFile is the path to a PEM encoded file containing the certificates
+// of the certificate authorities used to verify the server. If empty, the
+// certificate authorities of the host are used. certFile and keyFile are the
+// paths to a PEM encoded certificate and private key which are used for client
+// authentication. They may both be empty if the server does not require client
+// authentication.
+func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		caCerts, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("zoom: Could not parse any certificates from %s", caFile)
+		}
+	}
+	return config, nil
 }
 
 // NewConn gets a connection from the pool and returns it.
 // It can be used for directly interacting with the database. See
 // http://godoc.org/github.com/garyburd/redigo/redis for full documentation
 // on the redis.Conn type. You must call Close on any connections after you are
-// done using them. Failure to call Close can cause a resource leak.
+// done using them. Failure to call Close can cause a resource leak. In cluster
+// mode, NewConn returns a connection to the node at options.Address, which
+// might not serve the keys you are interested in. Use NewConnForKey instead.
 func (p *Pool) NewConn() redis.Conn {
 	return p.redisPool.Get()
 }
 
+// NewConnForKey gets a connection from the pool and returns it. In cluster
+// mode, the connection is to the node which serves the hash slot for the given
+// key. Otherwise it is equivalent to NewConn. Just like with NewConn, you must
+// call Close on any connections after you are done using them.
+func (p *Pool) NewConnForKey(key string) redis.Conn {
+	if p.cluster == nil {
+		return p.NewConn()
+	}
+	return p.cluster.connForSlot(keySlot(key))
+}
+
 // Close closes the pool. It should be run whenever the pool is no longer
 // needed. It is often used in conjunction with defer.
 func (p *Pool) Close() error {
+	if p.cluster != nil {
+		return p.cluster.close()
+	}
+	for _, replicaPool := range p.replicaPools {
+		if err := replicaPool.Close(); err != nil {
+			return err
+		}
+	}
 	return p.redisPool.Close()
 }
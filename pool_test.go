@@ -0,0 +1,242 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File pool_test.go tests the code in pool.go, including the options for TLS,
+// ACL authentication, and client names.
+
+package zoom
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestTLSAndAuthOptions(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	dir, err := ioutil.TempDir("", "zoom-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := writeTestCertificate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := newTLSTestProxy(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.close()
+
+	// The certificate of the proxy is self-signed, so it doubles as the CA
+	config, err := NewTLSConfig("", "", certFile)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewTLSConfig: %s", err.Error())
+	}
+	options := testPool.options.
+		WithAddress(proxy.address()).
+		WithTLSConfig(config).
+		WithUsername("zoom").
+		WithPassword("secret").
+		WithClientName("zoom-test")
+	pool := NewPoolWithOptions(options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	conn := pool.NewConn()
+	defer conn.Close()
+	name, err := redis.String(conn.Do("CLIENT", "GETNAME"))
+	if err != nil {
+		t.Fatalf("Unexpected error in CLIENT GETNAME: %s", err.Error())
+	}
+	if name != "zoom-test" {
+		t.Errorf("Expected client name to be zoom-test but got %s", name)
+	}
+	expectedAuth := []string{"AUTH", "zoom", "secret"}
+	if got := proxy.authArgs(); !reflect.DeepEqual(expectedAuth, got) {
+		t.Errorf("Expected AUTH command to be %v but got %v", expectedAuth, got)
+	}
+
+	// Connecting without trusting the certificate should fail
+	untrustedPool := NewPoolWithOptions(options.WithTLSConfig(&tls.Config{}))
+	defer func() {
+		_ = untrustedPool.Close()
+	}()
+	untrustedConn := untrustedPool.NewConn()
+	defer untrustedConn.Close()
+	if _, err := untrustedConn.Do("PING"); err == nil {
+		t.Errorf("Expected error when connecting to a server with an untrusted certificate but got none")
+	}
+}
+
+func TestTLSServer(t *testing.T) {
+	if *tlsAddress == "" {
+		t.Skip("Skipping TLS server test because the -tls-address flag was not set")
+	}
+	config, err := NewTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsCAFile)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewTLSConfig: %s", err.Error())
+	}
+	options := DefaultPoolOptions.
+		WithAddress(*tlsAddress).
+		WithDatabase(*database).
+		WithTLSConfig(config).
+		WithUsername(*username).
+		WithPassword(*password).
+		WithClientName("zoom-test")
+	pool := NewPoolWithOptions(options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	conn := pool.NewConn()
+	defer conn.Close()
+	name, err := redis.String(conn.Do("CLIENT", "GETNAME"))
+	if err != nil {
+		t.Fatalf("Unexpected error in CLIENT GETNAME: %s", err.Error())
+	}
+	if name != "zoom-test" {
+		t.Errorf("Expected client name to be zoom-test but got %s", name)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for localhost and
+// 127.0.0.1 and the corresponding private key to dir.
+func writeTestCertificate(dir string) (certFile string, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zoom-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// tlsTestProxy is a TLS server which forwards connections to the testing
+// database. It accepts any AUTH command sent as the first command on a
+// connection and records its arguments, since the testing database might not
+// have any ACL users.
+type tlsTestProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	auth     []string
+}
+
+// newTLSTestProxy starts a tlsTestProxy which uses the given certificate and
+// private key.
+func newTLSTestProxy(certFile, keyFile string) (*tlsTestProxy, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	proxy := &tlsTestProxy{listener: listener}
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (proxy *tlsTestProxy) address() string {
+	return proxy.listener.Addr().String()
+}
+
+func (proxy *tlsTestProxy) close() {
+	_ = proxy.listener.Close()
+}
+
+func (proxy *tlsTestProxy) authArgs() []string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.auth
+}
+
+func (proxy *tlsTestProxy) serve() {
+	for {
+		conn, err := proxy.listener.Accept()
+		if err != nil {
+			return
+		}
+		go proxy.handle(conn)
+	}
+}
+
+func (proxy *tlsTestProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	args, err := readFakeCommand(reader)
+	if err != nil {
+		return
+	}
+	backend, err := net.Dial(*network, *address)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+	if strings.ToUpper(args[0]) == "AUTH" {
+		proxy.mutex.Lock()
+		proxy.auth = args
+		proxy.mutex.Unlock()
+		fmt.Fprint(conn, "+OK\r\n")
+	} else {
+		// Forward the command as is
+		fmt.Fprintf(backend, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(backend, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	go func() {
+		_, _ = io.Copy(conn, backend)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(backend, reader)
+}
@@ -1,5 +1,7 @@
 package zoom
 
+import "context"
+
 // Query represents a query which will retrieve some models from
 // the database. A Query may consist of one or more query modifiers
 // (e.g. Filter or Order) and may be executed with a query finisher
@@ -25,12 +27,14 @@ func (collection *Collection) NewQuery() *Query {
 // constructor. By default, the records are sorted by ascending order by the
 // given field. To sort by descending order, put a negative sign before the
 // field name. Zoom can only sort by fields which have been indexed, i.e. those
-// which have the `zoom:"index"` struct tag. Only one order may be specified per
-// Order will set an error on the query if the fieldName is invalid, if another
-// order has already been applied to the query, or if the fieldName specified
-// does not correspond to an indexed field. The error, same as any other error
-// that occurs during the lifetime of the query, is not returned until the query
-// is executed.
+// which have the `zoom:"index"` struct tag. Order may be called more than once
+// to specify secondary orders. For example, Order("-Priority").Order("Name")
+// would sort by Priority in descending order, and then sort models with the
+// same Priority by Name in ascending order. Order will set an error on the
+// query if the fieldName is invalid, if the same field has already been used to
+// order the query, or if the fieldName specified does not correspond to an
+// indexed field. The error, same as any other error that occurs during the
+// lifetime of the query, is not returned until the query is executed.
 func (q *Query) Order(fieldName string) *Query {
 	q.query.Order(fieldName)
 	return q
@@ -82,47 +86,231 @@ func (q *Query) Exclude(fields ...string) *Query {
 // be an expression which includes a fieldName, a space, and an operator in that
 // order. For example: Filter("Age >=", 30) would only return models which have
 // an Age value greater than or equal to 30. Operators must be one of "=", "!=",
-// ">", "<", ">=", or "<=". You can only use Filter on fields which are indexed,
-// i.e. those which have the `zoom:"index"` struct tag. If multiple filters are
-// applied to the same query, the query will only return models which have
-// matches for *all* of the filters. Filter will set an error on the query if
-// the arguments are improperly formated, if the field you are attempting to
-// filter is not indexed, or if the type of value does not match the type of the
-// field. The error, same as any other error that occurs during the lifetime of
-// the query, is not returned until the query is executed.
+// ">", "<", ">=", "<=", "IN", "NOT IN", "PREFIX", or "BETWEEN". The IN and
+// NOT IN operators expect a slice or array of values, each of which has the
+// same type as the field. For example:
+// Filter("Status IN", []string{"open", "pending"}) would only return models
+// which have a Status of either "open" or "pending". Like "!=", "NOT IN" only
+// matches models which have a value for the field. The PREFIX operator only
+// works on string fields and matches values which start with the given string,
+// e.g. Filter("Name PREFIX", "ali"). The BETWEEN operator expects a Range and
+// matches values inside of it, e.g. Filter("Age BETWEEN", zoom.Range{Min: 18,
+// Max: 65, ExcludeMax: true}). Operators are not case sensitive. You can only
+// use Filter on fields which are indexed, i.e. those which have the
+// `zoom:"index"` struct tag. If multiple filters are applied to the same query,
+// the query will only return models which have matches for *all* of the
+// filters. Filter will set an error on the query if the arguments are
+// improperly formated, if the field you are attempting to filter is not
+// indexed, or if the type of value does not match the type of the field. The
+// error, same as any other error that occurs during the lifetime of the query,
+// is not returned until the query is executed.
 func (q *Query) Filter(filterString string, value interface{}) *Query {
 	q.query.Filter(filterString, value)
 	return q
 }
 
+// Between is a shorthand for Filter(fieldName+" BETWEEN", Range{Min: min, Max:
+// max}). It causes the query to only return models with a value for the given
+// field that is greater than or equal to min and less than or equal to max.
+// Between works on numeric and string fields and, unlike applying two separate
+// filters, only requires a single temporary set. Use Filter with a Range
+// directly if you need exclusive bounds.
+func (q *Query) Between(fieldName string, min, max interface{}) *Query {
+	q.query.Between(fieldName, min, max)
+	return q
+}
+
+// Range is the value used with the BETWEEN filter operator. Min and Max must
+// have the same type as the field being filtered. By default both bounds are
+// inclusive. Set ExcludeMin or ExcludeMax to make the corresponding bound
+// exclusive. For string fields, values are compared byte by byte.
+type Range struct {
+	Min, Max               interface{}
+	ExcludeMin, ExcludeMax bool
+}
+
+// After causes the query to only return models which come after the position
+// identified by cursor, which should be a cursor returned by RunPage. Unlike
+// Offset, After does not need to skip over the models on previous pages, and
+// models which are saved or deleted between pages will not cause other models
+// to be skipped or returned twice. If cursor is an empty string, After has no
+// effect, so you can use the same code to request the first page. The query
+// must have exactly one order, and it must be the same order that was used by
+// the query which created the cursor. After will set an error on the query if
+// cursor is invalid. The error, same as any other error that occurs during the
+// lifetime of the query, is not returned until the query is executed.
+func (q *Query) After(cursor string) *Query {
+	q.query.After(cursor)
+	return q
+}
+
+// Where applies a filter expression to the query, which will cause the query
+// to only return models which match the expression. Filter expressions can be
+// used to combine filters with a logical OR, which is not possible with Filter
+// alone. For example:
+//
+//	q.Where(zoom.Or(
+//	  zoom.NewFilter("Status =", "open"),
+//	  zoom.NewFilter("Status =", "pending"),
+//	))
+//
+// would only return models with a Status of "open" or "pending". Expressions
+// may be nested to any depth using Or and And. If Where is called more than
+// once, or is used together with Filter, the query will only return models
+// which match *all* of the filters and expressions. Where will set an error on
+// the query if any of the filters in expr are invalid. The error, same as any
+// other error that occurs during the lifetime of the query, is not returned
+// until the query is executed.
+func (q *Query) Where(expr FilterExpr) *Query {
+	q.query.Where(expr)
+	return q
+}
+
+// UsePrimary causes the query to be executed on the primary even if the pool
+// has replicas. Use it when the query needs to see the effects of writes which
+// might not have been replicated yet. Queries which need to store temporary
+// keys in the database (e.g. queries with filters) are always executed on the
+// primary.
+func (q *Query) UsePrimary() *Query {
+	q.query.usePrimary = true
+	return q
+}
+
+// FilterExpr is a filter expression which can be applied to a query with the
+// Where modifier. A FilterExpr is either a single filter, created with
+// NewFilter, or a group of filter expressions combined with a logical OR or
+// AND, created with Or or And respectively. Filter expressions are not checked
+// for validity until they are applied to a query.
+type FilterExpr struct {
+	filterString string
+	value        interface{}
+	group        bool
+	groupOp      groupOp
+	exprs        []FilterExpr
+}
+
+// NewFilter returns a FilterExpr consisting of a single filter. The arguments
+// have exactly the same meaning as the arguments to Query.Filter.
+func NewFilter(filterString string, value interface{}) FilterExpr {
+	return FilterExpr{
+		filterString: filterString,
+		value:        value,
+	}
+}
+
+// Or returns a FilterExpr which matches any model that matches at least one of
+// the given exprs. Internally, the ids matching each expr are combined with
+// ZUNIONSTORE, so sorting and pagination still happen in Redis.
+func Or(exprs ...FilterExpr) FilterExpr {
+	return FilterExpr{
+		group:   true,
+		groupOp: orGroup,
+		exprs:   exprs,
+	}
+}
+
+// And returns a FilterExpr which matches any model that matches all of the
+// given exprs. It is typically used to nest a group of filters inside of Or.
+func And(exprs ...FilterExpr) FilterExpr {
+	return FilterExpr{
+		group:   true,
+		groupOp: andGroup,
+		exprs:   exprs,
+	}
+}
+
+// isGroup returns true iff expr was created with Or or And.
+func (expr FilterExpr) isGroup() bool {
+	return expr.group
+}
+
 // Run executes the query and scans the results into models. The type of models
 // should be a pointer to a slice of Models. If no models fit the criteria, Run
 // will set the length of models to 0 but will *not* return an error. Run will
 // return the first error that occurred during the lifetime of the query (if
 // any), or if models is the wrong type.
 func (q *Query) Run(models interface{}) error {
-	tx := q.pool.NewTransaction()
+	return q.RunContext(context.Background(), models)
+}
+
+// RunContext is like Run but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) RunContext(ctx context.Context, models interface{}) error {
+	tx := q.newTransaction()
 	newTransactionQuery(q.query, tx).Run(models)
-	return tx.Exec()
+	return tx.ExecContext(ctx)
+}
+
+// RunPage is like Run but also returns a cursor which can be passed to After
+// to get the next page of results. The page size is determined by Limit, and
+// the query must have exactly one order. The cursor consists of the value of the
+// order field and the id of the last model in models, so the next page resumes
+// from that position using the field index. The order field will always be
+// scanned into models, even if it was not included. If there are no more pages,
+// the returned cursor will be an empty string. For example:
+//
+//	cursor := ""
+//	for {
+//		people := []*Person{}
+//		q := People.NewQuery().Order("-Age").Limit(100).After(cursor)
+//		next, err := q.RunPage(&people)
+//		if err != nil {
+//			// handle error
+//		}
+//		// do something with people
+//		if next == "" {
+//			break
+//		}
+//		cursor = next
+//	}
+//
+// RunPage will return the first error that occurred during the lifetime of the
+// query (if any), or if models is the wrong type.
+func (q *Query) RunPage(models interface{}) (string, error) {
+	return q.RunPageContext(context.Background(), models)
+}
+
+// RunPageContext is like RunPage but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) RunPageContext(ctx context.Context, models interface{}) (string, error) {
+	tx := q.newTransaction()
+	var nextCursor string
+	newTransactionQuery(q.query, tx).RunPage(models, &nextCursor)
+	if err := tx.ExecContext(ctx); err != nil {
+		return "", err
+	}
+	return nextCursor, nil
 }
 
 // RunOne is exactly like Run but finds only the first model that fits the query
 // criteria and scans the values into model. If no model fits the criteria,
 // RunOne *will* return a ModelNotFoundError.
 func (q *Query) RunOne(model Model) error {
-	tx := q.pool.NewTransaction()
+	return q.RunOneContext(context.Background(), model)
+}
+
+// RunOneContext is like RunOne but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) RunOneContext(ctx context.Context, model Model) error {
+	tx := q.newTransaction()
 	newTransactionQuery(q.query, tx).RunOne(model)
-	return tx.Exec()
+	return tx.ExecContext(ctx)
 }
 
 // Count counts the number of models that would be returned by the query without
 // actually retrieving the models themselves. Count will also return the first
 // error that occurred during the lifetime of the query (if any).
 func (q *Query) Count() (int, error) {
-	tx := q.pool.NewTransaction()
+	return q.CountContext(context.Background())
+}
+
+// CountContext is like Count but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) CountContext(ctx context.Context) (int, error) {
+	tx := q.newTransaction()
 	var count int
 	newTransactionQuery(q.query, tx).Count(&count)
-	if err := tx.Exec(); err != nil {
+	if err := tx.ExecContext(ctx); err != nil {
 		return 0, err
 	}
 	return count, nil
@@ -132,10 +320,16 @@ func (q *Query) Count() (int, error) {
 // models themselves. IDs will return the first error that occurred during the
 // lifetime of the query (if any).
 func (q *Query) IDs() ([]string, error) {
-	tx := q.pool.NewTransaction()
+	return q.IDsContext(context.Background())
+}
+
+// IDsContext is like IDs but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) IDsContext(ctx context.Context) ([]string, error) {
+	tx := q.newTransaction()
 	ids := []string{}
 	newTransactionQuery(q.query, tx).IDs(&ids)
-	if err := tx.Exec(); err != nil {
+	if err := tx.ExecContext(ctx); err != nil {
 		return nil, err
 	}
 	return ids, nil
@@ -144,10 +338,206 @@ func (q *Query) IDs() ([]string, error) {
 // StoreIDs executes the query and stores the model ids matching the query
 // criteria in a list identified by destKey. The list will be completely
 // overwritten, and the model ids stored there will be in the correct order if
-// the query includes an Order modifier. StoreIDs will return the first error
-// that occurred during the lifetime of the query (if any).
+// the query includes an Order modifier. In cluster mode, destKey must be in the
+// same hash slot as the keys for the collection, e.g. by including the name of
+// the collection in curly braces. StoreIDs will return the first error that
+// occurred during the lifetime of the query (if any).
 func (q *Query) StoreIDs(destKey string) error {
-	tx := q.pool.NewTransaction()
+	return q.StoreIDsContext(context.Background(), destKey)
+}
+
+// StoreIDsContext is like StoreIDs but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) StoreIDsContext(ctx context.Context, destKey string) error {
+	tx := q.newTransaction()
 	newTransactionQuery(q.query, tx).StoreIDs(destKey)
-	return tx.Exec()
+	return tx.ExecContext(ctx)
+}
+
+// Delete deletes every model that matches the query criteria and returns the
+// number of models that were deleted. Filters, order, limit, and offset are all
+// taken into account, so for example a query with Order and Limit deletes only
+// the first models in that order. The models are removed from the index of all
+// models and from any field indexes and unique indexes, exactly as if they had
+// been deleted with Collection.Delete. If the collection uses soft deletes,
+// the models are marked as deleted instead. The ids are found and the models are
+// deleted atomically in a single transaction. Delete will return the first
+// error that occurred during the lifetime of the query (if any).
+func (q *Query) Delete() (int, error) {
+	return q.DeleteContext(context.Background())
+}
+
+// DeleteContext is like Delete but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) DeleteContext(ctx context.Context) (int, error) {
+	tx := q.newTransaction()
+	count := 0
+	newTransactionQuery(q.query, tx).Delete(&count)
+	if err := tx.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Update sets the given fields to the given values for every model that
+// matches the query criteria and returns the number of models that were
+// updated. The keys of fieldValues are field names and the values must have the
+// same type as the corresponding fields (numeric values are converted if
+// needed). For a pointer field, the value may also have the type the field
+// points to, and a nil value sets the field to nil. Filters, order, limit, and
+// offset are all taken into account. The models are updated by a Lua script in
+// a single transaction, so Update does not need to retrieve any of the models
+// and is atomic with respect to other callers. Any numeric, boolean, or string
+// indexes on the fields are updated, and if the model has a version field, it
+// is incremented for each updated model. Update returns an error if any of the
+// fields are unique, the version field, or references to many other models.
+// Unlike SaveFields, Update does not change the expiration of models in a
+// collection with a TTL. Update will return the first error that occurred
+// during the lifetime of the query (if any).
+func (q *Query) Update(fieldValues map[string]interface{}) (int, error) {
+	return q.UpdateContext(context.Background(), fieldValues)
+}
+
+// UpdateContext is like Update but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) UpdateContext(ctx context.Context, fieldValues map[string]interface{}) (int, error) {
+	tx := q.newTransaction()
+	count := 0
+	newTransactionQuery(q.query, tx).Update(fieldValues, &count)
+	if err := tx.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Sum returns the sum of the values for the given field for all models that
+// match the query criteria. fieldName must be a numeric field which is indexed,
+// i.e. it has the `zoom:"index"` struct tag. The sum is computed in the database
+// by a Lua script, so none of the models need to be retrieved. Filters, limit,
+// and offset are all taken into account. Models which do not have a value for
+// the field (e.g. because it is a nil pointer) are skipped. If no models match
+// the query criteria, Sum returns 0. Sum will return the first error that
+// occurred during the lifetime of the query (if any), or if fieldName is
+// invalid.
+func (q *Query) Sum(fieldName string) (float64, error) {
+	return q.SumContext(context.Background(), fieldName)
+}
+
+// SumContext is like Sum but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) SumContext(ctx context.Context, fieldName string) (float64, error) {
+	tx := q.newTransaction()
+	var sum float64
+	newTransactionQuery(q.query, tx).Sum(fieldName, &sum)
+	if err := tx.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+// Min returns the minimum value for the given field out of all models that
+// match the query criteria. It works exactly like Sum, except that Min will
+// return a ModelNotFoundError if none of the models which match the query
+// criteria have a value for the field.
+func (q *Query) Min(fieldName string) (float64, error) {
+	return q.MinContext(context.Background(), fieldName)
+}
+
+// MinContext is like Min but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) MinContext(ctx context.Context, fieldName string) (float64, error) {
+	tx := q.newTransaction()
+	var min float64
+	newTransactionQuery(q.query, tx).Min(fieldName, &min)
+	if err := tx.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return min, nil
+}
+
+// Max returns the maximum value for the given field out of all models that
+// match the query criteria. It works exactly like Sum, except that Max will
+// return a ModelNotFoundError if none of the models which match the query
+// criteria have a value for the field.
+func (q *Query) Max(fieldName string) (float64, error) {
+	return q.MaxContext(context.Background(), fieldName)
+}
+
+// MaxContext is like Max but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) MaxContext(ctx context.Context, fieldName string) (float64, error) {
+	tx := q.newTransaction()
+	var max float64
+	newTransactionQuery(q.query, tx).Max(fieldName, &max)
+	if err := tx.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return max, nil
+}
+
+// Avg returns the average (mean) of the values for the given field for all
+// models that match the query criteria. It works exactly like Sum, except that
+// Avg will return a ModelNotFoundError if none of the models which match the
+// query criteria have a value for the field.
+func (q *Query) Avg(fieldName string) (float64, error) {
+	return q.AvgContext(context.Background(), fieldName)
+}
+
+// AvgContext is like Avg but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) AvgContext(ctx context.Context, fieldName string) (float64, error) {
+	tx := q.newTransaction()
+	var avg float64
+	newTransactionQuery(q.query, tx).Avg(fieldName, &avg)
+	if err := tx.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return avg, nil
+}
+
+// CountBy returns a map of each distinct value for the given field to the
+// number of models that match the query criteria and have that value. It is
+// useful for things like counting the number of models with each status.
+// fieldName must be an indexed field, i.e. it has the `zoom:"index"` struct tag.
+// The values are converted to strings. Numeric values are formatted without
+// any unnecessary decimals (e.g. "42" or "3.5") and boolean values are either
+// "true" or "false". The counts are computed in the database by a Lua script,
+// so none of the models need to be retrieved. Filters, limit, and offset are
+// all taken into account. Models which do not have a value for the field (e.g.
+// because it is a nil pointer) are not counted. CountBy will return the first
+// error that occurred during the lifetime of the query (if any), or if
+// fieldName is invalid.
+func (q *Query) CountBy(fieldName string) (map[string]int, error) {
+	return q.CountByContext(context.Background(), fieldName)
+}
+
+// CountByContext is like CountBy but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) CountByContext(ctx context.Context, fieldName string) (map[string]int, error) {
+	tx := q.newTransaction()
+	counts := map[string]int{}
+	newTransactionQuery(q.query, tx).CountBy(fieldName, &counts)
+	if err := tx.ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Distinct returns the distinct values for the given field out of all models
+// that match the query criteria. It works exactly like CountBy, but only returns
+// the values. The values are sorted in the same order that Order would use.
+func (q *Query) Distinct(fieldName string) ([]string, error) {
+	return q.DistinctContext(context.Background(), fieldName)
+}
+
+// DistinctContext is like Distinct but uses the given context. See
+// Transaction.ExecContext for details.
+func (q *Query) DistinctContext(ctx context.Context, fieldName string) ([]string, error) {
+	tx := q.newTransaction()
+	values := []string{}
+	newTransactionQuery(q.query, tx).Distinct(fieldName, &values)
+	if err := tx.ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/garyburd/redigo/redis"
@@ -100,6 +101,9 @@ func TestQueryFilterInt(t *testing.T) {
 	filterValues := []interface{}{-10, 0, 99999999, models[0].Int}
 	for _, val := range filterValues {
 		for op := range filterOps {
+			if !filterOps[op].isComparisonOp() {
+				continue
+			}
 			q := indexedTestModels.NewQuery().Filter("Int "+op, val)
 			testQuery(t, q, models)
 		}
@@ -119,6 +123,9 @@ func TestQueryFilterBool(t *testing.T) {
 	filterValues := []interface{}{true, false}
 	for _, val := range filterValues {
 		for op := range filterOps {
+			if !filterOps[op].isComparisonOp() {
+				continue
+			}
 			q := indexedTestModels.NewQuery().Filter("Bool "+op, val)
 			testQuery(t, q, models)
 		}
@@ -146,6 +153,9 @@ func TestQueryFilterString(t *testing.T) {
 	filterValues := []interface{}{"a", "AbCdE", models[0].String, incrementString(models[0].String), decrementString(models[0].String), models[0].String + " ", models[0].String[:len(models[0].String)-1]}
 	for _, val := range filterValues {
 		for op := range filterOps {
+			if !filterOps[op].isComparisonOp() {
+				continue
+			}
 			q := indexedTestModels.NewQuery().Filter("String "+op, val)
 			testQuery(t, q, models)
 		}
@@ -174,6 +184,9 @@ func TestQueryDoubleFilters(t *testing.T) {
 						// no sense in doing the same filter twice
 						continue
 					}
+					if !filterOps[o1].isComparisonOp() || !filterOps[o2].isComparisonOp() {
+						continue
+					}
 					q := indexedTestModels.NewQuery().Filter(f1+" "+o1, v1).Filter(f2+" "+o2, v2)
 					testQuery(t, q, models)
 				}
@@ -200,6 +213,9 @@ func TestQueryCombos(t *testing.T) {
 	for i, filterField := range fieldNames {
 		filterVal := filterValues[i]
 		for filterOp := range filterOps {
+			if !filterOps[filterOp].isComparisonOp() {
+				continue
+			}
 			for _, orderField := range fieldNames {
 				for _, orderPrefix := range []string{"", "-"} {
 					for _, offset := range offsets {
@@ -215,6 +231,797 @@ func TestQueryCombos(t *testing.T) {
 	}
 }
 
+func TestQueryMultipleOrders(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Create models with only a few distinct values for each field so that
+	// there are plenty of ties for the secondary orders to break.
+	models := createIndexedTestModels(20)
+	for i, model := range models {
+		model.Int = i % 3
+		model.String = []string{"a", "b"}[i%2]
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	fieldNames := []string{"Int", "String", "Bool"}
+	for _, first := range fieldNames {
+		for _, second := range fieldNames {
+			if first == second {
+				continue
+			}
+			for _, firstPrefix := range []string{"", "-"} {
+				for _, secondPrefix := range []string{"", "-"} {
+					q := indexedTestModels.NewQuery().Order(firstPrefix + first).Order(secondPrefix + second)
+					testQuery(t, q, models)
+					q = indexedTestModels.NewQuery().Order(firstPrefix + first).Order(secondPrefix + second).Limit(5).Offset(3)
+					testQuery(t, q, models)
+					q = indexedTestModels.NewQuery().Filter("Bool =", true).Order(firstPrefix + first).Order(secondPrefix + second)
+					testQuery(t, q, models)
+				}
+			}
+		}
+	}
+	q := indexedTestModels.NewQuery().Order("-Int").Order("String").Order("Bool").Limit(10)
+	testQuery(t, q, models)
+}
+
+func TestQueryMultipleOrdersNilPointers(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// A nil string is stored as NULL in the main hash, but the model is not in
+	// the string index, so it should be excluded while a model whose value is
+	// actually "NULL" should not.
+	nullString, zero, one := "NULL", 0, 1
+	withNil := &indexedPointersModel{Int: &zero}
+	withNULL := &indexedPointersModel{Int: &one, String: &nullString}
+	for _, model := range []*indexedPointersModel{withNil, withNULL} {
+		if err := indexedPointersModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	got := []*indexedPointersModel{}
+	if err := indexedPointersModels.NewQuery().Order("String").Order("Int").Run(&got); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if len(got) != 1 || got[0].ModelID() != withNULL.ModelID() {
+		ids := []string{}
+		for _, model := range got {
+			ids = append(ids, model.ModelID())
+		}
+		t.Errorf("Expected only %s but got %v", withNULL.ModelID(), ids)
+	}
+}
+
+func TestQueryOrderErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []*Query{
+		indexedTestModels.NewQuery().Order("Int").Order("-Int"),
+		indexedTestModels.NewQuery().Order("Foo"),
+		testModels.NewQuery().Order("Int"),
+	}
+	for i, q := range testCases {
+		if _, err := q.IDs(); err == nil {
+			t.Errorf("Expected an error in test case %d but got none", i)
+		}
+	}
+}
+
+func TestQueryWhere(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(20)
+	for i, model := range models {
+		model.Int = i % 5
+		model.String = []string{"open", "pending", "closed"}[i%3]
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	queries := []*Query{
+		indexedTestModels.NewQuery().Where(NewFilter("String =", "open")),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("String =", "open"), NewFilter("String =", "pending"))),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("Int <", 1), NewFilter("Int >", 3))),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("Int !=", 2), NewFilter("Bool =", true))),
+		indexedTestModels.NewQuery().Where(And(NewFilter("Int >=", 1), NewFilter("String !=", "closed"))),
+		indexedTestModels.NewQuery().Where(Or(
+			And(NewFilter("String =", "open"), NewFilter("Int <", 2)),
+			And(NewFilter("String =", "closed"), Or(NewFilter("Bool =", true), NewFilter("Int =", 4))),
+		)),
+		indexedTestModels.NewQuery().Filter("Bool =", false).Where(Or(NewFilter("String =", "open"), NewFilter("Int =", 3))),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("String =", "open"), NewFilter("String =", "closed"))).Where(Or(NewFilter("Int <", 1), NewFilter("Int >", 3))),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("String =", "open"), NewFilter("Int =", 3))).Order("-Int").Order("String").Limit(4).Offset(2),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("String =", "open"), NewFilter("Int =", 3))).Order("String").Limit(3),
+	}
+	for _, q := range queries {
+		testQuery(t, q, models)
+	}
+}
+
+func TestQueryFilterInAndNotIn(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(20)
+	for i, model := range models {
+		model.Int = i % 5
+		model.String = []string{"a", "b", "c", "d"}[i%4]
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	filterValues := map[string][]interface{}{
+		"Int":    {[]int{}, []int{1}, []int{0, 3}, []int{0, 1, 2, 3, 4}, []int{-1, 100}, [2]int{2, 4}},
+		"String": {[]string{}, []string{"a"}, []string{"b", "d"}, []string{"a", "e"}, []string{"aa"}},
+		"Bool":   {[]bool{}, []bool{true}, []bool{false}, []bool{true, false}},
+	}
+	for fieldName, values := range filterValues {
+		for _, val := range values {
+			for _, op := range []string{"IN", "NOT IN"} {
+				q := indexedTestModels.NewQuery().Filter(fieldName+" "+op, val)
+				testQuery(t, q, models)
+				q = indexedTestModels.NewQuery().Filter(fieldName+" "+op, val).Filter("Int >", 0).Order("-String").Order("Int").Limit(5).Offset(1)
+				testQuery(t, q, models)
+				q = indexedTestModels.NewQuery().Filter(fieldName+" "+op, val).Include("String")
+				testQuery(t, q, models)
+			}
+		}
+	}
+
+	// Test that IN and NOT IN work inside of filter groups
+	q := indexedTestModels.NewQuery().Where(Or(NewFilter("String IN", []string{"a", "b"}), NewFilter("Int NOT IN", []int{0, 1, 2})))
+	testQuery(t, q, models)
+
+	// Test invalid values for IN and NOT IN
+	invalidQueries := []*Query{
+		indexedTestModels.NewQuery().Filter("Int IN", 1),
+		indexedTestModels.NewQuery().Filter("Int IN", []string{"a"}),
+		indexedTestModels.NewQuery().Filter("String NOT IN", "a"),
+		indexedTestModels.NewQuery().Filter("String NOT IN", nil),
+		indexedTestModels.NewQuery().Filter("String NOT  IN", []string{"a"}),
+		indexedTestModels.NewQuery().Filter("Bool IN", []interface{}{true, 1}),
+	}
+	for i, q := range invalidQueries {
+		if _, err := q.IDs(); err == nil {
+			t.Errorf("Expected an error for invalid query %d but got none", i)
+		}
+	}
+}
+
+func TestQueryFilterPrefix(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(8)
+	for i, value := range []string{"alice", "ali", "alicia", "al", "bob", "ALICE", "alí", "ali baba"} {
+		models[i].String = value
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	for _, prefix := range []string{"", "a", "al", "ali", "alic", "alí", "ali ", "b", "c", "alicex"} {
+		q := indexedTestModels.NewQuery().Filter("String PREFIX", prefix)
+		testQuery(t, q, models)
+		q = indexedTestModels.NewQuery().Filter("String prefix", prefix).Order("-String").Limit(3)
+		testQuery(t, q, models)
+	}
+	q := indexedTestModels.NewQuery().Where(Or(NewFilter("String PREFIX", "alic"), NewFilter("String PREFIX", "b")))
+	testQuery(t, q, models)
+
+	// Test invalid uses of PREFIX
+	invalidQueries := []*Query{
+		indexedTestModels.NewQuery().Filter("Int PREFIX", 1),
+		indexedTestModels.NewQuery().Filter("Bool PREFIX", true),
+		indexedTestModels.NewQuery().Filter("String PREFIX", 1),
+	}
+	for i, q := range invalidQueries {
+		if _, err := q.IDs(); err == nil {
+			t.Errorf("Expected an error for invalid query %d but got none", i)
+		}
+	}
+}
+
+func TestQueryFilterBetween(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(10)
+	for i, model := range models {
+		model.Int = i - 3
+		model.String = []string{"a", "b", "bb", "c", "d"}[i%5]
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	ranges := map[string][]Range{
+		"Int":    {{Min: -1, Max: 3}, {Min: 3, Max: -1}, {Min: 0, Max: 0}, {Min: -100, Max: 100}},
+		"String": {{Min: "b", Max: "c"}, {Min: "bb", Max: "d"}, {Min: "a", Max: "a"}, {Min: "", Max: "z"}},
+	}
+	for fieldName, rngs := range ranges {
+		for _, rng := range rngs {
+			for _, excludeMin := range []bool{false, true} {
+				for _, excludeMax := range []bool{false, true} {
+					rng.ExcludeMin, rng.ExcludeMax = excludeMin, excludeMax
+					q := indexedTestModels.NewQuery().Filter(fieldName+" BETWEEN", rng)
+					testQuery(t, q, models)
+					q = indexedTestModels.NewQuery().Filter(fieldName+" BETWEEN", rng).Order("String").Order("-Int").Offset(1)
+					testQuery(t, q, models)
+				}
+			}
+			q := indexedTestModels.NewQuery().Between(fieldName, rng.Min, rng.Max)
+			testQuery(t, q, models)
+		}
+	}
+	q := indexedTestModels.NewQuery().Where(Or(NewFilter("Int BETWEEN", Range{Min: -3, Max: -2}), NewFilter("String BETWEEN", Range{Min: "c", Max: "d"})))
+	testQuery(t, q, models)
+
+	// Test invalid uses of BETWEEN
+	invalidQueries := []*Query{
+		indexedTestModels.NewQuery().Filter("Int BETWEEN", 1),
+		indexedTestModels.NewQuery().Filter("Int BETWEEN", Range{Min: 1, Max: "a"}),
+		indexedTestModels.NewQuery().Filter("Int BETWEEN", Range{Min: 1}),
+		indexedTestModels.NewQuery().Between("String", "a", 2),
+		indexedTestModels.NewQuery().Between("Bool", false, true),
+	}
+	for i, q := range invalidQueries {
+		if _, err := q.IDs(); err == nil {
+			t.Errorf("Expected an error for invalid query %d but got none", i)
+		}
+	}
+}
+
+func TestQueryRunPage(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use values with lots of ties so that we can test that models with the
+	// same value are ordered by id across pages.
+	models := createIndexedTestModels(23)
+	for i, model := range models {
+		model.Int = i % 4
+		model.String = []string{"a", "b", "bb"}[i%3]
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	newQueries := []func() *Query{
+		func() *Query { return indexedTestModels.NewQuery().Order("Int") },
+		func() *Query { return indexedTestModels.NewQuery().Order("-Int") },
+		func() *Query { return indexedTestModels.NewQuery().Order("String") },
+		func() *Query { return indexedTestModels.NewQuery().Order("-String") },
+		func() *Query { return indexedTestModels.NewQuery().Order("-Bool") },
+		func() *Query { return indexedTestModels.NewQuery().Order("Int").Filter("String !=", "b") },
+		func() *Query { return indexedTestModels.NewQuery().Order("-String").Include("Bool") },
+	}
+	for i, newQuery := range newQueries {
+		expectedIDs, err := newQuery().IDs()
+		if err != nil {
+			t.Fatalf("Unexpected error in IDs: %s", err.Error())
+		}
+		for _, pageSize := range []uint{1, 4, 7, 100} {
+			gotIDs := []string{}
+			cursor := ""
+			pages := 0
+			for {
+				pages++
+				q := newQuery().Limit(pageSize).After(cursor)
+				page := []*indexedTestModel{}
+				next, err := q.RunPage(&page)
+				if err != nil {
+					t.Fatalf("Unexpected error in RunPage for query %d: %s", i, err.Error())
+				}
+				if uint(len(page)) > pageSize {
+					t.Errorf("Expected at most %d models in page but got %d", pageSize, len(page))
+				}
+				for _, model := range page {
+					gotIDs = append(gotIDs, model.ModelID())
+				}
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if !reflect.DeepEqual(expectedIDs, gotIDs) {
+				t.Errorf("Wrong ids for query %d with page size %d.\nExpected: %v\nGot:      %v", i, pageSize, expectedIDs, gotIDs)
+			}
+			// The last page should not return a cursor, even if it is full
+			expectedPages := (len(expectedIDs) + int(pageSize) - 1) / int(pageSize)
+			if expectedPages == 0 {
+				expectedPages = 1
+			}
+			if pages != expectedPages {
+				t.Errorf("Expected %d pages for query %d with page size %d but got %d", expectedPages, i, pageSize, pages)
+			}
+		}
+	}
+
+	// Make sure that models which are saved or deleted before the cursor do not
+	// affect the next page, even if the model the cursor points to was deleted.
+	expectedIDs, err := indexedTestModels.NewQuery().Order("Int").IDs()
+	if err != nil {
+		t.Fatalf("Unexpected error in IDs: %s", err.Error())
+	}
+	firstPage := []*indexedTestModel{}
+	cursor, err := indexedTestModels.NewQuery().Order("Int").Limit(5).RunPage(&firstPage)
+	if err != nil {
+		t.Fatalf("Unexpected error in RunPage: %s", err.Error())
+	}
+	if _, err := indexedTestModels.Delete(firstPage[4].ModelID()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	if err := indexedTestModels.Save(&indexedTestModel{Int: -1}); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	secondPageIDs, err := indexedTestModels.NewQuery().Order("Int").Limit(5).After(cursor).IDs()
+	if err != nil {
+		t.Fatalf("Unexpected error in IDs: %s", err.Error())
+	}
+	if !reflect.DeepEqual(expectedIDs[5:10], secondPageIDs) {
+		t.Errorf("Wrong ids for second page.\nExpected: %v\nGot:      %v", expectedIDs[5:10], secondPageIDs)
+	}
+
+	// Test invalid uses of cursors
+	invalidQueries := []*Query{
+		indexedTestModels.NewQuery().Order("Int").After("not a cursor"),
+		indexedTestModels.NewQuery().Order("-Int").After(cursor),
+		indexedTestModels.NewQuery().Order("String").After(cursor),
+		indexedTestModels.NewQuery().After(cursor),
+		indexedTestModels.NewQuery().Order("Int").Order("String").After(cursor),
+		indexedTestModels.NewQuery(),
+	}
+	for i, q := range invalidQueries {
+		if _, err := q.RunPage(&[]*indexedTestModel{}); err == nil {
+			t.Errorf("Expected an error for invalid query %d but got none", i)
+		}
+	}
+}
+
+func TestQueryAggregates(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(10)
+	modelsByID := map[string]*indexedTestModel{}
+	for i, model := range models {
+		model.Int = i*3 - 5
+		model.Bool = i%3 == 0
+		model.SetModelID(strconv.Itoa(i))
+		modelsByID[model.ModelID()] = model
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	queries := []*Query{
+		indexedTestModels.NewQuery(),
+		indexedTestModels.NewQuery().Filter("Bool =", true),
+		indexedTestModels.NewQuery().Order("-Int").Limit(3).Offset(1),
+		indexedTestModels.NewQuery().Order("String"),
+		indexedTestModels.NewQuery().Order("Int").Filter("Int >", 0),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("Int <", 0), NewFilter("Bool =", true))),
+	}
+	for i, q := range queries {
+		ids, err := q.IDs()
+		if err != nil {
+			t.Fatalf("Unexpected error in IDs: %s", err.Error())
+		}
+		expectedSum, expectedMin, expectedMax := 0.0, 0.0, 0.0
+		for j, id := range ids {
+			value := float64(modelsByID[id].Int)
+			expectedSum += value
+			if j == 0 || value < expectedMin {
+				expectedMin = value
+			}
+			if j == 0 || value > expectedMax {
+				expectedMax = value
+			}
+		}
+		expectedAvg := expectedSum / float64(len(ids))
+		aggregates := []struct {
+			name     string
+			finisher func(string) (float64, error)
+			expected float64
+		}{
+			{"Sum", q.Sum, expectedSum},
+			{"Min", q.Min, expectedMin},
+			{"Max", q.Max, expectedMax},
+			{"Avg", q.Avg, expectedAvg},
+		}
+		for _, aggregate := range aggregates {
+			got, err := aggregate.finisher("Int")
+			if err != nil {
+				t.Errorf("Unexpected error in %s for query %d: %s", aggregate.name, i, err.Error())
+				continue
+			}
+			if got != aggregate.expected {
+				t.Errorf("Wrong result for %s with query %d (%s). Expected %v but got %v", aggregate.name, i, q, aggregate.expected, got)
+			}
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+
+	// Test aggregates inside of a transaction
+	tx = testPool.NewTransaction()
+	var sum, max float64
+	tx.Query(indexedTestModels).Filter("Bool =", true).Sum("Int", &sum)
+	tx.Query(indexedTestModels).Max("Int", &max)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in tx.Exec: %s", err.Error())
+	}
+	if expected := float64(-5 + 4 + 13 + 22); sum != expected {
+		t.Errorf("Wrong result for Sum in transaction. Expected %v but got %v", expected, sum)
+	}
+	if expected := float64(22); max != expected {
+		t.Errorf("Wrong result for Max in transaction. Expected %v but got %v", expected, max)
+	}
+
+	// If no models match, Sum should return 0 and the others should return a
+	// ModelNotFoundError.
+	q := indexedTestModels.NewQuery().Filter("Int >", 1000)
+	if sum, err := q.Sum("Int"); err != nil {
+		t.Errorf("Unexpected error in Sum: %s", err.Error())
+	} else if sum != 0 {
+		t.Errorf("Expected Sum to be 0 but got %v", sum)
+	}
+	for _, finisher := range []func(string) (float64, error){q.Min, q.Max, q.Avg} {
+		if _, err := finisher("Int"); err == nil {
+			t.Error("Expected a ModelNotFoundError but got none")
+		} else if _, ok := err.(ModelNotFoundError); !ok {
+			t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+		}
+	}
+
+	// Test invalid field names
+	for _, fieldName := range []string{"String", "Bool", "Foo"} {
+		if _, err := indexedTestModels.NewQuery().Sum(fieldName); err == nil {
+			t.Errorf("Expected an error for Sum(%q) but got none", fieldName)
+		}
+	}
+}
+
+func TestQueryCountByAndDistinct(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(12)
+	modelsByID := map[string]*indexedTestModel{}
+	for i, model := range models {
+		model.Int = i % 4
+		model.String = []string{"open", "closed", "pending"}[i%3]
+		model.Bool = i%2 == 0
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+	for _, model := range models {
+		modelsByID[model.ModelID()] = model
+	}
+
+	queries := []*Query{
+		indexedTestModels.NewQuery(),
+		indexedTestModels.NewQuery().Filter("Bool =", true),
+		indexedTestModels.NewQuery().Filter("String !=", "open").Filter("Int <", 3),
+		indexedTestModels.NewQuery().Order("-Int").Limit(5).Offset(2),
+		indexedTestModels.NewQuery().Order("String"),
+		indexedTestModels.NewQuery().Filter("Int >", 100),
+	}
+	fieldValue := map[string]func(*indexedTestModel) string{
+		"Int":    func(m *indexedTestModel) string { return strconv.Itoa(m.Int) },
+		"String": func(m *indexedTestModel) string { return m.String },
+		"Bool":   func(m *indexedTestModel) string { return strconv.FormatBool(m.Bool) },
+	}
+	for i, q := range queries {
+		ids, err := q.IDs()
+		if err != nil {
+			t.Fatalf("Unexpected error in IDs: %s", err.Error())
+		}
+		for fieldName, valueOf := range fieldValue {
+			expectedCounts := map[string]int{}
+			for _, id := range ids {
+				expectedCounts[valueOf(modelsByID[id])]++
+			}
+			gotCounts, err := q.CountBy(fieldName)
+			if err != nil {
+				t.Fatalf("Unexpected error in CountBy: %s", err.Error())
+			}
+			if !reflect.DeepEqual(expectedCounts, gotCounts) {
+				t.Errorf("Wrong result for CountBy(%q) with query %d (%s).\nExpected: %v\nGot:      %v", fieldName, i, q, expectedCounts, gotCounts)
+			}
+			gotValues, err := q.Distinct(fieldName)
+			if err != nil {
+				t.Fatalf("Unexpected error in Distinct: %s", err.Error())
+			}
+			if len(gotValues) != len(expectedCounts) {
+				t.Errorf("Wrong number of values for Distinct(%q) with query %d (%s). Expected %d but got %d: %v", fieldName, i, q, len(expectedCounts), len(gotValues), gotValues)
+			}
+			for _, value := range gotValues {
+				if _, found := expectedCounts[value]; !found {
+					t.Errorf("Unexpected value for Distinct(%q) with query %d (%s): %s", fieldName, i, q, value)
+				}
+			}
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+
+	// Distinct should return values in ascending order
+	if values, err := indexedTestModels.NewQuery().Distinct("String"); err != nil {
+		t.Fatalf("Unexpected error in Distinct: %s", err.Error())
+	} else if expected := []string{"closed", "open", "pending"}; !reflect.DeepEqual(expected, values) {
+		t.Errorf("Wrong result for Distinct. Expected %v but got %v", expected, values)
+	}
+
+	// Test inside of a transaction
+	tx = testPool.NewTransaction()
+	counts := map[string]int{}
+	tx.Query(indexedTestModels).Filter("Int =", 0).CountBy("String", &counts)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in tx.Exec: %s", err.Error())
+	}
+	if expected := map[string]int{"open": 1, "closed": 1, "pending": 1}; !reflect.DeepEqual(expected, counts) {
+		t.Errorf("Wrong result for CountBy in transaction. Expected %v but got %v", expected, counts)
+	}
+
+	// Test invalid field names
+	if _, err := indexedTestModels.NewQuery().CountBy("Foo"); err == nil {
+		t.Error("Expected an error for CountBy with invalid field name but got none")
+	}
+	if _, err := testModels.NewQuery().Distinct("Int"); err == nil {
+		t.Error("Expected an error for Distinct on unindexed field but got none")
+	}
+}
+
+func TestQueryDelete(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(10)
+	for i, model := range models {
+		model.Int = i
+		model.String = []string{"a", "b"}[i%2]
+		model.Bool = i%2 == 0
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	// Order, limit, and offset should be taken into account. The even values of
+	// Int in descending order are 8, 6, 4, 2, 0, so 6 and 4 should be deleted.
+	q := indexedTestModels.NewQuery().Filter("Bool =", true).Order("-Int").Limit(2).Offset(1)
+	count, err := q.Delete()
+	if err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 models to be deleted but got %d", count)
+	}
+	for i, model := range models {
+		if i == 4 || i == 6 {
+			expectModelDoesNotExist(t, indexedTestModels, model)
+			for _, fieldName := range []string{"Int", "String", "Bool"} {
+				expectIndexDoesNotExist(t, indexedTestModels, model, fieldName)
+			}
+		} else {
+			expectModelExists(t, indexedTestModels, model)
+		}
+	}
+	checkForLeakedTmpKeys(t, q.query)
+	expectNoIndexProblems(t, indexedTestModels)
+
+	// Test inside of a transaction
+	tx = testPool.NewTransaction()
+	tx.Query(indexedTestModels).Filter("Int <", 3).Delete(&count)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in tx.Exec: %s", err.Error())
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 models to be deleted but got %d", count)
+	}
+	if remaining, err := indexedTestModels.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if remaining != 5 {
+		t.Errorf("Expected 5 models to remain but got %d", remaining)
+	}
+	expectNoIndexProblems(t, indexedTestModels)
+
+	// Deleting a model should also remove its values from the unique indexes
+	if err := uniqueTestModels.Save(&uniqueTestModel{Email: "foo@example.com"}); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if count, err := uniqueTestModels.NewQuery().Delete(); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	} else if count != 1 {
+		t.Errorf("Expected 1 model to be deleted but got %d", count)
+	}
+	if err := uniqueTestModels.Save(&uniqueTestModel{Email: "foo@example.com"}); err != nil {
+		t.Errorf("Unexpected error saving a model with the email of a deleted model: %s", err.Error())
+	}
+}
+
+func TestQueryUpdate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(10)
+	for i, model := range models {
+		model.Int = i
+		model.String = "pending"
+		model.Bool = false
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	// Update the models with the three highest values of Int
+	q := indexedTestModels.NewQuery().Filter("Int >=", 2).Order("-Int").Limit(3)
+	count, err := q.Update(map[string]interface{}{
+		"String": "expired",
+		"Bool":   true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in Update: %s", err.Error())
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 models to be updated but got %d", count)
+	}
+	for i, model := range models {
+		if i >= 7 {
+			model.String = "expired"
+			model.Bool = true
+		}
+		got := &indexedTestModel{}
+		if err := indexedTestModels.Find(model.ModelID(), got); err != nil {
+			t.Fatalf("Unexpected error in Find: %s", err.Error())
+		}
+		if !reflect.DeepEqual(model, got) {
+			t.Errorf("Expected %+v but got %+v", model, got)
+		}
+	}
+	checkForLeakedTmpKeys(t, q.query)
+	expectNoIndexProblems(t, indexedTestModels)
+	if expiredCount, err := indexedTestModels.NewQuery().Filter("String =", "expired").Filter("Bool =", true).Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if expiredCount != 3 {
+		t.Errorf("Expected 3 expired models but got %d", expiredCount)
+	}
+
+	// Test inside of a transaction. Numeric values should be converted to the
+	// type of the field.
+	tx = testPool.NewTransaction()
+	tx.Query(indexedTestModels).Filter("String =", "pending").Update(map[string]interface{}{"Int": int64(100)}, &count)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in tx.Exec: %s", err.Error())
+	}
+	if count != 7 {
+		t.Errorf("Expected 7 models to be updated but got %d", count)
+	}
+	if ids, err := indexedTestModels.NewQuery().Filter("Int =", 100).IDs(); err != nil {
+		t.Fatalf("Unexpected error in IDs: %s", err.Error())
+	} else if len(ids) != 7 {
+		t.Errorf("Expected 7 models with Int = 100 but got %d", len(ids))
+	}
+	expectNoIndexProblems(t, indexedTestModels)
+
+	// Pointer fields can be set to a value or to nil
+	model := createIndexedPointersModel()
+	if err := indexedPointersModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if _, err := indexedPointersModels.NewQuery().Update(map[string]interface{}{"String": "foo", "Int": nil}); err != nil {
+		t.Fatalf("Unexpected error in Update: %s", err.Error())
+	}
+	got := &indexedPointersModel{}
+	if err := indexedPointersModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.String == nil || *got.String != "foo" {
+		t.Errorf("Expected String to be foo but got %v", got.String)
+	}
+	if got.Int != nil {
+		t.Errorf("Expected Int to be nil but got %v", *got.Int)
+	}
+	expectNoIndexProblems(t, indexedPointersModels)
+
+	// The version field should be incremented
+	versioned := &versionedTestModel{}
+	if err := versionedTestModels.Save(versioned); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if _, err := versionedTestModels.NewQuery().Update(map[string]interface{}{"Int": 5}); err != nil {
+		t.Fatalf("Unexpected error in Update: %s", err.Error())
+	}
+	versioned.Int = 6
+	if err := versionedTestModels.Save(versioned); err == nil {
+		t.Errorf("Expected a VersionConflictError for a model changed by Update but got none")
+	}
+	expectNoIndexProblems(t, versionedTestModels)
+
+	// Test invalid updates
+	invalidUpdates := []struct {
+		collection  *Collection
+		fieldValues map[string]interface{}
+	}{
+		{indexedTestModels, map[string]interface{}{}},
+		{indexedTestModels, map[string]interface{}{"Foo": 1}},
+		{indexedTestModels, map[string]interface{}{"Int": "a"}},
+		{uniqueTestModels, map[string]interface{}{"Email": "foo@example.com"}},
+		{versionedTestModels, map[string]interface{}{"Version": 1}},
+		{referenceTestModels, map[string]interface{}{"Many": nil}},
+	}
+	for i, update := range invalidUpdates {
+		if _, err := update.collection.NewQuery().Update(update.fieldValues); err == nil {
+			t.Errorf("Expected an error for invalid update %d but got none", i)
+		}
+	}
+}
+
+func TestQueryWhereErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []*Query{
+		indexedTestModels.NewQuery().Where(Or()),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("Foo =", 1), NewFilter("Int =", 1))),
+		indexedTestModels.NewQuery().Where(Or(NewFilter("Int =", "a"), NewFilter("Int =", 1))),
+		indexedTestModels.NewQuery().Where(Or(And(NewFilter("Int ==", 1)), NewFilter("Int =", 1))),
+	}
+	for i, q := range testCases {
+		if _, err := q.IDs(); err == nil {
+			t.Errorf("Expected an error in test case %d but got none", i)
+		}
+	}
+}
+
 func TestQueryRunOne(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -398,9 +1205,14 @@ func expectedResultsForQuery(q *query, models []*indexedTestModel) []*indexedTes
 		expected = orderedIntersectModels(applyFilter(expected, filter), expected)
 	}
 
-	// apply order (if applicable)
+	// apply filter groups
+	for _, group := range q.groups {
+		expected = applyFilterGroup(expected, group)
+	}
+
+	// apply orders (if applicable)
 	if q.hasOrder() {
-		expected = applyOrder(expected, q.order)
+		expected = applyOrders(expected, q.orders)
 	}
 
 	// apply limit/offset
@@ -418,6 +1230,17 @@ func expectedResultsForQuery(q *query, models []*indexedTestModel) []*indexedTes
 
 // applyFilter returns only the models which pass the filter criteria.
 func applyFilter(models []*indexedTestModel, filter filter) []*indexedTestModel {
+	switch filter.op {
+	case inOp, notInOp:
+		return applySetFilter(models, filter)
+	case prefixOp:
+		return filterModels(models, func(m *indexedTestModel) bool {
+			fieldVal := reflect.ValueOf(m).Elem().FieldByName(filter.fieldSpec.name).String()
+			return strings.HasPrefix(fieldVal, indirectFilterValue(filter.value).String())
+		})
+	case betweenOp:
+		return applyBetweenFilter(models, filter)
+	}
 	var filterFunc func(m *indexedTestModel) bool
 
 	switch filter.fieldSpec.indexKind {
@@ -488,6 +1311,72 @@ func applyFilter(models []*indexedTestModel, filter filter) []*indexedTestModel
 	return filterModels(models, filterFunc)
 }
 
+// applySetFilter returns only the models which pass the criteria for the given
+// IN or NOT IN filter.
+func applySetFilter(models []*indexedTestModel, filter filter) []*indexedTestModel {
+	return filterModels(models, func(m *indexedTestModel) bool {
+		matchesAny := false
+		for i := 0; i < filter.value.Len(); i++ {
+			elemFilter := filter
+			elemFilter.op = equalOp
+			elemFilter.value = filter.value.Index(i)
+			if len(applyFilter([]*indexedTestModel{m}, elemFilter)) == 1 {
+				matchesAny = true
+				break
+			}
+		}
+		if filter.op == inOp {
+			return matchesAny
+		}
+		return !matchesAny
+	})
+}
+
+// applyBetweenFilter returns only the models which pass the criteria for the
+// given BETWEEN filter. It does this by splitting the filter into two separate
+// comparison filters, one for each bound of the Range.
+func applyBetweenFilter(models []*indexedTestModel, filter filter) []*indexedTestModel {
+	rng := filter.value.Interface().(Range)
+	minFilter, maxFilter := filter, filter
+	minFilter.op, maxFilter.op = greaterOrEqualOp, lessOrEqualOp
+	if rng.ExcludeMin {
+		minFilter.op = greaterOp
+	}
+	if rng.ExcludeMax {
+		maxFilter.op = lessOp
+	}
+	minFilter.value = indirectFilterValue(reflect.ValueOf(rng.Min))
+	maxFilter.value = indirectFilterValue(reflect.ValueOf(rng.Max))
+	return applyFilter(applyFilter(models, minFilter), maxFilter)
+}
+
+// applyFilterGroup returns only the models which match the filter group.
+func applyFilterGroup(models []*indexedTestModel, group *filterGroup) []*indexedTestModel {
+	return filterModels(models, func(m *indexedTestModel) bool {
+		return modelMatchesFilterGroup(m, group)
+	})
+}
+
+// modelMatchesFilterGroup returns true iff m matches any (for Or groups) or all
+// (for And groups) of the filters and nested groups in group.
+func modelMatchesFilterGroup(m *indexedTestModel, group *filterGroup) bool {
+	matches := []bool{}
+	for _, filter := range group.filters {
+		matches = append(matches, len(applyFilter([]*indexedTestModel{m}, filter)) == 1)
+	}
+	for _, childGroup := range group.groups {
+		matches = append(matches, modelMatchesFilterGroup(m, childGroup))
+	}
+	for _, match := range matches {
+		if group.op == orGroup && match {
+			return true
+		} else if group.op == andGroup && !match {
+			return false
+		}
+	}
+	return group.op == andGroup
+}
+
 // filterModels returns only the models which return true when passed through
 // the filter function.
 func filterModels(models []*indexedTestModel, f func(*indexedTestModel) bool) []*indexedTestModel {
@@ -894,6 +1783,73 @@ func applyOrder(models []*indexedTestModel, order order) []*indexedTestModel {
 	return sortModels(models, order.fieldName, order.kind)
 }
 
+// compareFieldValues returns -1, 0, or 1 if the value of the field identified
+// by fieldName is less than, equal to, or greater than the value of the same
+// field for m2.
+func compareFieldValues(m1, m2 *indexedTestModel, fieldName string) int {
+	var less, greater bool
+	switch fieldName {
+	case "Int":
+		less, greater = m1.Int < m2.Int, m1.Int > m2.Int
+	case "String":
+		less, greater = m1.String < m2.String, m1.String > m2.String
+	case "Bool":
+		less, greater = !m1.Bool && m2.Bool, m1.Bool && !m2.Bool
+	}
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// applyOrders sorts the models by each of the given orders in turn. Models
+// which are equal for every order are sorted by id, in the direction of the
+// last order. Returns a copy, so the original is unchanged.
+func applyOrders(models []*indexedTestModel, orders []order) []*indexedTestModel {
+	results := make([]*indexedTestModel, len(models))
+	copy(results, models)
+	sorter := &modelSorter{
+		models: results,
+		lessFunc: func(m1, m2 *indexedTestModel) bool {
+			for _, order := range orders {
+				cmp := compareFieldValues(m1, m2, order.fieldName)
+				if cmp == 0 {
+					continue
+				}
+				if order.kind == descendingOrder {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+			if orders[len(orders)-1].kind == descendingOrder {
+				return m1.ModelID() > m2.ModelID()
+			}
+			return m1.ModelID() < m2.ModelID()
+		},
+	}
+	return sorter.Sort()
+}
+
+func TestApplyOrders(t *testing.T) {
+	models := createIndexedTestModels(4)
+	models[0].Int, models[0].String = 1, "b"
+	models[1].Int, models[1].String = 1, "a"
+	models[2].Int, models[2].String = 2, "a"
+	models[3].Int, models[3].String = 0, "c"
+	orders := []order{
+		{fieldName: "Int", kind: descendingOrder},
+		{fieldName: "String", kind: ascendingOrder},
+	}
+	expected := []*indexedTestModel{models[2], models[1], models[0], models[3]}
+	got := applyOrders(shuffleModels(models), orders)
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Models were not sorted correctly.\nExpected: %#v\nGot:  %#v", expected, got)
+	}
+}
+
 func TestApplyOrderNumeric(t *testing.T) {
 	expected := createIndexedTestModels(5)
 	expected[0].Int = 1
@@ -0,0 +1,220 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reference.go contains code related to reference fields, i.e. fields
+// with the `zoom:"ref"` struct tag which point to models in other collections.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// newLoadReferencesHandler returns a ReplyHandler which calls handler and then
+// causes the models referenced by any of the given fieldNames to be loaded into
+// the models returned by getModels after t is executed (see
+// Transaction.afterExec). If none of the fieldNames are reference fields, it
+// simply returns handler.
+func newLoadReferencesHandler(handler ReplyHandler, t *Transaction, spec *modelSpec, fieldNames []string, getModels func() []Model) ReplyHandler {
+	if len(spec.referenceFieldsForFieldNames(fieldNames)) == 0 {
+		return handler
+	}
+	return func(reply interface{}) error {
+		if err := handler(reply); err != nil {
+			return err
+		}
+		models := getModels()
+		t.afterExec = append(t.afterExec, func(exec func(*Transaction) error) error {
+			return loadReferences(t.pool, exec, spec, fieldNames, models)
+		})
+		return nil
+	}
+}
+
+// modelsGetter returns a function which converts models, which should be a
+// pointer to a slice of models, to []Model. It is meant to be used with
+// newLoadReferencesHandler, since the length of models is not known until the
+// reply has been scanned.
+func modelsGetter(models interface{}) func() []Model {
+	return func() []Model {
+		return Models(reflect.ValueOf(models).Elem().Interface())
+	}
+}
+
+// referenceFieldsForFieldNames returns the field specs for each of the given
+// fieldNames which is a reference to one or more other models.
+func (ms *modelSpec) referenceFieldsForFieldNames(fieldNames []string) []*fieldSpec {
+	fields := []*fieldSpec{}
+	for _, fieldName := range fieldNames {
+		if fs, found := ms.fieldsByName[fieldName]; found && fs.isReference() {
+			fields = append(fields, fs)
+		}
+	}
+	return fields
+}
+
+// hashFieldNames returns the field names and redis names for each field in ms
+// which is stored in the main hash, i.e. all fields except for references to
+// many other models.
+func (ms *modelSpec) hashFieldNames() (fieldNames []string, redisNames []string) {
+	for _, fs := range ms.fields {
+		if fs.kind == referencesField {
+			continue
+		}
+		fieldNames = append(fieldNames, fs.name)
+		redisNames = append(redisNames, fs.redisName)
+	}
+	return fieldNames, redisNames
+}
+
+// loadReferences loads the models referenced by any of the given fieldNames
+// into each model in models, using exec to execute the transactions it needs.
+// The lookups for all of the models and fields are batched together, so it
+// takes one round trip if there are only references to one model, or two if
+// the ids for references to many models need to be read first. Only one level
+// of references is loaded, so any references in the related models will only
+// have their ids set. Models which are referenced but no longer exist are
+// treated as if they were never referenced: references to one model are set to
+// nil and references to many models skip them. Their ids are not removed from
+// the database. References to many models are sorted by id.
+func loadReferences(pool *Pool, exec func(*Transaction) error, spec *modelSpec, fieldNames []string, models []Model) error {
+	refFields := spec.referenceFieldsForFieldNames(fieldNames)
+	if len(refFields) == 0 || len(models) == 0 {
+		return nil
+	}
+	relatedSpecs := map[*fieldSpec]*modelSpec{}
+	for _, fs := range refFields {
+		relatedSpec, found := pool.modelTypeToSpec[fs.refType]
+		if !found {
+			return fmt.Errorf("zoom: Could not load references for field %s.%s: type %s is not registered", spec.name, fs.name, fs.refType.String())
+		}
+		relatedSpecs[fs] = relatedSpec
+	}
+
+	// First get the ids for any references to many models, along with the
+	// fields of the models referenced by references to one model, whose ids
+	// were already scanned from the main hash.
+	tx := pool.NewTransaction()
+	hasMany := false
+	for _, fs := range refFields {
+		for _, model := range models {
+			fieldVal := reflect.ValueOf(model).Elem().FieldByName(fs.name)
+			if fs.kind == referencesField {
+				hasMany = true
+				tx.Command("SMEMBERS", redis.Args{spec.referencesKey(model.ModelID(), fs)}, newScanReferencesHandler(fieldVal))
+			} else {
+				loadRelatedModel(tx, relatedSpecs[fs], fieldVal)
+			}
+		}
+	}
+	if len(tx.actions) > 0 {
+		if err := exec(tx); err != nil {
+			return err
+		}
+	}
+	if !hasMany {
+		return nil
+	}
+
+	// Then get the fields for each model referenced by references to many
+	// models. Each related model already has its id set.
+	tx = pool.NewTransaction()
+	for _, fs := range refFields {
+		if fs.kind != referencesField {
+			continue
+		}
+		for _, model := range models {
+			fieldVal := reflect.ValueOf(model).Elem().FieldByName(fs.name)
+			for i := 0; i < fieldVal.Len(); i++ {
+				loadRelatedModel(tx, relatedSpecs[fs], fieldVal.Index(i))
+			}
+		}
+	}
+	if len(tx.actions) > 0 {
+		if err := exec(tx); err != nil {
+			return err
+		}
+	}
+
+	// Finally, remove any related models which no longer exist from references
+	// to many models.
+	for _, fs := range refFields {
+		if fs.kind != referencesField {
+			continue
+		}
+		for _, model := range models {
+			removeNilElements(reflect.ValueOf(model).Elem().FieldByName(fs.name))
+		}
+	}
+	return nil
+}
+
+// loadRelatedModel adds a command to the transaction which scans the fields of
+// the related model in relatedVal, which should be a pointer to a model with
+// its id set. It does nothing if relatedVal is nil. If the related model no
+// longer exists, relatedVal is set to nil when the transaction is executed.
+func loadRelatedModel(tx *Transaction, relatedSpec *modelSpec, relatedVal reflect.Value) {
+	relatedFieldNames, relatedRedisNames := relatedSpec.hashFieldNames()
+	if relatedVal.IsNil() || len(relatedRedisNames) == 0 {
+		return
+	}
+	mr := &modelRef{
+		spec:  relatedSpec,
+		model: relatedVal.Interface().(Model),
+	}
+	args := redis.Args{mr.key()}.Add(Interfaces(relatedRedisNames)...)
+	tx.Command("HMGET", args, newScanRelatedModelHandler(relatedFieldNames, mr, relatedVal))
+}
+
+// newScanReferencesHandler returns a ReplyHandler which sets fieldVal, which
+// should be a slice of pointers to models, to a new slice with one model for
+// each id in the reply. Only the id of each model is set.
+func newScanReferencesHandler(fieldVal reflect.Value) ReplyHandler {
+	return func(reply interface{}) error {
+		ids, err := redis.Strings(reply, nil)
+		if err != nil {
+			return err
+		}
+		sort.Strings(ids)
+		relatedVals := reflect.MakeSlice(fieldVal.Type(), len(ids), len(ids))
+		for i, id := range ids {
+			scanReferenceVal([]byte(id), relatedVals.Index(i))
+		}
+		fieldVal.Set(relatedVals)
+		return nil
+	}
+}
+
+// newScanRelatedModelHandler returns a ReplyHandler which scans the reply from
+// an HMGET command into the related model referenced by mr. If the related
+// model no longer exists, relatedVal is set to nil.
+func newScanRelatedModelHandler(fieldNames []string, mr *modelRef, relatedVal reflect.Value) ReplyHandler {
+	return func(reply interface{}) error {
+		fieldValues, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if modelWasDeleted(append(fieldValues, mr.model.ModelID())) {
+			relatedVal.Set(reflect.Zero(relatedVal.Type()))
+			return nil
+		}
+		return scanModel(fieldNames, fieldValues, mr)
+	}
+}
+
+// removeNilElements removes any nil elements from sliceVal, which should be
+// a settable slice of pointers.
+func removeNilElements(sliceVal reflect.Value) {
+	result := reflect.MakeSlice(sliceVal.Type(), 0, sliceVal.Len())
+	for i := 0; i < sliceVal.Len(); i++ {
+		if !sliceVal.Index(i).IsNil() {
+			result = reflect.Append(result, sliceVal.Index(i))
+		}
+	}
+	sliceVal.Set(result)
+}
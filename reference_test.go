@@ -0,0 +1,267 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reference_test.go tests the code in reference.go and the handling of
+// reference fields in Save, Delete, Find, and queries.
+
+package zoom
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestInvalidReferenceThrowsError(t *testing.T) {
+	testingSetUp()
+	testingTearDown()
+
+	type notAModel struct {
+		Int int
+	}
+	invalidModels := []Model{
+		&struct {
+			Ref int `zoom:"ref"`
+			RandomID
+		}{},
+		&struct {
+			Ref *notAModel `zoom:"ref"`
+			RandomID
+		}{},
+		&struct {
+			Ref []testModel `zoom:"ref"`
+			RandomID
+		}{},
+		&struct {
+			Ref *testModel `zoom:"ref,index"`
+			RandomID
+		}{},
+	}
+	for _, model := range invalidModels {
+		if _, err := compileModelSpec(reflect.TypeOf(model)); err == nil {
+			t.Errorf("Expected error when compiling spec for %T but got none", model)
+		}
+	}
+}
+
+func TestSaveAndDeleteReferences(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	related, err := createAndSaveTestModels(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &referenceTestModel{
+		Name: "a",
+		One:  related[0],
+		Many: []*testModel{related[1], related[2]},
+	}
+	if err := referenceTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Only the ids of the related models should be saved
+	modelKey := referenceTestModels.ModelKey(model.ModelID())
+	expectFieldEquals(t, modelKey, "One", nil, related[0].ModelID())
+	manyKey := modelKey + ":Many"
+	expectSetContains(t, manyKey, related[1].ModelID())
+	expectSetContains(t, manyKey, related[2].ModelID())
+
+	// Saving again should replace the set of ids
+	model.One = nil
+	model.Many = []*testModel{related[0]}
+	if err := referenceTestModels.SaveFields([]string{"One", "Many"}, model); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	expectFieldEquals(t, modelKey, "One", nil, "NULL")
+	expectSetContains(t, manyKey, related[0].ModelID())
+	expectSetDoesNotContain(t, manyKey, related[1].ModelID())
+
+	// Saving an empty slice should delete the set
+	model.Many = nil
+	if err := referenceTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, manyKey)
+
+	// Deleting the model should delete the set of ids but not the related
+	// models
+	model.Many = related
+	if err := referenceTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectKeyExists(t, manyKey)
+	if _, err := referenceTestModels.Delete(model.ModelID()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, manyKey)
+	expectModelsExist(t, testModels, Models(related))
+
+	// DeleteAll should also delete the sets of ids
+	if err := referenceTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectKeyExists(t, manyKey)
+	if _, err := referenceTestModels.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, manyKey)
+	expectModelsExist(t, testModels, Models(related))
+}
+
+func TestLoadReferences(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	related, err := createAndSaveTestModels(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &referenceTestModel{
+		Name: "a",
+		One:  related[0],
+		Many: []*testModel{related[1], related[2], related[3]},
+	}
+	// References to many models are loaded in order of their ids
+	sort.Slice(expected.Many, func(i, j int) bool {
+		return expected.Many[i].ModelID() < expected.Many[j].ModelID()
+	})
+	if err := referenceTestModels.Save(expected); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	other := &referenceTestModel{Name: "b"}
+	if err := referenceTestModels.Save(other); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// The related models should be loaded by Find and by queries
+	got := &referenceTestModel{}
+	if err := referenceTestModels.Find(expected.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Find did not load references.\nExpected: %+v\nGot:      %+v", expected, got)
+	}
+	gotModels := []*referenceTestModel{}
+	if err := referenceTestModels.FindAll(&gotModels); err != nil {
+		t.Fatalf("Unexpected error in FindAll: %s", err.Error())
+	}
+	if len(gotModels) != 2 {
+		t.Fatalf("Expected 2 models from FindAll but got %d", len(gotModels))
+	}
+	for _, gotModel := range gotModels {
+		switch gotModel.ModelID() {
+		case expected.ModelID():
+			if !reflect.DeepEqual(expected, gotModel) {
+				t.Errorf("FindAll did not load references.\nExpected: %+v\nGot:      %+v", expected, gotModel)
+			}
+		case other.ModelID():
+			if gotModel.One != nil || len(gotModel.Many) != 0 {
+				t.Errorf("Expected model without references to have none but got %+v", gotModel)
+			}
+		}
+	}
+	iter := referenceTestModels.Iter()
+	for iter.Next(got) {
+		if got.ModelID() == expected.ModelID() && !reflect.DeepEqual(expected, got) {
+			t.Errorf("Iterator did not load references.\nExpected: %+v\nGot:      %+v", expected, got)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Unexpected error in iterator: %s", err.Error())
+	}
+
+	// References should not be loaded if they are not included
+	got = &referenceTestModel{}
+	if err := referenceTestModels.FindFields(expected.ModelID(), []string{"Name"}, got); err != nil {
+		t.Fatalf("Unexpected error in FindFields: %s", err.Error())
+	}
+	if got.One != nil || got.Many != nil {
+		t.Errorf("Expected references to not be loaded but got %+v", got)
+	}
+	got = &referenceTestModel{}
+	if err := referenceTestModels.NewQuery().Include("Many").RunOne(got); err != nil {
+		t.Fatalf("Unexpected error in RunOne: %s", err.Error())
+	}
+	if got.One != nil {
+		t.Errorf("Expected One to not be loaded but got %+v", got.One)
+	}
+
+	// Related models which were deleted should be skipped
+	if _, err := testModels.Delete(related[0].ModelID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testModels.Delete(expected.Many[1].ModelID()); err != nil {
+		t.Fatal(err)
+	}
+	got = &referenceTestModel{}
+	if err := referenceTestModels.Find(expected.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.One != nil {
+		t.Errorf("Expected One to be nil after related model was deleted but got %+v", got.One)
+	}
+	expectedMany := []*testModel{expected.Many[0], expected.Many[2]}
+	if !reflect.DeepEqual(expectedMany, got.Many) {
+		t.Errorf("Expected Many to be %+v but got %+v", expectedMany, got.Many)
+	}
+
+	// Loading references should not write to the database, so the ids of the
+	// deleted models should still be in the set
+	manyKey := referenceTestModels.ModelKey(expected.ModelID()) + ":Many"
+	expectSetContains(t, manyKey, expected.Many[1].ModelID())
+}
+
+func TestLoadReferencesWithOneConnection(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	related, err := createAndSaveTestModels(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &referenceTestModel{
+		Name: "a",
+		One:  related[0],
+		Many: []*testModel{related[1]},
+	}
+	if err := referenceTestModels.Save(expected); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Loading references should not need a second connection, so it should not
+	// block forever if the pool only has one.
+	pool := NewPoolWithOptions(testPool.options.WithMaxActive(1).WithWait(true))
+	defer func() {
+		_ = pool.Close()
+	}()
+	if _, err := pool.NewCollection(&testModel{}); err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	models, err := pool.NewCollection(&referenceTestModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got := &referenceTestModel{}
+	if err := models.FindContext(ctx, expected.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in FindContext: %s", err.Error())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("FindContext did not load references.\nExpected: %+v\nGot:      %+v", expected, got)
+	}
+	if _, err := pool.Update(func(tx *Transaction) error {
+		got = &referenceTestModel{}
+		return tx.WatchAndFind(models, expected.ModelID(), got)
+	}, DefaultUpdateOptions); err != nil {
+		t.Fatalf("Unexpected error in Update: %s", err.Error())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("WatchAndFind did not load references.\nExpected: %+v\nGot:      %+v", expected, got)
+	}
+}
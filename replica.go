@@ -0,0 +1,178 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File replica.go contains code related to routing read-only transactions to
+// replicas.
+
+package zoom
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// readOnlyCommands is the set of commands which never write to the database.
+// A transaction consisting only of these commands can be sent to a replica.
+// SORT is handled separately, since it writes to the database if it has the
+// STORE option.
+var readOnlyCommands = map[string]bool{
+	"EXISTS":           true,
+	"GET":              true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"LLEN":             true,
+	"LRANGE":           true,
+	"MGET":             true,
+	"PTTL":             true,
+	"SCARD":            true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"TTL":              true,
+	"TYPE":             true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZLEXCOUNT":        true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCORE":           true,
+}
+
+// isReadOnly returns true iff a is a command which does not write to the
+// database. Scripts are never considered read-only.
+func (a *Action) isReadOnly() bool {
+	if a.kind != commandAction {
+		return false
+	}
+	name := strings.ToUpper(a.name)
+	if name == "SORT" {
+		for _, arg := range a.args {
+			if s, ok := arg.(string); ok && strings.ToUpper(s) == "STORE" {
+				return false
+			}
+		}
+		return true
+	}
+	return readOnlyCommands[name]
+}
+
+// actionsAreReadOnly returns true iff there is at least one action and every
+// action is read-only.
+func actionsAreReadOnly(actions []*Action) bool {
+	if len(actions) == 0 {
+		return false
+	}
+	for _, a := range actions {
+		if !a.isReadOnly() {
+			return false
+		}
+	}
+	return true
+}
+
+// connForActions returns a connection which can be used to execute the given
+// actions. If the pool has replicas, the actions are all read-only, usePrimary
+// is false, and the session s (which may be nil) has not executed a write
+// recently, it returns a connection to one of the replicas, chosen in
+// round-robin order. Otherwise, or if the connection to the replica failed, it
+// returns a connection to the primary.
+func (p *Pool) connForActions(actions []*Action, usePrimary bool, s *session) redis.Conn {
+	if len(p.replicaPools) == 0 {
+		return p.NewConn()
+	}
+	if !actionsAreReadOnly(actions) || usePrimary || p.inReadYourWritesWindow(s) {
+		return p.NewConn()
+	}
+	i := atomic.AddUint32(&p.nextReplica, 1) % uint32(len(p.replicaPools))
+	conn := p.replicaPools[i].Get()
+	if conn.Err() != nil {
+		// Fall back to the primary if the replica is not available
+		_ = conn.Close()
+		return p.NewConn()
+	}
+	return conn
+}
+
+// session keeps track of the writes executed by one caller, so that the
+// caller's reads can be sent to the primary for a while after each write (see
+// PoolOptions.ReadYourWrites). Sessions are attached to a context with
+// WithSession.
+type session struct {
+	// lastWrite is the time of the most recent write in the session, in unix
+	// nanoseconds. It must be accessed atomically.
+	lastWrite int64
+}
+
+// sessionKey is the key for the session in a context.
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx with a new session attached. If the pool
+// has replicas and the ReadYourWrites option is set, read-only transactions
+// which are executed with the returned context (or a context derived from it)
+// are sent to the primary for ReadYourWrites after any write which was
+// executed with it. Writes executed with other contexts do not affect where
+// those reads are sent. Typically you would call WithSession once for each
+// request or each user, e.g.:
+//
+//	ctx := zoom.WithSession(r.Context())
+//	if err := People.SaveContext(ctx, person); err != nil {
+//		// handle error
+//	}
+//	// FindContext is sent to the primary, so it sees the changes to person.
+//	if err := People.FindContext(ctx, person.ModelID(), person); err != nil {
+//		// handle error
+//	}
+func WithSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &session{})
+}
+
+// sessionFromContext returns the session attached to ctx by WithSession, or
+// nil if there is none.
+func sessionFromContext(ctx context.Context) *session {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// recordWrite records the time of the most recent write in the session s if
+// any of the given actions are not read-only. It does nothing if s is nil or
+// the pool has no replicas.
+func (p *Pool) recordWrite(s *session, actions []*Action) {
+	if s != nil && len(p.replicaPools) > 0 && !actionsAreReadOnly(actions) {
+		atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+	}
+}
+
+// inReadYourWritesWindow returns true iff the ReadYourWrites option is set
+// and the session s executed a write more recently than ReadYourWrites ago. It
+// returns false if s is nil.
+func (p *Pool) inReadYourWritesWindow(s *session) bool {
+	if p.options.ReadYourWrites <= 0 || s == nil {
+		return false
+	}
+	lastWrite := atomic.LoadInt64(&s.lastWrite)
+	return lastWrite != 0 && time.Since(time.Unix(0, lastWrite)) < p.options.ReadYourWrites
+}
+
+// UsePrimary causes the transaction to be executed on the primary even if it
+// only consists of read-only commands and the pool has replicas. Use it when
+// the transaction needs to see the effects of writes which might not have been
+// replicated yet.
+func (t *Transaction) UsePrimary() {
+	t.usePrimary = true
+}
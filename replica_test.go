@@ -0,0 +1,182 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File replica_test.go tests the code in replica.go, i.e. routing read-only
+// transactions to replicas.
+
+package zoom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestActionsAreReadOnly(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedTestModels(1)[0]
+	testCases := []struct {
+		description string
+		addActions  func(tx *Transaction)
+		expected    bool
+	}{
+		{
+			description: "Find",
+			addActions: func(tx *Transaction) {
+				tx.Find(indexedTestModels, "id", &indexedTestModel{})
+			},
+			expected: true,
+		},
+		{
+			description: "FindAll",
+			addActions: func(tx *Transaction) {
+				tx.FindAll(indexedTestModels, &[]*indexedTestModel{})
+			},
+			expected: true,
+		},
+		{
+			description: "Count",
+			addActions: func(tx *Transaction) {
+				var count int
+				tx.Count(indexedTestModels, &count)
+			},
+			expected: true,
+		},
+		{
+			description: "Query with an order",
+			addActions: func(tx *Transaction) {
+				q := indexedTestModels.NewQuery().Order("-Int").Limit(10)
+				newTransactionQuery(q.query, tx).Run(&[]*indexedTestModel{})
+			},
+			expected: true,
+		},
+		{
+			description: "Save",
+			addActions: func(tx *Transaction) {
+				tx.Save(indexedTestModels, model)
+			},
+			expected: false,
+		},
+		{
+			description: "Query with a filter",
+			addActions: func(tx *Transaction) {
+				q := indexedTestModels.NewQuery().Filter("Int >", 0)
+				newTransactionQuery(q.query, tx).Run(&[]*indexedTestModel{})
+			},
+			expected: false,
+		},
+		{
+			description: "Query with StoreIDs",
+			addActions: func(tx *Transaction) {
+				q := indexedTestModels.NewQuery().Order("Int")
+				newTransactionQuery(q.query, tx).StoreIDs("destKey")
+			},
+			expected: false,
+		},
+	}
+	for _, tc := range testCases {
+		tx := testPool.NewTransaction()
+		tc.addActions(tx)
+		if got := actionsAreReadOnly(tx.actions); got != tc.expected {
+			t.Errorf("%s: Expected actionsAreReadOnly to return %v but got %v", tc.description, tc.expected, got)
+		}
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The testing database doubles as the replica. With MaxIdle set to 0, the
+	// number of active connections in each pool tells us which pool a
+	// connection came from.
+	options := testPool.options.WithMaxIdle(0).WithReplicaAddresses(*address)
+	pool := NewPoolWithOptions(options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	readActions := []*Action{{kind: commandAction, name: "HGETALL", args: []interface{}{"key"}}}
+	writeActions := []*Action{{kind: commandAction, name: "HMSET", args: []interface{}{"key", "field", "value"}}}
+	expectConnFromReplica(t, pool, readActions, false, nil, true)
+	expectConnFromReplica(t, pool, writeActions, false, nil, false)
+	expectConnFromReplica(t, pool, readActions, true, nil, false)
+
+	// Reads should be sent to the primary shortly after a write in the same
+	// session if the ReadYourWrites option is set, but writes in other sessions
+	// should not matter.
+	rywPool := NewPoolWithOptions(options.WithReadYourWrites(time.Hour))
+	defer func() {
+		_ = rywPool.Close()
+	}()
+	writer := &session{}
+	other := &session{}
+	expectConnFromReplica(t, rywPool, readActions, false, writer, true)
+	rywPool.recordWrite(writer, writeActions)
+	expectConnFromReplica(t, rywPool, readActions, false, writer, false)
+	expectConnFromReplica(t, rywPool, readActions, false, other, true)
+	expectConnFromReplica(t, rywPool, readActions, false, nil, true)
+
+	// Sessions should be attached to contexts, and writes executed with a
+	// context should be recorded in its session.
+	ctx := WithSession(context.Background())
+	if sessionFromContext(ctx) == nil {
+		t.Fatal("Expected WithSession to attach a session to the context")
+	}
+	if sessionFromContext(context.Background()) != nil {
+		t.Error("Expected context without a session to have none")
+	}
+	tx := rywPool.NewTransaction()
+	tx.Command("SET", redis.Args{"replicaTestKey", "value"}, nil)
+	if err := tx.ExecContext(ctx); err != nil {
+		t.Fatalf("Unexpected error in ExecContext: %s", err.Error())
+	}
+	expectConnFromReplica(t, rywPool, readActions, false, sessionFromContext(ctx), false)
+	expectConnFromReplica(t, rywPool, readActions, false, other, true)
+
+	// Finders and queries should work when reading from a replica
+	models, err := pool.NewCollectionWithOptions(&replicaTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	expected := &replicaTestModel{Int: 42}
+	if err := models.Save(expected); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	got := &replicaTestModel{}
+	if err := models.Find(expected.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected %+v but got %+v", expected, got)
+	}
+	gotModels := []*replicaTestModel{}
+	if err := models.NewQuery().Order("Int").UsePrimary().Run(&gotModels); err != nil {
+		t.Fatalf("Unexpected error in Run: %s", err.Error())
+	}
+	if len(gotModels) != 1 || !reflect.DeepEqual(expected, gotModels[0]) {
+		t.Errorf("Expected [%+v] but got %+v", expected, gotModels)
+	}
+}
+
+// replicaTestModel is a model type used for testing pools with replicas.
+type replicaTestModel struct {
+	Int int `zoom:"index"`
+	RandomID
+}
+
+// expectConnFromReplica gets a connection for the given actions in session s
+// and reports an error if it did not come from a replica when expected to (or
+// vice versa). pool must have MaxIdle set to 0.
+func expectConnFromReplica(t *testing.T, pool *Pool, actions []*Action, usePrimary bool, s *session, expected bool) {
+	conn := pool.connForActions(actions, usePrimary, s)
+	defer conn.Close()
+	if got := pool.replicaPools[0].ActiveCount() == 1; got != expected {
+		t.Errorf("Expected connection for %s from replica to be %v but got %v (usePrimary = %v)", actions[0].name, expected, got, usePrimary)
+	}
+}
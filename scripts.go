@@ -16,16 +16,329 @@ import (
 
 var (
 	
+	aggregateFieldIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- aggregate_field_index is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a list, set, or sorted set which contains the ids of the
+--		models to aggregate. If idsKey is the same as fieldIndexKey, every model in
+--		the field index is included.
+-- 	2) fieldIndexKey: The key of a sorted set for a numeric field index
+-- The script then looks up the score of each id in the field index and returns
+-- an array with the following elements:
+-- 	1) The number of models which have a value for the field
+-- 	2) The sum of the values
+-- 	3) The minimum value, or nil if there were no values
+-- 	4) The maximum value, or nil if there were no values
+-- All the numbers are returned as strings so that they do not get truncated to
+-- integers by Redis. Models which do not have a value for the field (i.e. are
+-- not in the field index) are skipped.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local fieldIndexKey = ARGV[2]
+local count = 0
+local sum = 0
+local min = nil
+local max = nil
+local function add(score)
+	count = count + 1
+	sum = sum + score
+	if min == nil or score < min then
+		min = score
+	end
+	if max == nil or score > max then
+		max = score
+	end
+end
+if idsKey == fieldIndexKey then
+	-- We can read the scores directly from the field index
+	local membersAndScores = redis.call('ZRANGE', fieldIndexKey, 0, -1, 'WITHSCORES')
+	for i = 2, #membersAndScores, 2 do
+		add(tonumber(membersAndScores[i]))
+	end
+else
+	local ids = {}
+	local idsType = redis.call('TYPE', idsKey)['ok']
+	if idsType == 'list' then
+		ids = redis.call('LRANGE', idsKey, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsKey)
+	elseif idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsKey, 0, -1)
+	end
+	for i, id in ipairs(ids) do
+		local score = redis.call('ZSCORE', fieldIndexKey, id)
+		if score then
+			add(tonumber(score))
+		end
+	end
+end
+local function format(n)
+	if n == nil then
+		return false
+	end
+	return string.format('%.17g', n)
+end
+return {tostring(count), format(sum), format(min), format(max)}
+`)
+	countByFieldIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- count_by_field_index is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a list, set, or sorted set which contains the ids of the
+--		models to count. If idsKey is the same as fieldIndexKey, every model in the
+--		field index is counted.
+-- 	2) fieldIndexKey: The key of a sorted set for a field index
+-- 	3) kind: Either "numeric" (for numeric and boolean indexes) or "string"
+-- The script then counts the number of models for each distinct value in the
+-- field index and returns a flat array of value, count pairs in the order they
+-- appear in the field index (i.e. ascending order). For numeric indexes the
+-- value is the score. All values and counts are returned as strings. Models
+-- which do not have a value for the field are not counted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local fieldIndexKey = ARGV[2]
+local kind = ARGV[3]
+-- Build a table of the ids to count, unless we are counting every id
+local includedIDs = nil
+if idsKey ~= fieldIndexKey then
+	includedIDs = {}
+	local ids = {}
+	local idsType = redis.call('TYPE', idsKey)['ok']
+	if idsType == 'list' then
+		ids = redis.call('LRANGE', idsKey, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsKey)
+	elseif idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsKey, 0, -1)
+	end
+	for i, id in ipairs(ids) do
+		includedIDs[id] = true
+	end
+end
+local results = {}
+local lastValue = nil
+local count = 0
+local function add(value, id)
+	if includedIDs ~= nil and not includedIDs[id] then
+		return
+	end
+	if value ~= lastValue then
+		if lastValue ~= nil then
+			table.insert(results, lastValue)
+			table.insert(results, tostring(count))
+		end
+		lastValue = value
+		count = 0
+	end
+	count = count + 1
+end
+if kind == 'string' then
+	local members = redis.call('ZRANGE', fieldIndexKey, 0, -1)
+	for i, member in ipairs(members) do
+		-- The id is everything after the last NULL character and the value is
+		-- everything before it
+		local idStart = string.find(member, '%z[^%z]*$')
+		add(string.sub(member, 1, idStart-1), string.sub(member, idStart+1))
+	end
+else
+	local membersAndScores = redis.call('ZRANGE', fieldIndexKey, 0, -1, 'WITHSCORES')
+	for i = 1, #membersAndScores, 2 do
+		add(string.format('%.17g', tonumber(membersAndScores[i+1])), membersAndScores[i])
+	end
+end
+if lastValue ~= nil then
+	table.insert(results, lastValue)
+	table.insert(results, tostring(count))
+end
+return results
+`)
+	deleteExpiredModelsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_expired_models is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+-- 	2) The current time as a unix timestamp in milliseconds
+-- 	3) The maximum number of ids to check, or 0 for no limit
+-- 	4+) Any number of pairs of the following arguments, one for each field which
+--		needs to be cleaned up:
+--		a) The kind of the field, which is one of "numeric" (for numeric and
+--			boolean indexes), "string" (for string indexes), "unique" (for unique
+--			constraints), or "references" (for references to many other models)
+--		b) The name of the field as it is stored in redis
+-- The script then finds the ids of the models in the sorted set of expiration
+-- times whose expiration time has passed, up to the given limit. Since the expiration time
+-- was computed with the clock of the client which saved the model, the main
+-- hash is checked before anything is deleted. If it still exists, its
+-- expiration time is updated from the time to live that Redis reports, and the
+-- model is kept. Otherwise the model is deleted, including its id in the set of
+-- all ids (or the sorted set of soft deleted ids), and its values in any field
+-- indexes. It returns the number of models that were deleted and the number of
+-- ids that were checked. Every id which was checked is either deleted or moved
+-- past the current time, so if the number of ids checked is equal to the limit,
+-- the script should be run again to check the rest. Since the main
+-- hash has already expired, the values needed to find string and unique index
+-- entries are read from the hash of values which was written by
+-- save_expire_values.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local now = ARGV[2]
+local limit = tonumber(ARGV[3])
+local expireKey = collectionName .. ':expire'
+local allKey = collectionName .. ':all'
+local valuesKey = collectionName .. ':expire:values'
+local ids = nil
+if limit > 0 then
+	ids = redis.call('ZRANGEBYSCORE', expireKey, '-inf', now, 'LIMIT', 0, limit)
+else
+	ids = redis.call('ZRANGEBYSCORE', expireKey, '-inf', now)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	local ttl = redis.call('PTTL', modelKey)
+	if ttl > 0 then
+		-- The model has not expired yet
+		redis.call('ZADD', expireKey, now + ttl, id)
+	elseif ttl == -1 then
+		-- The model no longer expires, e.g. because it was saved after the TTL
+		-- was removed from the collection
+		redis.call('ZREM', expireKey, id)
+	else
+		count = count + 1
+		local values = redis.call('HGET', valuesKey, id)
+		if values ~= false then
+			values = cjson.decode(values)
+		else
+			values = {}
+		end
+		for j = 4, #ARGV, 2 do
+			local kind = ARGV[j]
+			local fieldName = ARGV[j+1]
+			local indexKey = collectionName .. ':' .. fieldName
+			if kind == 'numeric' then
+				redis.call('ZREM', indexKey, id)
+			elseif kind == 'string' then
+				local value = values[fieldName]
+				if value ~= nil then
+					redis.call('ZREM', indexKey, value .. '\0' .. id)
+				end
+			elseif kind == 'unique' then
+				local uniqueKey = indexKey .. ':unique'
+				local value = values[fieldName]
+				if value ~= nil and redis.call('HGET', uniqueKey, value) == id then
+					redis.call('HDEL', uniqueKey, value)
+				end
+			elseif kind == 'references' then
+				redis.call('DEL', modelKey .. ':' .. fieldName)
+			end
+		end
+		redis.call('SREM', allKey, id)
+		redis.call('ZREM', expireKey, id)
+		redis.call('HDEL', valuesKey, id)
+		-- The model might have been soft deleted
+		redis.call('ZREM', collectionName .. ':deleted', id)
+	end
+end
+return {count, #ids}
+`)
+	deleteModelsByListIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_models_by_list_ids is a lua script that takes the following arguments:
+-- 	1) The key of a list of model ids
+--		2) The key prefix of a registered model (its name, wrapped in a hash tag in
+--			cluster mode)
+--		3) The channel for change events, or an empty string if change events
+--			should not be published
+--		4) The name of the collection, which is included in change events
+-- 	5+) Any number of pairs of the following arguments, one for each field which
+--		needs to be cleaned up:
+--		a) The kind of the field, which is one of "numeric" (for numeric and
+--			boolean indexes), "string" (for string indexes), "unique" (for unique
+--			constraints), or "references" (for references to many other models)
+--		b) The name of the field as it is stored in redis
+-- The script then deletes all the models corresponding to the ids in the given
+-- list, including their main hash, their id in the set of all ids and the
+-- sorted set of expiration times (along with the values saved for removing
+-- expired models), and their values in any field indexes. If a channel is
+-- given, it publishes a delete event for each model. It returns the number of
+-- models that were deleted. It does not delete the given list.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local listKey = ARGV[1]
+local collectionName = ARGV[2]
+local channel = ARGV[3]
+local name = ARGV[4]
+local allKey = collectionName .. ':all'
+local expireKey = collectionName .. ':expire'
+local valuesKey = collectionName .. ':expire:values'
+local ids = redis.call('LRANGE', listKey, 0, -1)
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	-- Remove the model from the field indexes. This must happen before the main
+	-- hash is deleted, since string and unique indexes rely on the old values.
+	for j = 5, #ARGV, 2 do
+		local kind = ARGV[j]
+		local fieldName = ARGV[j+1]
+		local indexKey = collectionName .. ':' .. fieldName
+		if kind == 'numeric' then
+			redis.call('ZREM', indexKey, id)
+		elseif kind == 'string' then
+			local value = redis.call('HGET', modelKey, fieldName)
+			if value ~= false then
+				redis.call('ZREM', indexKey, value .. '\0' .. id)
+			end
+		elseif kind == 'unique' then
+			local uniqueKey = indexKey .. ':unique'
+			local value = redis.call('HGET', modelKey, fieldName)
+			if value ~= false and redis.call('HGET', uniqueKey, value) == id then
+				redis.call('HDEL', uniqueKey, value)
+			end
+		elseif kind == 'references' then
+			redis.call('DEL', modelKey .. ':' .. fieldName)
+		end
+	end
+	count = count + redis.call('DEL', modelKey)
+	redis.call('SREM', allKey, id)
+	redis.call('ZREM', expireKey, id)
+	redis.call('HDEL', valuesKey, id)
+	if channel ~= '' then
+		redis.call('PUBLISH', channel, cjson.encode({collection = name, id = id, op = 'delete'}))
+	end
+end
+return count
+`)
 	deleteModelsBySetIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
 -- delete_models_by_set_ids is a lua script that takes the following arguments:
 -- 	1) The key of a set of model ids
---		2) The name of a registered model
+--		2) The key prefix of a registered model (its name, wrapped in a hash tag in
+--			cluster mode)
+--		3+) Optionally, the redis names of any fields which are stored in separate
+--			keys (i.e. references to many other models)
 -- The script then deletes all the models corresponding to the ids in the given
--- set. It returns the number of models that were deleted. It does not delete the
--- given set.
+-- set, including the separate keys for the given field names. It returns the
+-- number of models that were deleted. It does not delete the given set.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -41,6 +354,10 @@ if #ids > 0 then
 		-- Delete the main hash for each model
 		local key = collectionName .. ':' .. id
 		count = count + redis.call('DEL', key)
+		-- Delete the separate keys for any fields (e.g. sets of referenced ids)
+		for j = 3, #ARGV do
+			redis.call('DEL', key .. ':' .. ARGV[j])
+		end
 		-- Remove the model id from the set of all ids
 		-- NOTE: this is not necessarily the same as the
 		-- setName we were given
@@ -55,7 +372,8 @@ return count
 -- license, which can be found in the LICENSE file.
 
 -- delete_string_index is a lua script that takes the following arguments:
--- 	1) The name of a registered model
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
 --		2) The id of the model to be deleted from the index
 --		3) The name of the indexed string field
 -- The script then checks if there is a value for the given field name stored in the
@@ -77,6 +395,130 @@ if oldValue ~= false then
 	local oldMember = oldValue .. "\0" .. modelID
 	redis.call("ZREM", indexKey, oldMember)
 end
+`)
+	extractIdsAfterCursorScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extract_ids_after_cursor is a lua script that takes the following arguments:
+-- 	1) setKey: The key of a sorted set for a field index
+-- 	2) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	3) kind: Either "numeric" (for numeric and boolean indexes) or "string"
+-- 	4) direction: Either "asc" or "desc"
+-- 	5) value: The field value (or score for numeric indexes) of the last model
+--		that was seen
+-- 	6) id: The id of the last model that was seen
+-- 	7) limit: The maximum number of ids to store, or 0 to store all of them
+-- The script then stores the ids of the models which come after the (value, id)
+-- pair in the given direction in destKey. Models with the same value are ordered
+-- by id, which matches the order used by ZRANGE for numeric indexes and by
+-- ZRANGEBYLEX for string indexes. The ids are scored by their position, so that
+-- sorting destKey in the given direction returns them in order. Only the ids
+-- which are stored are read from the field index. The model identified by id
+-- does not need to exist anymore.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = ARGV[1]
+local destKey = ARGV[2]
+local kind = ARGV[3]
+local direction = ARGV[4]
+local value = ARGV[5]
+local id = ARGV[6]
+local limit = tonumber(ARGV[7])
+-- compareBytes returns -1, 0, or 1 if a is less than, equal to, or greater
+-- than b respectively. It does not depend on the locale of the server.
+local function compareBytes(a, b)
+	local lenA, lenB = #a, #b
+	local minLen = math.min(lenA, lenB)
+	for i = 1, minLen do
+		local byteA, byteB = string.byte(a, i), string.byte(b, i)
+		if byteA ~= byteB then
+			if byteA < byteB then
+				return -1
+			end
+			return 1
+		end
+	end
+	if lenA == lenB then
+		return 0
+	elseif lenA < lenB then
+		return -1
+	end
+	return 1
+end
+-- store adds the given id to destKey after the ids which were already stored
+local count = 0
+local function store(member)
+	count = count + 1
+	if direction == 'desc' then
+		redis.call('ZADD', destKey, -count, member)
+	else
+		redis.call('ZADD', destKey, count, member)
+	end
+end
+-- rangeArgs returns the arguments for a range command on setKey from start to
+-- stop, followed by any extra arguments, which returns at most n members if n
+-- is positive.
+local function rangeArgs(start, stop, n, ...)
+	local args = {setKey, start, stop, ...}
+	if n > 0 then
+		table.insert(args, 'LIMIT')
+		table.insert(args, 0)
+		table.insert(args, n)
+	end
+	return args
+end
+if kind == 'string' then
+	-- Members of a string index are of the form value + NULL + id, so comparing
+	-- members directly gives the correct order for (value, id) pairs.
+	local members
+	local start = '(' .. value .. '\0' .. id
+	if direction == 'desc' then
+		members = redis.call('ZREVRANGEBYLEX', unpack(rangeArgs(start, '-', limit)))
+	else
+		members = redis.call('ZRANGEBYLEX', unpack(rangeArgs(start, '+', limit)))
+	end
+	for i, member in ipairs(members) do
+		-- The id is everything after the last NULL character
+		local idStart = string.find(member, '%z[^%z]*$')
+		store(string.sub(member, idStart+1))
+	end
+else
+	-- Get the members with a score that is equal to or after the given value
+	-- and then skip the ones with the same score which come before id. If there
+	-- is a limit, the members with the same score might all be skipped, so they
+	-- are not counted towards it.
+	local score = tonumber(value)
+	local n = 0
+	if limit > 0 then
+		n = limit + redis.call('ZCOUNT', setKey, value, value)
+	end
+	local membersAndScores
+	if direction == 'desc' then
+		membersAndScores = redis.call('ZREVRANGEBYSCORE', unpack(rangeArgs(value, '-inf', n, 'WITHSCORES')))
+	else
+		membersAndScores = redis.call('ZRANGEBYSCORE', unpack(rangeArgs(value, '+inf', n, 'WITHSCORES')))
+	end
+	for i = 1, #membersAndScores, 2 do
+		if limit > 0 and count >= limit then
+			break
+		end
+		local member = membersAndScores[i]
+		local isAfter = true
+		if tonumber(membersAndScores[i+1]) == score then
+			if direction == 'desc' then
+				isAfter = compareBytes(member, id) < 0
+			else
+				isAfter = compareBytes(member, id) > 0
+			end
+		end
+		if isAfter then
+			store(member)
+		end
+	end
+end
 `)
 	extractIdsFromFieldIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
@@ -139,5 +581,710 @@ if #members > 0 then
 		redis.call('ZADD', destKey, i, id)
 	end
 end
+`)
+	findDeletedPageScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_deleted_page is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) The minimum deletion time in unix milliseconds, or -inf
+--		3) An id. If not empty, models which were deleted exactly at the minimum
+--			deletion time are only included if their id sorts after it
+--		4) The maximum number of models to return
+--		5+) The redis names of the fields to return for each model
+-- The script then finds the soft deleted models in the order they were
+-- deleted, starting at the given position, and returns a list with up to three
+-- elements. The first is a list with the values of the given fields followed
+-- by the id of each model, in the same format as SORT with GET. If there are
+-- more models after the ones that were returned, the second and third elements
+-- are the deletion time and id of the last model that was returned.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local min = ARGV[2]
+local afterId = ARGV[3]
+local limit = tonumber(ARGV[4])
+local deletedKey = collectionName .. ':deleted'
+-- Collect up to limit + 1 (id, score) pairs so we know whether there is another
+-- page. Models which were deleted at the minimum time and whose id does not
+-- sort after afterId were on a previous page and are skipped.
+local ids = {}
+local scores = {}
+local offset = 0
+while #ids <= limit do
+	local batch = redis.call('ZRANGEBYSCORE', deletedKey, min, '+inf', 'WITHSCORES', 'LIMIT', offset, limit + 1)
+	if #batch == 0 then
+		break
+	end
+	for i = 1, #batch, 2 do
+		local id = batch[i]
+		local score = batch[i + 1]
+		if afterId == '' or tonumber(score) > tonumber(min) or id > afterId then
+			table.insert(ids, id)
+			table.insert(scores, score)
+			if #ids > limit then
+				break
+			end
+		end
+	end
+	offset = offset + #batch / 2
+end
+local fieldNames = {}
+for i = 5, #ARGV do
+	table.insert(fieldNames, ARGV[i])
+end
+local values = {}
+for i = 1, math.min(#ids, limit) do
+	if #fieldNames > 0 then
+		local fieldValues = redis.call('HMGET', collectionName .. ':' .. ids[i], unpack(fieldNames))
+		for j = 1, #fieldNames do
+			table.insert(values, fieldValues[j])
+		end
+	end
+	table.insert(values, ids[i])
+end
+if #ids > limit then
+	return {values, scores[limit], ids[limit]}
+end
+return {values}
+`)
+	findUniqueConflictScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_unique_conflict is a lua script that takes any number of groups of the
+-- following arguments:
+-- 	1) uniqueKey: The key of a hash which maps the values of a unique field to
+--		the id of the model which has that value
+-- 	2) value: The value that a model is about to be saved with
+-- 	3) id: The id of the model that is about to be saved
+-- The script checks each group in order and returns an array with the 1-based
+-- number of the first group that conflicts (i.e. the value already belongs to
+-- a different model) and the id of the model that the value belongs to. If
+-- there are no conflicts, it returns nil.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+for i = 1, #ARGV, 3 do
+	local uniqueKey = ARGV[i]
+	local value = ARGV[i+1]
+	local id = ARGV[i+2]
+	local existingID = redis.call('HGET', uniqueKey, value)
+	if existingID ~= false and existingID ~= id then
+		return {tostring((i+2)/3), existingID}
+	end
+end
+return false
+`)
+	findVersionConflictScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_version_conflict is a lua script that takes any number of groups of the
+-- following arguments:
+-- 	1) modelKey: The key of the main hash for a model
+-- 	2) versionField: The name of the version field as it is stored in the hash
+-- 	3) version: The version of the model that is about to be saved
+-- The script checks each group in order and returns an array with the 1-based
+-- number of the first group that conflicts (i.e. the version in the database
+-- is different) and the version in the database. If the model does not exist
+-- or does not have a version, its version is considered to be 0. If there are
+-- no conflicts, it returns nil.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+for i = 1, #ARGV, 3 do
+	local modelKey = ARGV[i]
+	local versionField = ARGV[i+1]
+	local version = tonumber(ARGV[i+2])
+	local currentVersion = tonumber(redis.call('HGET', modelKey, versionField)) or 0
+	if currentVersion ~= version then
+		return {(i+2)/3, currentVersion}
+	end
+end
+return false
+`)
+	incrementFieldScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- increment_field is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) The id of the model
+--		3) The name of a numeric field as it is stored in redis
+--		4) The amount to increment the field by
+--		5) The command to use for incrementing the field, which is either HINCRBY
+--			(for integer fields) or HINCRBYFLOAT (for float fields)
+--		6) "1" if the field has a numeric index, otherwise "0"
+--		7) The name of the version field as it is stored in redis, or an empty
+--			string if the model does not have a version field
+--		8) "1" if the version field is indexed, otherwise "0"
+--		9) The channel for change events, or an empty string if change events
+--			should not be published
+--		10) The change event to publish
+--		11) The smallest value the field can hold, or an empty string if there is
+--			no limit other than the one enforced by Redis
+--		12) The largest value the field can hold, or an empty string if there is
+--			no limit other than the one enforced by Redis
+-- The script then increments the field and updates the index on the field (if
+-- any), and increments the version field (if any). It returns the new value of
+-- the field, or nil if the model does not exist or was soft deleted. If the new
+-- value would be outside of the range given by the min and max arguments, the
+-- field is left unchanged and the script returns -1 instead.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local id = ARGV[2]
+local fieldName = ARGV[3]
+local delta = ARGV[4]
+local command = ARGV[5]
+local indexed = ARGV[6] == '1'
+local versionField = ARGV[7]
+local versionIndexed = ARGV[8] == '1'
+local channel = ARGV[9]
+local event = ARGV[10]
+local min = ARGV[11]
+local max = ARGV[12]
+local modelKey = collectionName .. ':' .. id
+-- Don't create a new hash if the model does not exist, and don't change models
+-- which were soft deleted
+if redis.call('EXISTS', modelKey) == 0 or redis.call('ZSCORE', collectionName .. ':deleted', id) then
+	return false
+end
+local oldValue = redis.call('HGET', modelKey, fieldName)
+redis.call(command, modelKey, fieldName, delta)
+-- Get the new value as a string to avoid losing precision for large integers
+local newValue = redis.call('HGET', modelKey, fieldName)
+local number = tonumber(newValue)
+if (min ~= '' and number < tonumber(min)) or (max ~= '' and number > tonumber(max)) then
+	-- Restore the old value, since the new one would not fit in the field
+	if oldValue then
+		redis.call('HSET', modelKey, fieldName, oldValue)
+	else
+		redis.call('HDEL', modelKey, fieldName)
+	end
+	return -1
+end
+if indexed then
+	redis.call('ZADD', collectionName .. ':' .. fieldName, newValue, id)
+end
+if versionField ~= '' then
+	local version = redis.call('HINCRBY', modelKey, versionField, 1)
+	if versionIndexed then
+		redis.call('ZADD', collectionName .. ':' .. versionField, version, id)
+	end
+end
+if channel ~= '' then
+	redis.call('PUBLISH', channel, event)
+end
+return newValue
+`)
+	orderIdsByFieldsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- order_ids_by_fields is a lua script that takes the following arguments:
+-- 	1) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	2) sourceKey: The key of a set or sorted set with the ids to sort, e.g. the
+--		ids which match the filters of a query
+-- 	3) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+-- 	4) The number of sort keys, n
+-- The next n*4 arguments are groups of four which describe each sort key, from
+-- highest to lowest priority:
+-- 	1) setKey: The key of a sorted set for a field index
+-- 	2) kind: Either "numeric" (for numeric and boolean indexes) or "string"
+-- 	3) direction: Either "asc" or "desc"
+-- 	4) The redis name of the field
+-- The script then sorts the ids in sourceKey which appear in every one of the
+-- given field indexes by each sort key in turn, using the model id as the final
+-- tie breaker (in the direction of the last sort key). Only the ids in
+-- sourceKey are looked up: the scores of numeric fields are read with ZSCORE,
+-- and the values of string fields are read from the main hash of each model
+-- with HMGET. The ids are stored in destKey with sequential scores so that the
+-- members are in the correct order. Strings are compared byte by byte, so the
+-- order is the same as the order used by ZRANGEBYLEX.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local destKey = ARGV[1]
+local sourceKey = ARGV[2]
+local collectionName = ARGV[3]
+local numKeys = tonumber(ARGV[4])
+-- compareBytes returns -1, 0, or 1 if a is less than, equal to, or greater
+-- than b respectively. It does not depend on the locale of the server.
+local function compareBytes(a, b)
+	local lenA, lenB = #a, #b
+	local minLen = math.min(lenA, lenB)
+	for i = 1, minLen do
+		local byteA, byteB = string.byte(a, i), string.byte(b, i)
+		if byteA ~= byteB then
+			if byteA < byteB then
+				return -1
+			end
+			return 1
+		end
+	end
+	if lenA == lenB then
+		return 0
+	elseif lenA < lenB then
+		return -1
+	end
+	return 1
+end
+-- Read the ids to sort
+local sourceIds = nil
+if redis.call('TYPE', sourceKey)['ok'] == 'set' then
+	sourceIds = redis.call('SMEMBERS', sourceKey)
+else
+	sourceIds = redis.call('ZRANGE', sourceKey, 0, -1)
+end
+local sortKeys = {}
+local stringFields = {}
+for k = 1, numKeys do
+	local sortKey = {
+		setKey = ARGV[4*k+1],
+		kind = ARGV[4*k+2],
+		desc = (ARGV[4*k+3] == 'desc'),
+		field = ARGV[4*k+4],
+	}
+	if sortKey.kind == 'string' then
+		table.insert(stringFields, sortKey.field)
+		sortKey.valueIndex = #stringFields
+	end
+	sortKeys[k] = sortKey
+end
+-- Build a table of id -> values, with one value for each sort key. Only
+-- include the ids which are present in every index.
+local ids = {}
+local values = {}
+for _, id in ipairs(sourceIds) do
+	local stringValues = {}
+	if #stringFields > 0 then
+		stringValues = redis.call('HMGET', collectionName .. ':' .. id, unpack(stringFields))
+	end
+	local idValues = {}
+	local presentInAll = true
+	for k, sortKey in ipairs(sortKeys) do
+		local value = nil
+		if sortKey.kind == 'string' then
+			-- The value in the main hash is only meaningful if the model is in the
+			-- string index, which is not the case for nil pointers. Members of a
+			-- string index are of the form value + NULL + id.
+			value = stringValues[sortKey.valueIndex]
+			if value and not redis.call('ZSCORE', sortKey.setKey, value .. '\0' .. id) then
+				value = nil
+			end
+		else
+			local score = redis.call('ZSCORE', sortKey.setKey, id)
+			if score then
+				value = tonumber(score)
+			end
+		end
+		if not value then
+			presentInAll = false
+			break
+		end
+		idValues[k] = value
+	end
+	if presentInAll then
+		table.insert(ids, id)
+		values[id] = idValues
+	end
+end
+-- Sort the ids by each sort key in turn
+table.sort(ids, function(a, b)
+	for k, sortKey in ipairs(sortKeys) do
+		local valueA, valueB = values[a][k], values[b][k]
+		if valueA ~= valueB then
+			local less = nil
+			if sortKey.kind == 'string' then
+				less = compareBytes(valueA, valueB) < 0
+			else
+				less = valueA < valueB
+			end
+			if sortKey.desc then
+				return not less
+			end
+			return less
+		end
+	end
+	if sortKeys[numKeys].desc then
+		return compareBytes(a, b) > 0
+	end
+	return compareBytes(a, b) < 0
+end)
+-- Add each id to destKey with a sequential score
+for i, id in ipairs(ids) do
+	redis.call('ZADD', destKey, i, id)
+end
+`)
+	purgeDeletedModelsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- purge_deleted_models is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) A unix timestamp in milliseconds
+--		3+) The redis names of any fields which are stored in separate keys (i.e.
+--			references to many other models)
+-- The script then permanently deletes every model which was soft deleted at or
+-- before the given time, including its main hash and the separate keys for the
+-- given field names. The models were already removed from the set of all ids
+-- and any field indexes when they were soft deleted. It returns the number of
+-- models that were purged.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local before = ARGV[2]
+local deletedKey = collectionName .. ':deleted'
+local expireKey = collectionName .. ':expire'
+local valuesKey = collectionName .. ':expire:values'
+local ids = redis.call('ZRANGEBYSCORE', deletedKey, '-inf', before)
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	redis.call('DEL', modelKey)
+	for j = 3, #ARGV do
+		redis.call('DEL', modelKey .. ':' .. ARGV[j])
+	end
+	redis.call('ZREM', deletedKey, id)
+	redis.call('ZREM', expireKey, id)
+	redis.call('HDEL', valuesKey, id)
+end
+return #ids
+`)
+	renameHashFieldScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- rename_hash_field is a lua script that takes the following arguments:
+-- 	1) key: The key of a hash, e.g. the main hash for a model
+-- 	2) oldField: The current name of the field
+-- 	3) newField: The new name of the field
+-- 	4) id: The id of the model
+-- 	5) oldIndexKey: The key of the field index for oldField
+-- 	6) newIndexKey: The key of the field index for newField
+-- 	7) oldUniqueKey: The key of the unique index for oldField
+-- 	8) newUniqueKey: The key of the unique index for newField
+-- The script renames oldField to newField. If the hash already has newField
+-- (e.g. because the model was saved with the new schema while the migration was
+-- running), the value of newField is kept and oldField is simply removed. The
+-- entries for the model in the field index and unique index for oldField are
+-- moved to the indexes for newField in the same way, without replacing any
+-- entries that were written for newField. If the hash does not have oldField,
+-- the script does nothing, so it is safe to run it more than once. It returns 1
+-- if the field was renamed and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+local key = ARGV[1]
+local oldField = ARGV[2]
+local newField = ARGV[3]
+local id = ARGV[4]
+local oldIndexKey = ARGV[5]
+local newIndexKey = ARGV[6]
+local oldUniqueKey = ARGV[7]
+local newUniqueKey = ARGV[8]
+local value = redis.call('HGET', key, oldField)
+if value == false then
+	return 0
+end
+local renamed = redis.call('HSETNX', key, newField, value) == 1
+redis.call('HDEL', key, oldField)
+-- Move the entry in the field index (if any). Numeric and boolean indexes use
+-- the id as the member, and string indexes use the value followed by a NULL
+-- character and the id.
+local score = redis.call('ZSCORE', oldIndexKey, id)
+if score ~= false then
+	redis.call('ZREM', oldIndexKey, id)
+	if renamed then
+		redis.call('ZADD', newIndexKey, score, id)
+	end
+end
+local member = value .. '\0' .. id
+if redis.call('ZSCORE', oldIndexKey, member) ~= false then
+	redis.call('ZREM', oldIndexKey, member)
+	if renamed then
+		redis.call('ZADD', newIndexKey, 0, member)
+	end
+end
+-- Move the entry in the unique index (if any). A value which already belongs
+-- to another model in the new unique index is reported as a
+-- UniqueConstraintError before the transaction is executed (see
+-- addRenameUniqueChecks in ../migration.go), so HSETNX only protects against
+-- overwriting it.
+if redis.call('HGET', oldUniqueKey, value) == id then
+	redis.call('HDEL', oldUniqueKey, value)
+	if renamed then
+		redis.call('HSETNX', newUniqueKey, value, id)
+	end
+end
+if renamed then
+	return 1
+end
+return 0
+`)
+	saveExpireValuesScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- save_expire_values is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+-- 	2) The id of the model
+-- 	3+) The redis names of any fields which have a string index or a unique
+--		constraint
+-- The script then copies the values of the given fields from the main hash of
+-- the model into a hash of encoded values which does not expire, so that the
+-- model can be removed from the string and unique indexes after Redis has
+-- removed the main hash. It does nothing if the main hash does not exist, and
+-- returns 1 if the values were copied or 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local id = ARGV[2]
+local modelKey = collectionName .. ':' .. id
+if redis.call('EXISTS', modelKey) == 0 then
+	return 0
+end
+local values = {}
+for i = 3, #ARGV do
+	local value = redis.call('HGET', modelKey, ARGV[i])
+	if value ~= false then
+		values[ARGV[i]] = value
+	end
+end
+redis.call('HSET', collectionName .. ':expire:values', id, cjson.encode(values))
+return 1
+`)
+	softDeleteModelsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- soft_delete_models is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) The current time as a unix timestamp in milliseconds
+--		3) The kind of the next argument, which is one of "id" (for a single model
+--			id), "set" (for the key of a set of model ids), or "list" (for the key of
+--			a list of model ids)
+--		4) The id or the key of the set or list of ids
+--		5) The channel for change events, or an empty string if change events
+--			should not be published
+--		6) The name of the collection, which is included in change events
+-- 	7+) Any number of pairs of the following arguments, one for each field which
+--		needs to be cleaned up:
+--		a) The kind of the field, which is one of "numeric" (for numeric and
+--			boolean indexes), "string" (for string indexes), "unique" (for unique
+--			constraints), or "references" (for references to many other models)
+--		b) The name of the field as it is stored in redis
+-- The script then soft deletes each of the given models which is in the set of
+-- all ids. It moves the id from the set of all ids to the sorted set of deleted
+-- ids, with the current time as the score, and removes the model from any field
+-- indexes and unique indexes. The main hash and any references to many other
+-- models are kept so that the model can be restored later. If a channel is
+-- given, it publishes a delete event for each model. It returns the number of
+-- models that were soft deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local now = ARGV[2]
+local sourceKind = ARGV[3]
+local source = ARGV[4]
+local channel = ARGV[5]
+local name = ARGV[6]
+local allKey = collectionName .. ':all'
+local deletedKey = collectionName .. ':deleted'
+local ids
+if sourceKind == 'set' then
+	ids = redis.call('SMEMBERS', source)
+elseif sourceKind == 'list' then
+	ids = redis.call('LRANGE', source, 0, -1)
+else
+	ids = {source}
+end
+local count = 0
+for i, id in ipairs(ids) do
+	-- Only soft delete models which have not already been deleted
+	if redis.call('SREM', allKey, id) == 1 then
+		local modelKey = collectionName .. ':' .. id
+		for j = 7, #ARGV, 2 do
+			local kind = ARGV[j]
+			local fieldName = ARGV[j+1]
+			local indexKey = collectionName .. ':' .. fieldName
+			if kind == 'numeric' then
+				redis.call('ZREM', indexKey, id)
+			elseif kind == 'string' then
+				local value = redis.call('HGET', modelKey, fieldName)
+				if value ~= false then
+					redis.call('ZREM', indexKey, value .. '\0' .. id)
+				end
+			elseif kind == 'unique' then
+				local uniqueKey = indexKey .. ':unique'
+				local value = redis.call('HGET', modelKey, fieldName)
+				if value ~= false and redis.call('HGET', uniqueKey, value) == id then
+					redis.call('HDEL', uniqueKey, value)
+				end
+			end
+		end
+		redis.call('ZADD', deletedKey, now, id)
+		count = count + 1
+		if channel ~= '' then
+			redis.call('PUBLISH', channel, cjson.encode({collection = name, id = id, op = 'delete'}))
+		end
+	end
+end
+return count
+`)
+	updateModelsByListIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_models_by_list_ids is a lua script that takes the following arguments:
+-- 	1) The key of a list of model ids
+--		2) The key prefix of a registered model (its name, wrapped in a hash tag in
+--			cluster mode)
+--		3) The channel for change events, or an empty string if change events
+--			should not be published
+--		4) The name of the collection, which is included in change events
+--		5) The names of the updated fields as a JSON array, which is included in
+--			change events
+--		6) The name of the version field as it is stored in redis, or an empty
+--			string if the model does not have a version field
+--		7) "1" if the version field is indexed, otherwise "0"
+-- 	8+) Any number of groups of the following arguments, one for each field to
+--		update:
+--		a) The name of the field as it is stored in redis
+--		b) The new value for the field as it is stored in the main hash
+--		c) The kind of index on the field, which is one of "none", "numeric" (for
+--			numeric and boolean indexes), or "string"
+--		d) "1" if the new value should be added to the index, or "0" if it is nil
+--		e) The score (for numeric indexes) or value (for string indexes) to add
+--			to the index
+-- The script then sets the given fields for each model in the given list which
+-- exists, replacing the old values in any field indexes, and increments the
+-- version field (if any). The values of any string indexed fields are also
+-- updated in the hash of values used to remove expired models from the indexes
+-- (if the model has an entry there). If a channel is given, it publishes a save
+-- event for each model. It returns the number of models that were updated. It does not
+-- delete the given list.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local listKey = ARGV[1]
+local collectionName = ARGV[2]
+local channel = ARGV[3]
+local name = ARGV[4]
+local fieldNames = ARGV[5]
+local versionField = ARGV[6]
+local versionIndexed = ARGV[7] == '1'
+local valuesKey = collectionName .. ':expire:values'
+local ids = redis.call('LRANGE', listKey, 0, -1)
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	-- Skip any models which do not exist
+	if redis.call('EXISTS', modelKey) == 1 then
+		local hashArgs = {}
+		local values = redis.call('HGET', valuesKey, id)
+		if values ~= false then
+			values = cjson.decode(values)
+		end
+		for j = 8, #ARGV, 5 do
+			local fieldName = ARGV[j]
+			local value = ARGV[j+1]
+			local kind = ARGV[j+2]
+			local hasIndexValue = ARGV[j+3] == '1'
+			local indexValue = ARGV[j+4]
+			local indexKey = collectionName .. ':' .. fieldName
+			if kind == 'numeric' then
+				if hasIndexValue then
+					redis.call('ZADD', indexKey, indexValue, id)
+				else
+					redis.call('ZREM', indexKey, id)
+				end
+			elseif kind == 'string' then
+				-- Remove the old value from the index (if any). This must happen before
+				-- the main hash is updated.
+				local oldValue = redis.call('HGET', modelKey, fieldName)
+				if oldValue ~= false then
+					redis.call('ZREM', indexKey, oldValue .. '\0' .. id)
+				end
+				if hasIndexValue then
+					redis.call('ZADD', indexKey, 0, indexValue .. '\0' .. id)
+				end
+				if values ~= false then
+					values[fieldName] = value
+				end
+			end
+			table.insert(hashArgs, fieldName)
+			table.insert(hashArgs, value)
+		end
+		redis.call('HMSET', modelKey, unpack(hashArgs))
+		if values ~= false then
+			redis.call('HSET', valuesKey, id, cjson.encode(values))
+		end
+		if versionField ~= '' then
+			local version = redis.call('HINCRBY', modelKey, versionField, 1)
+			if versionIndexed then
+				redis.call('ZADD', collectionName .. ':' .. versionField, version, id)
+			end
+		end
+		count = count + 1
+		if channel ~= '' then
+			local event = {collection = name, id = id, fields = cjson.decode(fieldNames), op = 'save'}
+			redis.call('PUBLISH', channel, cjson.encode(event))
+		end
+	end
+end
+return count
+`)
+	updateUniqueIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_unique_index is a lua script that takes the following arguments:
+-- 	1) modelKey: The key of the main hash for a model
+-- 	2) uniqueKey: The key of a hash which maps the values of a unique field to
+--		the id of the model which has that value
+-- 	3) fieldName: The name of the unique field as it is stored in redis
+-- 	4) id: The id of the model
+-- 	5) newValue: (optional) The new value for the field
+-- The script removes the old value for the field (if any) from the unique index
+-- and then, if newValue is given, adds newValue to the unique index.
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = ARGV[1]
+local uniqueKey = ARGV[2]
+local fieldName = ARGV[3]
+local id = ARGV[4]
+local newValue = ARGV[5]
+-- Get the old value from the existing model hash (if any)
+local oldValue = redis.call('HGET', modelKey, fieldName)
+if oldValue ~= false and redis.call('HGET', uniqueKey, oldValue) == id then
+	redis.call('HDEL', uniqueKey, oldValue)
+end
+if newValue ~= nil then
+	redis.call('HSET', uniqueKey, newValue, id)
+end
 `)
 )
\ No newline at end of file
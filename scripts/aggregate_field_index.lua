@@ -0,0 +1,68 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- aggregate_field_index is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a list, set, or sorted set which contains the ids of the
+--		models to aggregate. If idsKey is the same as fieldIndexKey, every model in
+--		the field index is included.
+-- 	2) fieldIndexKey: The key of a sorted set for a numeric field index
+-- The script then looks up the score of each id in the field index and returns
+-- an array with the following elements:
+-- 	1) The number of models which have a value for the field
+-- 	2) The sum of the values
+-- 	3) The minimum value, or nil if there were no values
+-- 	4) The maximum value, or nil if there were no values
+-- All the numbers are returned as strings so that they do not get truncated to
+-- integers by Redis. Models which do not have a value for the field (i.e. are
+-- not in the field index) are skipped.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local fieldIndexKey = ARGV[2]
+local count = 0
+local sum = 0
+local min = nil
+local max = nil
+local function add(score)
+	count = count + 1
+	sum = sum + score
+	if min == nil or score < min then
+		min = score
+	end
+	if max == nil or score > max then
+		max = score
+	end
+end
+if idsKey == fieldIndexKey then
+	-- We can read the scores directly from the field index
+	local membersAndScores = redis.call('ZRANGE', fieldIndexKey, 0, -1, 'WITHSCORES')
+	for i = 2, #membersAndScores, 2 do
+		add(tonumber(membersAndScores[i]))
+	end
+else
+	local ids = {}
+	local idsType = redis.call('TYPE', idsKey)['ok']
+	if idsType == 'list' then
+		ids = redis.call('LRANGE', idsKey, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsKey)
+	elseif idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsKey, 0, -1)
+	end
+	for i, id in ipairs(ids) do
+		local score = redis.call('ZSCORE', fieldIndexKey, id)
+		if score then
+			add(tonumber(score))
+		end
+	end
+end
+local function format(n)
+	if n == nil then
+		return false
+	end
+	return string.format('%.17g', n)
+end
+return {tostring(count), format(sum), format(min), format(max)}
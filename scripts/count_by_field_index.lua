@@ -0,0 +1,75 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- count_by_field_index is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a list, set, or sorted set which contains the ids of the
+--		models to count. If idsKey is the same as fieldIndexKey, every model in the
+--		field index is counted.
+-- 	2) fieldIndexKey: The key of a sorted set for a field index
+-- 	3) kind: Either "numeric" (for numeric and boolean indexes) or "string"
+-- The script then counts the number of models for each distinct value in the
+-- field index and returns a flat array of value, count pairs in the order they
+-- appear in the field index (i.e. ascending order). For numeric indexes the
+-- value is the score. All values and counts are returned as strings. Models
+-- which do not have a value for the field are not counted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local fieldIndexKey = ARGV[2]
+local kind = ARGV[3]
+-- Build a table of the ids to count, unless we are counting every id
+local includedIDs = nil
+if idsKey ~= fieldIndexKey then
+	includedIDs = {}
+	local ids = {}
+	local idsType = redis.call('TYPE', idsKey)['ok']
+	if idsType == 'list' then
+		ids = redis.call('LRANGE', idsKey, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsKey)
+	elseif idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsKey, 0, -1)
+	end
+	for i, id in ipairs(ids) do
+		includedIDs[id] = true
+	end
+end
+local results = {}
+local lastValue = nil
+local count = 0
+local function add(value, id)
+	if includedIDs ~= nil and not includedIDs[id] then
+		return
+	end
+	if value ~= lastValue then
+		if lastValue ~= nil then
+			table.insert(results, lastValue)
+			table.insert(results, tostring(count))
+		end
+		lastValue = value
+		count = 0
+	end
+	count = count + 1
+end
+if kind == 'string' then
+	local members = redis.call('ZRANGE', fieldIndexKey, 0, -1)
+	for i, member in ipairs(members) do
+		-- The id is everything after the last NULL character and the value is
+		-- everything before it
+		local idStart = string.find(member, '%z[^%z]*$')
+		add(string.sub(member, 1, idStart-1), string.sub(member, idStart+1))
+	end
+else
+	local membersAndScores = redis.call('ZRANGE', fieldIndexKey, 0, -1, 'WITHSCORES')
+	for i = 1, #membersAndScores, 2 do
+		add(string.format('%.17g', tonumber(membersAndScores[i+1])), membersAndScores[i])
+	end
+end
+if lastValue ~= nil then
+	table.insert(results, lastValue)
+	table.insert(results, tostring(count))
+end
+return results
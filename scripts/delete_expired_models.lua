@@ -0,0 +1,93 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_expired_models is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+-- 	2) The current time as a unix timestamp in milliseconds
+-- 	3) The maximum number of ids to check, or 0 for no limit
+-- 	4+) Any number of pairs of the following arguments, one for each field which
+--		needs to be cleaned up:
+--		a) The kind of the field, which is one of "numeric" (for numeric and
+--			boolean indexes), "string" (for string indexes), "unique" (for unique
+--			constraints), or "references" (for references to many other models)
+--		b) The name of the field as it is stored in redis
+-- The script then finds the ids of the models in the sorted set of expiration
+-- times whose expiration time has passed, up to the given limit. Since the expiration time
+-- was computed with the clock of the client which saved the model, the main
+-- hash is checked before anything is deleted. If it still exists, its
+-- expiration time is updated from the time to live that Redis reports, and the
+-- model is kept. Otherwise the model is deleted, including its id in the set of
+-- all ids (or the sorted set of soft deleted ids), and its values in any field
+-- indexes. It returns the number of models that were deleted and the number of
+-- ids that were checked. Every id which was checked is either deleted or moved
+-- past the current time, so if the number of ids checked is equal to the limit,
+-- the script should be run again to check the rest. Since the main
+-- hash has already expired, the values needed to find string and unique index
+-- entries are read from the hash of values which was written by
+-- save_expire_values.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local now = ARGV[2]
+local limit = tonumber(ARGV[3])
+local expireKey = collectionName .. ':expire'
+local allKey = collectionName .. ':all'
+local valuesKey = collectionName .. ':expire:values'
+local ids = nil
+if limit > 0 then
+	ids = redis.call('ZRANGEBYSCORE', expireKey, '-inf', now, 'LIMIT', 0, limit)
+else
+	ids = redis.call('ZRANGEBYSCORE', expireKey, '-inf', now)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	local ttl = redis.call('PTTL', modelKey)
+	if ttl > 0 then
+		-- The model has not expired yet
+		redis.call('ZADD', expireKey, now + ttl, id)
+	elseif ttl == -1 then
+		-- The model no longer expires, e.g. because it was saved after the TTL
+		-- was removed from the collection
+		redis.call('ZREM', expireKey, id)
+	else
+		count = count + 1
+		local values = redis.call('HGET', valuesKey, id)
+		if values ~= false then
+			values = cjson.decode(values)
+		else
+			values = {}
+		end
+		for j = 4, #ARGV, 2 do
+			local kind = ARGV[j]
+			local fieldName = ARGV[j+1]
+			local indexKey = collectionName .. ':' .. fieldName
+			if kind == 'numeric' then
+				redis.call('ZREM', indexKey, id)
+			elseif kind == 'string' then
+				local value = values[fieldName]
+				if value ~= nil then
+					redis.call('ZREM', indexKey, value .. '\0' .. id)
+				end
+			elseif kind == 'unique' then
+				local uniqueKey = indexKey .. ':unique'
+				local value = values[fieldName]
+				if value ~= nil and redis.call('HGET', uniqueKey, value) == id then
+					redis.call('HDEL', uniqueKey, value)
+				end
+			elseif kind == 'references' then
+				redis.call('DEL', modelKey .. ':' .. fieldName)
+			end
+		end
+		redis.call('SREM', allKey, id)
+		redis.call('ZREM', expireKey, id)
+		redis.call('HDEL', valuesKey, id)
+		-- The model might have been soft deleted
+		redis.call('ZREM', collectionName .. ':deleted', id)
+	end
+end
+return {count, #ids}
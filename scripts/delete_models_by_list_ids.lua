@@ -0,0 +1,70 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_models_by_list_ids is a lua script that takes the following arguments:
+-- 	1) The key of a list of model ids
+--		2) The key prefix of a registered model (its name, wrapped in a hash tag in
+--			cluster mode)
+--		3) The channel for change events, or an empty string if change events
+--			should not be published
+--		4) The name of the collection, which is included in change events
+-- 	5+) Any number of pairs of the following arguments, one for each field which
+--		needs to be cleaned up:
+--		a) The kind of the field, which is one of "numeric" (for numeric and
+--			boolean indexes), "string" (for string indexes), "unique" (for unique
+--			constraints), or "references" (for references to many other models)
+--		b) The name of the field as it is stored in redis
+-- The script then deletes all the models corresponding to the ids in the given
+-- list, including their main hash, their id in the set of all ids and the
+-- sorted set of expiration times (along with the values saved for removing
+-- expired models), and their values in any field indexes. If a channel is
+-- given, it publishes a delete event for each model. It returns the number of
+-- models that were deleted. It does not delete the given list.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local listKey = ARGV[1]
+local collectionName = ARGV[2]
+local channel = ARGV[3]
+local name = ARGV[4]
+local allKey = collectionName .. ':all'
+local expireKey = collectionName .. ':expire'
+local valuesKey = collectionName .. ':expire:values'
+local ids = redis.call('LRANGE', listKey, 0, -1)
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	-- Remove the model from the field indexes. This must happen before the main
+	-- hash is deleted, since string and unique indexes rely on the old values.
+	for j = 5, #ARGV, 2 do
+		local kind = ARGV[j]
+		local fieldName = ARGV[j+1]
+		local indexKey = collectionName .. ':' .. fieldName
+		if kind == 'numeric' then
+			redis.call('ZREM', indexKey, id)
+		elseif kind == 'string' then
+			local value = redis.call('HGET', modelKey, fieldName)
+			if value ~= false then
+				redis.call('ZREM', indexKey, value .. '\0' .. id)
+			end
+		elseif kind == 'unique' then
+			local uniqueKey = indexKey .. ':unique'
+			local value = redis.call('HGET', modelKey, fieldName)
+			if value ~= false and redis.call('HGET', uniqueKey, value) == id then
+				redis.call('HDEL', uniqueKey, value)
+			end
+		elseif kind == 'references' then
+			redis.call('DEL', modelKey .. ':' .. fieldName)
+		end
+	end
+	count = count + redis.call('DEL', modelKey)
+	redis.call('SREM', allKey, id)
+	redis.call('ZREM', expireKey, id)
+	redis.call('HDEL', valuesKey, id)
+	if channel ~= '' then
+		redis.call('PUBLISH', channel, cjson.encode({collection = name, id = id, op = 'delete'}))
+	end
+end
+return count
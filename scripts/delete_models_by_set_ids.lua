@@ -4,10 +4,13 @@
 
 -- delete_models_by_set_ids is a lua script that takes the following arguments:
 -- 	1) The key of a set of model ids
---		2) The name of a registered model
+--		2) The key prefix of a registered model (its name, wrapped in a hash tag in
+--			cluster mode)
+--		3+) Optionally, the redis names of any fields which are stored in separate
+--			keys (i.e. references to many other models)
 -- The script then deletes all the models corresponding to the ids in the given
--- set. It returns the number of models that were deleted. It does not delete the
--- given set.
+-- set, including the separate keys for the given field names. It returns the
+-- number of models that were deleted. It does not delete the given set.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -23,6 +26,10 @@ if #ids > 0 then
 		-- Delete the main hash for each model
 		local key = collectionName .. ':' .. id
 		count = count + redis.call('DEL', key)
+		-- Delete the separate keys for any fields (e.g. sets of referenced ids)
+		for j = 3, #ARGV do
+			redis.call('DEL', key .. ':' .. ARGV[j])
+		end
 		-- Remove the model id from the set of all ids
 		-- NOTE: this is not necessarily the same as the
 		-- setName we were given
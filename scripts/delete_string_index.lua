@@ -3,7 +3,8 @@
 -- license, which can be found in the LICENSE file.
 
 -- delete_string_index is a lua script that takes the following arguments:
--- 	1) The name of a registered model
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
 --		2) The id of the model to be deleted from the index
 --		3) The name of the indexed string field
 -- The script then checks if there is a value for the given field name stored in the
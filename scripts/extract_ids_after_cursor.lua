@@ -0,0 +1,123 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extract_ids_after_cursor is a lua script that takes the following arguments:
+-- 	1) setKey: The key of a sorted set for a field index
+-- 	2) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	3) kind: Either "numeric" (for numeric and boolean indexes) or "string"
+-- 	4) direction: Either "asc" or "desc"
+-- 	5) value: The field value (or score for numeric indexes) of the last model
+--		that was seen
+-- 	6) id: The id of the last model that was seen
+-- 	7) limit: The maximum number of ids to store, or 0 to store all of them
+-- The script then stores the ids of the models which come after the (value, id)
+-- pair in the given direction in destKey. Models with the same value are ordered
+-- by id, which matches the order used by ZRANGE for numeric indexes and by
+-- ZRANGEBYLEX for string indexes. The ids are scored by their position, so that
+-- sorting destKey in the given direction returns them in order. Only the ids
+-- which are stored are read from the field index. The model identified by id
+-- does not need to exist anymore.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = ARGV[1]
+local destKey = ARGV[2]
+local kind = ARGV[3]
+local direction = ARGV[4]
+local value = ARGV[5]
+local id = ARGV[6]
+local limit = tonumber(ARGV[7])
+-- compareBytes returns -1, 0, or 1 if a is less than, equal to, or greater
+-- than b respectively. It does not depend on the locale of the server.
+local function compareBytes(a, b)
+	local lenA, lenB = #a, #b
+	local minLen = math.min(lenA, lenB)
+	for i = 1, minLen do
+		local byteA, byteB = string.byte(a, i), string.byte(b, i)
+		if byteA ~= byteB then
+			if byteA < byteB then
+				return -1
+			end
+			return 1
+		end
+	end
+	if lenA == lenB then
+		return 0
+	elseif lenA < lenB then
+		return -1
+	end
+	return 1
+end
+-- store adds the given id to destKey after the ids which were already stored
+local count = 0
+local function store(member)
+	count = count + 1
+	if direction == 'desc' then
+		redis.call('ZADD', destKey, -count, member)
+	else
+		redis.call('ZADD', destKey, count, member)
+	end
+end
+-- rangeArgs returns the arguments for a range command on setKey from start to
+-- stop, followed by any extra arguments, which returns at most n members if n
+-- is positive.
+local function rangeArgs(start, stop, n, ...)
+	local args = {setKey, start, stop, ...}
+	if n > 0 then
+		table.insert(args, 'LIMIT')
+		table.insert(args, 0)
+		table.insert(args, n)
+	end
+	return args
+end
+if kind == 'string' then
+	-- Members of a string index are of the form value + NULL + id, so comparing
+	-- members directly gives the correct order for (value, id) pairs.
+	local members
+	local start = '(' .. value .. '\0' .. id
+	if direction == 'desc' then
+		members = redis.call('ZREVRANGEBYLEX', unpack(rangeArgs(start, '-', limit)))
+	else
+		members = redis.call('ZRANGEBYLEX', unpack(rangeArgs(start, '+', limit)))
+	end
+	for i, member in ipairs(members) do
+		-- The id is everything after the last NULL character
+		local idStart = string.find(member, '%z[^%z]*$')
+		store(string.sub(member, idStart+1))
+	end
+else
+	-- Get the members with a score that is equal to or after the given value
+	-- and then skip the ones with the same score which come before id. If there
+	-- is a limit, the members with the same score might all be skipped, so they
+	-- are not counted towards it.
+	local score = tonumber(value)
+	local n = 0
+	if limit > 0 then
+		n = limit + redis.call('ZCOUNT', setKey, value, value)
+	end
+	local membersAndScores
+	if direction == 'desc' then
+		membersAndScores = redis.call('ZREVRANGEBYSCORE', unpack(rangeArgs(value, '-inf', n, 'WITHSCORES')))
+	else
+		membersAndScores = redis.call('ZRANGEBYSCORE', unpack(rangeArgs(value, '+inf', n, 'WITHSCORES')))
+	end
+	for i = 1, #membersAndScores, 2 do
+		if limit > 0 and count >= limit then
+			break
+		end
+		local member = membersAndScores[i]
+		local isAfter = true
+		if tonumber(membersAndScores[i+1]) == score then
+			if direction == 'desc' then
+				isAfter = compareBytes(member, id) < 0
+			else
+				isAfter = compareBytes(member, id) > 0
+			end
+		end
+		if isAfter then
+			store(member)
+		end
+	end
+end
@@ -0,0 +1,69 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_deleted_page is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) The minimum deletion time in unix milliseconds, or -inf
+--		3) An id. If not empty, models which were deleted exactly at the minimum
+--			deletion time are only included if their id sorts after it
+--		4) The maximum number of models to return
+--		5+) The redis names of the fields to return for each model
+-- The script then finds the soft deleted models in the order they were
+-- deleted, starting at the given position, and returns a list with up to three
+-- elements. The first is a list with the values of the given fields followed
+-- by the id of each model, in the same format as SORT with GET. If there are
+-- more models after the ones that were returned, the second and third elements
+-- are the deletion time and id of the last model that was returned.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local min = ARGV[2]
+local afterId = ARGV[3]
+local limit = tonumber(ARGV[4])
+local deletedKey = collectionName .. ':deleted'
+-- Collect up to limit + 1 (id, score) pairs so we know whether there is another
+-- page. Models which were deleted at the minimum time and whose id does not
+-- sort after afterId were on a previous page and are skipped.
+local ids = {}
+local scores = {}
+local offset = 0
+while #ids <= limit do
+	local batch = redis.call('ZRANGEBYSCORE', deletedKey, min, '+inf', 'WITHSCORES', 'LIMIT', offset, limit + 1)
+	if #batch == 0 then
+		break
+	end
+	for i = 1, #batch, 2 do
+		local id = batch[i]
+		local score = batch[i + 1]
+		if afterId == '' or tonumber(score) > tonumber(min) or id > afterId then
+			table.insert(ids, id)
+			table.insert(scores, score)
+			if #ids > limit then
+				break
+			end
+		end
+	end
+	offset = offset + #batch / 2
+end
+local fieldNames = {}
+for i = 5, #ARGV do
+	table.insert(fieldNames, ARGV[i])
+end
+local values = {}
+for i = 1, math.min(#ids, limit) do
+	if #fieldNames > 0 then
+		local fieldValues = redis.call('HMGET', collectionName .. ':' .. ids[i], unpack(fieldNames))
+		for j = 1, #fieldNames do
+			table.insert(values, fieldValues[j])
+		end
+	end
+	table.insert(values, ids[i])
+end
+if #ids > limit then
+	return {values, scores[limit], ids[limit]}
+end
+return {values}
@@ -0,0 +1,27 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_unique_conflict is a lua script that takes any number of groups of the
+-- following arguments:
+-- 	1) uniqueKey: The key of a hash which maps the values of a unique field to
+--		the id of the model which has that value
+-- 	2) value: The value that a model is about to be saved with
+-- 	3) id: The id of the model that is about to be saved
+-- The script checks each group in order and returns an array with the 1-based
+-- number of the first group that conflicts (i.e. the value already belongs to
+-- a different model) and the id of the model that the value belongs to. If
+-- there are no conflicts, it returns nil.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+for i = 1, #ARGV, 3 do
+	local uniqueKey = ARGV[i]
+	local value = ARGV[i+1]
+	local id = ARGV[i+2]
+	local existingID = redis.call('HGET', uniqueKey, value)
+	if existingID ~= false and existingID ~= id then
+		return {tostring((i+2)/3), existingID}
+	end
+end
+return false
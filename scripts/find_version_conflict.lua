@@ -0,0 +1,27 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- find_version_conflict is a lua script that takes any number of groups of the
+-- following arguments:
+-- 	1) modelKey: The key of the main hash for a model
+-- 	2) versionField: The name of the version field as it is stored in the hash
+-- 	3) version: The version of the model that is about to be saved
+-- The script checks each group in order and returns an array with the 1-based
+-- number of the first group that conflicts (i.e. the version in the database
+-- is different) and the version in the database. If the model does not exist
+-- or does not have a version, its version is considered to be 0. If there are
+-- no conflicts, it returns nil.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+for i = 1, #ARGV, 3 do
+	local modelKey = ARGV[i]
+	local versionField = ARGV[i+1]
+	local version = tonumber(ARGV[i+2])
+	local currentVersion = tonumber(redis.call('HGET', modelKey, versionField)) or 0
+	if currentVersion ~= version then
+		return {(i+2)/3, currentVersion}
+	end
+end
+return false
@@ -0,0 +1,77 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- increment_field is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) The id of the model
+--		3) The name of a numeric field as it is stored in redis
+--		4) The amount to increment the field by
+--		5) The command to use for incrementing the field, which is either HINCRBY
+--			(for integer fields) or HINCRBYFLOAT (for float fields)
+--		6) "1" if the field has a numeric index, otherwise "0"
+--		7) The name of the version field as it is stored in redis, or an empty
+--			string if the model does not have a version field
+--		8) "1" if the version field is indexed, otherwise "0"
+--		9) The channel for change events, or an empty string if change events
+--			should not be published
+--		10) The change event to publish
+--		11) The smallest value the field can hold, or an empty string if there is
+--			no limit other than the one enforced by Redis
+--		12) The largest value the field can hold, or an empty string if there is
+--			no limit other than the one enforced by Redis
+-- The script then increments the field and updates the index on the field (if
+-- any), and increments the version field (if any). It returns the new value of
+-- the field, or nil if the model does not exist or was soft deleted. If the new
+-- value would be outside of the range given by the min and max arguments, the
+-- field is left unchanged and the script returns -1 instead.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local id = ARGV[2]
+local fieldName = ARGV[3]
+local delta = ARGV[4]
+local command = ARGV[5]
+local indexed = ARGV[6] == '1'
+local versionField = ARGV[7]
+local versionIndexed = ARGV[8] == '1'
+local channel = ARGV[9]
+local event = ARGV[10]
+local min = ARGV[11]
+local max = ARGV[12]
+local modelKey = collectionName .. ':' .. id
+-- Don't create a new hash if the model does not exist, and don't change models
+-- which were soft deleted
+if redis.call('EXISTS', modelKey) == 0 or redis.call('ZSCORE', collectionName .. ':deleted', id) then
+	return false
+end
+local oldValue = redis.call('HGET', modelKey, fieldName)
+redis.call(command, modelKey, fieldName, delta)
+-- Get the new value as a string to avoid losing precision for large integers
+local newValue = redis.call('HGET', modelKey, fieldName)
+local number = tonumber(newValue)
+if (min ~= '' and number < tonumber(min)) or (max ~= '' and number > tonumber(max)) then
+	-- Restore the old value, since the new one would not fit in the field
+	if oldValue then
+		redis.call('HSET', modelKey, fieldName, oldValue)
+	else
+		redis.call('HDEL', modelKey, fieldName)
+	end
+	return -1
+end
+if indexed then
+	redis.call('ZADD', collectionName .. ':' .. fieldName, newValue, id)
+end
+if versionField ~= '' then
+	local version = redis.call('HINCRBY', modelKey, versionField, 1)
+	if versionIndexed then
+		redis.call('ZADD', collectionName .. ':' .. versionField, version, id)
+	end
+end
+if channel ~= '' then
+	redis.call('PUBLISH', channel, event)
+end
+return newValue
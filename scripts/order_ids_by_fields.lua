@@ -0,0 +1,140 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- order_ids_by_fields is a lua script that takes the following arguments:
+-- 	1) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	2) sourceKey: The key of a set or sorted set with the ids to sort, e.g. the
+--		ids which match the filters of a query
+-- 	3) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+-- 	4) The number of sort keys, n
+-- The next n*4 arguments are groups of four which describe each sort key, from
+-- highest to lowest priority:
+-- 	1) setKey: The key of a sorted set for a field index
+-- 	2) kind: Either "numeric" (for numeric and boolean indexes) or "string"
+-- 	3) direction: Either "asc" or "desc"
+-- 	4) The redis name of the field
+-- The script then sorts the ids in sourceKey which appear in every one of the
+-- given field indexes by each sort key in turn, using the model id as the final
+-- tie breaker (in the direction of the last sort key). Only the ids in
+-- sourceKey are looked up: the scores of numeric fields are read with ZSCORE,
+-- and the values of string fields are read from the main hash of each model
+-- with HMGET. The ids are stored in destKey with sequential scores so that the
+-- members are in the correct order. Strings are compared byte by byte, so the
+-- order is the same as the order used by ZRANGEBYLEX.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local destKey = ARGV[1]
+local sourceKey = ARGV[2]
+local collectionName = ARGV[3]
+local numKeys = tonumber(ARGV[4])
+-- compareBytes returns -1, 0, or 1 if a is less than, equal to, or greater
+-- than b respectively. It does not depend on the locale of the server.
+local function compareBytes(a, b)
+	local lenA, lenB = #a, #b
+	local minLen = math.min(lenA, lenB)
+	for i = 1, minLen do
+		local byteA, byteB = string.byte(a, i), string.byte(b, i)
+		if byteA ~= byteB then
+			if byteA < byteB then
+				return -1
+			end
+			return 1
+		end
+	end
+	if lenA == lenB then
+		return 0
+	elseif lenA < lenB then
+		return -1
+	end
+	return 1
+end
+-- Read the ids to sort
+local sourceIds = nil
+if redis.call('TYPE', sourceKey)['ok'] == 'set' then
+	sourceIds = redis.call('SMEMBERS', sourceKey)
+else
+	sourceIds = redis.call('ZRANGE', sourceKey, 0, -1)
+end
+local sortKeys = {}
+local stringFields = {}
+for k = 1, numKeys do
+	local sortKey = {
+		setKey = ARGV[4*k+1],
+		kind = ARGV[4*k+2],
+		desc = (ARGV[4*k+3] == 'desc'),
+		field = ARGV[4*k+4],
+	}
+	if sortKey.kind == 'string' then
+		table.insert(stringFields, sortKey.field)
+		sortKey.valueIndex = #stringFields
+	end
+	sortKeys[k] = sortKey
+end
+-- Build a table of id -> values, with one value for each sort key. Only
+-- include the ids which are present in every index.
+local ids = {}
+local values = {}
+for _, id in ipairs(sourceIds) do
+	local stringValues = {}
+	if #stringFields > 0 then
+		stringValues = redis.call('HMGET', collectionName .. ':' .. id, unpack(stringFields))
+	end
+	local idValues = {}
+	local presentInAll = true
+	for k, sortKey in ipairs(sortKeys) do
+		local value = nil
+		if sortKey.kind == 'string' then
+			-- The value in the main hash is only meaningful if the model is in the
+			-- string index, which is not the case for nil pointers. Members of a
+			-- string index are of the form value + NULL + id.
+			value = stringValues[sortKey.valueIndex]
+			if value and not redis.call('ZSCORE', sortKey.setKey, value .. '\0' .. id) then
+				value = nil
+			end
+		else
+			local score = redis.call('ZSCORE', sortKey.setKey, id)
+			if score then
+				value = tonumber(score)
+			end
+		end
+		if not value then
+			presentInAll = false
+			break
+		end
+		idValues[k] = value
+	end
+	if presentInAll then
+		table.insert(ids, id)
+		values[id] = idValues
+	end
+end
+-- Sort the ids by each sort key in turn
+table.sort(ids, function(a, b)
+	for k, sortKey in ipairs(sortKeys) do
+		local valueA, valueB = values[a][k], values[b][k]
+		if valueA ~= valueB then
+			local less = nil
+			if sortKey.kind == 'string' then
+				less = compareBytes(valueA, valueB) < 0
+			else
+				less = valueA < valueB
+			end
+			if sortKey.desc then
+				return not less
+			end
+			return less
+		end
+	end
+	if sortKeys[numKeys].desc then
+		return compareBytes(a, b) > 0
+	end
+	return compareBytes(a, b) < 0
+end)
+-- Add each id to destKey with a sequential score
+for i, id in ipairs(ids) do
+	redis.call('ZADD', destKey, i, id)
+end
@@ -0,0 +1,36 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- purge_deleted_models is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) A unix timestamp in milliseconds
+--		3+) The redis names of any fields which are stored in separate keys (i.e.
+--			references to many other models)
+-- The script then permanently deletes every model which was soft deleted at or
+-- before the given time, including its main hash and the separate keys for the
+-- given field names. The models were already removed from the set of all ids
+-- and any field indexes when they were soft deleted. It returns the number of
+-- models that were purged.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local before = ARGV[2]
+local deletedKey = collectionName .. ':deleted'
+local expireKey = collectionName .. ':expire'
+local valuesKey = collectionName .. ':expire:values'
+local ids = redis.call('ZRANGEBYSCORE', deletedKey, '-inf', before)
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	redis.call('DEL', modelKey)
+	for j = 3, #ARGV do
+		redis.call('DEL', modelKey .. ':' .. ARGV[j])
+	end
+	redis.call('ZREM', deletedKey, id)
+	redis.call('ZREM', expireKey, id)
+	redis.call('HDEL', valuesKey, id)
+end
+return #ids
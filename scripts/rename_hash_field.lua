@@ -0,0 +1,70 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- rename_hash_field is a lua script that takes the following arguments:
+-- 	1) key: The key of a hash, e.g. the main hash for a model
+-- 	2) oldField: The current name of the field
+-- 	3) newField: The new name of the field
+-- 	4) id: The id of the model
+-- 	5) oldIndexKey: The key of the field index for oldField
+-- 	6) newIndexKey: The key of the field index for newField
+-- 	7) oldUniqueKey: The key of the unique index for oldField
+-- 	8) newUniqueKey: The key of the unique index for newField
+-- The script renames oldField to newField. If the hash already has newField
+-- (e.g. because the model was saved with the new schema while the migration was
+-- running), the value of newField is kept and oldField is simply removed. The
+-- entries for the model in the field index and unique index for oldField are
+-- moved to the indexes for newField in the same way, without replacing any
+-- entries that were written for newField. If the hash does not have oldField,
+-- the script does nothing, so it is safe to run it more than once. It returns 1
+-- if the field was renamed and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+local key = ARGV[1]
+local oldField = ARGV[2]
+local newField = ARGV[3]
+local id = ARGV[4]
+local oldIndexKey = ARGV[5]
+local newIndexKey = ARGV[6]
+local oldUniqueKey = ARGV[7]
+local newUniqueKey = ARGV[8]
+local value = redis.call('HGET', key, oldField)
+if value == false then
+	return 0
+end
+local renamed = redis.call('HSETNX', key, newField, value) == 1
+redis.call('HDEL', key, oldField)
+-- Move the entry in the field index (if any). Numeric and boolean indexes use
+-- the id as the member, and string indexes use the value followed by a NULL
+-- character and the id.
+local score = redis.call('ZSCORE', oldIndexKey, id)
+if score ~= false then
+	redis.call('ZREM', oldIndexKey, id)
+	if renamed then
+		redis.call('ZADD', newIndexKey, score, id)
+	end
+end
+local member = value .. '\0' .. id
+if redis.call('ZSCORE', oldIndexKey, member) ~= false then
+	redis.call('ZREM', oldIndexKey, member)
+	if renamed then
+		redis.call('ZADD', newIndexKey, 0, member)
+	end
+end
+-- Move the entry in the unique index (if any). A value which already belongs
+-- to another model in the new unique index is reported as a
+-- UniqueConstraintError before the transaction is executed (see
+-- addRenameUniqueChecks in ../migration.go), so HSETNX only protects against
+-- overwriting it.
+if redis.call('HGET', oldUniqueKey, value) == id then
+	redis.call('HDEL', oldUniqueKey, value)
+	if renamed then
+		redis.call('HSETNX', newUniqueKey, value, id)
+	end
+end
+if renamed then
+	return 1
+end
+return 0
@@ -0,0 +1,34 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- save_expire_values is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+-- 	2) The id of the model
+-- 	3+) The redis names of any fields which have a string index or a unique
+--		constraint
+-- The script then copies the values of the given fields from the main hash of
+-- the model into a hash of encoded values which does not expire, so that the
+-- model can be removed from the string and unique indexes after Redis has
+-- removed the main hash. It does nothing if the main hash does not exist, and
+-- returns 1 if the values were copied or 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local id = ARGV[2]
+local modelKey = collectionName .. ':' .. id
+if redis.call('EXISTS', modelKey) == 0 then
+	return 0
+end
+local values = {}
+for i = 3, #ARGV do
+	local value = redis.call('HGET', modelKey, ARGV[i])
+	if value ~= false then
+		values[ARGV[i]] = value
+	end
+end
+redis.call('HSET', collectionName .. ':expire:values', id, cjson.encode(values))
+return 1
@@ -0,0 +1,80 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- soft_delete_models is a lua script that takes the following arguments:
+-- 	1) The key prefix of a registered model (its name, wrapped in a hash tag in
+--		cluster mode)
+--		2) The current time as a unix timestamp in milliseconds
+--		3) The kind of the next argument, which is one of "id" (for a single model
+--			id), "set" (for the key of a set of model ids), or "list" (for the key of
+--			a list of model ids)
+--		4) The id or the key of the set or list of ids
+--		5) The channel for change events, or an empty string if change events
+--			should not be published
+--		6) The name of the collection, which is included in change events
+-- 	7+) Any number of pairs of the following arguments, one for each field which
+--		needs to be cleaned up:
+--		a) The kind of the field, which is one of "numeric" (for numeric and
+--			boolean indexes), "string" (for string indexes), "unique" (for unique
+--			constraints), or "references" (for references to many other models)
+--		b) The name of the field as it is stored in redis
+-- The script then soft deletes each of the given models which is in the set of
+-- all ids. It moves the id from the set of all ids to the sorted set of deleted
+-- ids, with the current time as the score, and removes the model from any field
+-- indexes and unique indexes. The main hash and any references to many other
+-- models are kept so that the model can be restored later. If a channel is
+-- given, it publishes a delete event for each model. It returns the number of
+-- models that were soft deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local now = ARGV[2]
+local sourceKind = ARGV[3]
+local source = ARGV[4]
+local channel = ARGV[5]
+local name = ARGV[6]
+local allKey = collectionName .. ':all'
+local deletedKey = collectionName .. ':deleted'
+local ids
+if sourceKind == 'set' then
+	ids = redis.call('SMEMBERS', source)
+elseif sourceKind == 'list' then
+	ids = redis.call('LRANGE', source, 0, -1)
+else
+	ids = {source}
+end
+local count = 0
+for i, id in ipairs(ids) do
+	-- Only soft delete models which have not already been deleted
+	if redis.call('SREM', allKey, id) == 1 then
+		local modelKey = collectionName .. ':' .. id
+		for j = 7, #ARGV, 2 do
+			local kind = ARGV[j]
+			local fieldName = ARGV[j+1]
+			local indexKey = collectionName .. ':' .. fieldName
+			if kind == 'numeric' then
+				redis.call('ZREM', indexKey, id)
+			elseif kind == 'string' then
+				local value = redis.call('HGET', modelKey, fieldName)
+				if value ~= false then
+					redis.call('ZREM', indexKey, value .. '\0' .. id)
+				end
+			elseif kind == 'unique' then
+				local uniqueKey = indexKey .. ':unique'
+				local value = redis.call('HGET', modelKey, fieldName)
+				if value ~= false and redis.call('HGET', uniqueKey, value) == id then
+					redis.call('HDEL', uniqueKey, value)
+				end
+			end
+		end
+		redis.call('ZADD', deletedKey, now, id)
+		count = count + 1
+		if channel ~= '' then
+			redis.call('PUBLISH', channel, cjson.encode({collection = name, id = id, op = 'delete'}))
+		end
+	end
+end
+return count
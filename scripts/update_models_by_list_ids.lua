@@ -0,0 +1,103 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_models_by_list_ids is a lua script that takes the following arguments:
+-- 	1) The key of a list of model ids
+--		2) The key prefix of a registered model (its name, wrapped in a hash tag in
+--			cluster mode)
+--		3) The channel for change events, or an empty string if change events
+--			should not be published
+--		4) The name of the collection, which is included in change events
+--		5) The names of the updated fields as a JSON array, which is included in
+--			change events
+--		6) The name of the version field as it is stored in redis, or an empty
+--			string if the model does not have a version field
+--		7) "1" if the version field is indexed, otherwise "0"
+-- 	8+) Any number of groups of the following arguments, one for each field to
+--		update:
+--		a) The name of the field as it is stored in redis
+--		b) The new value for the field as it is stored in the main hash
+--		c) The kind of index on the field, which is one of "none", "numeric" (for
+--			numeric and boolean indexes), or "string"
+--		d) "1" if the new value should be added to the index, or "0" if it is nil
+--		e) The score (for numeric indexes) or value (for string indexes) to add
+--			to the index
+-- The script then sets the given fields for each model in the given list which
+-- exists, replacing the old values in any field indexes, and increments the
+-- version field (if any). The values of any string indexed fields are also
+-- updated in the hash of values used to remove expired models from the indexes
+-- (if the model has an entry there). If a channel is given, it publishes a save
+-- event for each model. It returns the number of models that were updated. It does not
+-- delete the given list.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local listKey = ARGV[1]
+local collectionName = ARGV[2]
+local channel = ARGV[3]
+local name = ARGV[4]
+local fieldNames = ARGV[5]
+local versionField = ARGV[6]
+local versionIndexed = ARGV[7] == '1'
+local valuesKey = collectionName .. ':expire:values'
+local ids = redis.call('LRANGE', listKey, 0, -1)
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	-- Skip any models which do not exist
+	if redis.call('EXISTS', modelKey) == 1 then
+		local hashArgs = {}
+		local values = redis.call('HGET', valuesKey, id)
+		if values ~= false then
+			values = cjson.decode(values)
+		end
+		for j = 8, #ARGV, 5 do
+			local fieldName = ARGV[j]
+			local value = ARGV[j+1]
+			local kind = ARGV[j+2]
+			local hasIndexValue = ARGV[j+3] == '1'
+			local indexValue = ARGV[j+4]
+			local indexKey = collectionName .. ':' .. fieldName
+			if kind == 'numeric' then
+				if hasIndexValue then
+					redis.call('ZADD', indexKey, indexValue, id)
+				else
+					redis.call('ZREM', indexKey, id)
+				end
+			elseif kind == 'string' then
+				-- Remove the old value from the index (if any). This must happen before
+				-- the main hash is updated.
+				local oldValue = redis.call('HGET', modelKey, fieldName)
+				if oldValue ~= false then
+					redis.call('ZREM', indexKey, oldValue .. '\0' .. id)
+				end
+				if hasIndexValue then
+					redis.call('ZADD', indexKey, 0, indexValue .. '\0' .. id)
+				end
+				if values ~= false then
+					values[fieldName] = value
+				end
+			end
+			table.insert(hashArgs, fieldName)
+			table.insert(hashArgs, value)
+		end
+		redis.call('HMSET', modelKey, unpack(hashArgs))
+		if values ~= false then
+			redis.call('HSET', valuesKey, id, cjson.encode(values))
+		end
+		if versionField ~= '' then
+			local version = redis.call('HINCRBY', modelKey, versionField, 1)
+			if versionIndexed then
+				redis.call('ZADD', collectionName .. ':' .. versionField, version, id)
+			end
+		end
+		count = count + 1
+		if channel ~= '' then
+			local event = {collection = name, id = id, fields = cjson.decode(fieldNames), op = 'save'}
+			redis.call('PUBLISH', channel, cjson.encode(event))
+		end
+	end
+end
+return count
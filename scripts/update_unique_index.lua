@@ -0,0 +1,31 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_unique_index is a lua script that takes the following arguments:
+-- 	1) modelKey: The key of the main hash for a model
+-- 	2) uniqueKey: The key of a hash which maps the values of a unique field to
+--		the id of the model which has that value
+-- 	3) fieldName: The name of the unique field as it is stored in redis
+-- 	4) id: The id of the model
+-- 	5) newValue: (optional) The new value for the field
+-- The script removes the old value for the field (if any) from the unique index
+-- and then, if newValue is given, adds newValue to the unique index.
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = ARGV[1]
+local uniqueKey = ARGV[2]
+local fieldName = ARGV[3]
+local id = ARGV[4]
+local newValue = ARGV[5]
+-- Get the old value from the existing model hash (if any)
+local oldValue = redis.call('HGET', modelKey, fieldName)
+if oldValue ~= false and redis.call('HGET', uniqueKey, oldValue) == id then
+	redis.call('HDEL', uniqueKey, oldValue)
+end
+if newValue ~= nil then
+	redis.call('HSET', uniqueKey, newValue, id)
+end
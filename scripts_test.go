@@ -236,3 +236,63 @@ func TestExtractIDsFromStringIndexScript(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractIDsAfterCursorScript(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Create a numeric index and a string index with some ties
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	numericKey, stringKey := "numericIndex", "stringIndex"
+	scores := map[string]int{"a": 1, "b": 2, "c": 2, "d": 2, "e": 3, "f": 4}
+	for id, score := range scores {
+		if _, err := conn.Do("ZADD", numericKey, score, id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("ZADD", stringKey, 0, strconv.Itoa(score)+nullString+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		setKey      string
+		kind        string
+		direction   string
+		value       string
+		id          string
+		limit       int
+		expectedIDs []string
+	}{
+		{numericKey, "numeric", "asc", "2", "b", 0, []string{"c", "d", "e", "f"}},
+		{numericKey, "numeric", "asc", "2", "b", 2, []string{"c", "d"}},
+		{numericKey, "numeric", "asc", "2", "d", 1, []string{"e"}},
+		{numericKey, "numeric", "desc", "2", "d", 3, []string{"c", "b", "a"}},
+		{numericKey, "numeric", "desc", "1", "a", 3, []string{}},
+		{stringKey, "string", "asc", "2", "b", 3, []string{"c", "d", "e"}},
+		{stringKey, "string", "desc", "3", "e", 2, []string{"d", "c"}},
+		{stringKey, "string", "desc", "3", "e", 0, []string{"d", "c", "b", "a"}},
+	}
+	for i, tc := range testCases {
+		destKey := "ExtractIDsAfterCursorScript:" + strconv.Itoa(i)
+		args := redis.Args{tc.setKey, destKey, tc.kind, tc.direction, tc.value, tc.id, tc.limit}
+		if _, err := extractIdsAfterCursorScript.Do(conn, args...); err != nil {
+			t.Fatalf("Unexpected error in script for test case %d: %s", i, err.Error())
+		}
+		// The ids are scored so that they are in order when sorted in the given
+		// direction.
+		command := "ZRANGE"
+		if tc.direction == "desc" {
+			command = "ZREVRANGE"
+		}
+		gotIDs, err := redis.Strings(conn.Do(command, destKey, 0, -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotIDs, tc.expectedIDs) {
+			t.Errorf("Script results for test case %d were incorrect.\nExpected: %v\nGot:      %v", i, tc.expectedIDs, gotIDs)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sentinel.go contains code related to Redis Sentinel, including
+// discovering the address of the current master and verifying that a
+// connection is still connected to the master after a failover.
+
+package zoom
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// sentinelTimeout is the timeout for connecting to and reading from a sentinel.
+const sentinelTimeout = time.Second
+
+// sentinel discovers the address of the current master for a pool which uses
+// Redis Sentinel.
+type sentinel struct {
+	masterName string
+	// options are the options for the pool, which are used for connecting to
+	// the sentinels.
+	options PoolOptions
+	mutex   sync.Mutex
+	// addresses are the addresses of the sentinels. The sentinel which most
+	// recently replied is always first.
+	addresses []string
+}
+
+// newSentinel returns a sentinel which uses the sentinel addresses and master
+// name from the given options.
+func newSentinel(options PoolOptions) *sentinel {
+	return &sentinel{
+		masterName: options.MasterName,
+		options:    options,
+		addresses:  append([]string{}, options.SentinelAddresses...),
+	}
+}
+
+// masterAddress asks each sentinel in turn for the address of the current
+// master until one of them replies. The sentinel that replied is moved to the
+// front of the list, so it will be asked first next time.
+func (s *sentinel) masterAddress() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.addresses) == 0 {
+		return "", fmt.Errorf("zoom: PoolOptions.SentinelAddresses cannot be empty if MasterName is set")
+	}
+	var lastErr error
+	for i, sentinelAddress := range s.addresses {
+		address, err := s.masterAddressFromSentinel(sentinelAddress)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// Move the sentinel to the front of the list
+		copy(s.addresses[1:i+1], s.addresses[:i])
+		s.addresses[0] = sentinelAddress
+		return address, nil
+	}
+	return "", fmt.Errorf("zoom: Could not get the address of master %s from any sentinel: %s", s.masterName, lastErr.Error())
+}
+
+// masterAddressFromSentinel asks the sentinel with the given address for the
+// address of the current master. It connects to the sentinel with the same
+// network and TLS configuration as the pool, and authenticates with
+// SentinelPassword if it is set.
+func (s *sentinel) masterAddressFromSentinel(sentinelAddress string) (string, error) {
+	conn, err := dialTimeout(s.options, sentinelAddress, sentinelTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if s.options.SentinelPassword != "" {
+		if _, err := conn.Do("AUTH", s.options.SentinelPassword); err != nil {
+			return "", err
+		}
+	}
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err != nil {
+		if err == redis.ErrNil {
+			return "", fmt.Errorf("sentinel at %s does not know about master %s", sentinelAddress, s.masterName)
+		}
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("sentinel at %s returned an invalid address for master %s: %v", sentinelAddress, s.masterName, reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// checkMasterRole returns an error if conn is not connected to a master, e.g.
+// because the master was demoted to a replica after a failover. It uses the
+// ROLE command.
+var checkMasterRole = func(conn redis.Conn) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	var role string
+	if _, err := redis.Scan(reply, &role); err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("zoom: Expected to be connected to a master but the role was %s", role)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sentinel_test.go tests the code in sentinel.go and the behavior of a
+// pool which uses Redis Sentinel.
+
+package zoom
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestSentinel(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	fake, err := newFakeSentinel("mymaster", *address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.close()
+
+	// Pretend that every connection made before a failover was demoted to a
+	// replica, since we can't actually fail over the testing database.
+	demoted := map[redis.Conn]bool{}
+	seen := []redis.Conn{}
+	mutex := sync.Mutex{}
+	originalCheckMasterRole := checkMasterRole
+	defer func() {
+		checkMasterRole = originalCheckMasterRole
+	}()
+	checkMasterRole = func(conn redis.Conn) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if demoted[conn] {
+			return errors.New("role is slave")
+		}
+		seen = append(seen, conn)
+		return nil
+	}
+
+	// The first sentinel is not running, so the pool should fall back to the
+	// second one.
+	options := testPool.options.WithAddress("").WithMasterName("mymaster").WithSentinelAddresses("localhost:1", fake.address())
+	pool := NewPoolWithOptions(options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	conn := pool.NewConn()
+	if _, err := conn.Do("SET", "sentinelTestKey", "before"); err != nil {
+		t.Fatalf("Unexpected error in SET: %s", err.Error())
+	}
+	_ = conn.Close()
+	if fake.numQueries() != 1 {
+		t.Errorf("Expected the sentinel to be queried once but got %d", fake.numQueries())
+	}
+
+	// Fail over to a new master, which is really the same database at a
+	// different address.
+	host, port, _ := net.SplitHostPort(*address)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	} else {
+		host = "localhost"
+	}
+	fake.setMasterAddress(net.JoinHostPort(host, port))
+	mutex.Lock()
+	for _, conn := range seen {
+		demoted[conn] = true
+	}
+	mutex.Unlock()
+	conn = pool.NewConn()
+	if _, err := conn.Do("SET", "sentinelTestKey", "after"); err != nil {
+		t.Fatalf("Unexpected error in SET after failover: %s", err.Error())
+	}
+	_ = conn.Close()
+	if fake.numQueries() != 2 {
+		t.Errorf("Expected the sentinel to be queried again after failover but got %d queries", fake.numQueries())
+	}
+	checkConn := testPool.NewConn()
+	defer checkConn.Close()
+	got, err := redis.String(checkConn.Do("GET", "sentinelTestKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "after" {
+		t.Errorf("Expected sentinelTestKey to be after but got %s", got)
+	}
+
+	// A master name which the sentinels do not know about should result in an
+	// error.
+	unknownPool := NewPoolWithOptions(options.WithMasterName("unknown"))
+	defer func() {
+		_ = unknownPool.Close()
+	}()
+	conn = unknownPool.NewConn()
+	if _, err := conn.Do("PING"); err == nil {
+		t.Errorf("Expected error for unknown master name but got none")
+	}
+	_ = conn.Close()
+}
+
+func TestSentinelTLSAndPassword(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	dir, err := ioutil.TempDir("", "zoom-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := writeTestCertificate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := newTLSTestProxy(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.close()
+	fake, err := newTLSFakeSentinel("mymaster", proxy.address(), certFile, keyFile, "sentinelSecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.close()
+	// The testing database might not support the ROLE command
+	originalCheckMasterRole := checkMasterRole
+	defer func() {
+		checkMasterRole = originalCheckMasterRole
+	}()
+	checkMasterRole = func(redis.Conn) error {
+		return nil
+	}
+
+	// The connections to the sentinel should use TLS and SentinelPassword
+	config, err := NewTLSConfig("", "", certFile)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewTLSConfig: %s", err.Error())
+	}
+	options := testPool.options.
+		WithAddress("").
+		WithMasterName("mymaster").
+		WithSentinelAddresses(fake.address()).
+		WithTLSConfig(config).
+		WithSentinelPassword("sentinelSecret")
+	pool := NewPoolWithOptions(options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	conn := pool.NewConn()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Errorf("Unexpected error in PING: %s", err.Error())
+	}
+	_ = conn.Close()
+	if fake.numQueries() != 1 {
+		t.Errorf("Expected the sentinel to be queried once but got %d", fake.numQueries())
+	}
+
+	// A wrong password should result in an error
+	wrongPool := NewPoolWithOptions(options.WithSentinelPassword("wrong"))
+	defer func() {
+		_ = wrongPool.Close()
+	}()
+	conn = wrongPool.NewConn()
+	if _, err := conn.Do("PING"); err == nil {
+		t.Errorf("Expected error for wrong sentinel password but got none")
+	}
+	_ = conn.Close()
+}
+
+// fakeSentinel is a minimal server which understands the SENTINEL
+// get-master-addr-by-name command and the AUTH command, and nothing else.
+type fakeSentinel struct {
+	listener      net.Listener
+	masterName    string
+	password      string
+	mutex         sync.Mutex
+	masterAddress string
+	queries       int
+}
+
+// newFakeSentinel starts a fakeSentinel which reports that the master with the
+// given name is at masterAddress.
+func newFakeSentinel(masterName string, masterAddress string) (*fakeSentinel, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return startFakeSentinel(listener, masterName, masterAddress, ""), nil
+}
+
+// newTLSFakeSentinel is like newFakeSentinel but the fakeSentinel only accepts
+// TLS connections using the given certificate and private key, and requires
+// clients to authenticate with password.
+func newTLSFakeSentinel(masterName string, masterAddress string, certFile, keyFile string, password string) (*fakeSentinel, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	return startFakeSentinel(listener, masterName, masterAddress, password), nil
+}
+
+// startFakeSentinel starts a fakeSentinel which accepts connections from
+// listener.
+func startFakeSentinel(listener net.Listener, masterName string, masterAddress string, password string) *fakeSentinel {
+	fake := &fakeSentinel{
+		listener:      listener,
+		masterName:    masterName,
+		password:      password,
+		masterAddress: masterAddress,
+	}
+	go fake.serve()
+	return fake
+}
+
+func (fake *fakeSentinel) address() string {
+	return fake.listener.Addr().String()
+}
+
+func (fake *fakeSentinel) close() {
+	_ = fake.listener.Close()
+}
+
+func (fake *fakeSentinel) setMasterAddress(address string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.masterAddress = address
+}
+
+func (fake *fakeSentinel) numQueries() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.queries
+}
+
+func (fake *fakeSentinel) serve() {
+	for {
+		conn, err := fake.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fake.handle(conn)
+	}
+}
+
+func (fake *fakeSentinel) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := fake.password == ""
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) == 2 && strings.ToUpper(args[0]) == "AUTH" {
+			if args[1] != fake.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			fmt.Fprint(conn, "+OK\r\n")
+			continue
+		}
+		if !authenticated {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		if len(args) != 3 || strings.ToUpper(args[0]) != "SENTINEL" || strings.ToLower(args[1]) != "get-master-addr-by-name" {
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+			continue
+		}
+		fake.mutex.Lock()
+		fake.queries++
+		masterAddress := fake.masterAddress
+		fake.mutex.Unlock()
+		if args[2] != fake.masterName {
+			fmt.Fprint(conn, "*-1\r\n")
+			continue
+		}
+		host, port, _ := net.SplitHostPort(masterAddress)
+		fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+	}
+}
+
+// readFakeCommand reads a command in the Redis protocol and returns its
+// arguments.
+func readFakeCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:length])
+	}
+	return args, nil
+}
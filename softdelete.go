@@ -0,0 +1,423 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File softdelete.go contains code related to soft deleted models, i.e. models
+// in a collection with the SoftDelete option.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// newSoftDeleteDisabledError returns an error with a message describing that
+// methodName was called on a collection that does not use soft deletes.
+func newSoftDeleteDisabledError(methodName string) error {
+	return fmt.Errorf("zoom: %s only works for collections with soft deletes. To enable soft deletes, set the SoftDelete property to true in CollectionOptions when calling Pool.NewCollection", methodName)
+}
+
+// softDelete adds a script to the transaction which soft deletes the models
+// identified by source. kind is "id" if source is the id of a single model, or
+// "set" or "list" if source is the key of a set or list of ids. If channel is
+// not empty, a change event is published to it for each model. handler will be
+// called with the number of models that were soft deleted.
+func (t *Transaction) softDelete(c *Collection, kind string, source string, channel string, handler ReplyHandler) {
+	args := redis.Args{c.spec.keyPrefix(), unixMilliseconds(time.Now()), kind, source, channel, c.Name()}
+	args = append(args, c.fieldCleanupArgs()...)
+	t.Script(softDeleteModelsScript, args, handler)
+}
+
+// checkDeleted adds a command to the transaction which returns a
+// ModelNotFoundError when the transaction is executed if the model with the
+// given id was soft deleted and deleted is false, or if it was not soft
+// deleted and deleted is true.
+func (t *Transaction) checkDeleted(c *Collection, id string, deleted bool) {
+	t.Command("ZSCORE", redis.Args{c.spec.deletedKey(), id}, func(reply interface{}) error {
+		if (reply != nil) == deleted {
+			return nil
+		}
+		msg := fmt.Sprintf("Could not find %s with id = %s", c.spec.name, id)
+		if deleted {
+			msg = fmt.Sprintf("Could not find deleted %s with id = %s", c.spec.name, id)
+		}
+		return ModelNotFoundError{
+			Collection: c,
+			Msg:        msg,
+		}
+	})
+}
+
+// FindDeleted is like Find but only finds models which were soft deleted. It
+// returns a ModelNotFoundError if the model does not exist or was not soft
+// deleted, and an error if the collection does not use soft deletes.
+func (c *Collection) FindDeleted(id string, model Model) error {
+	return c.FindDeletedContext(context.Background(), id, model)
+}
+
+// FindDeletedContext is like FindDeleted but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) FindDeletedContext(ctx context.Context, id string, model Model) error {
+	t := c.pool.NewTransaction()
+	t.FindDeleted(c, id, model)
+	if err := t.ExecContext(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FindDeleted is like Find but only finds models which were soft deleted. Any
+// errors encountered will be added to the transaction and returned as an error
+// when the transaction is executed.
+func (t *Transaction) FindDeleted(c *Collection, id string, model Model) {
+	if c == nil {
+		t.setError(newNilCollectionError("FindDeleted"))
+		return
+	}
+	if !c.softDelete {
+		t.setError(newSoftDeleteDisabledError("FindDeleted"))
+		return
+	}
+	if err := c.checkModelType(model); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in FindDeleted or Transaction.FindDeleted: %s", err.Error()))
+		return
+	}
+	t.checkDeleted(c, id, true)
+	t.findModel(c, id, model)
+}
+
+// FindAllDeleted is like FindAll but finds all the models which were soft
+// deleted instead. The models are ordered by the time they were deleted, oldest
+// first. It returns an error if the collection does not use soft deletes.
+func (c *Collection) FindAllDeleted(models interface{}) error {
+	return c.FindAllDeletedContext(context.Background(), models)
+}
+
+// FindAllDeletedContext is like FindAllDeleted but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) FindAllDeletedContext(ctx context.Context, models interface{}) error {
+	t := c.pool.NewTransaction()
+	t.FindAllDeleted(c, models)
+	if err := t.ExecContext(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FindAllDeleted is like FindAll but finds all the models which were soft
+// deleted instead. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) FindAllDeleted(c *Collection, models interface{}) {
+	if c == nil {
+		t.setError(newNilCollectionError("FindAllDeleted"))
+		return
+	}
+	if !c.softDelete {
+		t.setError(newSoftDeleteDisabledError("FindAllDeleted"))
+		return
+	}
+	if err := c.checkModelsType(models); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in FindAllDeleted or Transaction.FindAllDeleted: %s", err.Error()))
+		return
+	}
+	t.sweepExpired(c)
+	// Since the deleted models are stored in a sorted set, "BY nosort" returns
+	// them in the order they were deleted.
+	sortArgs := c.spec.sortArgs(c.spec.deletedKey(), c.spec.fieldRedisNames(), 0, 0, false)
+	fieldNames := append(c.spec.fieldNames(), "-")
+	handler := newScanModelsHandler(c.spec, fieldNames, models)
+	t.Command("SORT", sortArgs, newLoadReferencesHandler(handler, t, c.spec, fieldNames, modelsGetter(models)))
+}
+
+// FindDeletedPage finds up to limit models which were soft deleted, in the
+// order they were deleted, and scans them into models. It returns a cursor which
+// can be passed to the next call to get the following page, or an empty string
+// if there are no more pages. If cursor is empty, the first page starts with the
+// models which were deleted at or after since. Pass in the zero time to start
+// with the oldest deleted model. For example, to go through the models which
+// were deleted in the last day:
+//
+//	cursor := ""
+//	for {
+//		people := []*Person{}
+//		since := time.Now().Add(-24 * time.Hour)
+//		next, err := People.FindDeletedPage(since, cursor, 100, &people)
+//		if err != nil {
+//			// handle error
+//		}
+//		// do something with people
+//		if next == "" {
+//			break
+//		}
+//		cursor = next
+//	}
+//
+// FindDeletedPage returns an error if the collection does not use soft deletes.
+func (c *Collection) FindDeletedPage(since time.Time, cursor string, limit int, models interface{}) (string, error) {
+	return c.FindDeletedPageContext(context.Background(), since, cursor, limit, models)
+}
+
+// FindDeletedPageContext is like FindDeletedPage but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) FindDeletedPageContext(ctx context.Context, since time.Time, cursor string, limit int, models interface{}) (string, error) {
+	t := c.pool.NewTransaction()
+	var next string
+	t.FindDeletedPage(c, since, cursor, limit, models, &next)
+	if err := t.ExecContext(ctx); err != nil {
+		return "", err
+	}
+	return next, nil
+}
+
+// deletedCursorOrder is the order of cursors returned by FindDeletedPage, which
+// distinguishes them from the cursors returned by Query.RunPage.
+const deletedCursorOrder = ":deleted"
+
+// FindDeletedPage finds up to limit soft deleted models starting at since or
+// cursor in an existing transaction. next will be set to the cursor for the following page, or an
+// empty string if there are no more pages. Any errors encountered will be added
+// to the transaction and returned as an error when the transaction is executed.
+func (t *Transaction) FindDeletedPage(c *Collection, since time.Time, cursor string, limit int, models interface{}, next *string) {
+	if c == nil {
+		t.setError(newNilCollectionError("FindDeletedPage"))
+		return
+	}
+	if !c.softDelete {
+		t.setError(newSoftDeleteDisabledError("FindDeletedPage"))
+		return
+	}
+	if err := c.checkModelsType(models); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in FindDeletedPage or Transaction.FindDeletedPage: %s", err.Error()))
+		return
+	}
+	if limit <= 0 {
+		t.setError(fmt.Errorf("zoom: Error in FindDeletedPage or Transaction.FindDeletedPage: limit must be positive but got %d", limit))
+		return
+	}
+	min, afterID := "-inf", ""
+	if cursor != "" {
+		decoded, err := decodeQueryCursor(cursor)
+		if err != nil {
+			t.setError(err)
+			return
+		}
+		if decoded.Order != deletedCursorOrder {
+			t.setError(fmt.Errorf("zoom: invalid cursor %q: not a cursor returned by FindDeletedPage", cursor))
+			return
+		}
+		min, afterID = decoded.Value, decoded.ID
+	} else if !since.IsZero() {
+		min = strconv.FormatInt(unixMilliseconds(since), 10)
+	}
+	t.sweepExpired(c)
+	redisFieldNames := c.spec.fieldRedisNames()
+	args := redis.Args{c.spec.keyPrefix(), min, afterID, limit}
+	args = append(args, Interfaces(redisFieldNames)...)
+	fieldNames := append(c.spec.fieldNames(), "-")
+	scanModels := newScanModelsHandler(c.spec, fieldNames, models)
+	handler := func(reply interface{}) error {
+		replies, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(replies) == 0 {
+			return fmt.Errorf("zoom: Error in FindDeletedPage or Transaction.FindDeletedPage: unexpected empty reply")
+		}
+		if next != nil {
+			*next = ""
+			if len(replies) == 3 {
+				values, err := redis.Strings(replies[1:], nil)
+				if err != nil {
+					return err
+				}
+				*next = (&queryCursor{Order: deletedCursorOrder, Value: values[0], ID: values[1]}).String()
+			}
+		}
+		return scanModels(replies[0])
+	}
+	t.Script(findDeletedPageScript, args, newLoadReferencesHandler(handler, t, c.spec, fieldNames, modelsGetter(models)))
+}
+
+// CountDeleted returns the number of models in the collection which were soft
+// deleted. It returns an error if the collection does not use soft deletes.
+func (c *Collection) CountDeleted() (int, error) {
+	return c.CountDeletedContext(context.Background())
+}
+
+// CountDeletedContext is like CountDeleted but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) CountDeletedContext(ctx context.Context) (int, error) {
+	t := c.pool.NewTransaction()
+	count := 0
+	t.CountDeleted(c, &count)
+	if err := t.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountDeleted counts the number of models in the collection which were soft
+// deleted in an existing transaction. It sets the value of count to the number
+// of models. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) CountDeleted(c *Collection, count *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("CountDeleted"))
+		return
+	}
+	if !c.softDelete {
+		t.setError(newSoftDeleteDisabledError("CountDeleted"))
+		return
+	}
+	t.sweepExpired(c)
+	t.Command("ZCARD", redis.Args{c.spec.deletedKey()}, NewScanIntHandler(count))
+}
+
+// DeletedAt returns the time that the model with the given id was soft deleted,
+// with millisecond precision. It returns a ModelNotFoundError if the model was
+// not soft deleted, and an error if the collection does not use soft deletes.
+func (c *Collection) DeletedAt(id string) (time.Time, error) {
+	return c.DeletedAtContext(context.Background(), id)
+}
+
+// DeletedAtContext is like DeletedAt but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) DeletedAtContext(ctx context.Context, id string) (time.Time, error) {
+	t := c.pool.NewTransaction()
+	var deletedAt time.Time
+	t.DeletedAt(c, id, &deletedAt)
+	if err := t.ExecContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+	return deletedAt, nil
+}
+
+// DeletedAt sets the value of deletedAt to the time that the model with the
+// given id was soft deleted in an existing transaction. Any errors encountered
+// will be added to the transaction and returned as an error when the
+// transaction is executed.
+func (t *Transaction) DeletedAt(c *Collection, id string, deletedAt *time.Time) {
+	if c == nil {
+		t.setError(newNilCollectionError("DeletedAt"))
+		return
+	}
+	if !c.softDelete {
+		t.setError(newSoftDeleteDisabledError("DeletedAt"))
+		return
+	}
+	t.Command("ZSCORE", redis.Args{c.spec.deletedKey(), id}, func(reply interface{}) error {
+		if reply == nil {
+			return ModelNotFoundError{
+				Collection: c,
+				Msg:        fmt.Sprintf("Could not find deleted %s with id = %s", c.spec.name, id),
+			}
+		}
+		ms, err := redis.Float64(reply, nil)
+		if err != nil {
+			return err
+		}
+		*deletedAt = time.Unix(0, int64(ms)*int64(time.Millisecond))
+		return nil
+	})
+}
+
+// Restore restores the soft deleted model with the given id, adding it back to
+// the index on all models and to any field indexes. It returns true if the
+// model was restored, or false if it was not soft deleted. If restoring the
+// model would violate a unique constraint because another model was saved with
+// the same value in the meantime, Restore returns a UniqueConstraintError and
+// the model stays deleted. If the collection has a TTL, the expiration is reset
+// as if the model was saved. Restore returns an error if the collection does
+// not use soft deletes.
+func (c *Collection) Restore(id string) (bool, error) {
+	return c.RestoreContext(context.Background(), id)
+}
+
+// RestoreContext is like Restore but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) RestoreContext(ctx context.Context, id string) (bool, error) {
+	if !c.softDelete {
+		return false, newSoftDeleteDisabledError("Restore")
+	}
+	restored := false
+	if _, err := c.pool.UpdateContext(ctx, func(tx *Transaction) error {
+		restored = false
+		if err := tx.watchKeys([]string{c.ModelKey(id), c.spec.deletedKey()}); err != nil {
+			return err
+		}
+		model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+		find := &Transaction{pool: tx.pool}
+		find.FindDeleted(c, id, model)
+		if find.err != nil {
+			return find.err
+		}
+		if err := doTransactionWithoutMulti(tx.conn, find); err != nil {
+			if _, ok := err.(ModelNotFoundError); ok {
+				return nil
+			}
+			return err
+		}
+		// Saving the model adds it back to the indexes and removes it from the
+		// deleted models.
+		tx.Save(c, model)
+		restored = true
+		return nil
+	}, DefaultUpdateOptions); err != nil {
+		return false, err
+	}
+	return restored, nil
+}
+
+// Purge permanently removes every model in the collection which was soft
+// deleted at or before the given time, and returns the number of models that
+// were removed. For example, to remove the models which were deleted more than
+// 30 days ago:
+//
+//	count, err := Users.Purge(time.Now().Add(-30 * 24 * time.Hour))
+//
+// Purge returns an error if the collection does not use soft deletes.
+func (c *Collection) Purge(before time.Time) (int, error) {
+	return c.PurgeContext(context.Background(), before)
+}
+
+// PurgeContext is like Purge but uses the given context. See
+// Transaction.ExecContext for details.
+func (c *Collection) PurgeContext(ctx context.Context, before time.Time) (int, error) {
+	t := c.pool.NewTransaction()
+	count := 0
+	t.Purge(c, before, &count)
+	if err := t.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Purge permanently removes every model in the collection which was soft
+// deleted at or before the given time in an existing transaction. count will
+// be set to the number of models that were removed. You may pass in nil for
+// count if you do not care about the number of models that were removed. Any
+// errors encountered will be added to the transaction and returned as an error
+// when the transaction is executed.
+func (t *Transaction) Purge(c *Collection, before time.Time, count *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("Purge"))
+		return
+	}
+	if !c.softDelete {
+		t.setError(newSoftDeleteDisabledError("Purge"))
+		return
+	}
+	var handler ReplyHandler
+	if count != nil {
+		handler = NewScanIntHandler(count)
+	}
+	args := redis.Args{c.spec.keyPrefix(), unixMilliseconds(before)}
+	args = append(args, Interfaces(c.spec.referencesFieldRedisNames())...)
+	t.Script(purgeDeletedModelsScript, args, handler)
+}
@@ -0,0 +1,388 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File softdelete_test.go tests the code in softdelete.go, i.e. soft deleting,
+// restoring, and purging models.
+
+package zoom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSoftDelete(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveSoftDeleteTestModels(3)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	deleted := models[0]
+	start := time.Now()
+	if ok, err := softDeleteTestModels.Delete(deleted.ID); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	} else if !ok {
+		t.Errorf("Expected Delete to return true but got false")
+	}
+	// Deleting the same model again should not do anything
+	if ok, err := softDeleteTestModels.Delete(deleted.ID); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	} else if ok {
+		t.Errorf("Expected second Delete to return false but got true")
+	}
+
+	// The main hash and references should still exist, but the model should be
+	// excluded from everything else.
+	expectKeyExists(t, softDeleteTestModels.ModelKey(deleted.ID))
+	expectKeyExists(t, softDeleteTestModels.spec.referencesKey(deleted.ID, softDeleteTestModels.spec.fieldsByName["Many"]))
+	expectSetDoesNotContain(t, softDeleteTestModels.IndexKey(), deleted.ID)
+	expectIndexDoesNotExist(t, softDeleteTestModels, deleted, "Int")
+	expectIndexDoesNotExist(t, softDeleteTestModels, deleted, "String")
+	expectNoIndexProblems(t, softDeleteTestModels)
+	expectModelNotFoundError(t, softDeleteTestModels.Find(deleted.ID, &softDeleteTestModel{}))
+	expectModelNotFoundError(t, softDeleteTestModels.FindFields(deleted.ID, []string{"Int"}, &softDeleteTestModel{}))
+	if exists, err := softDeleteTestModels.Exists(deleted.ID); err != nil {
+		t.Fatalf("Unexpected error in Exists: %s", err.Error())
+	} else if exists {
+		t.Errorf("Expected Exists to return false for a soft deleted model")
+	}
+	if count, err := softDeleteTestModels.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 2 {
+		t.Errorf("Expected Count to return 2 but got %d", count)
+	}
+	allModels := []*softDeleteTestModel{}
+	if err := softDeleteTestModels.FindAll(&allModels); err != nil {
+		t.Fatalf("Unexpected error in FindAll: %s", err.Error())
+	}
+	if len(allModels) != 2 {
+		t.Errorf("Expected FindAll to return 2 models but got %d", len(allModels))
+	}
+	if count, err := softDeleteTestModels.NewQuery().Filter("Int =", deleted.Int).Count(); err != nil {
+		t.Fatalf("Unexpected error in Query.Count: %s", err.Error())
+	} else if count != 0 {
+		t.Errorf("Expected query to exclude the soft deleted model but got %d models", count)
+	}
+	_, err = softDeleteTestModels.Increment(deleted.ID, "Int", 1)
+	expectModelNotFoundError(t, err)
+
+	// The soft deleted model should be available with the explicit APIs
+	got := &softDeleteTestModel{}
+	if err := softDeleteTestModels.FindDeleted(deleted.ID, got); err != nil {
+		t.Fatalf("Unexpected error in FindDeleted: %s", err.Error())
+	}
+	if got.Int != deleted.Int || got.String != deleted.String || got.Email != deleted.Email || len(got.Many) != 1 {
+		t.Errorf("Expected FindDeleted to return %+v but got %+v", deleted, got)
+	}
+	expectModelNotFoundError(t, softDeleteTestModels.FindDeleted(models[1].ID, &softDeleteTestModel{}))
+	deletedModels := []*softDeleteTestModel{}
+	if err := softDeleteTestModels.FindAllDeleted(&deletedModels); err != nil {
+		t.Fatalf("Unexpected error in FindAllDeleted: %s", err.Error())
+	}
+	if len(deletedModels) != 1 || deletedModels[0].ID != deleted.ID {
+		t.Errorf("Expected FindAllDeleted to return the deleted model but got %v", deletedModels)
+	}
+	if count, err := softDeleteTestModels.CountDeleted(); err != nil {
+		t.Fatalf("Unexpected error in CountDeleted: %s", err.Error())
+	} else if count != 1 {
+		t.Errorf("Expected CountDeleted to return 1 but got %d", count)
+	}
+	if deletedAt, err := softDeleteTestModels.DeletedAt(deleted.ID); err != nil {
+		t.Fatalf("Unexpected error in DeletedAt: %s", err.Error())
+	} else if deletedAt.Before(start.Truncate(time.Millisecond)) || deletedAt.After(time.Now()) {
+		t.Errorf("Expected DeletedAt to be between %s and now but got %s", start, deletedAt)
+	}
+	_, err = softDeleteTestModels.DeletedAt(models[1].ID)
+	expectModelNotFoundError(t, err)
+
+	// The unique value of the soft deleted model should be released
+	other := &softDeleteTestModel{Email: deleted.Email}
+	if err := softDeleteTestModels.Save(other); err != nil {
+		t.Errorf("Unexpected error saving a model with the same unique value: %s", err.Error())
+	}
+}
+
+func TestSoftDeleteAllAndQueryDelete(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveSoftDeleteTestModels(4)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	if count, err := softDeleteTestModels.NewQuery().Filter("Int =", models[0].Int).Delete(); err != nil {
+		t.Fatalf("Unexpected error in Query.Delete: %s", err.Error())
+	} else if count != 1 {
+		t.Errorf("Expected Query.Delete to return 1 but got %d", count)
+	}
+	// Make sure the models deleted by DeleteAll have a later deletion time
+	time.Sleep(2 * time.Millisecond)
+	if count, err := softDeleteTestModels.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	} else if count != 3 {
+		t.Errorf("Expected DeleteAll to return 3 but got %d", count)
+	}
+	if count, err := softDeleteTestModels.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 0 {
+		t.Errorf("Expected Count to return 0 but got %d", count)
+	}
+	deletedModels := []*softDeleteTestModel{}
+	if err := softDeleteTestModels.FindAllDeleted(&deletedModels); err != nil {
+		t.Fatalf("Unexpected error in FindAllDeleted: %s", err.Error())
+	}
+	if len(deletedModels) != 4 {
+		t.Fatalf("Expected FindAllDeleted to return 4 models but got %d", len(deletedModels))
+	}
+	// The model deleted by the query should be first
+	if deletedModels[0].ID != models[0].ID {
+		t.Errorf("Expected the first deleted model to be %s but got %s", models[0].ID, deletedModels[0].ID)
+	}
+	for _, model := range models {
+		expectKeyExists(t, softDeleteTestModels.ModelKey(model.ID))
+	}
+	expectNoIndexProblems(t, softDeleteTestModels)
+}
+
+func TestFindDeletedPage(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveSoftDeleteTestModels(5)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	// DeleteAll gives every model the same deletion time, so paging has to use
+	// the ids to break ties.
+	if _, err := softDeleteTestModels.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	expectedIDs := map[string]bool{}
+	for _, model := range models {
+		expectedIDs[model.ID] = true
+	}
+	cursor := ""
+	pages := 0
+	for {
+		page := []*softDeleteTestModel{}
+		next, err := softDeleteTestModels.FindDeletedPage(time.Time{}, cursor, 2, &page)
+		if err != nil {
+			t.Fatalf("Unexpected error in FindDeletedPage: %s", err.Error())
+		}
+		pages++
+		for _, got := range page {
+			if !expectedIDs[got.ID] {
+				t.Errorf("FindDeletedPage returned unexpected or duplicate model %s", got.ID)
+			}
+			delete(expectedIDs, got.ID)
+			if len(got.Many) != 1 {
+				t.Errorf("Expected FindDeletedPage to load references but got %d", len(got.Many))
+			}
+		}
+		if next == "" {
+			break
+		}
+		if len(page) != 2 {
+			t.Errorf("Expected a full page of 2 models before the last page but got %d", len(page))
+		}
+		cursor = next
+	}
+	if pages != 3 {
+		t.Errorf("Expected 3 pages but got %d", pages)
+	}
+	if len(expectedIDs) != 0 {
+		t.Errorf("FindDeletedPage did not return the models %v", expectedIDs)
+	}
+
+	// Give the models distinct deletion times and only find the newer ones.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	for i, model := range models {
+		if _, err := conn.Do("ZADD", softDeleteTestModels.spec.deletedKey(), (i+1)*1000, model.ID); err != nil {
+			t.Fatalf("Unexpected error in ZADD: %s", err.Error())
+		}
+	}
+	page := []*softDeleteTestModel{}
+	next, err := softDeleteTestModels.FindDeletedPage(time.Unix(3, 0), "", 10, &page)
+	if err != nil {
+		t.Fatalf("Unexpected error in FindDeletedPage: %s", err.Error())
+	}
+	if next != "" {
+		t.Errorf("Expected an empty cursor for the last page but got %q", next)
+	}
+	if len(page) != 3 {
+		t.Fatalf("Expected FindDeletedPage to return 3 models but got %d", len(page))
+	}
+	for i, got := range page {
+		if got.ID != models[i+2].ID {
+			t.Errorf("Expected model %d to be %s but got %s", i, models[i+2].ID, got.ID)
+		}
+	}
+
+	// Invalid arguments should return an error
+	if _, err := softDeleteTestModels.FindDeletedPage(time.Time{}, "", 0, &page); err == nil {
+		t.Errorf("Expected an error for a limit of 0 but got none")
+	}
+	queryCursor := (&queryCursor{Order: "Int", Value: "1", ID: models[0].ID}).String()
+	if _, err := softDeleteTestModels.FindDeletedPage(time.Time{}, queryCursor, 1, &page); err == nil {
+		t.Errorf("Expected an error for a cursor from a query but got none")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveSoftDeleteTestModels(2)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	restored, conflicting := models[0], models[1]
+	for _, model := range models {
+		if _, err := softDeleteTestModels.Delete(model.ID); err != nil {
+			t.Fatalf("Unexpected error in Delete: %s", err.Error())
+		}
+	}
+	if ok, err := softDeleteTestModels.Restore(restored.ID); err != nil {
+		t.Fatalf("Unexpected error in Restore: %s", err.Error())
+	} else if !ok {
+		t.Errorf("Expected Restore to return true but got false")
+	}
+	// Restoring a model which is not deleted should not do anything
+	if ok, err := softDeleteTestModels.Restore(restored.ID); err != nil {
+		t.Fatalf("Unexpected error in Restore: %s", err.Error())
+	} else if ok {
+		t.Errorf("Expected second Restore to return false but got true")
+	}
+	got := &softDeleteTestModel{}
+	if err := softDeleteTestModels.Find(restored.ID, got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int != restored.Int || got.String != restored.String || len(got.Many) != 1 {
+		t.Errorf("Expected Find to return %+v but got %+v", restored, got)
+	}
+	expectSetContains(t, softDeleteTestModels.IndexKey(), restored.ID)
+	expectIndexExists(t, softDeleteTestModels, restored, "Int")
+	expectIndexExists(t, softDeleteTestModels, restored, "String")
+	if count, err := softDeleteTestModels.NewQuery().Filter("String =", restored.String).Count(); err != nil {
+		t.Fatalf("Unexpected error in Query.Count: %s", err.Error())
+	} else if count != 1 {
+		t.Errorf("Expected query to include the restored model but got %d models", count)
+	}
+	if count, err := softDeleteTestModels.CountDeleted(); err != nil {
+		t.Fatalf("Unexpected error in CountDeleted: %s", err.Error())
+	} else if count != 1 {
+		t.Errorf("Expected CountDeleted to return 1 but got %d", count)
+	}
+	expectNoIndexProblems(t, softDeleteTestModels)
+
+	// Restoring a model whose unique value was taken by another model should
+	// fail and leave the model deleted.
+	other := &softDeleteTestModel{Email: conflicting.Email}
+	if err := softDeleteTestModels.Save(other); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	_, err = softDeleteTestModels.Restore(conflicting.ID)
+	expectUniqueConstraintError(t, err, "Email", other.ID)
+	expectModelNotFoundError(t, softDeleteTestModels.Find(conflicting.ID, &softDeleteTestModel{}))
+	if err := softDeleteTestModels.FindDeleted(conflicting.ID, &softDeleteTestModel{}); err != nil {
+		t.Errorf("Unexpected error in FindDeleted: %s", err.Error())
+	}
+}
+
+func TestPurge(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveSoftDeleteTestModels(3)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+	for _, model := range models[:2] {
+		if _, err := softDeleteTestModels.Delete(model.ID); err != nil {
+			t.Fatalf("Unexpected error in Delete: %s", err.Error())
+		}
+	}
+	// Models deleted after the given time should not be purged
+	if count, err := softDeleteTestModels.Purge(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("Unexpected error in Purge: %s", err.Error())
+	} else if count != 0 {
+		t.Errorf("Expected Purge to return 0 but got %d", count)
+	}
+	if count, err := softDeleteTestModels.Purge(time.Now()); err != nil {
+		t.Fatalf("Unexpected error in Purge: %s", err.Error())
+	} else if count != 2 {
+		t.Errorf("Expected Purge to return 2 but got %d", count)
+	}
+	manyField := softDeleteTestModels.spec.fieldsByName["Many"]
+	for _, model := range models[:2] {
+		expectKeyDoesNotExist(t, softDeleteTestModels.ModelKey(model.ID))
+		expectKeyDoesNotExist(t, softDeleteTestModels.spec.referencesKey(model.ID, manyField))
+	}
+	expectKeyDoesNotExist(t, softDeleteTestModels.spec.deletedKey())
+	// The model which was not deleted should be unaffected
+	if err := softDeleteTestModels.Find(models[2].ID, &softDeleteTestModel{}); err != nil {
+		t.Errorf("Unexpected error in Find: %s", err.Error())
+	}
+	if ok, err := softDeleteTestModels.Restore(models[0].ID); err != nil {
+		t.Fatalf("Unexpected error in Restore: %s", err.Error())
+	} else if ok {
+		t.Errorf("Expected Restore to return false for a purged model but got true")
+	}
+}
+
+func TestSoftDeleteDisabled(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if _, err := testModels.CountDeleted(); err == nil {
+		t.Errorf("Expected error in CountDeleted for a collection without soft deletes but got none")
+	}
+	if _, err := testModels.Restore("id"); err == nil {
+		t.Errorf("Expected error in Restore for a collection without soft deletes but got none")
+	}
+	if _, err := testModels.Purge(time.Now()); err == nil {
+		t.Errorf("Expected error in Purge for a collection without soft deletes but got none")
+	}
+	// SoftDelete requires Index
+	options := DefaultCollectionOptions.WithSoftDelete(true)
+	if _, err := NewPoolWithOptions(testPool.options).NewCollectionWithOptions(&softDeleteTestModel{}, options); err == nil {
+		t.Errorf("Expected error in NewCollectionWithOptions for SoftDelete without Index but got none")
+	}
+}
+
+// createAndSaveSoftDeleteTestModels creates and saves n softDeleteTestModels,
+// each with a unique Email and a reference to a new testModel.
+func createAndSaveSoftDeleteTestModels(n int) ([]*softDeleteTestModel, error) {
+	refs, err := createAndSaveTestModels(n)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]*softDeleteTestModel, n)
+	tx := testPool.NewTransaction()
+	for i := range models {
+		models[i] = &softDeleteTestModel{
+			Int:    i,
+			String: "string" + generateRandomID(),
+			Email:  generateRandomID() + "@example.com",
+			Many:   []*testModel{refs[i]},
+		}
+		tx.Save(softDeleteTestModels, models[i])
+	}
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// expectModelNotFoundError reports an error if err is not a ModelNotFoundError.
+func expectModelNotFoundError(t *testing.T, err error) {
+	if err == nil {
+		t.Errorf("Expected ModelNotFoundError but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected ModelNotFoundError but got %T: %s", err, err.Error())
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File subscription.go contains code related to publishing and subscribing to
+// change events for a collection.
+
+package zoom
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ChangeOperation is the kind of change described by a ChangeEvent.
+type ChangeOperation string
+
+const (
+	// SaveOperation means that a model was saved with Save, SaveFields,
+	// Increment, or Query.Update.
+	SaveOperation ChangeOperation = "save"
+	// DeleteOperation means that a model was deleted with Delete or
+	// Query.Delete. For Delete, it is published even if the model did not
+	// exist.
+	DeleteOperation ChangeOperation = "delete"
+	// DeleteAllOperation means that every model in the collection was deleted
+	// with DeleteAll. The ModelID of the event is empty.
+	DeleteAllOperation ChangeOperation = "deleteAll"
+)
+
+// ChangeEvent describes a change to a model in a collection with the Notify
+// option. ChangeEvents are delivered to the handler passed to Subscribe.
+type ChangeEvent struct {
+	// Collection is the name of the collection.
+	Collection string `json:"collection"`
+	// ModelID is the id of the model which was changed.
+	ModelID string `json:"id"`
+	// FieldNames are the names of the fields which were saved. It is empty for
+	// deletes.
+	FieldNames []string `json:"fields,omitempty"`
+	// Operation is the kind of change.
+	Operation ChangeOperation `json:"op"`
+}
+
+// subscriptionRetryInterval is how long a Subscription waits before trying to
+// reconnect after the connection to the database failed.
+var subscriptionRetryInterval = time.Second
+
+// ChangesChannel returns the name of the Redis channel that change events for
+// the collection are published to if the collection has the Notify option.
+// Because channels are shared between all the databases on a Redis server, the
+// name includes the database number. In cluster mode, the name of the
+// collection is wrapped in a hash tag, just like the keys for the collection.
+func (c *Collection) ChangesChannel() string {
+	return fmt.Sprintf("%s:changes:%d", c.spec.keyPrefix(), c.pool.options.Database)
+}
+
+// publishChange adds a command to the transaction for publishing a change
+// event iff c has the Notify option.
+func (t *Transaction) publishChange(c *Collection, op ChangeOperation, modelID string, fieldNames []string) {
+	if !c.notify {
+		return
+	}
+	payload, err := json.Marshal(ChangeEvent{
+		Collection: c.Name(),
+		ModelID:    modelID,
+		FieldNames: fieldNames,
+		Operation:  op,
+	})
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	t.Command("PUBLISH", redis.Args{c.ChangesChannel(), payload}, nil)
+}
+
+// Subscription receives the change events for a collection and passes them to
+// a handler. Use Collection.Subscribe to create a Subscription.
+type Subscription struct {
+	collection *Collection
+	handler    func(ChangeEvent)
+	// mutex protects conn and closed
+	mutex  sync.Mutex
+	conn   *redis.PubSubConn
+	closed bool
+	// closing is closed when Close is called and done is closed when the
+	// receiving goroutine exits.
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Subscribe starts listening for change events for the collection and calls
+// handler with each event in a separate goroutine. Events are delivered one at
+// a time, in the order they were published. Change events are only published
+// for collections with the Notify option. Subscribe returns an error if it
+// could not subscribe to the channel. If the connection to the database fails
+// later on, the Subscription will keep trying to reconnect until it is closed.
+// Like all Redis Pub/Sub messages, any events that are published while the
+// Subscription is disconnected will not be received, so you may wish to reload
+// any cached models after a failure. You should call Close on the Subscription
+// when you no longer need it.
+func (c *Collection) Subscribe(handler func(ChangeEvent)) (*Subscription, error) {
+	s := &Subscription{
+		collection: c,
+		handler:    handler,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	go s.receive()
+	return s, nil
+}
+
+// Close stops the Subscription and waits for the handler to return if it is
+// currently running. No more events will be delivered after Close returns. It
+// is safe to call Close more than once. Close must not be called from inside
+// the handler, since it would wait for itself to return. Use CloseAsync
+// instead.
+func (s *Subscription) Close() error {
+	err := s.CloseAsync()
+	<-s.done
+	return err
+}
+
+// CloseAsync is like Close but does not wait for the handler to return, so it
+// can be called from inside the handler. The handler will not be called again
+// once the current call returns. It is safe to call CloseAsync more than once.
+func (s *Subscription) CloseAsync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.closing)
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// connect dials a new connection and subscribes to the changes channel for the
+// collection. The connection does not come from the pool, because closing a
+// pooled connection blocks until it has unsubscribed, which would interfere
+// with the goroutine receiving messages.
+func (s *Subscription) connect() error {
+	rawConn, err := s.collection.pool.redisPool.Dial()
+	if err != nil {
+		return err
+	}
+	conn := &redis.PubSubConn{Conn: rawConn}
+	if err := conn.Subscribe(s.collection.ChangesChannel()); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	// Wait for the confirmation so that no events are missed after Subscribe
+	// returns.
+	switch reply := conn.Receive().(type) {
+	case error:
+		_ = conn.Close()
+		return reply
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return conn.Close()
+	}
+	s.conn = conn
+	return nil
+}
+
+// receive receives messages until the Subscription is closed, calling the
+// handler for each change event and reconnecting whenever the connection
+// fails.
+func (s *Subscription) receive() {
+	defer close(s.done)
+	for {
+		s.mutex.Lock()
+		conn := s.conn
+		s.mutex.Unlock()
+		if conn != nil {
+			s.receiveUntilError(conn)
+		}
+		// The connection failed or was closed.
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return
+		}
+		s.conn = nil
+		s.mutex.Unlock()
+		if conn != nil {
+			_ = conn.Close()
+		}
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(subscriptionRetryInterval):
+		}
+		// If we fail to reconnect, s.conn will be nil and we will try again
+		// after another interval.
+		_ = s.connect()
+	}
+}
+
+// receiveUntilError receives messages from conn and passes any change events to
+// the handler until there is an error.
+func (s *Subscription) receiveUntilError(conn *redis.PubSubConn) {
+	for {
+		switch reply := conn.Receive().(type) {
+		case redis.Message:
+			event := ChangeEvent{}
+			if err := json.Unmarshal(reply.Data, &event); err != nil {
+				// Ignore any messages which are not change events.
+				continue
+			}
+			// Messages which were already buffered can still be received after
+			// the Subscription was closed, so don't pass them to the handler.
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return
+			}
+			s.handler(event)
+		case error:
+			return
+		}
+	}
+}
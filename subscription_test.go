@@ -0,0 +1,202 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File subscription_test.go tests the code in subscription.go.
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	events := make(chan ChangeEvent, 10)
+	sub, err := notifyTestModels.Subscribe(func(event ChangeEvent) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in Subscribe: %s", err.Error())
+	}
+	defer sub.Close()
+
+	model := &notifyTestModel{Int: 1, String: "a"}
+	if err := notifyTestModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		FieldNames: []string{"Int", "String"},
+		Operation:  SaveOperation,
+	})
+	if err := notifyTestModels.SaveFields([]string{"Int"}, model); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		FieldNames: []string{"Int"},
+		Operation:  SaveOperation,
+	})
+	if _, err := notifyTestModels.Delete(model.ModelID()); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		Operation:  DeleteOperation,
+	})
+	if err := notifyTestModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		FieldNames: []string{"Int", "String"},
+		Operation:  SaveOperation,
+	})
+	if _, err := notifyTestModels.Increment(model.ModelID(), "Int", 1); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		FieldNames: []string{"Int"},
+		Operation:  SaveOperation,
+	})
+	if _, err := notifyTestModels.NewQuery().Update(map[string]interface{}{"Int": 2}); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		FieldNames: []string{"Int"},
+		Operation:  SaveOperation,
+	})
+	if _, err := notifyTestModels.NewQuery().Delete(); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		Operation:  DeleteOperation,
+	})
+	if _, err := notifyTestModels.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		Operation:  DeleteAllOperation,
+	})
+
+	// The Subscription should reconnect if the connection fails
+	originalInterval := subscriptionRetryInterval
+	subscriptionRetryInterval = 10 * time.Millisecond
+	defer func() {
+		subscriptionRetryInterval = originalInterval
+	}()
+	sub.mutex.Lock()
+	oldConn := sub.conn
+	_ = sub.conn.Conn.Close()
+	sub.mutex.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for {
+		sub.mutex.Lock()
+		reconnected := sub.conn != nil && sub.conn != oldConn
+		sub.mutex.Unlock()
+		if reconnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription did not reconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := notifyTestModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	expectChangeEvent(t, events, ChangeEvent{
+		Collection: "notifyTestModel",
+		ModelID:    model.ModelID(),
+		FieldNames: []string{"Int", "String"},
+		Operation:  SaveOperation,
+	})
+
+	// No more events should be delivered after Close
+	if err := sub.Close(); err != nil {
+		t.Errorf("Unexpected error in Close: %s", err.Error())
+	}
+	if err := notifyTestModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected no more events after Close but got %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionCloseAsync(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// CloseAsync should not wait for the handler to return, so it can be
+	// called from inside the handler.
+	closed := make(chan error, 1)
+	var sub *Subscription
+	ready := make(chan struct{})
+	var err error
+	sub, err = notifyTestModels.Subscribe(func(event ChangeEvent) {
+		<-ready
+		closed <- sub.CloseAsync()
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in Subscribe: %s", err.Error())
+	}
+	close(ready)
+	if err := notifyTestModels.Save(&notifyTestModel{Int: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Unexpected error in CloseAsync: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for CloseAsync to return inside the handler")
+	}
+
+	// The receiving goroutine should exit once the handler returns, so Close
+	// should not block.
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error in Close: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for Close to return")
+	}
+}
+
+// expectChangeEvent waits for the next event from events and calls t.Errorf if
+// it is not equal to expected.
+func expectChangeEvent(t *testing.T, events chan ChangeEvent, expected ChangeEvent) {
+	select {
+	case got := <-events:
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected event %+v but got %+v", expected, got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for event %+v", expected)
+	}
+}
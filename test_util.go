@@ -14,7 +14,9 @@ import (
 	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dchest/uniuri"
 	"github.com/garyburd/redigo/redis"
@@ -24,7 +26,15 @@ var (
 	address  = flag.String("address", "localhost:6379", "the address of a redis server to connect to")
 	network  = flag.String("network", "tcp", "the network to use for the database connection (e.g. 'tcp' or 'unix')")
 	database = flag.Int("database", 9, "the redis database number to use for testing")
-	testPool *Pool
+	// The following flags are only used for testing against a redis server
+	// started with TLS. The TLS server tests are skipped if tlsAddress is empty.
+	tlsAddress  = flag.String("tls-address", "", "the address of a redis server with TLS enabled to connect to")
+	tlsCertFile = flag.String("tls-cert-file", "", "the client certificate to use for the TLS server")
+	tlsKeyFile  = flag.String("tls-key-file", "", "the client private key to use for the TLS server")
+	tlsCAFile   = flag.String("tls-ca-file", "", "the certificate authority to use for verifying the TLS server")
+	username    = flag.String("username", "", "the ACL username to use for the TLS server")
+	password    = flag.String("password", "", "the password to use for the TLS server")
+	testPool    *Pool
 )
 
 // setUpOnce is used to enforce that the setup process happens exactly once,
@@ -132,6 +142,55 @@ func createAndSaveIndexedTestModels(n int) ([]*indexedTestModel, error) {
 	return models, nil
 }
 
+// referenceTestModel is a model type used for testing references to other
+// models.
+type referenceTestModel struct {
+	Name string
+	One  *testModel   `zoom:"ref"`
+	Many []*testModel `zoom:"ref"`
+	RandomID
+}
+
+// uniqueTestModel is a model type used for testing unique constraints.
+type uniqueTestModel struct {
+	Email    string  `zoom:"unique"`
+	Nickname *string `zoom:"unique,index"`
+	RandomID
+}
+
+// expiringTestModel is a model type used for testing collections with a TTL.
+type expiringTestModel struct {
+	Int    int          `zoom:"index"`
+	String string       `zoom:"index,unique"`
+	Many   []*testModel `zoom:"ref"`
+	RandomID
+}
+
+// versionedTestModel is a model type used for testing version fields.
+type versionedTestModel struct {
+	Int     int
+	String  string
+	Version int `zoom:"version,index"`
+	RandomID
+}
+
+// softDeleteTestModel is a model type used for testing collections with soft
+// deletes.
+type softDeleteTestModel struct {
+	Int    int          `zoom:"index"`
+	String string       `zoom:"index"`
+	Email  string       `zoom:"unique"`
+	Many   []*testModel `zoom:"ref"`
+	RandomID
+}
+
+// notifyTestModel is a model type used for testing change events.
+type notifyTestModel struct {
+	Int    int
+	String string
+	RandomID
+}
+
 type indexedPrimativesModel struct {
 	Uint    uint    `zoom:"index"`
 	Uint8   uint8   `zoom:"index"`
@@ -239,6 +298,12 @@ var (
 	indexedTestModels       *Collection
 	indexedPrimativesModels *Collection
 	indexedPointersModels   *Collection
+	referenceTestModels     *Collection
+	uniqueTestModels        *Collection
+	expiringTestModels      *Collection
+	notifyTestModels        *Collection
+	versionedTestModels     *Collection
+	softDeleteTestModels    *Collection
 )
 
 // registerTestingTypes registers the common types used for testing
@@ -247,6 +312,9 @@ func registerTestingTypes() {
 		collection **Collection
 		model      Model
 		index      bool
+		ttl        time.Duration
+		notify     bool
+		softDelete bool
 	}{
 		{
 			collection: &testModels,
@@ -268,9 +336,42 @@ func registerTestingTypes() {
 			model:      &indexedPointersModel{},
 			index:      true,
 		},
+		{
+			collection: &referenceTestModels,
+			model:      &referenceTestModel{},
+			index:      true,
+		},
+		{
+			collection: &uniqueTestModels,
+			model:      &uniqueTestModel{},
+			index:      true,
+		},
+		{
+			collection: &expiringTestModels,
+			model:      &expiringTestModel{},
+			index:      true,
+			ttl:        time.Hour,
+		},
+		{
+			collection: &notifyTestModels,
+			model:      &notifyTestModel{},
+			index:      true,
+			notify:     true,
+		},
+		{
+			collection: &versionedTestModels,
+			model:      &versionedTestModel{},
+			index:      true,
+		},
+		{
+			collection: &softDeleteTestModels,
+			model:      &softDeleteTestModel{},
+			index:      true,
+			softDelete: true,
+		},
 	}
 	for _, m := range testModelTypes {
-		options := DefaultCollectionOptions.WithIndex(true)
+		options := DefaultCollectionOptions.WithIndex(true).WithTTL(m.ttl).WithNotify(m.notify).WithSoftDelete(m.softDelete)
 		collection, err := testPool.NewCollectionWithOptions(m.model, options)
 		if err != nil {
 			panic(err)
@@ -307,6 +408,10 @@ func testingTearDown() {
 	if _, err := conn.Do("flushdb"); err != nil {
 		panic(err)
 	}
+	// The earliest expiration time found by the last sweep no longer applies
+	if expiringTestModels != nil {
+		atomic.StoreInt64(&expiringTestModels.nextExpiration, 0)
+	}
 }
 
 // expectSetContains sets an error via t.Errorf if member is not in the set
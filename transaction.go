@@ -8,7 +8,9 @@
 package zoom
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -18,10 +20,35 @@ import (
 // commands or lua scripts. Transactions feature delayed execution,
 // so nothing touches the database until you call Exec.
 type Transaction struct {
-	conn     redis.Conn
+	pool *Pool
+	conn redis.Conn
+	// slot is the hash slot that conn is bound to in cluster mode. conn is nil
+	// until the transaction watches a key or is executed, and slot is -1 until
+	// the transaction watches a key in cluster mode.
+	slot int
+	// usePrimary is true if the transaction should not be sent to a replica.
+	usePrimary bool
+	// ctx is the context passed to ExecContext. It is nil until the transaction
+	// is executed.
+	ctx      context.Context
 	actions  []*Action
 	err      error
 	watching []string
+	// uniqueChecks are the values for unique fields that will be saved by the
+	// transaction. They are checked by Exec before the transaction is executed.
+	uniqueChecks []*uniqueCheck
+	// versionChecks are the models with version fields that will be saved by
+	// the transaction. They are checked by Exec before the transaction is
+	// executed.
+	versionChecks []*versionCheck
+	// sweeps are the collections with a TTL whose expired models are removed
+	// from the indexes by Exec before the transaction is executed.
+	sweeps []*Collection
+	// afterExec are functions which are added by reply handlers and called
+	// after the transaction was executed, e.g. to load the models referenced by
+	// the models that were found. Each function is given a function which
+	// executes any further transactions it needs.
+	afterExec []func(exec func(*Transaction) error) error
 }
 
 // Action is a single step in a transaction and must be either a command
@@ -45,7 +72,8 @@ const (
 // NewTransaction instantiates and returns a new transaction.
 func (p *Pool) NewTransaction() *Transaction {
 	t := &Transaction{
-		conn: p.NewConn(),
+		pool: p,
+		slot: -1,
 	}
 	return t
 }
@@ -82,11 +110,17 @@ func (t *Transaction) Watch(model Model) error {
 // commands in the transaction will not be executed. Unlike most other
 // transaction methods, WatchKey does not use delayed execution. Because of how
 // the WATCH command works, WatchKey must send a command to Redis immediately.
-// You must call Watch or WatchKey before any other transaction methods.
+// You must call Watch or WatchKey before any other transaction methods. In
+// cluster mode, all the keys watched by a transaction must be in the same hash
+// slot, and only the actions for keys in that hash slot are executed
+// atomically with respect to the watched keys.
 func (t *Transaction) WatchKey(key string) error {
 	if len(t.actions) != 0 {
 		return fmt.Errorf("Cannot call WatchKey after other commands have been added to the transaction")
 	}
+	if err := t.bindKey(key); err != nil {
+		return err
+	}
 	if _, err := t.conn.Do("WATCH", key); err != nil {
 		return err
 	}
@@ -94,6 +128,24 @@ func (t *Transaction) WatchKey(key string) error {
 	return nil
 }
 
+// watchKeys is like WatchKey but watches all of the given keys with a single
+// WATCH command.
+func (t *Transaction) watchKeys(keys []string) error {
+	if len(t.actions) != 0 {
+		return fmt.Errorf("Cannot watch keys after other commands have been added to the transaction")
+	}
+	for _, key := range keys {
+		if err := t.bindKey(key); err != nil {
+			return err
+		}
+	}
+	if _, err := t.conn.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+		return err
+	}
+	t.watching = append(t.watching, keys...)
+	return nil
+}
+
 // Command adds a command action to the transaction with the given args.
 // handler will be called with the reply from this specific command when
 // the transaction is executed.
@@ -118,35 +170,94 @@ func (t *Transaction) Script(script *redis.Script, args redis.Args, handler Repl
 	})
 }
 
+// bindKey binds the transaction to the node which serves the hash slot for the
+// given key, or to the primary if the pool is not in cluster mode. It returns an
+// error if the transaction is already bound to a different hash slot.
+func (t *Transaction) bindKey(key string) error {
+	if t.pool.cluster == nil {
+		if t.conn == nil {
+			t.conn = t.getConn(t.pool.NewConn)
+		}
+		return nil
+	}
+	slot := keySlot(key)
+	if t.conn == nil {
+		t.conn = t.getConn(func() redis.Conn {
+			return t.pool.cluster.connForSlot(slot)
+		})
+		t.slot = slot
+	} else if slot != t.slot {
+		return fmt.Errorf("zoom: In cluster mode, all the keys watched or checked for unique constraints by a transaction must be in the same hash slot. Key %s is not in hash slot %d", key, t.slot)
+	}
+	return nil
+}
+
 // sendAction writes a to a connection buffer using conn.Send()
-func (t *Transaction) sendAction(a *Action) error {
+func sendAction(conn redis.Conn, a *Action) error {
 	switch a.kind {
 	case commandAction:
-		return t.conn.Send(a.name, a.args...)
+		return conn.Send(a.name, a.args...)
 	case scriptAction:
-		return a.script.Send(t.conn, a.args...)
+		return a.script.Send(conn, a.args...)
 	}
 	return nil
 }
 
 // doAction writes a to the connection buffer and then immediately
 // flushes the buffer and reads the reply via conn.Do()
-func (t *Transaction) doAction(a *Action) (interface{}, error) {
+func doAction(conn redis.Conn, a *Action) (interface{}, error) {
 	switch a.kind {
 	case commandAction:
-		return t.conn.Do(a.name, a.args...)
+		return conn.Do(a.name, a.args...)
 	case scriptAction:
-		return a.script.Do(t.conn, a.args...)
+		return a.script.Do(conn, a.args...)
 	}
 	return nil, nil
 }
 
 // Exec executes the transaction, sequentially sending each action and
-// calling all the action handlers with the corresponding replies.
+// calling all the action handlers with the corresponding replies. If the
+// transaction checks unique constraints or versions and the corresponding keys
+// are changed by other callers before it can be executed, the checks are
+// repeated a limited number of times with a short backoff, after which Exec
+// returns a WatchError.
+//
+// In cluster mode (see PoolOptions.Cluster), a transaction which involves keys
+// in more than one hash slot, e.g. because it saves models in more than one
+// collection, is executed as one MULTI/EXEC per slot. Each of those parts is
+// atomic, but the transaction as a whole is not. If one part fails, Exec
+// returns the error, but the parts which were executed before it stay
+// committed.
 func (t *Transaction) Exec() error {
+	return t.ExecContext(context.Background())
+}
+
+// ExecContext is like Exec but uses the given context. If ctx is done before a
+// connection is available, ExecContext stops waiting for it. The deadline of
+// ctx (if any) is applied to every read and write on the connections used by
+// the transaction, and if ctx is cancelled any pending reads and writes are
+// interrupted. In either case, ExecContext returns ctx.Err(). Note that if ctx
+// is done while the transaction is being executed, some or all of the actions
+// might have been executed anyway.
+func (t *Transaction) ExecContext(ctx context.Context) (err error) {
+	t.ctx = ctx
+	if t.conn != nil {
+		// The connection was bound before the transaction was executed, e.g. by
+		// WatchKey.
+		t.conn = watchContext(ctx, t.conn)
+	}
 	// Return the connection to the pool when we are done
 	defer func() {
-		_ = t.conn.Close()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+	}()
+	// The versions of any saved models were incremented by Save or SaveFields,
+	// so they need to be restored if the transaction failed.
+	defer func() {
+		if err != nil {
+			t.restoreVersions()
+		}
 	}()
 
 	// If the transaction had an error from a previous command, return it
@@ -154,52 +265,281 @@ func (t *Transaction) Exec() error {
 	if t.err != nil {
 		return t.err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Remove any expired models from the indexes that the transaction reads.
+	if err = t.sweepCollections(); err != nil {
+		if ctxErr := contextErr(ctx); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
 
-	if len(t.actions) == 1 && len(t.watching) == 0 {
-		// If there is only one command and no keys being watched, no need to use
-		// MULTI/EXEC
-		a := t.actions[0]
-		reply, err := t.doAction(a)
+	backoff := checkRetryOptions.Backoff
+	for attempt := 1; ; attempt++ {
+		// Check the unique constraints and versions (if any). This watches the
+		// corresponding keys, so if they are changed by another caller before the
+		// transaction is executed we need to check them again, up to
+		// checkRetryOptions.MaxAttempts times.
+		err = t.checkUniqueConstraints()
+		if err == nil {
+			err = t.checkVersions()
+		}
+		if err == nil {
+			if err = t.exec(); err == errCheckedKeysChanged {
+				if attempt >= checkRetryOptions.MaxAttempts {
+					return WatchError{keys: t.checkedKeys()}
+				}
+				if backoff, err = checkRetryOptions.wait(ctx, backoff); err == nil {
+					continue
+				}
+			}
+		}
+		if err == nil {
+			err = t.runAfterExec(ctx)
+		}
 		if err != nil {
+			if ctxErr := contextErr(ctx); ctxErr != nil {
+				// The error was most likely caused by the context being done
+				return ctxErr
+			}
+		}
+		return err
+	}
+}
+
+// checkRetryOptions controls how ExecContext retries when the keys checked for
+// unique constraints or versions are changed by another caller before the
+// transaction is executed. Once MaxAttempts is reached, ExecContext returns a
+// WatchError.
+var checkRetryOptions = UpdateOptions{
+	MaxAttempts: 10,
+	Backoff:     time.Millisecond,
+	MaxBackoff:  100 * time.Millisecond,
+}
+
+// checkedKeys returns the keys which are checked for the unique constraints and
+// versions in the transaction.
+func (t *Transaction) checkedKeys() []string {
+	keys := []string{}
+	for _, uc := range t.uniqueChecks {
+		keys = append(keys, uc.key())
+	}
+	for _, vc := range t.versionChecks {
+		keys = append(keys, vc.mr.key())
+	}
+	return keys
+}
+
+// runAfterExec returns the connection for the transaction to the pool and then
+// calls the functions in t.afterExec, which execute any further transactions
+// with ctx. The connection is returned first so that it is available to those
+// transactions, even if the pool has a small MaxActive.
+func (t *Transaction) runAfterExec(ctx context.Context) error {
+	if len(t.afterExec) == 0 {
+		return nil
+	}
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+	return t.callAfterExec(func(tx *Transaction) error {
+		return tx.ExecContext(ctx)
+	})
+}
+
+// callAfterExec calls each of the functions in t.afterExec with exec.
+func (t *Transaction) callAfterExec(exec func(*Transaction) error) error {
+	afterExec := t.afterExec
+	t.afterExec = nil
+	for _, f := range afterExec {
+		if err := f(exec); err != nil {
 			return err
 		}
-		if a.handler != nil {
-			if err := a.handler(reply); err != nil {
-				return err
-			}
+	}
+	return nil
+}
+
+// exec sends each action to the database and calls all the action handlers with
+// the corresponding replies.
+func (t *Transaction) exec() error {
+	var replies []interface{}
+	var err error
+	t.afterExec = nil
+	if t.pool.cluster == nil {
+		if t.conn == nil {
+			t.conn = t.getConn(func() redis.Conn {
+				return t.pool.connForActions(t.actions, t.usePrimary, sessionFromContext(t.ctx))
+			})
 		}
+		t.pool.recordWrite(sessionFromContext(t.ctx), t.actions)
+		replies, err = t.execActions(t.conn, t.actions, false)
 	} else {
-		// Send all the commands and scripts at once using MULTI/EXEC
-		if err := t.conn.Send("MULTI"); err != nil {
+		replies, err = t.execCluster()
+	}
+	if err != nil {
+		return err
+	}
+	// Iterate through the replies, calling the corresponding handler functions
+	for i, reply := range replies {
+		a := t.actions[i]
+		if err, ok := reply.(error); ok {
 			return err
 		}
-		for _, a := range t.actions {
-			if err := t.sendAction(a); err != nil {
+		if a.handler != nil {
+			if err := a.handler(reply); err != nil {
 				return err
 			}
 		}
-		// Invoke redis driver to execute the transaction
-		replies, err := redis.Values(t.conn.Do("EXEC"))
+	}
+	return nil
+}
+
+// execActions sends the given actions to the database using conn and returns
+// the replies. It uses MULTI/EXEC unless there is only one action and no keys
+// are being watched. If asking is true, it sends the ASKING command first,
+// which is needed to follow an ASK redirect in cluster mode.
+func (t *Transaction) execActions(conn redis.Conn, actions []*Action, asking bool) ([]interface{}, error) {
+	if len(actions) == 1 && len(t.watching) == 0 && len(t.uniqueChecks) == 0 && len(t.versionChecks) == 0 && !asking {
+		// If there is only one command and no keys being watched, no need to use
+		// MULTI/EXEC
+		reply, err := doAction(conn, actions[0])
 		if err != nil {
-			if err == redis.ErrNil && len(t.watching) > 0 {
-				return WatchError{keys: t.watching}
-			}
-			return err
+			return nil, err
 		}
-		// Iterate through the replies, calling the corresponding handler functions
-		for i, reply := range replies {
-			a := t.actions[i]
-			if err, ok := reply.(error); ok {
-				return err
-			}
-			if a.handler != nil {
-				if err := a.handler(reply); err != nil {
-					return err
-				}
+		return []interface{}{reply}, nil
+	}
+	if asking {
+		if err := conn.Send("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	// Send all the commands and scripts at once using MULTI/EXEC
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, a := range actions {
+		if err := sendAction(conn, a); err != nil {
+			return nil, err
+		}
+	}
+	// Invoke redis driver to execute the transaction
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		if err == redis.ErrNil && len(t.watching) > 0 {
+			return nil, WatchError{keys: t.watching}
+		}
+		if err == redis.ErrNil && (len(t.uniqueChecks) > 0 || len(t.versionChecks) > 0) {
+			return nil, errCheckedKeysChanged
+		}
+		return nil, err
+	}
+	return replies, nil
+}
+
+// execCluster executes the transaction in cluster mode. The actions are
+// grouped by the hash slot of the key they operate on (see actionKey), and each
+// group is executed in its own MULTI/EXEC on the node which serves the slot.
+// So each group is atomic, but the transaction as a whole is not. If the
+// transaction is watching any keys, the group for the hash slot of the watched
+// keys is executed first, and the other groups are only executed if the watched
+// keys did not change. The replies are returned in the same order as the
+// actions.
+func (t *Transaction) execCluster() ([]interface{}, error) {
+	slots := make([]int, len(t.actions))
+	for i, a := range t.actions {
+		if key := actionKey(a); key != "" {
+			slots[i] = keySlot(key)
+		} else if i > 0 {
+			// Actions without a key are executed together with the previous action
+			slots[i] = slots[i-1]
+		} else {
+			slots[i] = -1
+		}
+	}
+	// Actions without a key at the start of the transaction are executed together
+	// with the first action that has a key.
+	for i := len(slots) - 2; i >= 0; i-- {
+		if slots[i] == -1 {
+			slots[i] = slots[i+1]
+		}
+	}
+	// Group the actions by slot, in order of their first appearance, except that
+	// the group for the watched keys (if any) always comes first.
+	order := []int{}
+	groups := map[int][]int{}
+	if t.conn != nil {
+		order = append(order, t.slot)
+		groups[t.slot] = []int{}
+	}
+	for i, slot := range slots {
+		if _, found := groups[slot]; !found {
+			order = append(order, slot)
+		}
+		groups[slot] = append(groups[slot], i)
+	}
+	replies := make([]interface{}, len(t.actions))
+	for _, slot := range order {
+		actions := make([]*Action, len(groups[slot]))
+		for j, i := range groups[slot] {
+			actions[j] = t.actions[i]
+		}
+		var groupReplies []interface{}
+		var err error
+		if t.conn != nil && slot == t.slot {
+			groupReplies, err = t.execActions(t.conn, actions, false)
+			if r, ok := parseRedirect(err); ok && !r.ask {
+				// The watched keys have moved, so we can't follow the redirect. But we
+				// can make sure the next transaction goes to the right node.
+				t.pool.cluster.setSlotAddress(r.slot, r.address)
 			}
+		} else if slot == -1 {
+			// None of the actions have a key, so any node will do.
+			groupReplies, err = t.execSlot(0, actions)
+		} else {
+			groupReplies, err = t.execSlot(slot, actions)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range groups[slot] {
+			replies[i] = groupReplies[j]
+		}
+	}
+	return replies, nil
+}
+
+// execSlot executes the given actions on the node which serves the given hash
+// slot, following any MOVED or ASK redirects.
+func (t *Transaction) execSlot(slot int, actions []*Action) ([]interface{}, error) {
+	conn := t.getConn(func() redis.Conn {
+		return t.pool.cluster.connForSlot(slot)
+	})
+	asking := false
+	for redirects := 0; ; redirects++ {
+		replies, err := t.execActions(conn, actions, asking)
+		_ = conn.Close()
+		r, ok := parseRedirect(err)
+		if !ok || redirects >= maxRedirects {
+			return replies, err
+		}
+		if r.ask {
+			// The slot is being migrated and the keys have already been moved. The
+			// slot is still served by the same node for all other keys.
+			address := r.address
+			conn = t.getConn(func() redis.Conn {
+				return t.pool.cluster.connForAddress(address)
+			})
+			asking = true
+		} else {
+			t.pool.cluster.setSlotAddress(r.slot, r.address)
+			conn = t.getConn(func() redis.Conn {
+				return t.pool.cluster.connForSlot(slot)
+			})
+			asking = false
 		}
 	}
-	return nil
 }
 
 //go:generate go run scripts/main.go
@@ -211,16 +551,35 @@ func (t *Transaction) Exec() error {
 // the return value of the script. You can use the Name method of a Collection
 // to get the name.
 func (t *Transaction) DeleteModelsBySetIDs(setKey string, collectionName string, handler ReplyHandler) {
-	t.Script(deleteModelsBySetIdsScript, redis.Args{setKey, collectionName}, handler)
+	t.Script(deleteModelsBySetIdsScript, redis.Args{setKey, t.keyPrefixForName(collectionName)}, handler)
+}
+
+// keyPrefixForName returns the key prefix for the collection with the given
+// name. In cluster mode, the prefix includes a hash tag. If there is no
+// registered collection with the given name, it simply returns the name.
+func (t *Transaction) keyPrefixForName(collectionName string) string {
+	if spec, found := t.pool.modelNameToSpec[collectionName]; found {
+		return spec.keyPrefix()
+	}
+	return collectionName
+}
+
+// deleteModelsBySetIDs works like DeleteModelsBySetIDs, but also deletes the
+// separate keys for the fields identified by redisFieldNames (e.g. the sets of
+// ids for references to many other models) for each model. keyPrefix is the
+// key prefix for the collection (see modelSpec.keyPrefix).
+func (t *Transaction) deleteModelsBySetIDs(setKey string, keyPrefix string, redisFieldNames []string, handler ReplyHandler) {
+	args := redis.Args{setKey, keyPrefix}.Add(Interfaces(redisFieldNames)...)
+	t.Script(deleteModelsBySetIdsScript, args, handler)
 }
 
 // deleteStringIndex is a small function wrapper around a Lua script. The script
 // will atomically remove the existing string index, if any, on the given
-// fieldName for the model with the given modelID. You can use the Name method
-// of a Collection to get its name. fieldName should be the name as it is stored
-// in Redis.
-func (t *Transaction) deleteStringIndex(collectionName, modelID, fieldName string) {
-	t.Script(deleteStringIndexScript, redis.Args{collectionName, modelID, fieldName}, nil)
+// fieldName for the model with the given modelID. keyPrefix is the key prefix
+// for the collection (see modelSpec.keyPrefix). fieldName should be the name as
+// it is stored in Redis.
+func (t *Transaction) deleteStringIndex(keyPrefix, modelID, fieldName string) {
+	t.Script(deleteStringIndexScript, redis.Args{keyPrefix, modelID, fieldName}, nil)
 }
 
 // ExtractIDsFromFieldIndex is a small function wrapper around a Lua script. The
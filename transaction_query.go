@@ -1,6 +1,15 @@
 package zoom
 
-import "github.com/garyburd/redigo/redis"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
 
 // TransactionQuery represents a query which will be run inside an existing
 // transaction. A TransactionQuery may consist of one or more query modifiers
@@ -85,6 +94,27 @@ func (q *TransactionQuery) Filter(filterString string, value interface{}) *Trans
 	return q
 }
 
+// Between works exactly like Query.Between. See the documentation for
+// Query.Between for more information.
+func (q *TransactionQuery) Between(fieldName string, min, max interface{}) *TransactionQuery {
+	q.query.Between(fieldName, min, max)
+	return q
+}
+
+// Where works exactly like Query.Where. See the documentation for Query.Where
+// for more information.
+func (q *TransactionQuery) Where(expr FilterExpr) *TransactionQuery {
+	q.query.Where(expr)
+	return q
+}
+
+// After works exactly like Query.After. See the documentation for Query.After
+// for more information.
+func (q *TransactionQuery) After(cursor string) *TransactionQuery {
+	q.query.After(cursor)
+	return q
+}
+
 // Run will run the query and scan the results into models when the Transaction
 // is executed. It works very similarly to Query.Run, so you can check the
 // documentation for Query.Run for more information. The first error encountered
@@ -110,8 +140,86 @@ func (q *TransactionQuery) Run(models interface{}) {
 		// But in redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), limit, q.offset, q.order.kind == descendingOrder)
-	q.tx.Command("SORT", sortArgs, newScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models))
+	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), limit, q.offset, q.reverse())
+	handler := newScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models)
+	q.tx.Command("SORT", sortArgs, newLoadReferencesHandler(handler, q.tx, q.collection.spec, q.fieldNames(), modelsGetter(models)))
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// RunPage will run the query and scan the results into models when the
+// Transaction is executed, then set the value of nextCursor to a cursor which
+// can be passed to After to get the next page of results. It works very
+// similarly to Query.RunPage, so you can check the documentation for
+// Query.RunPage for more information. The first error encountered will be saved
+// to the corresponding Transaction (if there is not already an error for the
+// Transaction) and returned when you call Transaction.Exec.
+func (q *TransactionQuery) RunPage(models interface{}, nextCursor *string) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	if err := q.collection.spec.checkModelsType(models); err != nil {
+		q.tx.setError(err)
+		return
+	}
+	if len(q.orders) != 1 {
+		q.tx.setError(errors.New("zoom: RunPage requires a query with exactly one order"))
+		return
+	}
+	idsKey, tmpKeys, err := generateIDsSet(q.query, q.tx)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	limit := int(q.limit)
+	if limit == 0 {
+		// In our query syntax, a limit of 0 means unlimited
+		// But in redis, -1 means unlimited
+		limit = -1
+	}
+	// The order field is always scanned into the models, even if it was not
+	// included, because we need its value to create the cursor.
+	order := q.orders[0]
+	fieldNames := q.fieldNames()
+	if !stringSliceContains(fieldNames, order.fieldName) {
+		fieldNames = append(fieldNames, order.fieldName)
+	}
+	redisNames := []string{}
+	for _, fieldName := range fieldNames {
+		redisNames = append(redisNames, q.collection.spec.fieldsByName[fieldName].redisName)
+	}
+	// Check whether there is at least one model after this page. If not, there
+	// are no more pages and nextCursor should be empty.
+	hasNextPage := false
+	if q.hasLimit() {
+		nextArgs := q.collection.spec.sortArgs(idsKey, nil, 1, q.offset+q.limit, q.reverse())
+		q.tx.Command("SORT", nextArgs, func(reply interface{}) error {
+			ids, err := redis.Strings(reply, nil)
+			hasNextPage = len(ids) > 0
+			return err
+		})
+	}
+	sortArgs := q.collection.spec.sortArgs(idsKey, redisNames, limit, q.offset, q.reverse())
+	scanModels := newLoadReferencesHandler(newScanModelsHandler(q.collection.spec, append(fieldNames, "-"), models), q.tx, q.collection.spec, fieldNames, modelsGetter(models))
+	q.tx.Command("SORT", sortArgs, func(reply interface{}) error {
+		if err := scanModels(reply); err != nil {
+			return err
+		}
+		(*nextCursor) = ""
+		modelsVal := reflect.ValueOf(models).Elem()
+		if modelsVal.Len() == 0 || !hasNextPage {
+			return nil
+		}
+		lastModel := modelsVal.Index(modelsVal.Len() - 1).Interface().(Model)
+		cursor, err := newQueryCursor(q.collection.spec, order, lastModel)
+		if err != nil {
+			return err
+		}
+		(*nextCursor) = cursor.String()
+		return nil
+	})
 	if len(tmpKeys) > 0 {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
 	}
@@ -138,8 +246,11 @@ func (q *TransactionQuery) RunOne(model Model) {
 		q.tx.setError(err)
 		return
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), 1, q.offset, q.order.kind == descendingOrder)
-	q.tx.Command("SORT", sortArgs, newScanOneModelHandler(q.query, q.collection.spec, append(q.fieldNames(), "-"), model))
+	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), 1, q.offset, q.reverse())
+	handler := newScanOneModelHandler(q.query, q.collection.spec, append(q.fieldNames(), "-"), model)
+	q.tx.Command("SORT", sortArgs, newLoadReferencesHandler(handler, q.tx, q.collection.spec, q.fieldNames(), func() []Model {
+		return []Model{model}
+	}))
 	if len(tmpKeys) > 0 {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
 	}
@@ -156,8 +267,9 @@ func (q *TransactionQuery) Count(count *int) {
 		q.tx.setError(q.err)
 		return
 	}
-	if !q.hasFilters() {
+	if !q.hasFilters() && !q.hasCursor() {
 		// Start by getting the number of models in the all index set
+		q.tx.sweepExpired(q.collection)
 		q.tx.Command("SCARD", redis.Args{q.collection.spec.indexKey()}, func(reply interface{}) error {
 			gotCount, err := redis.Int(reply, nil)
 			if err != nil {
@@ -179,7 +291,7 @@ func (q *TransactionQuery) Count(count *int) {
 		// Instead we'll just count the number of ids that match the query
 		// criteria. To do in a single transaction, we use the StoreIDs method and
 		// then add a LLEN command.
-		destKey := generateRandomKey("tmp:countDestKey")
+		destKey := generateRandomKey("tmp:countDestKey:" + q.collection.spec.keyPrefix())
 		q.StoreIDs(destKey)
 		q.tx.Command("LLEN", redis.Args{destKey}, NewScanIntHandler(count))
 		// Delete the temporary destKey when we're done.
@@ -207,7 +319,7 @@ func (q *TransactionQuery) IDs(ids *[]string) {
 		// But in redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.reverse())
 	q.tx.Command("SORT", sortArgs, NewScanStringsHandler(ids))
 	if len(tmpKeys) > 0 {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
@@ -235,7 +347,7 @@ func (q *TransactionQuery) StoreIDs(destKey string) {
 		// But in Redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.reverse())
 	// Append the STORE argument to cause Redis to store the results in destKey.
 	sortAndStoreArgs := append(sortArgs, "STORE", destKey)
 	q.tx.Command("SORT", sortAndStoreArgs, nil)
@@ -243,3 +355,471 @@ func (q *TransactionQuery) StoreIDs(destKey string) {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
 	}
 }
+
+// Delete will delete every model that matches the query criteria and set the
+// value of count to the number of models that were deleted. It works very
+// similarly to Query.Delete, so you can check the documentation for
+// Query.Delete for more information. You may pass in nil for count if you do
+// not care about the number of models that were deleted. The first error
+// encountered will be saved to the corresponding Transaction (if there is not
+// already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) Delete(count *int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	// Store the ids of the models to delete in a temporary list, then delete
+	// each model in the list with a script.
+	idsKey := generateRandomKey("tmp:deleteIDs:" + q.collection.spec.keyPrefix())
+	q.StoreIDs(idsKey)
+	channel := ""
+	if q.collection.notify {
+		channel = q.collection.ChangesChannel()
+	}
+	var handler ReplyHandler
+	if count != nil {
+		handler = NewScanIntHandler(count)
+	}
+	if q.collection.softDelete {
+		q.tx.softDelete(q.collection, "list", idsKey, channel, handler)
+		q.tx.Command("DEL", redis.Args{idsKey}, nil)
+		return
+	}
+	args := redis.Args{idsKey, q.collection.spec.keyPrefix(), channel, q.collection.Name()}
+	args = append(args, q.collection.fieldCleanupArgs()...)
+	q.tx.Script(deleteModelsByListIdsScript, args, handler)
+	q.tx.Command("DEL", redis.Args{idsKey}, nil)
+}
+
+// Update will set the given fields to the given values for every model that
+// matches the query criteria and set the value of count to the number of models
+// that were updated. It works very similarly to Query.Update, so you can check
+// the documentation for Query.Update for more information. You may pass in nil
+// for count if you do not care about the number of models that were updated.
+// The first error encountered will be saved to the corresponding Transaction
+// (if there is not already an error for the Transaction) and returned when you
+// call Transaction.Exec.
+func (q *TransactionQuery) Update(fieldValues map[string]interface{}, count *int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fieldArgs, fieldNames, err := q.collection.updateFieldArgs(fieldValues)
+	if err != nil {
+		q.tx.setError(fmt.Errorf("zoom: Error in Update or TransactionQuery.Update: %s", err.Error()))
+		return
+	}
+	eventFieldNames, err := json.Marshal(q.collection.spec.withVersionField(fieldNames))
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	// Store the ids of the models to update in a temporary list, then update
+	// each model in the list with a script.
+	idsKey := generateRandomKey("tmp:updateIDs:" + q.collection.spec.keyPrefix())
+	q.StoreIDs(idsKey)
+	channel := ""
+	if q.collection.notify {
+		channel = q.collection.ChangesChannel()
+	}
+	versionField, versionIndexed := "", 0
+	if fs := q.collection.spec.versionField; fs != nil {
+		versionField = fs.redisName
+		if fs.indexKind != noIndex {
+			versionIndexed = 1
+		}
+	}
+	var handler ReplyHandler
+	if count != nil {
+		handler = NewScanIntHandler(count)
+	}
+	args := redis.Args{idsKey, q.collection.spec.keyPrefix(), channel, q.collection.Name(), eventFieldNames, versionField, versionIndexed}
+	args = append(args, fieldArgs...)
+	q.tx.Script(updateModelsByListIdsScript, args, handler)
+	q.tx.Command("DEL", redis.Args{idsKey}, nil)
+}
+
+// updateFieldArgs returns the arguments for the update_models_by_list_ids
+// script which describe the new value of each field in fieldValues, along with
+// the sorted names of the fields. It returns an error if any of the fields do
+// not exist, cannot be updated, or if a value has the wrong type.
+func (c *Collection) updateFieldArgs(fieldValues map[string]interface{}) (redis.Args, []string, error) {
+	if len(fieldValues) == 0 {
+		return nil, nil, errors.New("At least one field must be given")
+	}
+	fieldNames := make([]string, 0, len(fieldValues))
+	for fieldName := range fieldValues {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	// Set the new values on an empty model so that they can be converted the
+	// same way as in SaveFields.
+	mr := &modelRef{
+		collection: c,
+		model:      reflect.New(c.spec.typ.Elem()).Interface().(Model),
+		spec:       c.spec,
+	}
+	for _, fieldName := range fieldNames {
+		fs, found := c.spec.fieldsByName[fieldName]
+		if !found {
+			return nil, nil, fmt.Errorf("Collection %s does not have field named %s", c.Name(), fieldName)
+		}
+		switch {
+		case fs.unique:
+			return nil, nil, fmt.Errorf("Cannot update field %s because it is unique", fieldName)
+		case fs == c.spec.versionField:
+			return nil, nil, fmt.Errorf("Cannot update field %s because it is the version field", fieldName)
+		case fs.kind == referencesField:
+			return nil, nil, fmt.Errorf("Cannot update field %s because it is a reference to many other models", fieldName)
+		}
+		if err := setFieldValue(mr.fieldValue(fieldName), fieldValues[fieldName]); err != nil {
+			return nil, nil, fmt.Errorf("Invalid value for field %s: %s", fieldName, err.Error())
+		}
+	}
+	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The first element of hashArgs is the key for the model, followed by pairs
+	// of field names and values in the same order as c.spec.fields.
+	args := redis.Args{}
+	i := 1
+	for _, fs := range c.spec.fields {
+		if !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		args = append(args, hashArgs[i], hashArgs[i+1])
+		i += 2
+		fieldValue := mr.fieldValue(fs.name)
+		for fieldValue.Kind() == reflect.Ptr && !fieldValue.IsNil() {
+			fieldValue = fieldValue.Elem()
+		}
+		isNil := fieldValue.Kind() == reflect.Ptr
+		switch {
+		case fs.indexKind == noIndex:
+			args = append(args, "none", 0, "")
+		case isNil:
+			kind := "numeric"
+			if fs.indexKind == stringIndex {
+				kind = "string"
+			}
+			args = append(args, kind, 0, "")
+		case fs.indexKind == numericIndex:
+			args = append(args, "numeric", 1, numericScore(fieldValue))
+		case fs.indexKind == booleanIndex:
+			args = append(args, "numeric", 1, boolScore(fieldValue))
+		case fs.indexKind == stringIndex:
+			args = append(args, "string", 1, fieldValue.String())
+		}
+	}
+	return args, fieldNames, nil
+}
+
+// setFieldValue sets field to value. value must be assignable to the type of
+// field, or to the type it points to if field is a pointer. Numeric values are
+// converted to the type of field if needed. If value is nil, field is set to
+// its zero value.
+func setFieldValue(field reflect.Value, value interface{}) error {
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	val := reflect.ValueOf(value)
+	typ := field.Type()
+	if typ.Kind() == reflect.Ptr && !val.Type().AssignableTo(typ) {
+		// Allocate a new value for field to point to
+		ptr := reflect.New(typ.Elem())
+		if err := setFieldValue(ptr.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+	switch {
+	case val.Type().AssignableTo(typ):
+		field.Set(val)
+	case typeIsNumeric(val.Type()) && typeIsNumeric(typ):
+		field.Set(val.Convert(typ))
+	default:
+		return fmt.Errorf("type %s cannot be used as %s", val.Type(), typ)
+	}
+	return nil
+}
+
+// Sum will set the value of sum to the sum of the values for the given field
+// for all models that match the query criteria. It works very similarly to
+// Query.Sum, so you can check the documentation for Query.Sum for more
+// information. The first error encountered will be saved to the corresponding
+// Transaction (if there is not already an error for the Transaction) and
+// returned when you call Transaction.Exec.
+func (q *TransactionQuery) Sum(fieldName string, sum *float64) {
+	q.aggregate("Sum", fieldName, func(agg fieldAggregate) error {
+		(*sum) = agg.sum
+		return nil
+	})
+}
+
+// Min will set the value of min to the minimum value for the given field out
+// of all models that match the query criteria. It works very similarly to
+// Query.Min, so you can check the documentation for Query.Min for more
+// information. The first error encountered will be saved to the corresponding
+// Transaction (if there is not already an error for the Transaction) and
+// returned when you call Transaction.Exec.
+func (q *TransactionQuery) Min(fieldName string, min *float64) {
+	q.aggregate("Min", fieldName, func(agg fieldAggregate) error {
+		if agg.count == 0 {
+			return q.newNoValuesError(fieldName)
+		}
+		(*min) = agg.min
+		return nil
+	})
+}
+
+// Max will set the value of max to the maximum value for the given field out
+// of all models that match the query criteria. It works very similarly to
+// Query.Max, so you can check the documentation for Query.Max for more
+// information. The first error encountered will be saved to the corresponding
+// Transaction (if there is not already an error for the Transaction) and
+// returned when you call Transaction.Exec.
+func (q *TransactionQuery) Max(fieldName string, max *float64) {
+	q.aggregate("Max", fieldName, func(agg fieldAggregate) error {
+		if agg.count == 0 {
+			return q.newNoValuesError(fieldName)
+		}
+		(*max) = agg.max
+		return nil
+	})
+}
+
+// Avg will set the value of avg to the average (mean) of the values for the
+// given field for all models that match the query criteria. It works very
+// similarly to Query.Avg, so you can check the documentation for Query.Avg for
+// more information. The first error encountered will be saved to the
+// corresponding Transaction (if there is not already an error for the
+// Transaction) and returned when you call Transaction.Exec.
+func (q *TransactionQuery) Avg(fieldName string, avg *float64) {
+	q.aggregate("Avg", fieldName, func(agg fieldAggregate) error {
+		if agg.count == 0 {
+			return q.newNoValuesError(fieldName)
+		}
+		(*avg) = agg.sum / float64(agg.count)
+		return nil
+	})
+}
+
+// fieldAggregate holds the values returned by the aggregate_field_index
+// script.
+type fieldAggregate struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// aggregate adds a script to the transaction which will compute the aggregate
+// values for the given field over all the models that match the query criteria.
+// handler will be called with the results when the transaction is executed.
+// finisherName is only used in error messages.
+func (q *TransactionQuery) aggregate(finisherName string, fieldName string, handler func(fieldAggregate) error) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fieldSpec, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.%s: could not find field %s in type %s", finisherName, fieldName, q.collection.spec.typ.String()))
+		return
+	}
+	if fieldSpec.indexKind != numericIndex {
+		q.tx.setError(fmt.Errorf("zoom: Query.%s is only allowed on numeric indexed fields and %s.%s is not (try adding the `zoom:\"index\"` struct tag)", finisherName, q.collection.spec.typ.String(), fieldName))
+		return
+	}
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(fieldName)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := q.generateIDsKeyForField(fieldIndexKey)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	q.tx.Script(aggregateFieldIndexScript, redis.Args{idsKey, fieldIndexKey}, func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(values) != 4 {
+			return fmt.Errorf("zoom: unexpected reply from aggregate script: %v", values)
+		}
+		agg := fieldAggregate{}
+		countString, err := redis.String(values[0], nil)
+		if err != nil {
+			return err
+		}
+		if agg.count, err = strconv.Atoi(countString); err != nil {
+			return err
+		}
+		if agg.sum, err = redis.Float64(values[1], nil); err != nil {
+			return err
+		}
+		if agg.count > 0 {
+			if agg.min, err = redis.Float64(values[2], nil); err != nil {
+				return err
+			}
+			if agg.max, err = redis.Float64(values[3], nil); err != nil {
+				return err
+			}
+		}
+		return handler(agg)
+	})
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// generateIDsKeyForField returns the key of a list, set, or sorted set which
+// contains the ids of all models that match the query criteria, for use by
+// scripts which read the values of a single field index. As an optimization, if
+// every model in the field index matches the query, it returns fieldIndexKey
+// itself. Like generateIDsSet, it may also return some temporary keys which
+// should be deleted after the ids have been read.
+func (q *TransactionQuery) generateIDsKeyForField(fieldIndexKey string) (idsKey string, tmpKeys []interface{}, err error) {
+	switch {
+	case q.hasLimit() || q.hasOffset():
+		// Limit and offset depend on the order of the ids, so we need to store
+		// the ids in a list first.
+		idsKey = generateRandomKey("tmp:ids:" + fieldIndexKey)
+		q.StoreIDs(idsKey)
+		return idsKey, []interface{}{idsKey}, nil
+	case !q.hasFilters() && !q.hasOrder():
+		// Every model in the field index matches the query, so the script can
+		// read the values directly from the field index.
+		q.tx.sweepExpired(q.collection)
+		return fieldIndexKey, nil, nil
+	default:
+		return generateIDsSet(q.query, q.tx)
+	}
+}
+
+// CountBy will set the value of counts to a map of each distinct value for the
+// given field to the number of models that match the query criteria and have
+// that value. It works very similarly to Query.CountBy, so you can check the
+// documentation for Query.CountBy for more information. The first error
+// encountered will be saved to the corresponding Transaction (if there is not
+// already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) CountBy(fieldName string, counts *map[string]int) {
+	q.countBy("CountBy", fieldName, func(values []string, valueCounts []int) error {
+		(*counts) = make(map[string]int, len(values))
+		for i, value := range values {
+			(*counts)[value] = valueCounts[i]
+		}
+		return nil
+	})
+}
+
+// Distinct will set the value of values to the distinct values for the given
+// field out of all models that match the query criteria. It works very
+// similarly to Query.Distinct, so you can check the documentation for
+// Query.Distinct for more information. The first error encountered will be
+// saved to the corresponding Transaction (if there is not already an error for
+// the Transaction) and returned when you call Transaction.Exec.
+func (q *TransactionQuery) Distinct(fieldName string, values *[]string) {
+	q.countBy("Distinct", fieldName, func(distinctValues []string, _ []int) error {
+		(*values) = distinctValues
+		return nil
+	})
+}
+
+// countBy adds a script to the transaction which will count the number of
+// models that match the query criteria for each distinct value of the given
+// field. handler will be called with the values, converted to strings, and
+// their corresponding counts when the transaction is executed. The values are
+// in the same order as they appear in the field index. finisherName is only used
+// in error messages.
+func (q *TransactionQuery) countBy(finisherName string, fieldName string, handler func(values []string, counts []int) error) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fieldSpec, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.%s: could not find field %s in type %s", finisherName, fieldName, q.collection.spec.typ.String()))
+		return
+	}
+	if fieldSpec.indexKind == noIndex {
+		q.tx.setError(fmt.Errorf("zoom: Query.%s is only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", finisherName, q.collection.spec.typ.String(), fieldName))
+		return
+	}
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(fieldName)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := q.generateIDsKeyForField(fieldIndexKey)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	kind := "numeric"
+	if fieldSpec.indexKind == stringIndex {
+		kind = "string"
+	}
+	q.tx.Script(countByFieldIndexScript, redis.Args{idsKey, fieldIndexKey, kind}, func(reply interface{}) error {
+		valuesAndCounts, err := redis.Strings(reply, nil)
+		if err != nil {
+			return err
+		}
+		values := make([]string, 0, len(valuesAndCounts)/2)
+		counts := make([]int, 0, len(valuesAndCounts)/2)
+		for i := 0; i+1 < len(valuesAndCounts); i += 2 {
+			value, err := formatIndexValue(fieldSpec, valuesAndCounts[i])
+			if err != nil {
+				return err
+			}
+			count, err := strconv.Atoi(valuesAndCounts[i+1])
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+			counts = append(counts, count)
+		}
+		return handler(values, counts)
+	})
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// formatIndexValue converts a value from the field index for fieldSpec into
+// the string used by CountBy and Distinct. String values are returned as-is,
+// numeric scores are formatted without any unnecessary decimals, and boolean
+// scores are converted to "true" or "false".
+func formatIndexValue(fieldSpec *fieldSpec, value string) (string, error) {
+	switch fieldSpec.indexKind {
+	case numericIndex:
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(score, 'f', -1, 64), nil
+	case booleanIndex:
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(score != 0), nil
+	}
+	return value, nil
+}
+
+// newNoValuesError returns a ModelNotFoundError which indicates that none of
+// the models which match the query criteria have a value for fieldName.
+func (q *TransactionQuery) newNoValuesError(fieldName string) error {
+	return ModelNotFoundError{
+		Collection: q.collection,
+		Msg:        fmt.Sprintf("Could not find any models with a value for %s with the given query criteria: %s", fieldName, q.query),
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File unique.go contains code related to unique constraints, i.e. fields with
+// the `zoom:"unique"` struct tag.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// uniqueCheck represents a value that a model is about to be saved with for a
+// field with a unique constraint. uniqueChecks are added to a transaction by
+// Save and SaveFields and are checked by Exec before the transaction is
+// executed.
+type uniqueCheck struct {
+	collection *Collection
+	fs         *fieldSpec
+	value      interface{}
+	id         string
+}
+
+// key returns the key for the hash which maps each value of the field to the id
+// of the model which has that value.
+func (uc *uniqueCheck) key() string {
+	return uc.collection.spec.uniqueIndexKey(uc.fs)
+}
+
+// newError returns a UniqueConstraintError indicating that the value of uc
+// already belongs to the model with the given existingID.
+func (uc *uniqueCheck) newError(existingID string) error {
+	return UniqueConstraintError{
+		Collection: uc.collection,
+		FieldName:  uc.fs.name,
+		Value:      uc.value,
+		ExistingID: existingID,
+	}
+}
+
+// errCheckedKeysChanged is returned by exec if the keys watched by
+// checkUniqueConstraints or checkVersions were changed before the transaction
+// was executed, in which case they need to be checked again.
+var errCheckedKeysChanged = errors.New("zoom: the keys for unique constraints or versions changed before the transaction could be executed")
+
+// saveUniqueIndexesForFields adds commands to the transaction for updating the
+// unique indexes for each of the given fieldNames that has a unique constraint.
+// It also adds a uniqueCheck for each new value, which will be checked before
+// the transaction is executed.
+func (t *Transaction) saveUniqueIndexesForFields(fieldNames []string, mr *modelRef) {
+	for _, fs := range mr.spec.fields {
+		if !fs.unique || !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		args := redis.Args{mr.key(), mr.spec.uniqueIndexKey(fs), fs.redisName, mr.model.ModelID()}
+		value, hasValue := uniqueValue(mr, fs)
+		if !hasValue {
+			// Nil values are not constrained, but the old value (if any) still
+			// needs to be removed.
+			t.Script(updateUniqueIndexScript, args, nil)
+			continue
+		}
+		t.uniqueChecks = append(t.uniqueChecks, &uniqueCheck{
+			collection: mr.collection,
+			fs:         fs,
+			value:      value,
+			id:         mr.model.ModelID(),
+		})
+		t.Script(updateUniqueIndexScript, append(args, value), nil)
+	}
+}
+
+// uniqueValue returns the value of the field for fs in the given model, as it
+// is passed to Redis as the field of the unique index. hasValue is false if the
+// field is a nil pointer, in which case the value is not constrained.
+func uniqueValue(mr *modelRef, fs *fieldSpec) (value interface{}, hasValue bool) {
+	fieldVal := mr.fieldValue(fs.name)
+	if fs.kind == pointerField {
+		if fieldVal.IsNil() {
+			return nil, false
+		}
+		fieldVal = fieldVal.Elem()
+	}
+	value = fieldVal.Interface()
+	if fs.typ == reflect.TypeOf(time.Duration(0)) {
+		// Use the same representation as the main hash. See mainHashArgsForFields.
+		value = int64(value.(time.Duration))
+	}
+	return value, true
+}
+
+// deleteUniqueIndexes adds commands to the transaction for removing the values
+// of the model with the given id from the unique indexes of c.
+func (t *Transaction) deleteUniqueIndexes(c *Collection, id string) {
+	for _, fs := range c.spec.fields {
+		if !fs.unique {
+			continue
+		}
+		args := redis.Args{c.ModelKey(id), c.spec.uniqueIndexKey(fs), fs.redisName, id}
+		t.Script(updateUniqueIndexScript, args, nil)
+	}
+}
+
+// checkUniqueConstraints watches the keys for each unique index that the
+// transaction is about to update, and then returns a UniqueConstraintError if
+// any of the values to be saved already belong to a different model. Because
+// the keys are watched, the transaction will not be executed if the unique
+// indexes are changed after they were checked.
+func (t *Transaction) checkUniqueConstraints() error {
+	if len(t.uniqueChecks) == 0 {
+		return nil
+	}
+	// Make sure the models in the transaction do not conflict with each other.
+	ids := map[string]string{}
+	for _, uc := range t.uniqueChecks {
+		valueKey := uc.key() + "\x00" + fmt.Sprint(uc.value)
+		if id, found := ids[valueKey]; found && id != uc.id {
+			return uc.newError(id)
+		}
+		ids[valueKey] = uc.id
+	}
+	// Watch the unique indexes and then check them all in a single script.
+	watchArgs := redis.Args{}
+	scriptArgs := redis.Args{}
+	for _, uc := range t.uniqueChecks {
+		// In cluster mode, the unique indexes must all be in the same hash slot
+		if err := t.bindKey(uc.key()); err != nil {
+			return err
+		}
+		watchArgs = append(watchArgs, uc.key())
+		scriptArgs = append(scriptArgs, uc.key(), uc.value, uc.id)
+	}
+	if _, err := t.conn.Do("WATCH", watchArgs...); err != nil {
+		return err
+	}
+	reply, err := redis.Values(findUniqueConflictScript.Do(t.conn, scriptArgs...))
+	if err != nil {
+		if err == redis.ErrNil {
+			// There were no conflicts
+			return nil
+		}
+		return err
+	}
+	var i int
+	var existingID string
+	if _, err := redis.Scan(reply, &i, &existingID); err != nil {
+		return err
+	}
+	return t.uniqueChecks[i-1].newError(existingID)
+}
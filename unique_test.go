@@ -0,0 +1,128 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File unique_test.go tests the code in unique.go and the handling of unique
+// constraints in Save, SaveFields, and Delete.
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInvalidUniqueThrowsError(t *testing.T) {
+	testingSetUp()
+	testingTearDown()
+
+	type invalid struct {
+		Time time.Time `zoom:"unique"`
+		RandomID
+	}
+	if _, err := compileModelSpec(reflect.TypeOf(&invalid{})); err == nil {
+		t.Error("Expected error when compiling spec for unique inconvertible field but got none")
+	}
+}
+
+func TestUniqueConstraint(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	nickname := "foo"
+	a := &uniqueTestModel{Email: "a@example.com", Nickname: &nickname}
+	if err := uniqueTestModels.Save(a); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectFieldEquals(t, "uniqueTestModel:Email:unique", "a@example.com", nil, a.ModelID())
+
+	// Saving the same model again should not violate the constraint
+	if err := uniqueTestModels.Save(a); err != nil {
+		t.Fatalf("Unexpected error saving the same model twice: %s", err.Error())
+	}
+
+	// Saving a different model with the same value should fail and none of the
+	// commands in the transaction should be executed
+	b := &uniqueTestModel{Email: "a@example.com"}
+	other := &testModel{Int: 1}
+	tx := testPool.NewTransaction()
+	tx.Save(testModels, other)
+	tx.Save(uniqueTestModels, b)
+	expectUniqueConstraintError(t, tx.Exec(), "Email", a.ModelID())
+	expectModelDoesNotExist(t, uniqueTestModels, b)
+	expectModelDoesNotExist(t, testModels, other)
+	b.Email = "b@example.com"
+	b.Nickname = &nickname
+	expectUniqueConstraintError(t, uniqueTestModels.Save(b), "Nickname", a.ModelID())
+	expectModelDoesNotExist(t, uniqueTestModels, b)
+
+	// Nil values should not be constrained
+	b.Nickname = nil
+	if err := uniqueTestModels.Save(b); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	c := &uniqueTestModel{Email: "c@example.com"}
+	if err := uniqueTestModels.Save(c); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Changing the value should free up the old value
+	a.Email = "new@example.com"
+	if err := uniqueTestModels.SaveFields([]string{"Email"}, a); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	expectFieldEquals(t, "uniqueTestModel:Email:unique", "new@example.com", nil, a.ModelID())
+	c.Email = "a@example.com"
+	if err := uniqueTestModels.Save(c); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectUniqueConstraintError(t, uniqueTestModels.SaveFields([]string{"Email"}, &uniqueTestModel{Email: "new@example.com"}), "Email", a.ModelID())
+
+	// Deleting a model should free up its values
+	if _, err := uniqueTestModels.Delete(a.ModelID()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	d := &uniqueTestModel{Email: "new@example.com", Nickname: &nickname}
+	if err := uniqueTestModels.Save(d); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Two models in the same transaction should not be able to have the same
+	// value
+	tx = testPool.NewTransaction()
+	tx.Save(uniqueTestModels, &uniqueTestModel{Email: "e@example.com"})
+	tx.Save(uniqueTestModels, &uniqueTestModel{Email: "e@example.com"})
+	if err := tx.Exec(); err == nil {
+		t.Error("Expected error when saving two models with the same value in one transaction but got none")
+	} else if _, ok := err.(UniqueConstraintError); !ok {
+		t.Errorf("Expected UniqueConstraintError but got %T: %s", err, err.Error())
+	}
+
+	// DeleteAll should delete the unique indexes
+	if _, err := uniqueTestModels.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, "uniqueTestModel:Email:unique")
+	expectKeyDoesNotExist(t, "uniqueTestModel:Nickname:unique")
+}
+
+// expectUniqueConstraintError calls t.Errorf if err is not a
+// UniqueConstraintError with the given fieldName and existingID.
+func expectUniqueConstraintError(t *testing.T, err error, fieldName string, existingID string) {
+	if err == nil {
+		t.Errorf("Expected UniqueConstraintError for field %s but got none", fieldName)
+		return
+	}
+	uniqueErr, ok := err.(UniqueConstraintError)
+	if !ok {
+		t.Errorf("Expected UniqueConstraintError but got %T: %s", err, err.Error())
+		return
+	}
+	if uniqueErr.FieldName != fieldName {
+		t.Errorf("Expected FieldName to be %s but got %s", fieldName, uniqueErr.FieldName)
+	}
+	if uniqueErr.ExistingID != existingID {
+		t.Errorf("Expected ExistingID to be %s but got %s", existingID, uniqueErr.ExistingID)
+	}
+}
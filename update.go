@@ -0,0 +1,324 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File update.go contains code related to Pool.Update, which retries
+// optimistically locked transactions automatically.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// UpdateOptions contains various options for Pool.Update.
+type UpdateOptions struct {
+	// MaxAttempts is the maximum number of times the update function will be
+	// called. A value of 0 means unlimited.
+	MaxAttempts int
+	// Backoff is the amount of time to wait before the second attempt. It is
+	// doubled after each attempt, up to MaxBackoff. The actual amount of time is
+	// chosen at random between half of the backoff and the full backoff, so that
+	// conflicting callers are less likely to conflict again.
+	Backoff time.Duration
+	// MaxBackoff is the maximum amount of time to wait between attempts.
+	MaxBackoff time.Duration
+}
+
+// DefaultUpdateOptions is the default set of options for Pool.Update.
+var DefaultUpdateOptions = UpdateOptions{
+	MaxAttempts: 10,
+	Backoff:     time.Millisecond,
+	MaxBackoff:  100 * time.Millisecond,
+}
+
+// WithMaxAttempts returns a new copy of the options with the MaxAttempts
+// property set to the given value. It does not mutate the original options.
+func (options UpdateOptions) WithMaxAttempts(maxAttempts int) UpdateOptions {
+	options.MaxAttempts = maxAttempts
+	return options
+}
+
+// WithBackoff returns a new copy of the options with the Backoff property set
+// to the given value. It does not mutate the original options.
+func (options UpdateOptions) WithBackoff(backoff time.Duration) UpdateOptions {
+	options.Backoff = backoff
+	return options
+}
+
+// WithMaxBackoff returns a new copy of the options with the MaxBackoff property
+// set to the given value. It does not mutate the original options.
+func (options UpdateOptions) WithMaxBackoff(maxBackoff time.Duration) UpdateOptions {
+	options.MaxBackoff = maxBackoff
+	return options
+}
+
+// Update calls update with a new transaction and then executes the transaction,
+// retrying with a new transaction if the execution failed because of a
+// conflicting change. update should use WatchAndFind to read any models it
+// needs before it adds any other actions to the transaction. If any of those
+// models are changed by another caller before the transaction is executed,
+// Exec returns a WatchError and the whole process is repeated, including
+// reading the models again. Update also retries if Exec returns a
+// VersionConflictError. It returns the number of attempts that were made, which
+// is useful for metrics, and the error from the last attempt (if any). If update
+// returns an error, the transaction is not executed and Update returns the error
+// immediately. Only the models read with WatchAndFind or WatchAndFindFields (and
+// any keys watched with Watch or WatchKey) are watched. Other reads, such as
+// tx.Find, tx.FindFields or a query added to the transaction, are not watched
+// and are not read immediately: they are queued and executed along with the
+// writes, so their results are not available inside update and a change to
+// those models does not cause a retry. The same is true for models read outside of the
+// transaction, e.g. with Collection.Find. For example:
+//
+//	attempts, err := pool.Update(func(tx *zoom.Transaction) error {
+//		post := &Post{}
+//		if err := tx.WatchAndFind(Posts, postID, post); err != nil {
+//			return err
+//		}
+//		post.Likes++
+//		tx.Save(Posts, post)
+//		return nil
+//	}, zoom.DefaultUpdateOptions)
+func (p *Pool) Update(update func(tx *Transaction) error, options UpdateOptions) (int, error) {
+	return p.UpdateContext(context.Background(), update, options)
+}
+
+// UpdateContext is like Update but uses the given context. It stops retrying and
+// returns ctx.Err() if ctx is done while waiting between attempts. See
+// Transaction.ExecContext for details.
+func (p *Pool) UpdateContext(ctx context.Context, update func(tx *Transaction) error, options UpdateOptions) (int, error) {
+	backoff := options.Backoff
+	for attempt := 1; ; attempt++ {
+		tx := p.NewTransaction()
+		if err := update(tx); err != nil {
+			tx.discard()
+			return attempt, err
+		}
+		err := tx.ExecContext(ctx)
+		if !isConflictError(err) {
+			return attempt, err
+		}
+		if options.MaxAttempts > 0 && attempt >= options.MaxAttempts {
+			return attempt, err
+		}
+		if backoff, err = options.wait(ctx, backoff); err != nil {
+			return attempt, err
+		}
+	}
+}
+
+// wait waits for a random amount of time between half of backoff and the full
+// backoff, or until ctx is done, in which case it returns ctx.Err(). It returns
+// the backoff to use for the next attempt, which is double the given backoff
+// (up to options.MaxBackoff).
+func (options UpdateOptions) wait(ctx context.Context, backoff time.Duration) (time.Duration, error) {
+	if backoff <= 0 {
+		return backoff, ctx.Err()
+	}
+	wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return backoff, ctx.Err()
+	}
+	if backoff *= 2; options.MaxBackoff > 0 && backoff > options.MaxBackoff {
+		backoff = options.MaxBackoff
+	}
+	return backoff, nil
+}
+
+// isConflictError returns true iff err is a WatchError or VersionConflictError,
+// which means the transaction failed because of a change by another caller.
+func isConflictError(err error) bool {
+	switch err.(type) {
+	case WatchError, VersionConflictError:
+		return true
+	}
+	return false
+}
+
+// WatchAndFind watches the given model for changes and then immediately
+// retrieves it from the database and scans its values into model. Because of
+// how the WATCH command works, it must be called before any other transaction
+// methods except for Watch, WatchKey, and other calls to WatchAndFind or
+// WatchAndFindFields. If the model changes after it was retrieved but before
+// the transaction is executed, Exec will return a WatchError and the commands
+// in the transaction will not be executed. It returns a ModelNotFoundError if
+// the model does not exist, which does not prevent the transaction from being
+// executed. Unlike Transaction.Find, which is queued and only read when the
+// transaction is executed, this is the way to read a model inside Pool.Update.
+func (t *Transaction) WatchAndFind(c *Collection, id string, model Model) error {
+	return t.watchAndFind("WatchAndFind", c, id, func(find *Transaction) {
+		find.Find(c, id, model)
+	})
+}
+
+// WatchAndFindFields is like WatchAndFind but finds and sets only the specified
+// fields, in the same way as FindFields. The whole model is still watched, so a
+// change to any of its fields causes a WatchError.
+func (t *Transaction) WatchAndFindFields(c *Collection, id string, fieldNames []string, model Model) error {
+	return t.watchAndFind("WatchAndFindFields", c, id, func(find *Transaction) {
+		find.FindFields(c, id, fieldNames, model)
+	})
+}
+
+// watchAndFind watches the model with the given id and then calls addFind to
+// add the actions needed to find it to a separate transaction, which is sent
+// immediately on t.conn. methodName is used in error messages.
+func (t *Transaction) watchAndFind(methodName string, c *Collection, id string, addFind func(find *Transaction)) error {
+	if len(t.actions) != 0 {
+		return fmt.Errorf("zoom: Cannot call %s after other commands have been added to the transaction", methodName)
+	}
+	if c == nil {
+		return newNilCollectionError(methodName)
+	}
+	if err := t.WatchKey(c.ModelKey(id)); err != nil {
+		return err
+	}
+	// Soft deleting a model does not change the main hash, so the deleted models
+	// need to be watched as well.
+	if c.softDelete {
+		if err := t.WatchKey(c.spec.deletedKey()); err != nil {
+			return err
+		}
+	}
+	// Use a separate transaction to build the actions needed to find the model
+	find := &Transaction{pool: t.pool}
+	addFind(find)
+	if find.err != nil {
+		return find.err
+	}
+	return doTransactionWithoutMulti(t.conn, find)
+}
+
+// doTransactionWithoutMulti is like doActionsWithoutMulti but sends the actions
+// in t and then calls the functions in t.afterExec (e.g. to load references),
+// which also use conn for any further transactions.
+func doTransactionWithoutMulti(conn redis.Conn, t *Transaction) error {
+	if t.err != nil {
+		return t.err
+	}
+	if err := doActionsWithoutMulti(conn, t.actions); err != nil {
+		return err
+	}
+	return t.callAfterExec(func(tx *Transaction) error {
+		return doTransactionWithoutMulti(conn, tx)
+	})
+}
+
+// doActionsWithoutMulti sends the given actions to the database using conn as a
+// pipeline and calls all the action handlers with the corresponding replies.
+// Unlike execActions, it does not use MULTI/EXEC, so any keys that are being
+// watched remain watched.
+func doActionsWithoutMulti(conn redis.Conn, actions []*Action) error {
+	for _, a := range actions {
+		if err := sendAction(conn, a); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	replies := make([]interface{}, len(actions))
+	for i := range actions {
+		reply, err := conn.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return err
+			}
+			reply = err
+		}
+		replies[i] = reply
+	}
+	for i, reply := range replies {
+		if err, ok := reply.(error); ok {
+			return err
+		}
+		if handler := actions[i].handler; handler != nil {
+			if err := handler(reply); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findExistingModels retrieves the given fields for each model in ids which
+// exists, using tx.conn without executing the transaction. It is used to read
+// models after watching their keys. The models are returned in the same order
+// as ids, skipping any models which do not exist or were soft deleted. If c uses
+// soft deletes, the caller should watch the key for the deleted models too.
+func findExistingModels(c *Collection, tx *Transaction, ids []string, fieldNames []string) ([]*modelRef, error) {
+	exists := make([]bool, len(ids))
+	actions := []*Action{}
+	for i, id := range ids {
+		i := i
+		actions = append(actions, &Action{
+			kind: commandAction,
+			name: "EXISTS",
+			args: redis.Args{c.ModelKey(id)},
+			handler: func(reply interface{}) error {
+				var err error
+				exists[i], err = redis.Bool(reply, nil)
+				return err
+			},
+		})
+		if c.softDelete {
+			actions = append(actions, &Action{
+				kind: commandAction,
+				name: "ZSCORE",
+				args: redis.Args{c.spec.deletedKey(), id},
+				handler: func(reply interface{}) error {
+					if reply != nil {
+						exists[i] = false
+					}
+					return nil
+				},
+			})
+		}
+	}
+	if err := doActionsWithoutMulti(tx.conn, actions); err != nil {
+		return nil, err
+	}
+	find := &Transaction{pool: tx.pool}
+	mrs := []*modelRef{}
+	for i, id := range ids {
+		if !exists[i] {
+			continue
+		}
+		model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+		find.FindFields(c, id, fieldNames, model)
+		mrs = append(mrs, &modelRef{
+			collection: c,
+			model:      model,
+			spec:       c.spec,
+		})
+	}
+	if find.err != nil {
+		return nil, find.err
+	}
+	if err := doTransactionWithoutMulti(tx.conn, find); err != nil {
+		return nil, err
+	}
+	return mrs, nil
+}
+
+// discard returns the connection for the transaction to the pool (if any)
+// without executing the transaction. It also restores the versions of any
+// models that were incremented by Save or SaveFields.
+func (t *Transaction) discard() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+	t.restoreVersions()
+}
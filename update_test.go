@@ -0,0 +1,210 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File update_test.go tests the code in update.go, i.e. Pool.Update and
+// Transaction.WatchAndFind.
+
+package zoom
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateConcurrent(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &testModel{}
+	if err := testModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	// Increment Int concurrently. No updates should be lost.
+	numIncrements := 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, numIncrements)
+	for i := 0; i < numIncrements; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := testPool.Update(func(tx *Transaction) error {
+				m := &testModel{}
+				if err := tx.WatchAndFind(testModels, model.ModelID(), m); err != nil {
+					return err
+				}
+				m.Int++
+				tx.Save(testModels, m)
+				return nil
+			}, DefaultUpdateOptions.WithMaxAttempts(0))
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unexpected error in Update: %s", err.Error())
+	}
+	got := &testModel{}
+	if err := testModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int != numIncrements {
+		t.Errorf("Expected Int to be %d but got %d", numIncrements, got.Int)
+	}
+}
+
+func TestUpdateAttempts(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &testModel{}
+	if err := testModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	// conflictingUpdate returns an update function which changes the model from
+	// outside the transaction during the first numConflicts attempts.
+	conflictingUpdate := func(numConflicts int) func(tx *Transaction) error {
+		calls := 0
+		return func(tx *Transaction) error {
+			calls++
+			m := &testModel{}
+			if err := tx.WatchAndFind(testModels, model.ModelID(), m); err != nil {
+				return err
+			}
+			if calls <= numConflicts {
+				other := &testModel{RandomID: RandomID{ID: model.ModelID()}, String: "conflict"}
+				if err := testModels.Save(other); err != nil {
+					return err
+				}
+			}
+			m.Int++
+			tx.Save(testModels, m)
+			return nil
+		}
+	}
+	options := DefaultUpdateOptions.WithMaxAttempts(3).WithBackoff(time.Microsecond)
+
+	attempts, err := testPool.Update(conflictingUpdate(2), options)
+	if err != nil {
+		t.Fatalf("Unexpected error in Update: %s", err.Error())
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts but got %d", attempts)
+	}
+
+	// If every attempt conflicts, Update should return a WatchError
+	attempts, err = testPool.Update(conflictingUpdate(3), options)
+	if _, ok := err.(WatchError); !ok {
+		t.Errorf("Expected a WatchError but got %T: %v", err, err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts but got %d", attempts)
+	}
+
+	// Errors returned by the update function should not be retried
+	expectedErr := errors.New("update failed")
+	attempts, err = testPool.Update(func(tx *Transaction) error {
+		return expectedErr
+	}, options)
+	if err != expectedErr {
+		t.Errorf("Expected %v but got %v", expectedErr, err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt but got %d", attempts)
+	}
+
+	// WatchAndFind should return a ModelNotFoundError for a model which does
+	// not exist
+	_, err = testPool.Update(func(tx *Transaction) error {
+		return tx.WatchAndFind(testModels, "fakeID", &testModel{})
+	}, options)
+	if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got %T: %v", err, err)
+	}
+}
+
+func TestWatchAndFindFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &testModel{Int: 1, String: "original"}
+	if err := testModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	calls := 0
+	attempts, err := testPool.Update(func(tx *Transaction) error {
+		calls++
+		m := &testModel{}
+		if err := tx.WatchAndFindFields(testModels, model.ModelID(), []string{"Int"}, m); err != nil {
+			return err
+		}
+		if m.String != "" {
+			t.Errorf("Expected WatchAndFindFields to only set Int but String was %q", m.String)
+		}
+		// Changing a field which was not read should still cause a retry
+		if calls == 1 {
+			other := &testModel{RandomID: RandomID{ID: model.ModelID()}, Int: m.Int, String: "conflict"}
+			if err := testModels.Save(other); err != nil {
+				return err
+			}
+		}
+		m.Int++
+		tx.SaveFields(testModels, []string{"Int"}, m)
+		return nil
+	}, DefaultUpdateOptions.WithBackoff(time.Microsecond))
+	if err != nil {
+		t.Fatalf("Unexpected error in Update: %s", err.Error())
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts but got %d", attempts)
+	}
+	got := &testModel{}
+	if err := testModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int != 2 || got.String != "conflict" {
+		t.Errorf("Expected Int = 2 and String = conflict but got %d and %s", got.Int, got.String)
+	}
+
+	// WatchAndFindFields must be called before any other actions
+	tx := testPool.NewTransaction()
+	tx.Command("PING", nil, nil)
+	err = tx.WatchAndFindFields(testModels, model.ModelID(), []string{"Int"}, &testModel{})
+	if err == nil || !strings.HasPrefix(err.Error(), "zoom: ") {
+		t.Errorf("Expected a zoom error for WatchAndFindFields after other commands but got %v", err)
+	}
+	tx.discard()
+}
+
+func TestUpdateOptionsWait(t *testing.T) {
+	options := DefaultUpdateOptions.WithBackoff(time.Millisecond).WithMaxBackoff(3 * time.Millisecond)
+
+	// The backoff should double after each wait, up to MaxBackoff
+	backoff := options.Backoff
+	for _, expected := range []time.Duration{2 * time.Millisecond, 3 * time.Millisecond, 3 * time.Millisecond} {
+		var err error
+		if backoff, err = options.wait(context.Background(), backoff); err != nil {
+			t.Fatalf("Unexpected error in wait: %s", err.Error())
+		}
+		if backoff != expected {
+			t.Errorf("Expected backoff to be %s but got %s", expected, backoff)
+		}
+	}
+
+	// wait should stop waiting once the context is done, even without a backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := options.wait(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("Expected wait to return %v but got %v", context.Canceled, err)
+	}
+	if _, err := options.wait(ctx, 0); err != context.Canceled {
+		t.Errorf("Expected wait to return %v but got %v", context.Canceled, err)
+	}
+}
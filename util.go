@@ -29,6 +29,9 @@ var (
 	// NULL character and is the lowest possible value (in terms of codepoint, which is also
 	// how redis sorts strings) for an ASCII character.
 	nullString = string([]byte{byte(0)})
+	// maxByteString is used as a suffix for string prefix tricks. This is a string which consists
+	// of the byte 255, which is the highest possible byte value and never appears in valid UTF-8.
+	maxByteString = string([]byte{byte(255)})
 	// hardwareID is a unique id for the current machine. Right now it uses the crc32 checksum of the MAC address.
 	hardwareID = ""
 )
@@ -0,0 +1,154 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File version.go contains code related to optimistic concurrency with version
+// numbers, i.e. fields with the `zoom:"version"` struct tag.
+
+package zoom
+
+import (
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// versionCheck represents a model with a version field that is about to be
+// saved. versionChecks are added to a transaction by Save and SaveFields and
+// are checked by Exec before the transaction is executed.
+type versionCheck struct {
+	mr *modelRef
+	// version is the version of the model before it was incremented by Save
+	// or SaveFields. It must match the version in the database.
+	version int64
+	// copies are any other models with the same id and version which were
+	// saved in the same transaction. They share the check for mr and their
+	// versions are incremented and restored along with it.
+	copies []*modelRef
+}
+
+// newError returns a VersionConflictError indicating that the version of the
+// model in the database is currentVersion.
+func (vc *versionCheck) newError(currentVersion int64) error {
+	return VersionConflictError{
+		Collection:     vc.mr.collection,
+		ID:             vc.mr.model.ModelID(),
+		Version:        vc.version,
+		CurrentVersion: currentVersion,
+	}
+}
+
+// withVersionField returns fieldNames with the name of the version field
+// appended if the model has a version field which is not already included.
+func (ms *modelSpec) withVersionField(fieldNames []string) []string {
+	if ms.versionField == nil || stringSliceContains(fieldNames, ms.versionField.name) {
+		return fieldNames
+	}
+	return append(append([]string{}, fieldNames...), ms.versionField.name)
+}
+
+// version returns the value of the version field of the model.
+func (mr *modelRef) version() int64 {
+	fieldVal := mr.fieldValue(mr.spec.versionField.name)
+	switch fieldVal.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(fieldVal.Uint())
+	default:
+		return fieldVal.Int()
+	}
+}
+
+// setVersion sets the value of the version field of the model.
+func (mr *modelRef) setVersion(version int64) {
+	fieldVal := mr.fieldValue(mr.spec.versionField.name)
+	switch fieldVal.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fieldVal.SetUint(uint64(version))
+	default:
+		fieldVal.SetInt(version)
+	}
+}
+
+// saveVersion increments the version of the model (if it has a version field)
+// and adds a versionCheck for the old version, which will be checked before the
+// transaction is executed. It must be called before any of the field values are
+// used, so that the new version is saved. If the model was already saved in the
+// transaction, the version is only incremented once and the existing check for
+// the version before the first save is kept. If the transaction fails, the
+// version of the model is restored by restoreVersions.
+func (t *Transaction) saveVersion(mr *modelRef) {
+	if mr.spec.versionField == nil {
+		return
+	}
+	version := mr.version()
+	for _, vc := range t.versionChecks {
+		if vc.mr.key() != mr.key() {
+			continue
+		}
+		if vc.mr.model == mr.model {
+			// The version was already incremented by the first save
+			return
+		}
+		if vc.version == version {
+			vc.copies = append(vc.copies, mr)
+			mr.setVersion(version + 1)
+			return
+		}
+		// A copy of the model with a different version needs its own check,
+		// which will fail if the other one succeeds.
+	}
+	t.versionChecks = append(t.versionChecks, &versionCheck{
+		mr:      mr,
+		version: version,
+	})
+	mr.setVersion(version + 1)
+}
+
+// restoreVersions restores the version of each model that was incremented by
+// saveVersion. It is called if the transaction fails.
+func (t *Transaction) restoreVersions() {
+	for _, vc := range t.versionChecks {
+		vc.mr.setVersion(vc.version)
+		for _, mr := range vc.copies {
+			mr.setVersion(vc.version)
+		}
+	}
+}
+
+// checkVersions watches the key for each model with a version field that the
+// transaction is about to save, and then returns a VersionConflictError if the
+// version in the database does not match the version of the model before it was
+// incremented. Because the keys are watched, the transaction will not be
+// executed if any of the models are changed after they were checked.
+func (t *Transaction) checkVersions() error {
+	if len(t.versionChecks) == 0 {
+		return nil
+	}
+	watchArgs := redis.Args{}
+	scriptArgs := redis.Args{}
+	for _, vc := range t.versionChecks {
+		// In cluster mode, the models must all be in the same hash slot
+		if err := t.bindKey(vc.mr.key()); err != nil {
+			return err
+		}
+		watchArgs = append(watchArgs, vc.mr.key())
+		scriptArgs = append(scriptArgs, vc.mr.key(), vc.mr.spec.versionField.redisName, vc.version)
+	}
+	if _, err := t.conn.Do("WATCH", watchArgs...); err != nil {
+		return err
+	}
+	reply, err := redis.Values(findVersionConflictScript.Do(t.conn, scriptArgs...))
+	if err != nil {
+		if err == redis.ErrNil {
+			// There were no conflicts
+			return nil
+		}
+		return err
+	}
+	var i int
+	var currentVersion int64
+	if _, err := redis.Scan(reply, &i, &currentVersion); err != nil {
+		return err
+	}
+	return t.versionChecks[i-1].newError(currentVersion)
+}
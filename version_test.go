@@ -0,0 +1,222 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File version_test.go tests the code in version.go, i.e. optimistic
+// concurrency with version fields.
+
+package zoom
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestInvalidVersionThrowsError(t *testing.T) {
+	type notAnInteger struct {
+		Version string `zoom:"version"`
+		RandomID
+	}
+	type twoVersions struct {
+		Version      int `zoom:"version"`
+		OtherVersion int `zoom:"version"`
+		RandomID
+	}
+	type uniqueVersion struct {
+		Version int `zoom:"version,unique"`
+		RandomID
+	}
+	for _, model := range []Model{&notAnInteger{}, &twoVersions{}, &uniqueVersion{}} {
+		if _, err := compileModelSpec(reflect.TypeOf(model)); err == nil {
+			t.Errorf("Expected error when compiling model spec for %T but got none", model)
+		}
+	}
+}
+
+func TestVersionConflict(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Saving a new model should set the version to 1
+	model := &versionedTestModel{Int: 1}
+	if err := versionedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if model.Version != 1 {
+		t.Errorf("Expected Version to be 1 but got %d", model.Version)
+	}
+	expectFieldEquals(t, versionedTestModels.ModelKey(model.ModelID()), "Version", versionedTestModels.spec.fallback, 1)
+
+	// Get a second copy of the model and then update the first one
+	stale := &versionedTestModel{}
+	if err := versionedTestModels.Find(model.ModelID(), stale); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	model.Int = 2
+	if err := versionedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if model.Version != 2 {
+		t.Errorf("Expected Version to be 2 but got %d", model.Version)
+	}
+
+	// Saving the stale copy should fail, and the stale copy should be unchanged
+	stale.Int = 3
+	err := versionedTestModels.Save(stale)
+	if err == nil {
+		t.Fatalf("Expected a VersionConflictError but got none")
+	}
+	conflictErr, ok := err.(VersionConflictError)
+	if !ok {
+		t.Fatalf("Expected a VersionConflictError but got %T: %s", err, err.Error())
+	}
+	if conflictErr.ID != model.ModelID() || conflictErr.Version != 1 || conflictErr.CurrentVersion != 2 {
+		t.Errorf("Unexpected VersionConflictError: %+v", conflictErr)
+	}
+	if stale.Version != 1 {
+		t.Errorf("Expected Version of the stale model to be restored to 1 but got %d", stale.Version)
+	}
+	got := &versionedTestModel{}
+	if err := versionedTestModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, got) {
+		t.Errorf("Expected %+v but got %+v", model, got)
+	}
+
+	// SaveFields should also check and increment the version, even if it is not
+	// one of the given fields
+	model.String = "updated"
+	if err := versionedTestModels.SaveFields([]string{"String"}, model); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	if model.Version != 3 {
+		t.Errorf("Expected Version to be 3 but got %d", model.Version)
+	}
+	expectFieldEquals(t, versionedTestModels.ModelKey(model.ModelID()), "Version", versionedTestModels.spec.fallback, 3)
+	if err := versionedTestModels.SaveFields([]string{"String"}, stale); err == nil {
+		t.Errorf("Expected a VersionConflictError from SaveFields but got none")
+	} else if _, ok := err.(VersionConflictError); !ok {
+		t.Errorf("Expected a VersionConflictError but got %T: %s", err, err.Error())
+	}
+
+	// The version field can be indexed
+	ids, err := versionedTestModels.NewQuery().Filter("Version =", 3).IDs()
+	if err != nil {
+		t.Fatalf("Unexpected error in query: %s", err.Error())
+	}
+	if len(ids) != 1 || ids[0] != model.ModelID() {
+		t.Errorf("Expected query to return [%s] but got %v", model.ModelID(), ids)
+	}
+}
+
+func TestVersionSaveTwiceInTransaction(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &versionedTestModel{Int: 1}
+	if err := versionedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Saving the same model twice in one transaction should only check and
+	// increment the version once
+	tx := testPool.NewTransaction()
+	model.Int = 2
+	tx.Save(versionedTestModels, model)
+	model.String = "updated"
+	tx.SaveFields(versionedTestModels, []string{"String"}, model)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if model.Version != 2 {
+		t.Errorf("Expected Version to be 2 but got %d", model.Version)
+	}
+	expectFieldEquals(t, versionedTestModels.ModelKey(model.ModelID()), "Version", versionedTestModels.spec.fallback, 2)
+
+	// The same should be true for two copies of the model with the same version
+	other := &versionedTestModel{}
+	if err := versionedTestModels.Find(model.ModelID(), other); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	tx = testPool.NewTransaction()
+	tx.Save(versionedTestModels, model)
+	tx.Save(versionedTestModels, other)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if model.Version != 3 || other.Version != 3 {
+		t.Errorf("Expected both Versions to be 3 but got %d and %d", model.Version, other.Version)
+	}
+	expectFieldEquals(t, versionedTestModels.ModelKey(model.ModelID()), "Version", versionedTestModels.spec.fallback, 3)
+
+	// A stale copy in the same transaction should still cause a conflict, and
+	// the versions of both models should be restored
+	stale := &versionedTestModel{}
+	*stale = *model
+	stale.Version = 1
+	tx = testPool.NewTransaction()
+	tx.Save(versionedTestModels, model)
+	tx.Save(versionedTestModels, stale)
+	if err := tx.Exec(); err == nil {
+		t.Errorf("Expected a VersionConflictError but got none")
+	} else if _, ok := err.(VersionConflictError); !ok {
+		t.Errorf("Expected a VersionConflictError but got %T: %s", err, err.Error())
+	}
+	if model.Version != 3 || stale.Version != 1 {
+		t.Errorf("Expected Versions to be restored to 3 and 1 but got %d and %d", model.Version, stale.Version)
+	}
+}
+
+func TestVersionConcurrentUpdates(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &versionedTestModel{}
+	if err := versionedTestModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	// Increment Int concurrently, retrying whenever there is a conflict. No
+	// updates should be lost.
+	numIncrements := 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, numIncrements)
+	for i := 0; i < numIncrements; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				m := &versionedTestModel{}
+				if err := versionedTestModels.Find(model.ModelID(), m); err != nil {
+					errs <- err
+					return
+				}
+				m.Int++
+				err := versionedTestModels.Save(m)
+				if _, ok := err.(VersionConflictError); ok {
+					continue
+				}
+				if err != nil {
+					errs <- err
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	got := &versionedTestModel{}
+	if err := versionedTestModels.Find(model.ModelID(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Int != numIncrements {
+		t.Errorf("Expected Int to be %d but got %d", numIncrements, got.Int)
+	}
+	if got.Version != numIncrements+1 {
+		t.Errorf("Expected Version to be %d but got %d", numIncrements+1, got.Version)
+	}
+}